@@ -65,6 +65,10 @@ join_euis=[{{ range $index, $elm := .Filters.JoinEUIs }}
 #   * semtech_udp
 #   * concentratord
 #   * basic_station
+#   * mqtt
+#   * replay
+#   * grpc
+#   * exec
 type="{{ .Backend.Type }}"
 
 
@@ -105,6 +109,210 @@ type="{{ .Backend.Type }}"
   command_url="{{ .Backend.Concentratord.CommandURL }}"
 
 
+  # MQTT backend.
+  #
+  # This backend subscribes to the events published by a packet-forwarder
+  # to a (southbound) MQTT broker and publishes the commands back to this
+  # broker. Please note that when the same broker is used for the integration,
+  # the topics must not overlap with the integration topics.
+  [backend.mqtt]
+
+  # MQTT servers.
+  #
+  # Configure one or multiple MQTT server to connect to. Each item must be in
+  # the following format: scheme://host:port where scheme is tcp, ssl or ws.
+  servers=[{{ range $index, $elm := .Backend.MQTT.Servers }}
+    "{{ $elm }}",{{ end }}
+  ]
+
+  # Connect with the given username (optional)
+  username="{{ .Backend.MQTT.Username }}"
+
+  # Connect with the given password (optional)
+  password="{{ .Backend.MQTT.Password }}"
+
+  # Quality of service level
+  qos={{ .Backend.MQTT.QOS }}
+
+  # Clean session
+  clean_session={{ .Backend.MQTT.CleanSession }}
+
+  # Client ID
+  #
+  # When left blank, a random id will be generated. This requires
+  # clean_session=true.
+  client_id="{{ .Backend.MQTT.ClientID }}"
+
+  # CA certificate file (optional)
+  ca_cert="{{ .Backend.MQTT.CACert }}"
+
+  # TLS certificate file (optional)
+  tls_cert="{{ .Backend.MQTT.TLSCert }}"
+
+  # TLS key file (optional)
+  tls_key="{{ .Backend.MQTT.TLSKey }}"
+
+  # Keep alive.
+  keep_alive="{{ .Backend.MQTT.KeepAlive }}"
+
+  # Maximum interval that will be waited between reconnection attempts.
+  max_reconnect_interval="{{ .Backend.MQTT.MaxReconnectInterval }}"
+
+  # Payload marshaler.
+  #
+  # This defines how the payloads published by the packet-forwarder are
+  # encoded. Valid options are:
+  # * protobuf:  Protobuf encoding
+  # * json:      JSON encoding
+  marshaler="{{ .Backend.MQTT.Marshaler }}"
+
+  # Event topic.
+  #
+  # The topic (filter) to subscribe to for receiving the gateway events.
+  # The event type is retrieved from the last topic level, or from the
+  # event=[EventType] part of the topic. The gateway ID is retrieved from
+  # the payload.
+  event_topic="{{ .Backend.MQTT.EventTopic }}"
+
+  # Command topic template.
+  #
+  # This template is used for publishing the gateway commands.
+  command_topic_template="{{ .Backend.MQTT.CommandTopicTemplate }}"
+
+  # Gateway cleanup.
+  #
+  # A gateway from which no event has been received within this duration
+  # will be unsubscribed from the integration. Set this to 0 to disable.
+  gateway_cleanup="{{ .Backend.MQTT.GatewayCleanup }}"
+
+
+  # Replay backend.
+  #
+  # This backend replays the uplink frames and gateway stats from a file,
+  # e.g. for testing a network-server without radios. Received downlink
+  # frames, gateway configuration and raw packet-forwarder commands are
+  # written to the (optional) downlink file.
+  [backend.replay]
+
+  # File to replay.
+  file="{{ .Backend.Replay.File }}"
+
+  # File format.
+  #
+  # Valid options are:
+  # * json:      JSON Lines, each line containing a record in the format of
+  #              {"time": "...", "type": "up|stats", "payload": {...}}, where
+  #              the payload is the JSON encoded gw.UplinkFrame or gw.GatewayStats.
+  #              Other records (e.g. written by the recorder) are skipped. The
+  #              file may be gzip compressed.
+  # * protobuf:  Length-delimited (varint size prefix) google.protobuf.Any
+  #              messages, wrapping a gw.UplinkFrame or gw.GatewayStats.
+  format="{{ .Backend.Replay.Format }}"
+
+  # Speed multiplier.
+  #
+  # The events are replayed using their original relative timing, divided by
+  # this multiplier (e.g. 2 replays twice as fast). The timing is taken from
+  # the record time, or the time of the wrapped message. Set this to 0 to
+  # replay the events as fast as possible.
+  speed={{ .Backend.Replay.Speed }}
+
+  # Loop.
+  #
+  # When set, the file will be replayed from the start after the last event.
+  loop={{ .Backend.Replay.Loop }}
+
+  # Gateway ID.
+  #
+  # When set, the Gateway ID of the replayed events will be rewritten to
+  # this Gateway ID.
+  gateway_id="{{ .Backend.Replay.GatewayID }}"
+
+  # Rewrite timestamps.
+  #
+  # When set, the time of the replayed events will be set to the time of
+  # replaying.
+  rewrite_timestamps={{ .Backend.Replay.RewriteTimestamps }}
+
+  # Downlink file.
+  #
+  # The received commands will be appended to this file as JSON Lines
+  # records (optional).
+  downlink_file="{{ .Backend.Replay.DownlinkFile }}"
+
+  # Downlink TX acknowledgement.
+  #
+  # When set, a TX acknowledgement is emitted for every received downlink
+  # frame (the first item is acknowledged, the other items are ignored).
+  downlink_tx_ack={{ .Backend.Replay.DownlinkTxAck }}
+
+
+  # gRPC backend.
+  #
+  # This backend implements a gRPC server to which the gateway software
+  # opens one bidirectional stream per gateway. Each stream message is a
+  # google.protobuf.Any, wrapping a gw.UplinkFrame, gw.GatewayStats,
+  # gw.DownlinkTXAck or gw.RawPacketForwarderEvent (upstream) or a
+  # gw.DownlinkFrame, gw.GatewayConfiguration or gw.RawPacketForwarderCommand
+  # (downstream). The Gateway ID must be set as gateway-id request metadata.
+  # A new stream for the same Gateway ID replaces (and closes) the existing
+  # stream. Dead connections are detected using gRPC keepalive pings.
+  # See internal/backend/grpc/gateway_bridge.proto for the service definition.
+  [backend.grpc]
+
+  # ip:port to bind the gRPC listener to.
+  bind="{{ .Backend.GRPC.Bind }}"
+
+  # TLS certificate and key files.
+  #
+  # When set, the gRPC listener will use TLS to secure the connections
+  # between the gateways and ChirpStack Gateway Bridge (optional).
+  tls_cert="{{ .Backend.GRPC.TLSCert }}"
+  tls_key="{{ .Backend.GRPC.TLSKey }}"
+
+  # TLS CA certificate.
+  #
+  # When configured, ChirpStack Gateway Bridge will validate that the client
+  # certificate of the gateway has been signed by this CA certificate and
+  # that the certificate CommonName matches the Gateway ID (mutual TLS).
+  ca_cert="{{ .Backend.GRPC.CACert }}"
+
+
+  # Exec backend.
+  #
+  # This backend starts the configured command as a child process and
+  # communicates with it using JSON Lines over stdin and stdout. Each line
+  # is an object holding the message type and the JSON encoded payload,
+  # e.g. {"type": "up", "payload": {...}}.
+  #
+  # The process must write the following types to stdout:
+  #   * up    (gw.UplinkFrame)
+  #   * stats (gw.GatewayStats)
+  #   * ack   (gw.DownlinkTXAck)
+  #   * raw   (gw.RawPacketForwarderEvent)
+  #
+  # ChirpStack Gateway Bridge writes the following types to stdin:
+  #   * down   (gw.DownlinkFrame)
+  #   * config (gw.GatewayConfiguration)
+  #   * raw    (gw.RawPacketForwarderCommand)
+  #
+  # Everything written to stderr is logged.
+  [backend.exec]
+
+  # Command to execute, including its arguments.
+  command="{{ .Backend.Exec.Command }}"
+
+  # Restart delay.
+  #
+  # When the process exits, it will be restarted after this delay. On
+  # every subsequent failure, the delay is doubled until it reaches the
+  # max. restart delay.
+  restart_delay="{{ .Backend.Exec.RestartDelay }}"
+
+  # Max. restart delay.
+  max_restart_delay="{{ .Backend.Exec.MaxRestartDelay }}"
+
+
   # Basic Station backend.
   [backend.basic_station]
 
@@ -207,13 +415,187 @@ type="{{ .Backend.Type }}"
       frequency={{ $concentrator.FSK.Frequency }}
 {{ end }}
 
+# Forwarder configuration.
+#
+# The forwarder forwards the gateway events to the integration and the
+# commands to the gateway backend. These are queued per gateway and are
+# handled by a fixed number of workers. The events and commands of a single
+# gateway are handled one at a time, in order. Downlinks, downlink acks,
+# gateway configuration and raw packet-forwarder commands have priority over
+# uplinks, connection-state events and raw packet-forwarder events, which
+# have priority over stats.
+[forwarder]
+# Number of workers.
+workers={{ .Forwarder.Workers }}
+
+# Max. number of queued events and commands per gateway.
+queue_size={{ .Forwarder.QueueSize }}
+
+# Drop policy.
+#
+# This defines what happens when the queue of a gateway is full:
+#   * drop_oldest: the oldest item with the lowest priority is dropped
+#                  (unless the new item has a lower priority)
+#   * drop_newest: the new item is dropped
+#   * block: the backend blocks until there is space in the queue
+#
+# The block policy only applies to the uplink, stats and raw packet-forwarder
+# events. The downlink acks and the commands (which
+# must not block the integration) are handled by the drop_oldest policy.
+#
+# The gateway (un)subscribe events are never dropped and do not count
+# towards the queue size.
+#
+# Dropped items are counted by the forwarder_queue_dropped_count metric.
+drop_policy="{{ .Forwarder.DropPolicy }}"
+
+  # Uplink de-duplication.
+  #
+  # When enabled, the copies of an uplink frame received by multiple gateways
+  # (or by multiple boards of the same gateway) within the de-duplication
+  # window are merged into a single event. As this event carries the RX
+  # meta-data of every receiver, it is published as up_set event
+  # (gw.UplinkFrameSet) instead of up event (gw.UplinkFrame), using the ID
+  # of the gateway that received the first copy. With the MQTT integration,
+  # the uplinks are therefore published to the event/up_set topic instead of
+  # the event/up topic. As the ChirpStack Network Server (v3) only subscribes
+  # to the event/up topic, this must not be enabled when it is the consumer.
+  # Other consumers must subscribe to the up_set events before enabling this
+  # option. Processors, meta-data and integration
+  # connections must list the up_set event type to apply to these events.
+  #
+  # Copies are identified by the hash of the PHYPayload.
+  [forwarder.deduplication]
+  # Enable uplink de-duplication.
+  enabled={{ .Forwarder.Deduplication.Enabled }}
+
+  # De-duplication window.
+  #
+  # Each uplink event is delayed by this duration.
+  window="{{ .Forwarder.Deduplication.Window }}"
+
+
+  # Event processors.
+  #
+  # The processors are applied in the configured order to the events
+  # (up, stats, ack, raw, conn) forwarded from the backend to the integration
+  # and to the commands (down, config, raw_command) forwarded from the
+  # integration to the backend. Each processor can be limited to a set of
+  # event_types and gateway_ids (by default it applies to all events). When a
+  # processor drops an event, the remaining processors are skipped and the
+  # event is counted by the processor_event_dropped_count metric. Gateway
+  # command execution requests and responses are not passed through the
+  # processors.
+  #
+  # Processor types:
+  #   * filter: drops the uplinks not matching the net_ids and join_euis
+  #     filters of [forwarder.processors.filter] (see [filters] for the
+  #     syntax), or the global filters when these are not set
+  #   * meta_data: adds the gateway meta-data (see [meta_data]) to the event,
+  #     limited to the keys of [forwarder.processors.meta_data] when set (see
+  #     [meta_data.events] for how the meta-data is published)
+  #   * sample: keeps a random sample of the events, the rate (0 - 1) of
+  #     [forwarder.processors.sample] defines the fraction to keep
+  #   * rewrite: rewrites the gateway IDs using the gateway_ids map
+  #     (from = to) of [forwarder.processors.rewrite], the reverse mapping
+  #     must be configured as a separate processor for the commands
+  #   * route: publishes the events to the destinations of
+  #     [forwarder.processors.route] only, this requires the MQTT integration
+  #     with multiple connections (the destinations are the connection names)
+  #   * script: calls the Lua functions of the [forwarder.processors.script]
+  #     file (see below)
+  #
+  # The meta-data configured under [meta_data.events] is added by processors
+  # which are applied after the configured processors.
+  #
+  # Example:
+  # [[forwarder.processors]]
+  # type="filter"
+  # event_types=["up"]
+  #
+  #   [forwarder.processors.filter]
+  #   net_ids=["000000"]
+  #
+  # [[forwarder.processors]]
+  # type="sample"
+  # event_types=["stats"]
+  #
+  #   [forwarder.processors.sample]
+  #   rate=0.1
+  #
+  # [[forwarder.processors]]
+  # name="secondary_up"
+  # type="route"
+  # event_types=["up"]
+  # gateway_ids=["0102030405060708"]
+  #
+  #   [forwarder.processors.route]
+  #   destinations=["secondary"]
+  #
+  # Script processor.
+  #
+  # The script defines a function per event type: onUplink, onUplinkSet,
+  # onStats, onAck, onRaw, onConn, onDownlink, onConfig and onRawCommand.
+  # Each function is called with the event (in the json_decoded format) and
+  # its meta-data as tables. The function can modify both tables and drops the event by
+  # returning false. For stats events, the meta-data table replaces the
+  # meta_data field of the event. Events without matching function are
+  # left as-is. Only the base, table, string and math libraries are
+  # available. As the script is loaded into multiple Lua states (one per
+  # concurrent call), the global variables must not be used to keep state.
+  #
+  # An event is dropped when the function fails or when a limit is exceeded:
+  #   * max_execution_duration: the max. execution duration per call
+  #   * max_call_stack_size: the max. depth of the Lua call stack
+  #   * max_registry_size: the max. number of slots of the Lua data stack
+  #   * max_memory_size: the max. memory (in bytes) used by the tables and
+  #     strings (disabled when set to 0, the default)
+  #
+  # The memory size is not measured, as the Lua VM does not report its
+  # allocations. It is an estimate of the size of the values that can be
+  # reached by the script (including the globals), the actual memory usage
+  # can be higher. As the estimation is done while the script is running,
+  # enabling the memory limit slows down the execution of the script.
+  #
+  # Example:
+  # [[forwarder.processors]]
+  # type="script"
+  # event_types=["up", "stats", "down"]
+  #
+  #   [forwarder.processors.script]
+  #   file="/etc/chirpstack-gateway-bridge/rules.lua"
+  #   max_execution_duration="10ms"
+  #   max_call_stack_size=64
+  #   max_registry_size=16384
+  #   max_memory_size=4194304
+  #
+  # Example script (rules.lua):
+  # function onUplink(up, meta)
+  #   if up.rxInfo.rssi < -125 then
+  #     return false
+  #   end
+  #   meta.channel = tostring(up.txInfo.frequency)
+  # end
+
+
 # Integration configuration.
 [integration]
+# Integration type.
+#
+# Valid options are:
+#   * mqtt
+#   * amqp
+#   * kafka
+#   * http
+type="{{ .Integration.Type }}"
+
 # Payload marshaler.
 #
-# This defines how the MQTT payloads are encoded. Valid options are:
+# This defines how the payloads are encoded. Valid options are:
 # * protobuf:  Protobuf encoding
 # * json:      JSON encoding (easier for debugging, but less compact than 'protobuf')
+# * json_decoded: JSON encoding with HEX / UUID encoded IDs and the decoded
+#                 LoRaWAN PHYPayload fields for uplinks (for debugging)
 marshaler="{{ .Integration.Marshaler }}"
 
   # MQTT integration configuration.
@@ -224,6 +606,26 @@ marshaler="{{ .Integration.Marshaler }}"
   # Command topic template.
   command_topic_template="{{ .Integration.MQTT.CommandTopicTemplate }}"
 
+  # State topic template.
+  #
+  # The connection state (conn) of each gateway is published to this topic
+  # when the gateway connects to or disconnects from the backend.
+  state_topic_template="{{ .Integration.MQTT.StateTopicTemplate }}"
+
+  # Publish the gateway states as retained messages.
+  state_retained={{ .Integration.MQTT.StateRetained }}
+
+  # Bridge state topic template.
+  #
+  # The connection state of the ChirpStack Gateway Bridge itself is published
+  # (retained) to this topic. It is also used as the MQTT last will topic,
+  # so that an OFFLINE state is published by the broker when the bridge dies.
+  # In that case, all the gateways of this bridge must be considered offline.
+  # Available variables are .ClientID and .Hostname. This is disabled when
+  # left blank (the default), e.g. set it to
+  # "gateway-bridge/{{ "{{ .Hostname }}" }}/state/conn" to enable it.
+  bridge_state_topic_template="{{ .Integration.MQTT.BridgeStateTopicTemplate }}"
+
   # Keep alive will set the amount of time (in seconds) that the client should
   # wait before sending a PING request to the broker. This will allow the client
   # to know that a connection has not been lost with the server.
@@ -240,6 +642,180 @@ marshaler="{{ .Integration.Marshaler }}"
   # process will be terminated on a connection error.
   terminate_on_connect_error={{ .Integration.MQTT.TerminateOnConnectError }}
 
+  # Protocol version.
+  #
+  # Valid options are:
+  #   * 4: MQTT v3.1.1
+  #   * 5: MQTT v5
+  #
+  # When set to 5, each event is published with the following user
+  # properties: gateway_id, event and the event ID (e.g. uplink_id). The
+  # content-type is set to match the marshaler. Gateway command execution
+  # requests with a response-topic are replied to on that topic, including
+  # the correlation-data of the request. Note that MQTT v5 does not support
+  # the ws:// and wss:// schemes.
+  protocol_version={{ .Integration.MQTT.ProtocolVersion }}
+
+  # Message expiry (MQTT v5 only).
+  #
+  # When set, the events are published with the given message expiry
+  # interval. Set to 0 to disable.
+  # Valid units are 'ms', 's', 'm', 'h'. Note that these values can be combined, e.g. '24h30m15s'.
+  message_expiry="{{ .Integration.MQTT.MessageExpiry }}"
+
+  # Command QoS.
+  #
+  # The quality of service level used for the command subscriptions. When
+  # not set, the qos of the authentication section is used.
+  # command_qos=1
+
+  # Command policy.
+  #
+  # When multiple connections are configured (see below), this defines
+  # from which connections commands are accepted. Valid options are:
+  #   * all: commands are accepted from all connections
+  #   * first: commands are only accepted from the first connection
+  #   * list: commands are only accepted from the connections listed
+  #           in command_connections
+  command_policy="{{ .Integration.MQTT.CommandPolicy }}"
+
+  # Command connections.
+  #
+  # The names of the connections from which commands are accepted when
+  # the command policy is set to list.
+  command_connections=[{{ range $index, $elm := .Integration.MQTT.CommandConnections }}
+    "{{ $elm }}",{{ end }}
+  ]
+
+  # Session per gateway.
+  #
+  # When enabled, a separate MQTT session is opened for each gateway. The
+  # session is opened when the gateway connects and is closed when the
+  # gateway disconnects. This makes it possible to use a device identity per
+  # gateway, e.g. with GCP Cloud IoT Core, Azure IoT Hub or AWS IoT Core.
+  #
+  # The following authentication options are executed as template, so that
+  # the credentials can be looked up by the gateway ID:
+  #   * generic: username, client_id, tls_cert, tls_key and the credential
+  #     helper command and file
+  #   * gcp_cloud_iot_core: device_id and jwt_key_file
+  #   * azure_iot_hub: device_id, tls_cert and tls_key (X.509 authentication)
+  #   * aws_iot_core: thing_name, tls_cert and tls_key
+  #
+  # Example: tls_cert="/etc/chirpstack-gateway-bridge/certs/{{ "{{ .GatewayID }}" }}.pem"
+  #
+  # Instead of the bridge state, the OFFLINE state of the gateway is used as
+  # last will of the session and its ONLINE state is published once the
+  # session has connected. When the outbox is enabled, an outbox is
+  # created per gateway (in a sub-directory of the outbox path). This can not
+  # be used in combination with multiple connections, Sparkplug B or shared
+  # subscriptions.
+  session_per_gateway={{ .Integration.MQTT.SessionPerGateway }}
+
+
+  # Outbox configuration.
+  #
+  # When a path is set, events which can not be published (because the
+  # connection is down or the publish fails) are stored in an on-disk outbox.
+  # While connected, events are published directly and are not written to
+  # disk. The outbox is drained in order once connected to the MQTT broker.
+  # This prevents events from being lost when the connection is down, or
+  # when the ChirpStack Gateway Bridge is restarted while events are pending.
+  [integration.mqtt.outbox]
+  # Path of the outbox directory.
+  #
+  # Leave blank to disable the outbox. When using multiple connections, each
+  # connection must use its own path.
+  path="{{ .Integration.MQTT.Outbox.Path }}"
+
+  # Max. size (in bytes).
+  #
+  # When exceeded, the oldest events are dropped. Set to 0 to disable.
+  max_size={{ .Integration.MQTT.Outbox.MaxSize }}
+
+  # Max. age.
+  #
+  # Events older than the given duration are dropped. Set to 0 to disable.
+  max_age="{{ .Integration.MQTT.Outbox.MaxAge }}"
+
+
+  # Sparkplug B configuration.
+  #
+  # When enabled, the events are published using the Sparkplug B topic
+  # namespace and payload format, for Sparkplug B aware (SCADA) consumers.
+  # The ChirpStack Gateway Bridge is the edge node and each gateway is a
+  # device of this edge node (the device ID is the gateway ID). The NBIRTH
+  # and DBIRTH certificates contain the gateway meta-data (see [meta_data])
+  # as Properties/<key> metrics and the NDEATH is registered as MQTT last will.
+  # Stats and uplinks are published as DDATA metrics. For a de-duplicated
+  # uplink, the metrics contain the RX meta-data of the first copy and the
+  # Uplink/Receivers metric the number of receivers. The Command/Exec and
+  # Command/Config DCMD metrics accept a gateway command execution request
+  # and a gateway configuration, encoded using the configured marshaler
+  # (String metric for json, Bytes metric for protobuf). Exec responses are
+  # published as the Command/Exec Response DDATA metric.
+  #
+  # This requires the generic authentication type. The topic templates, the
+  # per event-type configuration, the bridge state and the outbox are not used
+  # in this mode.
+  [integration.mqtt.sparkplug_b]
+  # Enable Sparkplug B.
+  enabled={{ .Integration.MQTT.SparkplugB.Enabled }}
+
+  # Group ID.
+  group_id="{{ .Integration.MQTT.SparkplugB.GroupID }}"
+
+  # Edge node ID.
+  #
+  # When blank, the hostname is used.
+  edge_node_id="{{ .Integration.MQTT.SparkplugB.EdgeNodeID }}"
+
+
+  # Shared subscription.
+  #
+  # This makes it possible to run multiple ChirpStack Gateway Bridge instances
+  # (e.g. behind a load-balancer), of which each instance holds a subset of
+  # the gateways. The commands are received through a MQTT shared subscription
+  # ($share/<group>/<command topic>), by which the broker delivers each command
+  # to one of the instances. An instance receiving a command for a gateway it
+  # does not hold, re-publishes the command under the forward topic prefix,
+  # to which the instance holding the gateway is subscribed.
+  #
+  # This requires a broker supporting shared subscriptions and a command topic
+  # template containing the gateway ID as topic level. It can not be used in
+  # combination with the GCP Cloud IoT Core or Azure IoT Hub authentication,
+  # or with Sparkplug B.
+  [integration.mqtt.shared_subscription]
+  # Enable shared subscription.
+  enabled={{ .Integration.MQTT.SharedSubscription.Enabled }}
+
+  # Shared subscription group.
+  #
+  # All the instances must use the same group.
+  group="{{ .Integration.MQTT.SharedSubscription.Group }}"
+
+  # Forward topic prefix.
+  #
+  # Commands for a gateway held by an other instance are re-published to the
+  # command topic, prefixed by this prefix.
+  forward_topic_prefix="{{ .Integration.MQTT.SharedSubscription.ForwardTopicPrefix }}"
+
+
+  # Per event-type configuration.
+  #
+  # For each event type (up, stats, ack, raw, exec, conn), the qos, the retain
+  # flag and the topic template can be overridden. Unset options fall back to
+  # the settings above. The topic template overrides and the retain flag are
+  # ignored when using the GCP Cloud IoT Core or Azure IoT Hub authentication,
+  # as these use fixed topics. The retain flag is also ignored when using the
+  # AWS IoT Core authentication.
+  #
+  # Example:
+  # [integration.mqtt.events.stats]
+  # qos=1
+  # retain=true
+  # topic_template="gateway/{{ "{{ .GatewayID }}" }}/stats"
+
 
   # MQTT authentication.
   [integration.mqtt.auth]
@@ -301,6 +877,34 @@ marshaler="{{ .Integration.Marshaler }}"
     # mqtt TLS key file (optional)
     tls_key="{{ .Integration.MQTT.Auth.Generic.TLSKey }}"
 
+      # Credential helper (optional).
+      #
+      # Instead of a static username and password, the credentials can be
+      # obtained by executing a command or by reading a file (e.g. written by
+      # a local agent issuing short-lived JWTs). The command or file must
+      # return a JSON object in the following format:
+      #
+      # {"username": "...", "password": "...", "expires_in": 3600}
+      #
+      # Instead of expires_in (seconds), the expiration time can be given as
+      # expires_at (RFC3339 timestamp). Both are optional. The credentials are
+      # obtained on each connect. When they expire, ChirpStack Gateway Bridge
+      # re-connects with fresh credentials after 90% of their lifetime.
+      # Credentials are never logged.
+      [integration.mqtt.auth.generic.credential_helper]
+      # Command to execute (optional).
+      #
+      # Example: ["/usr/local/bin/token-agent", "--audience", "mqtt"]
+      command=[{{ range $index, $elm := .Integration.MQTT.Auth.Generic.CredentialHelper.Command }}
+        "{{ $elm }}",{{ end }}
+      ]
+
+      # File to read (optional).
+      file="{{ .Integration.MQTT.Auth.Generic.CredentialHelper.File }}"
+
+      # Max. execution duration of the command.
+      timeout="{{ .Integration.MQTT.Auth.Generic.CredentialHelper.Timeout }}"
+
 
     # Google Cloud Platform Cloud IoT Core authentication.
     #
@@ -377,6 +981,218 @@ marshaler="{{ .Integration.Marshaler }}"
     tls_key="{{ .Integration.MQTT.Auth.AzureIoTHub.TLSKey }}"
 
 
+    # AWS IoT Core authentication (X.509 client certificate).
+    #
+    # The topic templates must fit the AWS IoT Core restrictions (max. 7
+    # forward slashes, max. 256 bytes and not starting with '$'). As AWS IoT
+    # Core does not support QoS 2, the qos is limited to 1. Messages are never
+    # published with the retain flag (including the state messages).
+    [integration.mqtt.auth.aws_iot_core]
+    # MQTT server.
+    #
+    # This is the device data endpoint of your AWS account. When using port 443,
+    # the x-amzn-mqtt-ca ALPN protocol is used, as required by AWS IoT Core.
+    # Example: ssl://xxxxxxxxxxxxxx-ats.iot.eu-west-1.amazonaws.com:8883
+    server="{{ .Integration.MQTT.Auth.AWSIoTCore.Server }}"
+
+    # Thing name.
+    #
+    # This is used as MQTT client ID, which is required when the policy of the
+    # thing uses the iot:Connection.Thing.ThingName policy variable.
+    thing_name="{{ .Integration.MQTT.Auth.AWSIoTCore.ThingName }}"
+
+    # CA certificate file (optional).
+    #
+    # When blank, the system CA certificates are used (which include the
+    # Amazon Root CA).
+    ca_cert="{{ .Integration.MQTT.Auth.AWSIoTCore.CACert }}"
+
+    # Client certificates.
+    #
+    # Configure the tls_cert (certificate file) and tls_key (private-key file)
+    # of the thing.
+    tls_cert="{{ .Integration.MQTT.Auth.AWSIoTCore.TLSCert }}"
+    tls_key="{{ .Integration.MQTT.Auth.AWSIoTCore.TLSKey }}"
+
+
+  # MQTT connections.
+  #
+  # When one or multiple connections are configured, the MQTT integration
+  # connects to each of them instead of using the configuration above. Each
+  # connection accepts the same options as the [integration.mqtt] section
+  # (including the auth sub-sections), plus a name, a marshaler and the event
+  # types to publish (leave empty to publish all event types). Unset topic
+  # templates, state retained, keep alive, reconnect interval, protocol
+  # version, message expiry, terminate on connect error, auth type, generic
+  # auth servers and qos, outbox max. size and max. age and marshaler fall
+  # back to the values above. Each event is published to all connections
+  # matching the event type. The connections are started independently, a
+  # connection which can not connect does not block the other connections.
+  # Events for a connection which has not connected yet are stored in its
+  # outbox (when configured).
+  #
+  # Example:
+  # [[integration.mqtt.connections]]
+  # name="primary"
+  # marshaler="protobuf"
+  # event_types=["up", "stats", "ack", "exec", "raw"]
+  #
+  #   [integration.mqtt.connections.auth.generic]
+  #   servers=["tcp://ns1.example.com:1883"]
+  #
+  # [[integration.mqtt.connections]]
+  # name="secondary"
+  # marshaler="json"
+  # event_types=["up", "stats"]
+  #
+  #   [integration.mqtt.connections.auth.generic]
+  #   servers=["tcp://ns2.example.com:1883"]
+
+
+  # AMQP integration configuration.
+  #
+  # Events are published to the configured topic exchange. Commands are
+  # consumed from a queue per gateway, which is created (and bound using
+  # the command routing-key) when the gateway connects and is deleted
+  # when the gateway disconnects. The command type is taken from the last
+  # part of the routing-key (down, config, exec or raw).
+  [integration.amqp]
+  # AMQP server URL.
+  #
+  # Use amqps:// for a TLS connection.
+  url="{{ .Integration.AMQP.URL }}"
+
+  # Exchange.
+  #
+  # This must be a topic exchange. It is declared (as durable) when it
+  # does not exist.
+  exchange="{{ .Integration.AMQP.Exchange }}"
+
+  # Event routing-key template.
+  event_routing_key_template="{{ .Integration.AMQP.EventRoutingKeyTemplate }}"
+
+  # Command routing-key template.
+  #
+  # This is the routing-key used for binding the per gateway command queue
+  # to the exchange.
+  command_routing_key_template="{{ .Integration.AMQP.CommandRoutingKeyTemplate }}"
+
+  # Command queue-name template.
+  command_queue_name_template="{{ .Integration.AMQP.CommandQueueNameTemplate }}"
+
+
+  # Kafka integration configuration.
+  #
+  # Events are produced to the event topic, using the Gateway ID as message
+  # key so that the ordering of the events is kept per gateway. Commands are
+  # consumed from all partitions of the command topic, starting at the
+  # newest offset, by every ChirpStack Gateway Bridge instance. No consumer
+  # group is used and no offsets are committed, thus commands published while
+  # the ChirpStack Gateway Bridge is not running are not consumed. Each
+  # command message must have the Gateway ID (HEX encoded) as key and a
+  # 'command' header containing the command type (down, config, exec or raw).
+  # Commands of which the key does not match the Gateway ID of the payload
+  # are rejected. Commands for gateways that are not connected to this
+  # instance are ignored.
+  [integration.kafka]
+  # Kafka brokers.
+  brokers=[{{ range $index, $elm := .Integration.Kafka.Brokers }}
+    "{{ $elm }}",{{ end }}
+  ]
+
+  # Kafka version.
+  #
+  # This must be 0.11.0 or higher, as the idempotent producer and
+  # message headers are used.
+  version="{{ .Integration.Kafka.Version }}"
+
+  # Event topic template.
+  event_topic_template="{{ .Integration.Kafka.EventTopicTemplate }}"
+
+  # Command topic.
+  command_topic="{{ .Integration.Kafka.CommandTopic }}"
+
+  # Connect using TLS.
+  tls={{ .Integration.Kafka.TLS }}
+
+  # CA certificate file (optional).
+  ca_cert="{{ .Integration.Kafka.CACert }}"
+
+  # TLS certificate and key files (optional).
+  tls_cert="{{ .Integration.Kafka.TLSCert }}"
+  tls_key="{{ .Integration.Kafka.TLSKey }}"
+
+  # SASL mechanism.
+  #
+  # Leave blank to disable SASL authentication. Valid options are:
+  #   * plain
+  #   * scram_sha256
+  #   * scram_sha512
+  sasl_mechanism="{{ .Integration.Kafka.SASLMechanism }}"
+
+  # SASL username and password.
+  sasl_username="{{ .Integration.Kafka.SASLUsername }}"
+  sasl_password="{{ .Integration.Kafka.SASLPassword }}"
+
+
+  # HTTP integration configuration.
+  #
+  # Events are sent as POST requests to each of the configured event URLs.
+  # The request has the following headers:
+  #   * Content-Type: depends on the configured marshaler
+  #   * X-Gateway-ID: the Gateway ID
+  #   * X-Event: the event type (up, stats, ack, raw or exec)
+  #   * X-Timestamp: the Unix timestamp (in seconds) of the request (when
+  #                  the signing secret is set)
+  #   * X-Signature: the signature of the request (when the signing secret
+  #                  is set)
+  #
+  # The signature is the HEX encoded HMAC-SHA256 of:
+  #   {Method}\n{Path}\n{GatewayID}\n{Timestamp}\n{Body}
+  # where GatewayID is HEX encoded and Timestamp equals the X-Timestamp header.
+  #
+  # When the bind is set, commands can be sent as POST requests to:
+  #   /gateway/{GatewayID}/command/{CommandType}
+  # where CommandType is down, config, exec or raw. These requests must have
+  # valid X-Timestamp and X-Signature headers. Requests older than 5 minutes
+  # are rejected, as are requests of which the signature was already used.
+  [integration.http]
+  # Event URLs.
+  event_urls=[{{ range $index, $elm := .Integration.HTTP.EventURLs }}
+    "{{ $elm }}",{{ end }}
+  ]
+
+  # Request timeout.
+  timeout="{{ .Integration.HTTP.Timeout }}"
+
+  # Max. number of retries.
+  #
+  # Requests resulting in a connection error or in a 5xx or 429 response
+  # are retried. The delay between retries is doubled on every retry. The
+  # retries are performed in the background, thus a retried event can be
+  # received after events that were published later.
+  max_retries={{ .Integration.HTTP.MaxRetries }}
+
+  # Retry delay.
+  retry_delay="{{ .Integration.HTTP.RetryDelay }}"
+
+  # Signing secret.
+  #
+  # This secret is used for signing the event requests and for validating
+  # the signature of the command requests. It must be set when the bind is
+  # set.
+  signing_secret="{{ .Integration.HTTP.SigningSecret }}"
+
+  # ip:port to bind the command endpoint to.
+  #
+  # Leave blank to disable the command endpoint.
+  bind="{{ .Integration.HTTP.Bind }}"
+
+  # TLS certificate and key files (optional).
+  tls_cert="{{ .Integration.HTTP.TLSCert }}"
+  tls_key="{{ .Integration.HTTP.TLSKey }}"
+
+
 # Metrics configuration.
 [metrics]
 
@@ -392,6 +1208,56 @@ marshaler="{{ .Integration.Marshaler }}"
   # metrics endpoint.
   bind="{{ .Metrics.Prometheus.Bind }}"
 
+  # OpenTelemetry tracing.
+  #
+  # When enabled, the uplinks are traced from their receipt by the backend
+  # until they are published by the integration and the downlinks from their
+  # receipt by the integration until the TX acknowledgement. The uplink ID or
+  # downlink ID is used as trace ID, so that the trace of a frame can be
+  # looked up by its ID. The downlink token is added as span attribute.
+  #
+  # Spans are created by the Semtech UDP and Basic Station backends, the
+  # forwarder (queueing, processing and de-duplication) and the MQTT
+  # integration. They are exported to an OpenTelemetry collector using OTLP
+  # over HTTP (Protobuf encoding).
+  #
+  # For testing, a local collector (logging the received spans) can be
+  # started using the docker-compose.yml of the source repository:
+  # docker-compose up otel-collector
+  [metrics.tracing]
+  # Enable tracing.
+  enabled={{ .Metrics.Tracing.Enabled }}
+
+  # OTLP/HTTP endpoint of the collector.
+  #
+  # The spans are posted to the /v1/traces path of this endpoint.
+  endpoint="{{ .Metrics.Tracing.Endpoint }}"
+
+  # Export timeout.
+  timeout="{{ .Metrics.Tracing.Timeout }}"
+
+  # Service name.
+  #
+  # This is set as service.name resource attribute.
+  service_name="{{ .Metrics.Tracing.ServiceName }}"
+
+  # Sample ratio.
+  #
+  # The ratio of uplinks and downlinks to trace, between 0 and 1. The decision
+  # is based on the uplink or downlink ID.
+  sample_ratio={{ .Metrics.Tracing.SampleRatio }}
+
+  # HTTP headers (optional).
+  #
+  # Additional headers to send with each export request, e.g. for
+  # authentication.
+  [metrics.tracing.headers]
+  # Example:
+  # Authorization="Bearer secret"
+  {{ range $k, $v := .Metrics.Tracing.Headers }}
+  {{ $k }}="{{ $v }}"
+  {{ end }}
+
 
 # Gateway meta-data.
 #
@@ -445,6 +1311,31 @@ marshaler="{{ .Integration.Marshaler }}"
   {{ $k }}="{{ $v }}"
   {{ end }}
 
+
+  # Per event-type configuration.
+  #
+  # For each event type (stats, up, ack), this defines if the meta-data is
+  # published with the event and which keys are included. When keys is empty,
+  # all the keys are included. Use this to only attach the few keys needed
+  # to high-rate events like uplinks.
+  #
+  # The stats events carry the meta-data in their meta_data field. Uplink and
+  # ack events do not have such a field, these are only supported by the MQTT
+  # integration. With MQTT v5, the meta-data is published as user properties
+  # (prefixed by meta_data.), with MQTT v3.1.1 it is added as metaData object
+  # to the payload. The latter requires the json or json_decoded marshaler.
+  #
+  # Example:
+  # [meta_data.events.up]
+  # enabled=true
+  # keys=["site", "antenna", "tenant"]
+{{ range $k, $v := .MetaData.Events }}
+  [meta_data.events.{{ $k }}]
+  enabled={{ $v.Enabled }}
+  keys=[{{ range $index, $elm := $v.Keys }}
+    "{{ $elm }}",{{ end }}
+  ]
+{{ end }}
 # Executable commands.
 #
 # The configured commands can be triggered by sending a message to the
@@ -459,6 +1350,58 @@ marshaler="{{ .Integration.Marshaler }}"
   max_execution_duration="{{ $v.MaxExecutionDuration }}"
   command="{{ $v.Command }}"
 {{ end }}
+
+# Traffic recorder.
+#
+# The recorder appends the received events (up, stats, ack, raw and exec) and
+# commands (down, config, raw_command and exec) to a JSON Lines file, each line
+# containing a record in the format of
+# {"time": "...", "direction": "event|command", "type": "...", "payload": {...}},
+# where the payload is the JSON encoded message. Events and commands are
+# recorded as received, before the processors are applied.
+#
+# Recorded files can be replayed using the replay backend (json format), e.g.
+# to reproduce an incident offline. Gzip compressed files are decompressed
+# by the replay backend.
+[recorder]
+  # Record all gateways.
+  enabled={{ .Recorder.Enabled }}
+
+  # Enable the recorder gateway command.
+  #
+  # When enabled, the recording of a single gateway can be started and stopped
+  # using the gateway command execution request (exec command) with command
+  # "recorder" and as stdin "start", "stop" or "status". The stdout of the
+  # response contains the recording status of the gateway.
+  command_enabled={{ .Recorder.CommandEnabled }}
+
+  # File to record to.
+  #
+  # This must be set when the recorder or the recorder command is enabled.
+  file="{{ .Recorder.File }}"
+
+  # Max. file size (bytes).
+  #
+  # Once the file exceeds this size, it is rotated. The file is renamed to
+  # <file>.1, <file>.1 to <file>.2, etc.
+  max_size={{ .Recorder.MaxSize }}
+
+  # Max. number of rotated files to keep.
+  #
+  # When set to 0, the file is removed on rotation.
+  max_files={{ .Recorder.MaxFiles }}
+
+  # Gzip rotated files.
+  #
+  # When set, the rotated files are gzip compressed (<file>.1.gz, ...). The
+  # file being written to is never compressed.
+  gzip={{ .Recorder.Gzip }}
+
+  # Queue size.
+  #
+  # The records are written asynchronously. When the queue is full, records
+  # are dropped.
+  queue_size={{ .Recorder.QueueSize }}
 `
 
 var configCmd = &cobra.Command{
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
@@ -17,6 +18,8 @@ import (
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/metadata"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/metrics"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/recorder"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/tracing"
 )
 
 func run(cmd *cobra.Command, args []string) error {
@@ -30,7 +33,9 @@ func run(cmd *cobra.Command, args []string) error {
 		setupIntegration,
 		setupForwarder,
 		setupMetrics,
+		setupTracing,
 		setupMetaData,
+		setupRecorder,
 		setupCommands,
 		startIntegration,
 		startBackend,
@@ -47,6 +52,15 @@ func run(cmd *cobra.Command, args []string) error {
 	log.WithField("signal", <-sigChan).Info("signal received")
 	log.Warning("shutting down server")
 
+	for _, t := range []func() error{
+		stopRecorder,
+		shutdownTracing,
+	} {
+		if err := t(); err != nil {
+			log.Error(err)
+		}
+	}
+
 	return nil
 }
 
@@ -91,6 +105,23 @@ func setupMetrics() error {
 	return nil
 }
 
+func setupTracing() error {
+	if err := tracing.Setup(config.C); err != nil {
+		return errors.Wrap(err, "setup tracing error")
+	}
+	return nil
+}
+
+func shutdownTracing() error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.C.Metrics.Tracing.Timeout)
+	defer cancel()
+
+	if err := tracing.Shutdown(ctx); err != nil {
+		return errors.Wrap(err, "shutdown tracing error")
+	}
+	return nil
+}
+
 func setupMetaData() error {
 	if err := metadata.Setup(config.C); err != nil {
 		return errors.Wrap(err, "setup meta-data error")
@@ -98,6 +129,18 @@ func setupMetaData() error {
 	return nil
 }
 
+func setupRecorder() error {
+	if err := recorder.Setup(config.C); err != nil {
+		return errors.Wrap(err, "setup recorder error")
+	}
+	return nil
+}
+
+func stopRecorder() error {
+	recorder.Stop()
+	return nil
+}
+
 func setupFilters() error {
 	if err := filters.Setup(config.C); err != nil {
 		return errors.Wrap(err, "setup filters error")
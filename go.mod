@@ -3,17 +3,19 @@ module github.com/brocaar/chirpstack-gateway-bridge
 go 1.14
 
 require (
+	github.com/Shopify/sarama v1.23.1
 	github.com/brocaar/chirpstack-api/go/v3 v3.6.0
 	github.com/brocaar/lorawan v0.0.0-20190814113539-8eb2a8d6da09
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/eclipse/paho.golang v0.11.0
 	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/go-zeromq/zmq4 v0.7.0
 	github.com/gofrs/uuid v3.2.0+incompatible
-	github.com/golang/protobuf v1.3.5
+	github.com/golang/protobuf v1.5.2
 	github.com/gopherjs/gopherjs v0.0.0-20190430165422-3e4dfb77656c // indirect
 	github.com/goreleaser/goreleaser v0.106.0
 	github.com/goreleaser/nfpm v0.11.0
-	github.com/gorilla/websocket v1.4.1
+	github.com/gorilla/websocket v1.4.2
 	github.com/jacobsa/crypto v0.0.0-20190317225127-9f44e2d11115 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/patrickmn/go-cache v2.1.0+incompatible
@@ -24,9 +26,20 @@ require (
 	github.com/spf13/afero v1.2.0 // indirect
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.4.0
-	github.com/stretchr/testify v1.4.0
-	golang.org/x/lint v0.0.0-20190409202823-959b441ac422
-	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
-	golang.org/x/tools v0.0.0-20190709211700-7b25e351ac0e // indirect
-	google.golang.org/appengine v1.6.1 // indirect
+	github.com/streadway/amqp v1.0.0
+	github.com/stretchr/testify v1.7.1
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
+	// The script memory limit (internal/processor/script_memory.go) depends
+	// on the VM internals, review it before upgrading.
+	github.com/yuin/gopher-lua v1.1.1
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	go.opentelemetry.io/proto/otlp v0.16.0
+	golang.org/x/lint v0.0.0-20200302205851-738671d3881b
+	google.golang.org/grpc v1.46.0
+	google.golang.org/protobuf v1.28.0
+	gopkg.in/jcmturner/goidentity.v3 v3.0.0 // indirect
 )
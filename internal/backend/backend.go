@@ -9,6 +9,10 @@ import (
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/basicstation"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/concentratord"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/exec"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/grpc"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/mqtt"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/replay"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 )
@@ -26,6 +30,14 @@ func Setup(conf config.Config) error {
 		backend, err = basicstation.NewBackend(conf)
 	case "concentratord":
 		backend, err = concentratord.NewBackend(conf)
+	case "mqtt":
+		backend, err = mqtt.NewBackend(conf)
+	case "replay":
+		backend, err = replay.NewBackend(conf)
+	case "grpc":
+		backend, err = grpc.NewBackend(conf)
+	case "exec":
+		backend, err = exec.NewBackend(conf)
 	default:
 		return fmt.Errorf("unknown backend type: %s", conf.Backend.Type)
 	}
@@ -21,11 +21,14 @@ import (
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/brocaar/chirpstack-api/go/v3/gw"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/basicstation/structs"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/tracing"
 	"github.com/brocaar/lorawan"
 	"github.com/brocaar/lorawan/band"
 	"github.com/brocaar/lorawan/gps"
@@ -202,10 +205,15 @@ func (b *Backend) SetSubscribeEventFunc(f func(events.Subscribe)) {
 }
 
 // SendDownlinkFrame sends the given downlink frame.
-func (b *Backend) SendDownlinkFrame(df gw.DownlinkFrame) error {
+func (b *Backend) SendDownlinkFrame(df gw.DownlinkFrame) (err error) {
 	b.Lock()
 	defer b.Unlock()
 
+	span := tracing.Start(df.GetDownlinkId(), "basicstation.dnmsg", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("gateway_id", fmt.Sprintf("%x", df.GetGatewayId())),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	// for backwards compatibility
 	if df.Token == 0 {
 		tokenB := make([]byte, 2)
@@ -215,6 +223,7 @@ func (b *Backend) SendDownlinkFrame(df gw.DownlinkFrame) error {
 
 		df.Token = uint32(binary.BigEndian.Uint16(tokenB))
 	}
+	span.SetAttributes(attribute.Int64("token", int64(df.Token)))
 
 	pl, err := structs.DownlinkFrameFromProto(b.band, df)
 	if err != nil {
@@ -627,6 +636,11 @@ func (b *Backend) handleJoinRequest(gatewayID lorawan.EUI64, v structs.JoinReque
 	}
 	uplinkFrame.RxInfo.UplinkId = uplinkID[:]
 
+	span := tracing.Start(uplinkID[:], "basicstation.jreq", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("gateway_id", gatewayID.String()),
+	))
+	defer span.End()
+
 	log.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"uplink_id":  uplinkID,
@@ -656,6 +670,11 @@ func (b *Backend) handleProprietaryDataFrame(gatewayID lorawan.EUI64, v structs.
 	}
 	uplinkFrame.RxInfo.UplinkId = uplinkID[:]
 
+	span := tracing.Start(uplinkID[:], "basicstation.propdf", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("gateway_id", gatewayID.String()),
+	))
+	defer span.End()
+
 	log.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"uplink_id":  uplinkID,
@@ -685,6 +704,12 @@ func (b *Backend) handleDownlinkTransmittedMessage(gatewayID lorawan.EUI64, v st
 	var downID uuid.UUID
 	copy(downID[:], txack.GetDownlinkId())
 
+	span := tracing.Start(downID[:], "basicstation.dntxed", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("gateway_id", gatewayID.String()),
+		attribute.Int64("token", int64(txack.Token)),
+	))
+	defer span.End()
+
 	log.WithFields(log.Fields{
 		"gateway_id":  gatewayID,
 		"downlink_id": downID,
@@ -714,6 +739,11 @@ func (b *Backend) handleUplinkDataFrame(gatewayID lorawan.EUI64, v structs.Uplin
 	}
 	uplinkFrame.RxInfo.UplinkId = uplinkID[:]
 
+	span := tracing.Start(uplinkID[:], "basicstation.updf", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("gateway_id", gatewayID.String()),
+	))
+	defer span.End()
+
 	log.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"uplink_id":  uplinkID,
@@ -0,0 +1,531 @@
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/commands"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/filters"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+// maxLineSize defines the max. size of a single JSON Lines message.
+const maxLineSize = 1024 * 1024
+
+var errNotRunning = errors.New("process is not running")
+
+// message defines a single JSON Lines message exchanged with the process.
+type message struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Backend implements a backend which starts an external process and
+// exchanges JSON Lines messages with it over stdin and stdout.
+type Backend struct {
+	sync.RWMutex
+
+	// Callback functions for handling events.
+	downlinkTxAckFunc           func(gw.DownlinkTXAck)
+	gatewayStatsFunc            func(gw.GatewayStats)
+	uplinkFrameFunc             func(gw.UplinkFrame)
+	rawPacketForwarderEventFunc func(gw.RawPacketForwarderEvent)
+	subscribeEventFunc          func(events.Subscribe)
+
+	command         []string
+	restartDelay    time.Duration
+	maxRestartDelay time.Duration
+
+	// cmd and stdin are set while the process is running.
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	// writeMux serializes the writes to stdin. A separate mutex is used, as
+	// a write blocks when the process stops reading stdin and Stop must
+	// always be able to close stdin and kill the process.
+	writeMux sync.Mutex
+
+	json     marshaler.JSON
+	gateways map[lorawan.EUI64]struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.Config) (*Backend, error) {
+	b := Backend{
+		restartDelay:    conf.Backend.Exec.RestartDelay,
+		maxRestartDelay: conf.Backend.Exec.MaxRestartDelay,
+		gateways:        make(map[lorawan.EUI64]struct{}),
+		done:            make(chan struct{}),
+	}
+
+	var err error
+	b.command, err = commands.ParseCommandLine(conf.Backend.Exec.Command)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse command error")
+	}
+	if len(b.command) == 0 {
+		return nil, errors.New("no command is given")
+	}
+
+	if b.maxRestartDelay < b.restartDelay {
+		b.maxRestartDelay = b.restartDelay
+	}
+
+	log.WithFields(log.Fields{
+		"exec":              b.command[0],
+		"args":              b.command[1:],
+		"restart_delay":     b.restartDelay,
+		"max_restart_delay": b.maxRestartDelay,
+	}).Info("backend/exec: setting up backend")
+
+	return &b, nil
+}
+
+// Start starts the process and restarts it with backoff when it exits.
+func (b *Backend) Start() error {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		delay := b.restartDelay
+
+		for {
+			start := time.Now()
+			err := b.run()
+			if b.isClosed() {
+				return
+			}
+			if err != nil {
+				log.WithError(err).Error("backend/exec: process error")
+			}
+
+			// reset the backoff when the process has been running for a
+			// while, else keep increasing the delay
+			if time.Since(start) > b.maxRestartDelay {
+				delay = b.restartDelay
+			}
+
+			log.WithField("delay", delay).Info("backend/exec: restarting process")
+
+			select {
+			case <-b.done:
+				return
+			case <-time.After(delay):
+			}
+
+			delay = delay * 2
+			if delay > b.maxRestartDelay {
+				delay = b.maxRestartDelay
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the process and the backend.
+func (b *Backend) Stop() error {
+	b.Lock()
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+
+	if b.cmd != nil {
+		// Closing stdin first signals child processes of the process (which
+		// might have inherited stdout) to exit.
+		b.stdin.Close()
+
+		if err := b.cmd.Process.Kill(); err != nil {
+			log.WithError(err).Error("backend/exec: kill process error")
+		}
+	}
+	b.Unlock()
+
+	b.wg.Wait()
+
+	return nil
+}
+
+// SetDownlinkTxAckFunc sets the DownlinkTXAck handler func.
+func (b *Backend) SetDownlinkTxAckFunc(f func(gw.DownlinkTXAck)) {
+	b.downlinkTxAckFunc = f
+}
+
+// SetGatewayStatsFunc sets the GatewayStats handler func.
+func (b *Backend) SetGatewayStatsFunc(f func(gw.GatewayStats)) {
+	b.gatewayStatsFunc = f
+}
+
+// SetUplinkFrameFunc sets the UplinkFrame handler func.
+func (b *Backend) SetUplinkFrameFunc(f func(gw.UplinkFrame)) {
+	b.uplinkFrameFunc = f
+}
+
+// SetRawPacketForwarderEventFunc sets the RawPacketForwarderEvent handler func.
+func (b *Backend) SetRawPacketForwarderEventFunc(f func(gw.RawPacketForwarderEvent)) {
+	b.rawPacketForwarderEventFunc = f
+}
+
+// SetSubscribeEventFunc sets the Subscribe handler func.
+func (b *Backend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	b.subscribeEventFunc = f
+}
+
+// SendDownlinkFrame sends the given downlink frame to the process.
+func (b *Backend) SendDownlinkFrame(pl gw.DownlinkFrame) error {
+	var downID uuid.UUID
+	copy(downID[:], pl.GetDownlinkId())
+
+	if err := b.writeMessage("down", &pl); err != nil {
+		return errors.Wrap(err, "write downlink frame error")
+	}
+
+	log.WithFields(log.Fields{
+		"downlink_id": downID,
+	}).Info("backend/exec: downlink frame sent to process")
+
+	return nil
+}
+
+// ApplyConfiguration sends the given configuration to the process.
+func (b *Backend) ApplyConfiguration(pl gw.GatewayConfiguration) error {
+	if err := b.writeMessage("config", &pl); err != nil {
+		return errors.Wrap(err, "write gateway configuration error")
+	}
+	return nil
+}
+
+// RawPacketForwarderCommand sends the given raw command to the process.
+func (b *Backend) RawPacketForwarderCommand(pl gw.RawPacketForwarderCommand) error {
+	if err := b.writeMessage("raw", &pl); err != nil {
+		return errors.Wrap(err, "write raw packet-forwarder command error")
+	}
+	return nil
+}
+
+func (b *Backend) isClosed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// run starts the process and blocks until it exits.
+func (b *Backend) run() error {
+	cmd := exec.Command(b.command[0], b.command[1:]...)
+	cmd.Env = os.Environ()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errors.Wrap(err, "get stdin pipe error")
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, "get stdout pipe error")
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.Wrap(err, "get stderr pipe error")
+	}
+
+	// The process is started while holding the lock, so that Stop either
+	// prevents the start or is able to kill the started process.
+	b.Lock()
+	if b.isClosed() {
+		b.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		b.Unlock()
+		return errors.Wrap(err, "start process error")
+	}
+	b.cmd = cmd
+	b.stdin = stdin
+	b.Unlock()
+
+	restartCounter().Inc()
+	log.WithField("pid", cmd.Process.Pid).Info("backend/exec: process started")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.readStderr(stderr)
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLineSize)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		if err := b.handleLine(scanner.Bytes()); err != nil {
+			log.WithError(err).Error("backend/exec: handle message error")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// The process must be killed, as it would block forever on writing
+		// to stdout once nothing is reading it anymore.
+		log.WithError(err).Error("backend/exec: read stdout error, killing process")
+		if err := cmd.Process.Kill(); err != nil {
+			log.WithError(err).Error("backend/exec: kill process error")
+		}
+	}
+
+	wg.Wait()
+	err = cmd.Wait()
+
+	b.Lock()
+	b.cmd = nil
+	b.stdin = nil
+	b.Unlock()
+
+	b.removeGateways()
+
+	if err != nil {
+		return errors.Wrap(err, "process exited")
+	}
+
+	log.Info("backend/exec: process exited")
+	return nil
+}
+
+func (b *Backend) readStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLineSize)
+	for scanner.Scan() {
+		log.WithField("stderr", scanner.Text()).Info("backend/exec: process log")
+	}
+	if err := scanner.Err(); err != nil {
+		log.WithError(err).Error("backend/exec: read stderr error")
+
+		// Keep draining stderr, so that the process does not block on
+		// writing to it.
+		io.Copy(ioutil.Discard, r)
+	}
+}
+
+func (b *Backend) writeMessage(typ string, msg proto.Message) error {
+	pl, err := b.json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal message error")
+	}
+
+	bb, err := json.Marshal(message{
+		Type:    typ,
+		Payload: pl,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal json lines message error")
+	}
+
+	b.RLock()
+	stdin := b.stdin
+	b.RUnlock()
+
+	if stdin == nil {
+		return errNotRunning
+	}
+
+	b.writeMux.Lock()
+	defer b.writeMux.Unlock()
+
+	if _, err := stdin.Write(append(bb, '\n')); err != nil {
+		return errors.Wrap(err, "write to stdin error")
+	}
+
+	commandCounter(typ).Inc()
+
+	return nil
+}
+
+func (b *Backend) handleLine(line []byte) error {
+	var msg message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return errors.Wrap(err, "unmarshal json lines message error")
+	}
+
+	switch msg.Type {
+	case "up":
+		var pl gw.UplinkFrame
+		if err := b.json.Unmarshal(msg.Payload, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal uplink frame error")
+		}
+		b.handleUplinkFrame(pl)
+	case "stats":
+		var pl gw.GatewayStats
+		if err := b.json.Unmarshal(msg.Payload, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal gateway stats error")
+		}
+		b.handleGatewayStats(pl)
+	case "ack":
+		var pl gw.DownlinkTXAck
+		if err := b.json.Unmarshal(msg.Payload, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal downlink tx ack error")
+		}
+		b.handleDownlinkTxAck(pl)
+	case "raw":
+		var pl gw.RawPacketForwarderEvent
+		if err := b.json.Unmarshal(msg.Payload, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal raw packet-forwarder event error")
+		}
+		b.handleRawPacketForwarderEvent(pl)
+	default:
+		return fmt.Errorf("unexpected message type: %s", msg.Type)
+	}
+
+	eventCounter(msg.Type).Inc()
+	return nil
+}
+
+func (b *Backend) handleUplinkFrame(pl gw.UplinkFrame) {
+	if pl.RxInfo == nil {
+		pl.RxInfo = &gw.UplinkRXInfo{}
+	}
+	if len(pl.RxInfo.UplinkId) == 0 {
+		id, _ := uuid.NewV4()
+		pl.RxInfo.UplinkId = id[:]
+	}
+
+	var gatewayID lorawan.EUI64
+	var uplinkID uuid.UUID
+	copy(gatewayID[:], pl.RxInfo.GatewayId)
+	copy(uplinkID[:], pl.RxInfo.UplinkId)
+
+	b.setGateway(gatewayID)
+
+	if !filters.MatchFilters(pl.PhyPayload) {
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"uplink_id":  uplinkID,
+		}).Debug("backend/exec: frame dropped because of configured filters")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"uplink_id":  uplinkID,
+	}).Info("backend/exec: uplink frame received")
+
+	if b.uplinkFrameFunc != nil {
+		b.uplinkFrameFunc(pl)
+	}
+}
+
+func (b *Backend) handleGatewayStats(pl gw.GatewayStats) {
+	if len(pl.StatsId) == 0 {
+		id, _ := uuid.NewV4()
+		pl.StatsId = id[:]
+	}
+
+	var gatewayID lorawan.EUI64
+	var statsID uuid.UUID
+	copy(gatewayID[:], pl.GatewayId)
+	copy(statsID[:], pl.StatsId)
+
+	b.setGateway(gatewayID)
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"stats_id":   statsID,
+	}).Info("backend/exec: gateway stats received")
+
+	if b.gatewayStatsFunc != nil {
+		b.gatewayStatsFunc(pl)
+	}
+}
+
+func (b *Backend) handleDownlinkTxAck(pl gw.DownlinkTXAck) {
+	var gatewayID lorawan.EUI64
+	var downID uuid.UUID
+	copy(gatewayID[:], pl.GatewayId)
+	copy(downID[:], pl.DownlinkId)
+
+	b.setGateway(gatewayID)
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": downID,
+	}).Info("backend/exec: downlink tx acknowledgement received")
+
+	if b.downlinkTxAckFunc != nil {
+		b.downlinkTxAckFunc(pl)
+	}
+}
+
+func (b *Backend) handleRawPacketForwarderEvent(pl gw.RawPacketForwarderEvent) {
+	var gatewayID lorawan.EUI64
+	var rawID uuid.UUID
+	copy(gatewayID[:], pl.GatewayId)
+	copy(rawID[:], pl.RawId)
+
+	b.setGateway(gatewayID)
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"raw_id":     rawID,
+	}).Info("backend/exec: raw packet-forwarder event received")
+
+	if b.rawPacketForwarderEventFunc != nil {
+		b.rawPacketForwarderEventFunc(pl)
+	}
+}
+
+// setGateway sends a subscribe event the first time the given gateway ID
+// is seen.
+func (b *Backend) setGateway(gatewayID lorawan.EUI64) {
+	b.Lock()
+	_, ok := b.gateways[gatewayID]
+	b.gateways[gatewayID] = struct{}{}
+	b.Unlock()
+
+	if !ok && b.subscribeEventFunc != nil {
+		b.subscribeEventFunc(events.Subscribe{
+			Subscribe: true,
+			GatewayID: gatewayID,
+		})
+	}
+}
+
+// removeGateways sends an unsubscribe event for all the gateways that
+// were seen while the process was running.
+func (b *Backend) removeGateways() {
+	b.Lock()
+	gateways := b.gateways
+	b.gateways = make(map[lorawan.EUI64]struct{})
+	b.Unlock()
+
+	for gatewayID := range gateways {
+		if b.subscribeEventFunc != nil {
+			b.subscribeEventFunc(events.Subscribe{
+				Subscribe: false,
+				GatewayID: gatewayID,
+			})
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package exec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+type BackendTestSuite struct {
+	suite.Suite
+
+	tempDir   string
+	gatewayID lorawan.EUI64
+}
+
+func (ts *BackendTestSuite) SetupSuite() {
+	log.SetLevel(log.ErrorLevel)
+	ts.gatewayID = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+}
+
+func (ts *BackendTestSuite) SetupTest() {
+	assert := require.New(ts.T())
+
+	var err error
+	ts.tempDir, err = ioutil.TempDir("", "test")
+	assert.NoError(err)
+}
+
+func (ts *BackendTestSuite) TearDownTest() {
+	os.RemoveAll(ts.tempDir)
+}
+
+// writeScript writes the given shell script to the temp. directory and
+// returns the command to execute it.
+func (ts *BackendTestSuite) writeScript(script string) string {
+	assert := require.New(ts.T())
+
+	path := filepath.Join(ts.tempDir, "adapter.sh")
+	assert.NoError(ioutil.WriteFile(path, []byte(script), 0700))
+
+	return fmt.Sprintf("/bin/sh %s", path)
+}
+
+func (ts *BackendTestSuite) TestEvents() {
+	assert := require.New(ts.T())
+
+	var conf config.Config
+	conf.Backend.Exec.Command = ts.writeScript(`
+echo '{"type": "up", "payload": {"phyPayload": "AQID", "rxInfo": {"gatewayID": "AQIDBAUGBwg=", "rssi": -60}}}'
+echo '{"type": "stats", "payload": {"gatewayID": "AQIDBAUGBwg=", "rxPacketsReceived": 10}}'
+echo '{"type": "ack", "payload": {"gatewayID": "AQIDBAUGBwg=", "token": 1234}}'
+echo 'invalid line'
+echo 'adapter log line' 1>&2
+cat > /dev/null
+`)
+	conf.Backend.Exec.RestartDelay = time.Second
+	conf.Backend.Exec.MaxRestartDelay = time.Second
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	subscribeChan := make(chan events.Subscribe, 1)
+	uplinkChan := make(chan gw.UplinkFrame, 1)
+	statsChan := make(chan gw.GatewayStats, 1)
+	txAckChan := make(chan gw.DownlinkTXAck, 1)
+
+	b.SetSubscribeEventFunc(func(pl events.Subscribe) { subscribeChan <- pl })
+	b.SetUplinkFrameFunc(func(pl gw.UplinkFrame) { uplinkChan <- pl })
+	b.SetGatewayStatsFunc(func(pl gw.GatewayStats) { statsChan <- pl })
+	b.SetDownlinkTxAckFunc(func(pl gw.DownlinkTXAck) { txAckChan <- pl })
+
+	assert.NoError(b.Start())
+
+	assert.Equal(events.Subscribe{Subscribe: true, GatewayID: ts.gatewayID}, <-subscribeChan)
+
+	up := <-uplinkChan
+	assert.Equal([]byte{1, 2, 3}, up.PhyPayload)
+	assert.Equal(ts.gatewayID[:], up.RxInfo.GatewayId)
+	assert.EqualValues(-60, up.RxInfo.Rssi)
+	assert.Len(up.RxInfo.UplinkId, 16)
+
+	stats := <-statsChan
+	assert.Equal(ts.gatewayID[:], stats.GatewayId)
+	assert.EqualValues(10, stats.RxPacketsReceived)
+
+	ack := <-txAckChan
+	assert.Equal(ts.gatewayID[:], ack.GatewayId)
+	assert.EqualValues(1234, ack.Token)
+
+	assert.NoError(b.Stop())
+	assert.Equal(events.Subscribe{Subscribe: false, GatewayID: ts.gatewayID}, <-subscribeChan)
+}
+
+func (ts *BackendTestSuite) TestCommands() {
+	assert := require.New(ts.T())
+
+	outFile := filepath.Join(ts.tempDir, "stdin.jsonl")
+
+	var conf config.Config
+	conf.Backend.Exec.Command = ts.writeScript(fmt.Sprintf(`
+echo '{"type": "stats", "payload": {"gatewayID": "AQIDBAUGBwg="}}'
+exec cat > %s
+`, outFile))
+	conf.Backend.Exec.RestartDelay = time.Second
+	conf.Backend.Exec.MaxRestartDelay = time.Second
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	statsChan := make(chan gw.GatewayStats, 1)
+	b.SetGatewayStatsFunc(func(pl gw.GatewayStats) { statsChan <- pl })
+
+	assert.Equal(errNotRunning, errors.Cause(b.ApplyConfiguration(gw.GatewayConfiguration{})))
+
+	assert.NoError(b.Start())
+	<-statsChan
+
+	assert.NoError(b.SendDownlinkFrame(gw.DownlinkFrame{
+		GatewayId: ts.gatewayID[:],
+		Token:     1234,
+	}))
+	assert.NoError(b.ApplyConfiguration(gw.GatewayConfiguration{
+		GatewayId: ts.gatewayID[:],
+		Version:   "1.2.3",
+	}))
+	assert.NoError(b.RawPacketForwarderCommand(gw.RawPacketForwarderCommand{
+		GatewayId: ts.gatewayID[:],
+		Payload:   []byte{1, 2, 3},
+	}))
+
+	// wait until all lines have been written by the process
+	var lines []string
+	for i := 0; i < 50; i++ {
+		b, _ := ioutil.ReadFile(outFile)
+		lines = strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.NoError(b.Stop())
+
+	assert.Len(lines, 3)
+	assert.Contains(lines[0], `"type":"down"`)
+	assert.Contains(lines[0], `"token":1234`)
+	assert.Contains(lines[1], `"type":"config"`)
+	assert.Contains(lines[1], `"version":"1.2.3"`)
+	assert.Contains(lines[2], `"type":"raw"`)
+	assert.Contains(lines[2], `"payload":"AQID"`)
+}
+
+func (ts *BackendTestSuite) TestRestart() {
+	assert := require.New(ts.T())
+
+	var conf config.Config
+	conf.Backend.Exec.Command = ts.writeScript(`
+echo '{"type": "stats", "payload": {"gatewayID": "AQIDBAUGBwg="}}'
+exit 1
+`)
+	conf.Backend.Exec.RestartDelay = 10 * time.Millisecond
+	conf.Backend.Exec.MaxRestartDelay = 20 * time.Millisecond
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	subscribeChan := make(chan events.Subscribe, 10)
+	b.SetSubscribeEventFunc(func(pl events.Subscribe) { subscribeChan <- pl })
+
+	assert.NoError(b.Start())
+
+	// the gateway is (un)subscribed on every process (re)start / exit
+	for i := 0; i < 3; i++ {
+		assert.Equal(events.Subscribe{Subscribe: true, GatewayID: ts.gatewayID}, <-subscribeChan)
+		assert.Equal(events.Subscribe{Subscribe: false, GatewayID: ts.gatewayID}, <-subscribeChan)
+	}
+
+	assert.NoError(b.Stop())
+}
+
+func (ts *BackendTestSuite) TestStopBlockedWrite() {
+	assert := require.New(ts.T())
+
+	// the process never reads stdin, causing the writes to block once the
+	// pipe buffer is full
+	var conf config.Config
+	conf.Backend.Exec.Command = ts.writeScript(`
+echo '{"type": "stats", "payload": {"gatewayID": "AQIDBAUGBwg="}}'
+exec sleep 60
+`)
+	conf.Backend.Exec.RestartDelay = time.Second
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	subscribeChan := make(chan events.Subscribe, 10)
+	b.SetSubscribeEventFunc(func(pl events.Subscribe) { subscribeChan <- pl })
+
+	assert.NoError(b.Start())
+	assert.Equal(events.Subscribe{Subscribe: true, GatewayID: ts.gatewayID}, <-subscribeChan)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		for {
+			if err := b.SendDownlinkFrame(gw.DownlinkFrame{
+				Items: []*gw.DownlinkFrameItem{
+					{PhyPayload: make([]byte, 16*1024)},
+				},
+			}); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}()
+
+	// give the writer some time to fill the pipe buffer
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- b.Stop()
+	}()
+
+	select {
+	case err := <-stopped:
+		assert.NoError(err)
+	case <-time.After(5 * time.Second):
+		ts.T().Fatal("stop blocked by write")
+	}
+
+	select {
+	case err := <-writeErr:
+		assert.Error(err)
+	case <-time.After(5 * time.Second):
+		ts.T().Fatal("write did not return")
+	}
+}
+
+func (ts *BackendTestSuite) TestRestartOnLineTooLong() {
+	assert := require.New(ts.T())
+
+	// the process writes a stdout line exceeding the max. line size and
+	// then keeps writing, which blocks once nothing is reading stdout
+	var conf config.Config
+	conf.Backend.Exec.Command = ts.writeScript(fmt.Sprintf(`
+echo '{"type": "stats", "payload": {"gatewayID": "AQIDBAUGBwg="}}'
+head -c %d /dev/zero | tr '\0' 'x'
+echo
+exec yes
+`, maxLineSize+1))
+	conf.Backend.Exec.RestartDelay = 10 * time.Millisecond
+	conf.Backend.Exec.MaxRestartDelay = 20 * time.Millisecond
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	subscribeChan := make(chan events.Subscribe, 10)
+	b.SetSubscribeEventFunc(func(pl events.Subscribe) { subscribeChan <- pl })
+
+	assert.NoError(b.Start())
+
+	for i := 0; i < 2; i++ {
+		select {
+		case pl := <-subscribeChan:
+			assert.Equal(events.Subscribe{Subscribe: true, GatewayID: ts.gatewayID}, pl)
+		case <-time.After(5 * time.Second):
+			ts.T().Fatal("process was not restarted")
+		}
+		assert.Equal(events.Subscribe{Subscribe: false, GatewayID: ts.gatewayID}, <-subscribeChan)
+	}
+
+	assert.NoError(b.Stop())
+}
+
+func (ts *BackendTestSuite) TestInvalidCommand() {
+	assert := require.New(ts.T())
+
+	var conf config.Config
+	_, err := NewBackend(conf)
+	assert.Error(err)
+}
+
+func TestBackend(t *testing.T) {
+	suite.Run(t, new(BackendTestSuite))
+}
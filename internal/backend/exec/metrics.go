@@ -0,0 +1,35 @@
+package exec
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_exec_event_count",
+		Help: "The number of events received from the process (per type).",
+	}, []string{"event"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_exec_command_count",
+		Help: "The number of commands sent to the process (per type).",
+	}, []string{"command"})
+
+	rc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_exec_restart_count",
+		Help: "The number of times the process has been (re)started.",
+	})
+)
+
+func eventCounter(typ string) prometheus.Counter {
+	return ec.With(prometheus.Labels{"event": typ})
+}
+
+func commandCounter(typ string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"command": typ})
+}
+
+func restartCounter() prometheus.Counter {
+	return rc
+}
@@ -0,0 +1,465 @@
+package grpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/filters"
+	"github.com/brocaar/lorawan"
+)
+
+// Keepalive settings. The server pings the gateway after keepaliveTime of
+// inactivity and closes the connection when there is no response within
+// keepaliveTimeout. Gateways are allowed to ping every keepaliveMinTime.
+const (
+	keepaliveTime    = time.Minute
+	keepaliveTimeout = 20 * time.Second
+	keepaliveMinTime = 10 * time.Second
+)
+
+// serviceDesc describes the GatewayBridgeService (see gateway_bridge.proto).
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "gwbridge.GatewayBridgeService",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Stream",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*Backend).handleStream(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "gateway_bridge.proto",
+}
+
+// Backend implements a gRPC backend. Gateways connect to this backend
+// using a bidirectional stream of google.protobuf.Any messages.
+type Backend struct {
+	sync.RWMutex
+
+	server   *grpc.Server
+	ln       net.Listener
+	isClosed bool
+
+	gateways gateways
+
+	downlinkTxAckFunc           func(gw.DownlinkTXAck)
+	uplinkFrameFunc             func(gw.UplinkFrame)
+	gatewayStatsFunc            func(gw.GatewayStats)
+	rawPacketForwarderEventFunc func(gw.RawPacketForwarderEvent)
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.Config) (*Backend, error) {
+	b := Backend{
+		gateways: gateways{
+			gateways: make(map[lorawan.EUI64]*gateway),
+		},
+	}
+
+	var opts []grpc.ServerOption
+
+	if conf.Backend.GRPC.TLSCert != "" && conf.Backend.GRPC.TLSKey != "" {
+		kp, err := tls.LoadX509KeyPair(conf.Backend.GRPC.TLSCert, conf.Backend.GRPC.TLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls key-pair error")
+		}
+
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{kp},
+		}
+
+		// if the CA cert is configured, setup client certificate verification.
+		if conf.Backend.GRPC.CACert != "" {
+			rawCACert, err := ioutil.ReadFile(conf.Backend.GRPC.CACert)
+			if err != nil {
+				return nil, errors.Wrap(err, "read ca cert error")
+			}
+
+			caCertPool := x509.NewCertPool()
+			if !caCertPool.AppendCertsFromPEM(rawCACert) {
+				return nil, errors.New("append ca cert to pool error")
+			}
+
+			tlsConfig.ClientCAs = caCertPool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	// Detect dead (e.g. half-open) connections, so that these are removed
+	// even when the gateway does not reconnect.
+	opts = append(opts,
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    keepaliveTime,
+			Timeout: keepaliveTimeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             keepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+	)
+
+	b.server = grpc.NewServer(opts...)
+	b.server.RegisterService(&serviceDesc, &b)
+
+	var err error
+	b.ln, err = net.Listen("tcp", conf.Backend.GRPC.Bind)
+	if err != nil {
+		return nil, errors.Wrap(err, "create listener error")
+	}
+
+	return &b, nil
+}
+
+// Start starts the backend.
+func (b *Backend) Start() error {
+	go func() {
+		log.WithFields(log.Fields{
+			"bind": b.ln.Addr(),
+		}).Info("backend/grpc: starting grpc listener")
+
+		if err := b.server.Serve(b.ln); err != nil && !b.closed() {
+			log.WithError(err).Fatal("backend/grpc: server error")
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the backend.
+func (b *Backend) Stop() error {
+	b.Lock()
+	b.isClosed = true
+	b.Unlock()
+
+	b.server.Stop()
+	return nil
+}
+
+// SetDownlinkTxAckFunc sets the DownlinkTXAck handler func.
+func (b *Backend) SetDownlinkTxAckFunc(f func(gw.DownlinkTXAck)) {
+	b.downlinkTxAckFunc = f
+}
+
+// SetGatewayStatsFunc sets the GatewayStats handler func.
+func (b *Backend) SetGatewayStatsFunc(f func(gw.GatewayStats)) {
+	b.gatewayStatsFunc = f
+}
+
+// SetUplinkFrameFunc sets the UplinkFrame handler func.
+func (b *Backend) SetUplinkFrameFunc(f func(gw.UplinkFrame)) {
+	b.uplinkFrameFunc = f
+}
+
+// SetRawPacketForwarderEventFunc sets the RawPacketForwarderEvent handler func.
+func (b *Backend) SetRawPacketForwarderEventFunc(f func(gw.RawPacketForwarderEvent)) {
+	b.rawPacketForwarderEventFunc = f
+}
+
+// SetSubscribeEventFunc sets the Subscribe handler func.
+func (b *Backend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	b.gateways.subscribeEventFunc = f
+}
+
+// SendDownlinkFrame sends the given downlink frame.
+func (b *Backend) SendDownlinkFrame(pl gw.DownlinkFrame) error {
+	var gatewayID lorawan.EUI64
+	var downID uuid.UUID
+	copy(gatewayID[:], pl.GetGatewayId())
+	copy(downID[:], pl.GetDownlinkId())
+
+	if err := b.sendToGateway(gatewayID, "down", &pl); err != nil {
+		return errors.Wrap(err, "send to gateway error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": downID,
+	}).Info("backend/grpc: downlink-frame sent to gateway")
+
+	return nil
+}
+
+// ApplyConfiguration applies the given configuration to the gateway.
+func (b *Backend) ApplyConfiguration(pl gw.GatewayConfiguration) error {
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GetGatewayId())
+
+	if err := b.sendToGateway(gatewayID, "config", &pl); err != nil {
+		return errors.Wrap(err, "send to gateway error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"version":    pl.Version,
+	}).Info("backend/grpc: gateway configuration sent to gateway")
+
+	return nil
+}
+
+// RawPacketForwarderCommand sends the given raw command to the packet-forwarder.
+func (b *Backend) RawPacketForwarderCommand(pl gw.RawPacketForwarderCommand) error {
+	var gatewayID lorawan.EUI64
+	var rawID uuid.UUID
+	copy(gatewayID[:], pl.GetGatewayId())
+	copy(rawID[:], pl.GetRawId())
+
+	if err := b.sendToGateway(gatewayID, "raw", &pl); err != nil {
+		return errors.Wrap(err, "send to gateway error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"raw_id":     rawID,
+	}).Info("backend/grpc: raw packet-forwarder command sent to gateway")
+
+	return nil
+}
+
+func (b *Backend) closed() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.isClosed
+}
+
+func (b *Backend) sendToGateway(gatewayID lorawan.EUI64, command string, msg proto.Message) error {
+	gw, err := b.gateways.get(gatewayID)
+	if err != nil {
+		return err
+	}
+
+	if err := gw.send(msg); err != nil {
+		return err
+	}
+
+	commandCounter(command).Inc()
+
+	return nil
+}
+
+func (b *Backend) handleStream(stream grpc.ServerStream) error {
+	gatewayID, err := getGatewayID(stream)
+	if err != nil {
+		log.WithError(err).Error("backend/grpc: get gateway id error")
+		return err
+	}
+
+	// an existing connection with the same gateway id is replaced
+	gw := newGateway(stream)
+	if err := b.gateways.set(gatewayID, gw); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	connectCounter().Inc()
+
+	log.WithField("gateway_id", gatewayID).Info("backend/grpc: gateway connected")
+
+	defer func() {
+		if err := b.gateways.remove(gatewayID, gw); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/grpc: remove gateway error")
+		}
+		disconnectCounter().Inc()
+
+		log.WithField("gateway_id", gatewayID).Info("backend/grpc: gateway disconnected")
+	}()
+
+	// The stream is cancelled by returning from the handler, which unblocks
+	// the receive loop.
+	done := make(chan struct{})
+	go func() {
+		b.receiveLoop(gatewayID, stream)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-gw.replaced:
+		log.WithField("gateway_id", gatewayID).Warning("backend/grpc: connection replaced by new connection with same gateway id")
+		return status.Error(codes.Aborted, "connection replaced by new connection with same gateway id")
+	}
+}
+
+func (b *Backend) receiveLoop(gatewayID lorawan.EUI64, stream grpc.ServerStream) {
+	for {
+		var a any.Any
+		if err := stream.RecvMsg(&a); err != nil {
+			if err != io.EOF && status.Code(err) != codes.Canceled {
+				log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/grpc: receive message error")
+			}
+			return
+		}
+
+		if err := b.handleMessage(gatewayID, &a); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"gateway_id": gatewayID,
+				"type_url":   a.GetTypeUrl(),
+			}).Error("backend/grpc: handle message error")
+		}
+	}
+}
+
+func (b *Backend) handleMessage(gatewayID lorawan.EUI64, a *any.Any) error {
+	switch {
+	case ptypes.Is(a, &gw.UplinkFrame{}):
+		var pl gw.UplinkFrame
+		if err := ptypes.UnmarshalAny(a, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal uplink frame error")
+		}
+		eventCounter("up").Inc()
+		b.handleUplinkFrame(gatewayID, pl)
+	case ptypes.Is(a, &gw.GatewayStats{}):
+		var pl gw.GatewayStats
+		if err := ptypes.UnmarshalAny(a, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal gateway stats error")
+		}
+		eventCounter("stats").Inc()
+		b.handleGatewayStats(gatewayID, pl)
+	case ptypes.Is(a, &gw.DownlinkTXAck{}):
+		var pl gw.DownlinkTXAck
+		if err := ptypes.UnmarshalAny(a, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal downlink tx ack error")
+		}
+		eventCounter("ack").Inc()
+		b.handleDownlinkTxAck(gatewayID, pl)
+	case ptypes.Is(a, &gw.RawPacketForwarderEvent{}):
+		var pl gw.RawPacketForwarderEvent
+		if err := ptypes.UnmarshalAny(a, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal raw packet-forwarder event error")
+		}
+		eventCounter("raw").Inc()
+		b.handleRawPacketForwarderEvent(gatewayID, pl)
+	default:
+		return errors.New("unexpected message type")
+	}
+
+	return nil
+}
+
+func (b *Backend) handleUplinkFrame(gatewayID lorawan.EUI64, pl gw.UplinkFrame) {
+	// the gateway id is always set to the id of the stream
+	if pl.RxInfo == nil {
+		pl.RxInfo = &gw.UplinkRXInfo{}
+	}
+	pl.RxInfo.GatewayId = gatewayID[:]
+
+	var uplinkID uuid.UUID
+	copy(uplinkID[:], pl.RxInfo.GetUplinkId())
+
+	if !filters.MatchFilters(pl.PhyPayload) {
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"uplink_id":  uplinkID,
+		}).Debug("backend/grpc: frame dropped because of configured filters")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"uplink_id":  uplinkID,
+	}).Info("backend/grpc: uplink frame received")
+
+	if b.uplinkFrameFunc != nil {
+		b.uplinkFrameFunc(pl)
+	}
+}
+
+func (b *Backend) handleGatewayStats(gatewayID lorawan.EUI64, pl gw.GatewayStats) {
+	pl.GatewayId = gatewayID[:]
+
+	var statsID uuid.UUID
+	copy(statsID[:], pl.GetStatsId())
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"stats_id":   statsID,
+	}).Info("backend/grpc: gateway stats received")
+
+	if b.gatewayStatsFunc != nil {
+		b.gatewayStatsFunc(pl)
+	}
+}
+
+func (b *Backend) handleDownlinkTxAck(gatewayID lorawan.EUI64, pl gw.DownlinkTXAck) {
+	pl.GatewayId = gatewayID[:]
+
+	var downID uuid.UUID
+	copy(downID[:], pl.GetDownlinkId())
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": downID,
+	}).Info("backend/grpc: downlink tx acknowledgement received")
+
+	if b.downlinkTxAckFunc != nil {
+		b.downlinkTxAckFunc(pl)
+	}
+}
+
+func (b *Backend) handleRawPacketForwarderEvent(gatewayID lorawan.EUI64, pl gw.RawPacketForwarderEvent) {
+	pl.GatewayId = gatewayID[:]
+
+	var rawID uuid.UUID
+	copy(rawID[:], pl.GetRawId())
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"raw_id":     rawID,
+	}).Info("backend/grpc: raw packet-forwarder event received")
+
+	if b.rawPacketForwarderEventFunc != nil {
+		b.rawPacketForwarderEventFunc(pl)
+	}
+}
+
+// getGatewayID returns the Gateway ID from the gateway-id request metadata.
+// When a client certificate has been presented, it validates that the
+// CommonName matches the Gateway ID.
+func getGatewayID(stream grpc.ServerStream) (lorawan.EUI64, error) {
+	var gatewayID lorawan.EUI64
+
+	md, ok := metadata.FromIncomingContext(stream.Context())
+	if !ok || len(md.Get("gateway-id")) != 1 {
+		return gatewayID, status.Error(codes.InvalidArgument, "gateway-id metadata must be set")
+	}
+
+	if err := gatewayID.UnmarshalText([]byte(md.Get("gateway-id")[0])); err != nil {
+		return gatewayID, status.Error(codes.InvalidArgument, "invalid gateway-id metadata")
+	}
+
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+			var cn lorawan.EUI64
+			if err := cn.UnmarshalText([]byte(tlsInfo.State.PeerCertificates[0].Subject.CommonName)); err != nil || cn != gatewayID {
+				return gatewayID, status.Error(codes.PermissionDenied, "certificate CommonName does not match gateway id")
+			}
+		}
+	}
+
+	return gatewayID, nil
+}
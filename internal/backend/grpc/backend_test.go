@@ -0,0 +1,271 @@
+package grpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+type BackendTestSuite struct {
+	suite.Suite
+
+	backend   *Backend
+	conn      *grpc.ClientConn
+	stream    grpc.ClientStream
+	gatewayID lorawan.EUI64
+
+	subscribeEventChan chan events.Subscribe
+}
+
+func (ts *BackendTestSuite) SetupSuite() {
+	log.SetLevel(log.ErrorLevel)
+	ts.gatewayID = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+}
+
+func (ts *BackendTestSuite) SetupTest() {
+	assert := require.New(ts.T())
+
+	var conf config.Config
+	conf.Backend.GRPC.Bind = "127.0.0.1:0"
+
+	var err error
+	ts.backend, err = NewBackend(conf)
+	assert.NoError(err)
+
+	subscribeEventChan := make(chan events.Subscribe, 1)
+	ts.subscribeEventChan = subscribeEventChan
+	ts.backend.SetSubscribeEventFunc(func(pl events.Subscribe) {
+		subscribeEventChan <- pl
+	})
+	assert.NoError(ts.backend.Start())
+
+	ts.conn, err = grpc.Dial(ts.backend.ln.Addr().String(), grpc.WithInsecure())
+	assert.NoError(err)
+
+	ts.stream = ts.openStream(ts.gatewayID.String())
+	assert.Equal(events.Subscribe{Subscribe: true, GatewayID: ts.gatewayID}, <-ts.subscribeEventChan)
+}
+
+func (ts *BackendTestSuite) TearDownTest() {
+	ts.conn.Close()
+	ts.backend.Stop()
+}
+
+func (ts *BackendTestSuite) openStream(gatewayID string) grpc.ClientStream {
+	assert := require.New(ts.T())
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "gateway-id", gatewayID)
+	stream, err := ts.conn.NewStream(ctx, &serviceDesc.Streams[0], "/gwbridge.GatewayBridgeService/Stream")
+	assert.NoError(err)
+
+	// force the stream to be opened
+	assert.NoError(stream.SendMsg(&any.Any{}))
+
+	return stream
+}
+
+func (ts *BackendTestSuite) send(msg proto.Message) {
+	assert := require.New(ts.T())
+
+	a, err := ptypes.MarshalAny(msg)
+	assert.NoError(err)
+	assert.NoError(ts.stream.SendMsg(a))
+}
+
+func (ts *BackendTestSuite) receive(msg proto.Message) {
+	assert := require.New(ts.T())
+
+	var a any.Any
+	assert.NoError(ts.stream.RecvMsg(&a))
+	assert.NoError(ptypes.UnmarshalAny(&a, msg))
+}
+
+func (ts *BackendTestSuite) TestUplinkFrame() {
+	assert := require.New(ts.T())
+
+	uplinkFrameChan := make(chan gw.UplinkFrame, 1)
+	ts.backend.SetUplinkFrameFunc(func(pl gw.UplinkFrame) {
+		uplinkFrameChan <- pl
+	})
+
+	ts.send(&gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3, 4},
+		RxInfo: &gw.UplinkRXInfo{
+			Rssi: -60,
+		},
+	})
+
+	received := <-uplinkFrameChan
+	assert.True(proto.Equal(&gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3, 4},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: ts.gatewayID[:],
+			Rssi:      -60,
+		},
+	}, &received))
+}
+
+func (ts *BackendTestSuite) TestGatewayStats() {
+	assert := require.New(ts.T())
+
+	gatewayStatsChan := make(chan gw.GatewayStats, 1)
+	ts.backend.SetGatewayStatsFunc(func(pl gw.GatewayStats) {
+		gatewayStatsChan <- pl
+	})
+
+	ts.send(&gw.GatewayStats{
+		RxPacketsReceived: 10,
+	})
+
+	received := <-gatewayStatsChan
+	assert.True(proto.Equal(&gw.GatewayStats{
+		GatewayId:         ts.gatewayID[:],
+		RxPacketsReceived: 10,
+	}, &received))
+}
+
+func (ts *BackendTestSuite) TestDownlinkTxAck() {
+	assert := require.New(ts.T())
+
+	txAckChan := make(chan gw.DownlinkTXAck, 1)
+	ts.backend.SetDownlinkTxAckFunc(func(pl gw.DownlinkTXAck) {
+		txAckChan <- pl
+	})
+
+	ts.send(&gw.DownlinkTXAck{
+		Token: 1234,
+		Items: []*gw.DownlinkTXAckItem{
+			{Status: gw.TxAckStatus_OK},
+		},
+	})
+
+	received := <-txAckChan
+	assert.True(proto.Equal(&gw.DownlinkTXAck{
+		GatewayId: ts.gatewayID[:],
+		Token:     1234,
+		Items: []*gw.DownlinkTXAckItem{
+			{Status: gw.TxAckStatus_OK},
+		},
+	}, &received))
+}
+
+func (ts *BackendTestSuite) TestSendDownlinkFrame() {
+	assert := require.New(ts.T())
+
+	df := gw.DownlinkFrame{
+		GatewayId: ts.gatewayID[:],
+		Token:     1234,
+		Items: []*gw.DownlinkFrameItem{
+			{PhyPayload: []byte{1, 2, 3, 4}},
+		},
+	}
+	assert.NoError(ts.backend.SendDownlinkFrame(df))
+
+	var received gw.DownlinkFrame
+	ts.receive(&received)
+	assert.True(proto.Equal(&df, &received))
+
+	ts.T().Run("Unknown gateway", func(t *testing.T) {
+		assert := require.New(t)
+
+		df.GatewayId = []byte{8, 7, 6, 5, 4, 3, 2, 1}
+		assert.Error(ts.backend.SendDownlinkFrame(df))
+	})
+}
+
+func (ts *BackendTestSuite) TestApplyConfiguration() {
+	assert := require.New(ts.T())
+
+	conf := gw.GatewayConfiguration{
+		GatewayId: ts.gatewayID[:],
+		Version:   "1.2.3",
+	}
+	assert.NoError(ts.backend.ApplyConfiguration(conf))
+
+	var received gw.GatewayConfiguration
+	ts.receive(&received)
+	assert.True(proto.Equal(&conf, &received))
+}
+
+func (ts *BackendTestSuite) TestRawPacketForwarderCommand() {
+	assert := require.New(ts.T())
+
+	raw := gw.RawPacketForwarderCommand{
+		GatewayId: ts.gatewayID[:],
+		Payload:   []byte{1, 2, 3},
+	}
+	assert.NoError(ts.backend.RawPacketForwarderCommand(raw))
+
+	var received gw.RawPacketForwarderCommand
+	ts.receive(&received)
+	assert.True(proto.Equal(&raw, &received))
+}
+
+func (ts *BackendTestSuite) TestDuplicateConnection() {
+	assert := require.New(ts.T())
+
+	old, err := ts.backend.gateways.get(ts.gatewayID)
+	assert.NoError(err)
+
+	// the new connection replaces the existing connection
+	stream := ts.openStream(ts.gatewayID.String())
+
+	var a any.Any
+	err = ts.stream.RecvMsg(&a)
+	assert.Equal(codes.Aborted, status.Code(err))
+
+	registered, err := ts.backend.gateways.get(ts.gatewayID)
+	assert.NoError(err)
+	assert.False(old == registered)
+
+	// the replaced connection must not unregister the gateway
+	assert.Equal(errGatewayDoesNotExist, ts.backend.gateways.remove(ts.gatewayID, old))
+	assert.Len(ts.subscribeEventChan, 0)
+
+	// commands are sent to the new connection
+	conf := gw.GatewayConfiguration{GatewayId: ts.gatewayID[:], Version: "1.2.3"}
+	assert.NoError(ts.backend.ApplyConfiguration(conf))
+
+	var received gw.GatewayConfiguration
+	assert.NoError(stream.RecvMsg(&a))
+	assert.NoError(ptypes.UnmarshalAny(&a, &received))
+	assert.Equal("1.2.3", received.Version)
+}
+
+func (ts *BackendTestSuite) TestInvalidGatewayID() {
+	assert := require.New(ts.T())
+
+	stream := ts.openStream("foo")
+	var a any.Any
+	err := stream.RecvMsg(&a)
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+}
+
+func (ts *BackendTestSuite) TestDisconnect() {
+	assert := require.New(ts.T())
+
+	assert.NoError(ts.stream.CloseSend())
+	assert.Equal(events.Subscribe{Subscribe: false, GatewayID: ts.gatewayID}, <-ts.subscribeEventChan)
+
+	_, err := ts.backend.gateways.get(ts.gatewayID)
+	assert.Equal(errGatewayDoesNotExist, err)
+}
+
+func TestBackend(t *testing.T) {
+	suite.Run(t, new(BackendTestSuite))
+}
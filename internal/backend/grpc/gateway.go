@@ -0,0 +1,106 @@
+package grpc
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/lorawan"
+)
+
+var errGatewayDoesNotExist = errors.New("gateway does not exist")
+
+type gateway struct {
+	sync.Mutex
+	stream grpc.ServerStream
+
+	// replaced is closed when the gateway has been replaced by a new
+	// connection with the same gateway id.
+	replaced chan struct{}
+}
+
+func newGateway(stream grpc.ServerStream) *gateway {
+	return &gateway{
+		stream:   stream,
+		replaced: make(chan struct{}),
+	}
+}
+
+// send wraps the given message in a google.protobuf.Any and sends it to
+// the gateway. As a gRPC stream is not safe for concurrent sends, this
+// is guarded by a mutex.
+func (g *gateway) send(msg proto.Message) error {
+	a, err := ptypes.MarshalAny(msg)
+	if err != nil {
+		return err
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	return g.stream.SendMsg(a)
+}
+
+type gateways struct {
+	sync.RWMutex
+	gateways map[lorawan.EUI64]*gateway
+
+	subscribeEventFunc func(events.Subscribe)
+}
+
+func (g *gateways) get(id lorawan.EUI64) (*gateway, error) {
+	g.RLock()
+	defer g.RUnlock()
+
+	gw, ok := g.gateways[id]
+	if !ok {
+		return nil, errGatewayDoesNotExist
+	}
+	return gw, nil
+}
+
+// set registers the given gateway. A gateway with the same id which has
+// already been registered (e.g. a half-open connection of a gateway that
+// reconnected) is replaced and its connection is cancelled.
+func (g *gateways) set(id lorawan.EUI64, gw *gateway) error {
+	g.Lock()
+	defer g.Unlock()
+
+	old, ok := g.gateways[id]
+	g.gateways[id] = gw
+
+	// the gateway is still subscribed
+	if ok {
+		close(old.replaced)
+		return nil
+	}
+
+	if g.subscribeEventFunc != nil {
+		g.subscribeEventFunc(events.Subscribe{Subscribe: true, GatewayID: id})
+	}
+
+	return nil
+}
+
+// remove unregisters the given gateway. It returns errGatewayDoesNotExist
+// when the registered gateway is not the given gateway (e.g. it has been
+// replaced by a new connection).
+func (g *gateways) remove(id lorawan.EUI64, gw *gateway) error {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.gateways[id] != gw {
+		return errGatewayDoesNotExist
+	}
+
+	if g.subscribeEventFunc != nil {
+		g.subscribeEventFunc(events.Subscribe{Subscribe: false, GatewayID: id})
+	}
+
+	delete(g.gateways, id)
+	return nil
+}
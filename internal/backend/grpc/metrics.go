@@ -0,0 +1,44 @@
+package grpc
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_grpc_event_count",
+		Help: "The number of events received from the gateways (per type).",
+	}, []string{"event"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_grpc_command_count",
+		Help: "The number of commands sent to the gateways (per type).",
+	}, []string{"command"})
+
+	gwc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_grpc_gateway_connect_count",
+		Help: "The number of gateway streams opened.",
+	})
+
+	gwd = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_grpc_gateway_disconnect_count",
+		Help: "The number of gateway streams closed.",
+	})
+)
+
+func eventCounter(typ string) prometheus.Counter {
+	return ec.With(prometheus.Labels{"event": typ})
+}
+
+func commandCounter(typ string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"command": typ})
+}
+
+func connectCounter() prometheus.Counter {
+	return gwc
+}
+
+func disconnectCounter() prometheus.Counter {
+	return gwd
+}
@@ -0,0 +1,474 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/filters"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+// Backend implements a MQTT gateway backend. It subscribes to the events
+// published by the packet-forwarder to a (southbound) MQTT broker and
+// publishes the commands back to this broker.
+type Backend struct {
+	sync.RWMutex
+
+	conn       paho.Client
+	clientOpts *paho.ClientOptions
+	closed     bool
+
+	// Callback functions for handling events.
+	downlinkTxAckFunc           func(gw.DownlinkTXAck)
+	gatewayStatsFunc            func(gw.GatewayStats)
+	uplinkFrameFunc             func(gw.UplinkFrame)
+	rawPacketForwarderEventFunc func(gw.RawPacketForwarderEvent)
+
+	gateways       gateways
+	gatewayCleanup time.Duration
+
+	qos                  uint8
+	eventTopic           string
+	commandTopicTemplate *template.Template
+	marshaler            marshaler.Marshaler
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.Config) (*Backend, error) {
+	var err error
+
+	b := Backend{
+		clientOpts: paho.NewClientOptions(),
+		gateways: gateways{
+			gateways: make(map[lorawan.EUI64]time.Time),
+		},
+		gatewayCleanup: conf.Backend.MQTT.GatewayCleanup,
+		qos:            conf.Backend.MQTT.QOS,
+		eventTopic:     conf.Backend.MQTT.EventTopic,
+	}
+
+	b.marshaler, err = marshaler.New(conf.Backend.MQTT.Marshaler)
+	if err != nil {
+		return nil, errors.Wrap(err, "new marshaler error")
+	}
+
+	b.commandTopicTemplate, err = template.New("command").Parse(conf.Backend.MQTT.CommandTopicTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse command-topic template error")
+	}
+
+	tlsConfig, err := newTLSConfig(conf.Backend.MQTT.CACert, conf.Backend.MQTT.TLSCert, conf.Backend.MQTT.TLSKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "new tls config error")
+	}
+	if tlsConfig != nil {
+		b.clientOpts.SetTLSConfig(tlsConfig)
+	}
+
+	for _, server := range conf.Backend.MQTT.Servers {
+		b.clientOpts.AddBroker(server)
+	}
+	b.clientOpts.SetUsername(conf.Backend.MQTT.Username)
+	b.clientOpts.SetPassword(conf.Backend.MQTT.Password)
+	b.clientOpts.SetCleanSession(conf.Backend.MQTT.CleanSession)
+	b.clientOpts.SetClientID(conf.Backend.MQTT.ClientID)
+	b.clientOpts.SetProtocolVersion(4)
+	b.clientOpts.SetAutoReconnect(true)
+	b.clientOpts.SetOnConnectHandler(b.onConnected)
+	b.clientOpts.SetConnectionLostHandler(b.onConnectionLost)
+	b.clientOpts.SetKeepAlive(conf.Backend.MQTT.KeepAlive)
+	b.clientOpts.SetMaxReconnectInterval(conf.Backend.MQTT.MaxReconnectInterval)
+
+	log.WithFields(log.Fields{
+		"servers":     conf.Backend.MQTT.Servers,
+		"event_topic": b.eventTopic,
+	}).Info("backend/mqtt: setting up backend")
+
+	return &b, nil
+}
+
+// Start starts the backend.
+func (b *Backend) Start() error {
+	b.connectLoop()
+
+	if b.gatewayCleanup > 0 {
+		go func() {
+			for !b.isClosed() {
+				time.Sleep(b.gatewayCleanup)
+				log.Debug("backend/mqtt: cleanup gateway registry")
+				b.gateways.cleanup(b.gatewayCleanup)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Stop stops the backend.
+func (b *Backend) Stop() error {
+	b.Lock()
+	b.closed = true
+	b.Unlock()
+
+	b.conn.Disconnect(250)
+	return nil
+}
+
+// SetDownlinkTxAckFunc sets the DownlinkTXAck handler func.
+func (b *Backend) SetDownlinkTxAckFunc(f func(gw.DownlinkTXAck)) {
+	b.downlinkTxAckFunc = f
+}
+
+// SetGatewayStatsFunc sets the GatewayStats handler func.
+func (b *Backend) SetGatewayStatsFunc(f func(gw.GatewayStats)) {
+	b.gatewayStatsFunc = f
+}
+
+// SetUplinkFrameFunc sets the UplinkFrame handler func.
+func (b *Backend) SetUplinkFrameFunc(f func(gw.UplinkFrame)) {
+	b.uplinkFrameFunc = f
+}
+
+// SetRawPacketForwarderEventFunc sets the RawPacketForwarderEvent handler func.
+func (b *Backend) SetRawPacketForwarderEventFunc(f func(gw.RawPacketForwarderEvent)) {
+	b.rawPacketForwarderEventFunc = f
+}
+
+// SetSubscribeEventFunc sets the Subscribe handler func.
+func (b *Backend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	b.gateways.subscribeEventFunc = f
+}
+
+// SendDownlinkFrame sends the given downlink frame.
+func (b *Backend) SendDownlinkFrame(pl gw.DownlinkFrame) error {
+	var gatewayID lorawan.EUI64
+	var downID uuid.UUID
+	copy(gatewayID[:], pl.GetGatewayId())
+	copy(downID[:], pl.GetDownlinkId())
+
+	if err := b.publishCommand(gatewayID, "down", &pl); err != nil {
+		return errors.Wrap(err, "publish downlink frame error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": downID,
+	}).Info("backend/mqtt: downlink-frame published")
+
+	return nil
+}
+
+// ApplyConfiguration applies the given configuration to the gateway.
+func (b *Backend) ApplyConfiguration(pl gw.GatewayConfiguration) error {
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GetGatewayId())
+
+	if err := b.publishCommand(gatewayID, "config", &pl); err != nil {
+		return errors.Wrap(err, "publish gateway configuration error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"version":    pl.Version,
+	}).Info("backend/mqtt: gateway configuration published")
+
+	return nil
+}
+
+// RawPacketForwarderCommand sends the given raw command to the packet-forwarder.
+func (b *Backend) RawPacketForwarderCommand(pl gw.RawPacketForwarderCommand) error {
+	var gatewayID lorawan.EUI64
+	var rawID uuid.UUID
+	copy(gatewayID[:], pl.GetGatewayId())
+	copy(rawID[:], pl.GetRawId())
+
+	if err := b.publishCommand(gatewayID, "raw", &pl); err != nil {
+		return errors.Wrap(err, "publish raw packet-forwarder command error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"raw_id":     rawID,
+	}).Info("backend/mqtt: raw packet-forwarder command published")
+
+	return nil
+}
+
+func (b *Backend) isClosed() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.closed
+}
+
+func (b *Backend) connect() error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.conn = paho.NewClient(b.clientOpts)
+	if token := b.conn.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
+
+// connectLoop blocks until the client is connected
+func (b *Backend) connectLoop() {
+	for {
+		if err := b.connect(); err != nil {
+			log.WithError(err).Error("backend/mqtt: connection error")
+			time.Sleep(time.Second * 2)
+		} else {
+			break
+		}
+	}
+}
+
+func (b *Backend) onConnected(c paho.Client) {
+	log.WithFields(log.Fields{
+		"topic": b.eventTopic,
+		"qos":   b.qos,
+	}).Info("backend/mqtt: connected to mqtt broker, subscribing to event topic")
+
+	for {
+		if token := c.Subscribe(b.eventTopic, b.qos, b.handleEvent); token.Wait() && token.Error() != nil {
+			log.WithError(token.Error()).WithField("topic", b.eventTopic).Error("backend/mqtt: subscribe error")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		break
+	}
+}
+
+func (b *Backend) onConnectionLost(c paho.Client, err error) {
+	log.WithError(err).Error("backend/mqtt: connection error")
+}
+
+func (b *Backend) handleEvent(c paho.Client, msg paho.Message) {
+	var err error
+	event := getEventType(msg.Topic())
+
+	switch event {
+	case "up":
+		err = b.handleUplinkFrame(msg.Payload())
+	case "stats":
+		err = b.handleGatewayStats(msg.Payload())
+	case "ack":
+		err = b.handleDownlinkTxAck(msg.Payload())
+	case "raw":
+		err = b.handleRawPacketForwarderEvent(msg.Payload())
+	default:
+		log.WithFields(log.Fields{
+			"topic": msg.Topic(),
+		}).Warning("backend/mqtt: unexpected event received")
+		return
+	}
+
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"topic": msg.Topic(),
+			"event": event,
+		}).Error("backend/mqtt: handle event error")
+		return
+	}
+
+	eventCounter(event).Inc()
+}
+
+func (b *Backend) handleUplinkFrame(bb []byte) error {
+	var pl gw.UplinkFrame
+	if err := b.marshaler.Unmarshal(bb, &pl); err != nil {
+		return errors.Wrap(err, "unmarshal error")
+	}
+
+	var gatewayID lorawan.EUI64
+	var uplinkID uuid.UUID
+	copy(gatewayID[:], pl.GetRxInfo().GetGatewayId())
+	copy(uplinkID[:], pl.GetRxInfo().GetUplinkId())
+
+	b.gateways.set(gatewayID)
+
+	if !filters.MatchFilters(pl.PhyPayload) {
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"uplink_id":  uplinkID,
+		}).Debug("backend/mqtt: frame dropped because of configured filters")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"uplink_id":  uplinkID,
+	}).Info("backend/mqtt: uplink event received")
+
+	if b.uplinkFrameFunc != nil {
+		b.uplinkFrameFunc(pl)
+	}
+
+	return nil
+}
+
+func (b *Backend) handleGatewayStats(bb []byte) error {
+	var pl gw.GatewayStats
+	if err := b.marshaler.Unmarshal(bb, &pl); err != nil {
+		return errors.Wrap(err, "unmarshal error")
+	}
+
+	var gatewayID lorawan.EUI64
+	var statsID uuid.UUID
+	copy(gatewayID[:], pl.GetGatewayId())
+	copy(statsID[:], pl.GetStatsId())
+
+	b.gateways.set(gatewayID)
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"stats_id":   statsID,
+	}).Info("backend/mqtt: stats event received")
+
+	if b.gatewayStatsFunc != nil {
+		b.gatewayStatsFunc(pl)
+	}
+
+	return nil
+}
+
+func (b *Backend) handleDownlinkTxAck(bb []byte) error {
+	var pl gw.DownlinkTXAck
+	if err := b.marshaler.Unmarshal(bb, &pl); err != nil {
+		return errors.Wrap(err, "unmarshal error")
+	}
+
+	var gatewayID lorawan.EUI64
+	var downID uuid.UUID
+	copy(gatewayID[:], pl.GetGatewayId())
+	copy(downID[:], pl.GetDownlinkId())
+
+	b.gateways.set(gatewayID)
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": downID,
+	}).Info("backend/mqtt: ack event received")
+
+	if b.downlinkTxAckFunc != nil {
+		b.downlinkTxAckFunc(pl)
+	}
+
+	return nil
+}
+
+func (b *Backend) handleRawPacketForwarderEvent(bb []byte) error {
+	var pl gw.RawPacketForwarderEvent
+	if err := b.marshaler.Unmarshal(bb, &pl); err != nil {
+		return errors.Wrap(err, "unmarshal error")
+	}
+
+	var gatewayID lorawan.EUI64
+	var rawID uuid.UUID
+	copy(gatewayID[:], pl.GetGatewayId())
+	copy(rawID[:], pl.GetRawId())
+
+	b.gateways.set(gatewayID)
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"raw_id":     rawID,
+	}).Info("backend/mqtt: raw packet-forwarder event received")
+
+	if b.rawPacketForwarderEventFunc != nil {
+		b.rawPacketForwarderEventFunc(pl)
+	}
+
+	return nil
+}
+
+func (b *Backend) publishCommand(gatewayID lorawan.EUI64, command string, msg proto.Message) error {
+	topic := bytes.NewBuffer(nil)
+	if err := b.commandTopicTemplate.Execute(topic, struct {
+		GatewayID   lorawan.EUI64
+		CommandType string
+	}{gatewayID, command}); err != nil {
+		return errors.Wrap(err, "execute command topic template error")
+	}
+
+	bb, err := b.marshaler.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal message error")
+	}
+
+	log.WithFields(log.Fields{
+		"topic":   topic.String(),
+		"qos":     b.qos,
+		"command": command,
+	}).Debug("backend/mqtt: publishing command")
+
+	b.RLock()
+	defer b.RUnlock()
+
+	if token := b.conn.Publish(topic.String(), b.qos, false, bb); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	commandCounter(command).Inc()
+
+	return nil
+}
+
+// getEventType returns the event type from the given topic. Both
+// .../[EventType] and ...?event=[EventType] topic formats are supported.
+func getEventType(topic string) string {
+	for _, event := range []string{"up", "stats", "ack", "raw"} {
+		if strings.HasSuffix(topic, "/"+event) || strings.Contains(topic, "event="+event) {
+			return event
+		}
+	}
+
+	return ""
+}
+
+func newTLSConfig(cafile, certFile, certKeyFile string) (*tls.Config, error) {
+	if cafile == "" && certFile == "" && certKeyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if cafile != "" {
+		cacert, err := ioutil.ReadFile(cafile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load ca-cert error")
+		}
+		certpool := x509.NewCertPool()
+		certpool.AppendCertsFromPEM(cacert)
+
+		tlsConfig.RootCAs = certpool
+	}
+
+	if certFile != "" && certKeyFile != "" {
+		kp, err := tls.LoadX509KeyPair(certFile, certKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls key-pair error")
+		}
+		tlsConfig.Certificates = []tls.Certificate{kp}
+	}
+
+	return tlsConfig, nil
+}
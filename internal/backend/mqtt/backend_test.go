@@ -0,0 +1,286 @@
+package mqtt
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+type BackendTestSuite struct {
+	suite.Suite
+
+	mqttClient paho.Client
+	backend    *Backend
+	gatewayID  lorawan.EUI64
+
+	subscribeEventChan chan events.Subscribe
+}
+
+func (ts *BackendTestSuite) SetupSuite() {
+	assert := require.New(ts.T())
+
+	log.SetLevel(log.ErrorLevel)
+
+	server := "tcp://127.0.0.1:1883/1"
+	var username string
+	var password string
+
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		server = v
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		username = v
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		password = v
+	}
+
+	opts := paho.NewClientOptions().AddBroker(server).SetUsername(username).SetPassword(password)
+	ts.mqttClient = paho.NewClient(opts)
+	token := ts.mqttClient.Connect()
+	token.Wait()
+	assert.NoError(token.Error())
+
+	ts.gatewayID = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var conf config.Config
+	conf.Backend.MQTT.Servers = []string{server}
+	conf.Backend.MQTT.Username = username
+	conf.Backend.MQTT.Password = password
+	conf.Backend.MQTT.CleanSession = true
+	conf.Backend.MQTT.Marshaler = "json"
+	conf.Backend.MQTT.EventTopic = "test-forwarder/+/event/+"
+	conf.Backend.MQTT.CommandTopicTemplate = "test-forwarder/{{ .GatewayID }}/command/{{ .CommandType }}"
+
+	var err error
+	ts.backend, err = NewBackend(conf)
+	assert.NoError(err)
+
+	ts.subscribeEventChan = make(chan events.Subscribe, 1)
+	ts.backend.SetSubscribeEventFunc(func(pl events.Subscribe) {
+		ts.subscribeEventChan <- pl
+	})
+
+	assert.NoError(ts.backend.Start())
+	time.Sleep(100 * time.Millisecond)
+}
+
+func (ts *BackendTestSuite) TearDownSuite() {
+	ts.mqttClient.Disconnect(0)
+	ts.backend.Stop()
+}
+
+func (ts *BackendTestSuite) publishEvent(event string, msg proto.Message) {
+	assert := require.New(ts.T())
+
+	b, err := ts.backend.marshaler.Marshal(msg)
+	assert.NoError(err)
+
+	token := ts.mqttClient.Publish("test-forwarder/"+ts.gatewayID.String()+"/event/"+event, 0, false, b)
+	token.Wait()
+	assert.NoError(token.Error())
+}
+
+func (ts *BackendTestSuite) subscribeCommand(command string) chan []byte {
+	assert := require.New(ts.T())
+
+	commandChan := make(chan []byte, 1)
+	token := ts.mqttClient.Subscribe("test-forwarder/"+ts.gatewayID.String()+"/command/"+command, 0, func(c paho.Client, msg paho.Message) {
+		commandChan <- msg.Payload()
+	})
+	token.Wait()
+	assert.NoError(token.Error())
+
+	return commandChan
+}
+
+func (ts *BackendTestSuite) TestUplinkFrame() {
+	assert := require.New(ts.T())
+
+	uplinkFrameChan := make(chan gw.UplinkFrame, 1)
+	ts.backend.SetUplinkFrameFunc(func(pl gw.UplinkFrame) {
+		uplinkFrameChan <- pl
+	})
+
+	uf := gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3, 4},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: ts.gatewayID[:],
+			CrcStatus: gw.CRCStatus_CRC_OK,
+		},
+	}
+	ts.publishEvent("up", &uf)
+
+	received := <-uplinkFrameChan
+	assert.True(proto.Equal(&uf, &received))
+
+	ts.T().Run("Gateway subscribed", func(t *testing.T) {
+		assert := require.New(t)
+
+		select {
+		case pl := <-ts.subscribeEventChan:
+			assert.Equal(events.Subscribe{Subscribe: true, GatewayID: ts.gatewayID}, pl)
+		default:
+			// the gateway was already registered by an earlier test
+			ts.backend.gateways.RLock()
+			_, ok := ts.backend.gateways.gateways[ts.gatewayID]
+			ts.backend.gateways.RUnlock()
+			assert.True(ok)
+		}
+	})
+}
+
+func (ts *BackendTestSuite) TestGatewayStats() {
+	assert := require.New(ts.T())
+
+	gatewayStatsChan := make(chan gw.GatewayStats, 1)
+	ts.backend.SetGatewayStatsFunc(func(pl gw.GatewayStats) {
+		gatewayStatsChan <- pl
+	})
+
+	stats := gw.GatewayStats{
+		GatewayId:         ts.gatewayID[:],
+		RxPacketsReceived: 10,
+	}
+	ts.publishEvent("stats", &stats)
+
+	received := <-gatewayStatsChan
+	assert.True(proto.Equal(&stats, &received))
+}
+
+func (ts *BackendTestSuite) TestDownlinkTxAck() {
+	assert := require.New(ts.T())
+
+	txAckChan := make(chan gw.DownlinkTXAck, 1)
+	ts.backend.SetDownlinkTxAckFunc(func(pl gw.DownlinkTXAck) {
+		txAckChan <- pl
+	})
+
+	ack := gw.DownlinkTXAck{
+		GatewayId: ts.gatewayID[:],
+		Token:     1234,
+		Items: []*gw.DownlinkTXAckItem{
+			{
+				Status: gw.TxAckStatus_OK,
+			},
+		},
+	}
+	ts.publishEvent("ack", &ack)
+
+	received := <-txAckChan
+	assert.True(proto.Equal(&ack, &received))
+}
+
+func (ts *BackendTestSuite) TestSendDownlinkFrame() {
+	assert := require.New(ts.T())
+	commandChan := ts.subscribeCommand("down")
+
+	df := gw.DownlinkFrame{
+		GatewayId: ts.gatewayID[:],
+		Token:     1234,
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+			},
+		},
+	}
+	assert.NoError(ts.backend.SendDownlinkFrame(df))
+
+	var received gw.DownlinkFrame
+	assert.NoError(ts.backend.marshaler.Unmarshal(<-commandChan, &received))
+	assert.True(proto.Equal(&df, &received))
+}
+
+func (ts *BackendTestSuite) TestApplyConfiguration() {
+	assert := require.New(ts.T())
+	commandChan := ts.subscribeCommand("config")
+
+	conf := gw.GatewayConfiguration{
+		GatewayId: ts.gatewayID[:],
+		Version:   "1.2.3",
+	}
+	assert.NoError(ts.backend.ApplyConfiguration(conf))
+
+	var received gw.GatewayConfiguration
+	assert.NoError(ts.backend.marshaler.Unmarshal(<-commandChan, &received))
+	assert.True(proto.Equal(&conf, &received))
+}
+
+func (ts *BackendTestSuite) TestRawPacketForwarderCommand() {
+	assert := require.New(ts.T())
+	commandChan := ts.subscribeCommand("raw")
+
+	raw := gw.RawPacketForwarderCommand{
+		GatewayId: ts.gatewayID[:],
+		Payload:   []byte{1, 2, 3},
+	}
+	assert.NoError(ts.backend.RawPacketForwarderCommand(raw))
+
+	var received gw.RawPacketForwarderCommand
+	assert.NoError(ts.backend.marshaler.Unmarshal(<-commandChan, &received))
+	assert.True(proto.Equal(&raw, &received))
+}
+
+func TestBackend(t *testing.T) {
+	suite.Run(t, new(BackendTestSuite))
+}
+
+func TestGetEventType(t *testing.T) {
+	tests := []struct {
+		Topic    string
+		Expected string
+	}{
+		{"gateway/0102030405060708/event/up", "up"},
+		{"gateway/0102030405060708/event/stats", "stats"},
+		{"gateway/0102030405060708/event/ack", "ack"},
+		{"gateway/0102030405060708/event/raw", "raw"},
+		{"devices/0102030405060708/messages/events/event=up", "up"},
+		{"gateway/0102030405060708/event/setup", ""},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Topic, func(t *testing.T) {
+			assert := require.New(t)
+			assert.Equal(tst.Expected, getEventType(tst.Topic))
+		})
+	}
+}
+
+func TestGatewaysCleanup(t *testing.T) {
+	assert := require.New(t)
+
+	var subscribeEvents []events.Subscribe
+	g := gateways{
+		gateways: make(map[lorawan.EUI64]time.Time),
+		subscribeEventFunc: func(pl events.Subscribe) {
+			subscribeEvents = append(subscribeEvents, pl)
+		},
+	}
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	g.set(gatewayID)
+	g.set(gatewayID)
+	assert.Equal([]events.Subscribe{{Subscribe: true, GatewayID: gatewayID}}, subscribeEvents)
+
+	g.cleanup(time.Minute)
+	assert.Len(g.gateways, 1)
+
+	g.gateways[gatewayID] = time.Now().Add(-2 * time.Minute)
+	g.cleanup(time.Minute)
+	assert.Len(g.gateways, 0)
+	assert.Equal([]events.Subscribe{
+		{Subscribe: true, GatewayID: gatewayID},
+		{Subscribe: false, GatewayID: gatewayID},
+	}, subscribeEvents)
+}
@@ -0,0 +1,59 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/lorawan"
+)
+
+// gateways contains the gateways registry.
+type gateways struct {
+	sync.RWMutex
+	gateways map[lorawan.EUI64]time.Time
+
+	subscribeEventFunc func(events.Subscribe)
+}
+
+// set updates the last-seen timestamp of the given gateway. When the gateway
+// was not yet registered, a subscribe event is sent.
+func (g *gateways) set(gatewayID lorawan.EUI64) {
+	g.Lock()
+	defer g.Unlock()
+
+	if _, ok := g.gateways[gatewayID]; !ok {
+		connectCounter().Inc()
+
+		if g.subscribeEventFunc != nil {
+			g.subscribeEventFunc(events.Subscribe{
+				Subscribe: true,
+				GatewayID: gatewayID,
+			})
+		}
+	}
+
+	g.gateways[gatewayID] = time.Now()
+}
+
+// cleanup removes the gateways from which no event has been received within
+// the given duration.
+func (g *gateways) cleanup(d time.Duration) {
+	g.Lock()
+	defer g.Unlock()
+
+	for gatewayID, lastSeen := range g.gateways {
+		if lastSeen.Before(time.Now().Add(-d)) {
+			disconnectCounter().Inc()
+
+			if g.subscribeEventFunc != nil {
+				g.subscribeEventFunc(events.Subscribe{
+					Subscribe: false,
+					GatewayID: gatewayID,
+				})
+			}
+
+			delete(g.gateways, gatewayID)
+		}
+	}
+}
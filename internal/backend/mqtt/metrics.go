@@ -0,0 +1,44 @@
+package mqtt
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_mqtt_event_count",
+		Help: "The number of received events (per type).",
+	}, []string{"event"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_mqtt_command_count",
+		Help: "The number of published commands (per type).",
+	}, []string{"command"})
+
+	gwc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_mqtt_gateway_connect_count",
+		Help: "The number of gateways that were seen by the backend.",
+	})
+
+	gwd = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_mqtt_gateway_disconnect_count",
+		Help: "The number of gateways that were removed after inactivity.",
+	})
+)
+
+func eventCounter(typ string) prometheus.Counter {
+	return ec.With(prometheus.Labels{"event": typ})
+}
+
+func commandCounter(typ string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"command": typ})
+}
+
+func connectCounter() prometheus.Counter {
+	return gwc
+}
+
+func disconnectCounter() prometheus.Counter {
+	return gwd
+}
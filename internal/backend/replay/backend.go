@@ -0,0 +1,392 @@
+package replay
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/record"
+	"github.com/brocaar/lorawan"
+)
+
+// Backend implements a replay backend. It reads the uplink frames and
+// gateway stats from a file and emits these using their original relative
+// timing. Received commands are written to the (optional) downlink file.
+type Backend struct {
+	sync.RWMutex
+
+	// Callback functions for handling events.
+	downlinkTxAckFunc  func(gw.DownlinkTXAck)
+	gatewayStatsFunc   func(gw.GatewayStats)
+	uplinkFrameFunc    func(gw.UplinkFrame)
+	subscribeEventFunc func(events.Subscribe)
+
+	file              string
+	format            string
+	speed             float64
+	loop              bool
+	gatewayID         *lorawan.EUI64
+	rewriteTimestamps bool
+	downlinkTxAck     bool
+
+	downlinkFile *os.File
+
+	gateways map[lorawan.EUI64]struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.Config) (*Backend, error) {
+	b := Backend{
+		file:              conf.Backend.Replay.File,
+		format:            conf.Backend.Replay.Format,
+		speed:             conf.Backend.Replay.Speed,
+		loop:              conf.Backend.Replay.Loop,
+		rewriteTimestamps: conf.Backend.Replay.RewriteTimestamps,
+		downlinkTxAck:     conf.Backend.Replay.DownlinkTxAck,
+		gateways:          make(map[lorawan.EUI64]struct{}),
+		done:              make(chan struct{}),
+	}
+
+	if b.speed < 0 {
+		return nil, errors.New("speed must be >= 0")
+	}
+
+	if conf.Backend.Replay.GatewayID != "" {
+		var gatewayID lorawan.EUI64
+		if err := gatewayID.UnmarshalText([]byte(conf.Backend.Replay.GatewayID)); err != nil {
+			return nil, errors.Wrap(err, "unmarshal gateway id error")
+		}
+		b.gatewayID = &gatewayID
+	}
+
+	// validate that the file can be opened using the configured format
+	f, err := os.Open(b.file)
+	if err != nil {
+		return nil, errors.Wrap(err, "open replay file error")
+	}
+	_, err = newEventReader(b.format, f)
+	f.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "new event reader error")
+	}
+
+	if conf.Backend.Replay.DownlinkFile != "" {
+		b.downlinkFile, err = os.OpenFile(conf.Backend.Replay.DownlinkFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			return nil, errors.Wrap(err, "open downlink file error")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"file":   b.file,
+		"format": b.format,
+		"speed":  b.speed,
+		"loop":   b.loop,
+	}).Info("backend/replay: setting up backend")
+
+	return &b, nil
+}
+
+// Start starts the backend.
+func (b *Backend) Start() error {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		for {
+			count, err := b.replay()
+			if err != nil {
+				log.WithError(err).Error("backend/replay: replay file error")
+				return
+			}
+
+			if !b.loop || count == 0 || b.isClosed() {
+				log.Info("backend/replay: replay completed")
+				return
+			}
+
+			log.Debug("backend/replay: restarting replay")
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the backend.
+func (b *Backend) Stop() error {
+	b.Lock()
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+	b.Unlock()
+
+	b.wg.Wait()
+
+	if b.downlinkFile != nil {
+		return b.downlinkFile.Close()
+	}
+
+	return nil
+}
+
+// SetDownlinkTxAckFunc sets the DownlinkTXAck handler func.
+func (b *Backend) SetDownlinkTxAckFunc(f func(gw.DownlinkTXAck)) {
+	b.downlinkTxAckFunc = f
+}
+
+// SetGatewayStatsFunc sets the GatewayStats handler func.
+func (b *Backend) SetGatewayStatsFunc(f func(gw.GatewayStats)) {
+	b.gatewayStatsFunc = f
+}
+
+// SetUplinkFrameFunc sets the UplinkFrame handler func.
+func (b *Backend) SetUplinkFrameFunc(f func(gw.UplinkFrame)) {
+	b.uplinkFrameFunc = f
+}
+
+// SetRawPacketForwarderEventFunc sets the RawPacketForwarderEvent handler func.
+func (b *Backend) SetRawPacketForwarderEventFunc(func(gw.RawPacketForwarderEvent)) {
+	// not provided by the replay backend.
+}
+
+// SetSubscribeEventFunc sets the Subscribe handler func.
+func (b *Backend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	b.subscribeEventFunc = f
+}
+
+// SendDownlinkFrame records the given downlink frame.
+func (b *Backend) SendDownlinkFrame(pl gw.DownlinkFrame) error {
+	if err := b.writeRecord("down", &pl); err != nil {
+		return errors.Wrap(err, "write downlink frame error")
+	}
+
+	if b.downlinkTxAck && b.downlinkTxAckFunc != nil {
+		ack := gw.DownlinkTXAck{
+			GatewayId:  pl.GetGatewayId(),
+			Token:      pl.GetToken(),
+			DownlinkId: pl.GetDownlinkId(),
+		}
+		for i := range pl.GetItems() {
+			status := gw.TxAckStatus_IGNORED
+			if i == 0 {
+				status = gw.TxAckStatus_OK
+			}
+			ack.Items = append(ack.Items, &gw.DownlinkTXAckItem{
+				Status: status,
+			})
+		}
+
+		b.downlinkTxAckFunc(ack)
+	}
+
+	return nil
+}
+
+// ApplyConfiguration records the given configuration.
+func (b *Backend) ApplyConfiguration(pl gw.GatewayConfiguration) error {
+	if err := b.writeRecord("config", &pl); err != nil {
+		return errors.Wrap(err, "write gateway configuration error")
+	}
+	return nil
+}
+
+// RawPacketForwarderCommand records the given raw command.
+func (b *Backend) RawPacketForwarderCommand(pl gw.RawPacketForwarderCommand) error {
+	if err := b.writeRecord("raw", &pl); err != nil {
+		return errors.Wrap(err, "write raw packet-forwarder command error")
+	}
+	return nil
+}
+
+func (b *Backend) isClosed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *Backend) writeRecord(typ string, msg proto.Message) error {
+	commandCounter(typ).Inc()
+
+	if b.downlinkFile == nil {
+		return nil
+	}
+
+	rec, err := record.New(record.DirectionCommand, typ, msg)
+	if err != nil {
+		return errors.Wrap(err, "new record error")
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return record.Write(b.downlinkFile, rec)
+}
+
+// replay replays the events from the configured file once. It returns
+// the number of emitted events when all events have been emitted or when
+// the backend has been stopped.
+func (b *Backend) replay() (int, error) {
+	f, err := os.Open(b.file)
+	if err != nil {
+		return 0, errors.Wrap(err, "open replay file error")
+	}
+	defer f.Close()
+
+	r, err := newEventReader(b.format, f)
+	if err != nil {
+		return 0, errors.Wrap(err, "new event reader error")
+	}
+
+	var count int
+	var first, start time.Time
+
+	for {
+		ev, err := r.next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, errors.Wrap(err, "read event error")
+		}
+
+		if ts := ev.getTime(); !ts.IsZero() && b.speed > 0 {
+			if first.IsZero() {
+				first = ts
+				start = time.Now()
+			}
+
+			delay := time.Duration(float64(ts.Sub(first))/b.speed) - time.Since(start)
+			if delay > 0 {
+				select {
+				case <-b.done:
+					return count, nil
+				case <-time.After(delay):
+				}
+			}
+		}
+
+		if b.isClosed() {
+			return count, nil
+		}
+
+		b.emit(ev)
+		count++
+	}
+}
+
+func (b *Backend) emit(ev event) {
+	now, _ := ptypes.TimestampProto(time.Now())
+
+	if ev.uplinkFrame != nil {
+		if ev.uplinkFrame.RxInfo == nil {
+			ev.uplinkFrame.RxInfo = &gw.UplinkRXInfo{}
+		}
+		if b.gatewayID != nil {
+			ev.uplinkFrame.RxInfo.GatewayId = b.gatewayID[:]
+		}
+		if b.rewriteTimestamps {
+			ev.uplinkFrame.RxInfo.Time = now
+		}
+		if len(ev.uplinkFrame.RxInfo.UplinkId) == 0 {
+			id, _ := uuid.NewV4()
+			ev.uplinkFrame.RxInfo.UplinkId = id[:]
+		}
+
+		var gatewayID lorawan.EUI64
+		var uplinkID uuid.UUID
+		copy(gatewayID[:], ev.uplinkFrame.RxInfo.GatewayId)
+		copy(uplinkID[:], ev.uplinkFrame.RxInfo.UplinkId)
+
+		b.setGateway(gatewayID)
+		eventCounter("up").Inc()
+
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"uplink_id":  uplinkID,
+		}).Info("backend/replay: uplink event replayed")
+
+		if b.uplinkFrameFunc != nil {
+			b.uplinkFrameFunc(*ev.uplinkFrame)
+		}
+	}
+
+	if ev.gatewayStats != nil {
+		if b.gatewayID != nil {
+			ev.gatewayStats.GatewayId = b.gatewayID[:]
+		}
+		if b.rewriteTimestamps {
+			ev.gatewayStats.Time = now
+		}
+		if len(ev.gatewayStats.StatsId) == 0 {
+			id, _ := uuid.NewV4()
+			ev.gatewayStats.StatsId = id[:]
+		}
+
+		var gatewayID lorawan.EUI64
+		var statsID uuid.UUID
+		copy(gatewayID[:], ev.gatewayStats.GatewayId)
+		copy(statsID[:], ev.gatewayStats.StatsId)
+
+		b.setGateway(gatewayID)
+		eventCounter("stats").Inc()
+
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"stats_id":   statsID,
+		}).Info("backend/replay: stats event replayed")
+
+		if b.gatewayStatsFunc != nil {
+			b.gatewayStatsFunc(*ev.gatewayStats)
+		}
+	}
+}
+
+// setGateway sends a subscribe event the first time the given gateway ID
+// is seen.
+func (b *Backend) setGateway(gatewayID lorawan.EUI64) {
+	b.Lock()
+	_, ok := b.gateways[gatewayID]
+	b.gateways[gatewayID] = struct{}{}
+	b.Unlock()
+
+	if !ok && b.subscribeEventFunc != nil {
+		b.subscribeEventFunc(events.Subscribe{
+			Subscribe: true,
+			GatewayID: gatewayID,
+		})
+	}
+}
+
+// getTime returns the time of the event. This is the record time if set,
+// else the time of the wrapped message.
+func (e event) getTime() time.Time {
+	if !e.time.IsZero() {
+		return e.time
+	}
+
+	var ts time.Time
+	if e.uplinkFrame != nil && e.uplinkFrame.GetRxInfo().GetTime() != nil {
+		ts, _ = ptypes.Timestamp(e.uplinkFrame.GetRxInfo().GetTime())
+	}
+	if e.gatewayStats != nil && e.gatewayStats.GetTime() != nil {
+		ts, _ = ptypes.Timestamp(e.gatewayStats.GetTime())
+	}
+	return ts
+}
@@ -0,0 +1,301 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/record"
+	"github.com/brocaar/lorawan"
+)
+
+type BackendTestSuite struct {
+	suite.Suite
+
+	tempDir   string
+	gatewayID lorawan.EUI64
+	start     time.Time
+}
+
+func (ts *BackendTestSuite) SetupSuite() {
+	log.SetLevel(log.ErrorLevel)
+	ts.gatewayID = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	ts.start = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func (ts *BackendTestSuite) SetupTest() {
+	assert := require.New(ts.T())
+
+	var err error
+	ts.tempDir, err = ioutil.TempDir("", "test")
+	assert.NoError(err)
+}
+
+func (ts *BackendTestSuite) TearDownTest() {
+	os.RemoveAll(ts.tempDir)
+}
+
+func (ts *BackendTestSuite) writeJSONFile() string {
+	assert := require.New(ts.T())
+
+	var m marshaler.JSON
+	f, err := os.Create(filepath.Join(ts.tempDir, "replay.jsonl"))
+	assert.NoError(err)
+	defer f.Close()
+
+	write := func(t time.Time, typ string, msg proto.Message) {
+		pl, err := m.Marshal(msg)
+		assert.NoError(err)
+		b, err := json.Marshal(record.Record{Time: t, Type: typ, Payload: pl})
+		assert.NoError(err)
+		_, err = f.Write(append(b, '\n'))
+		assert.NoError(err)
+	}
+
+	write(ts.start, "up", &gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: ts.gatewayID[:],
+		},
+	})
+	write(ts.start.Add(100*time.Millisecond), "down", &gw.DownlinkFrame{
+		GatewayId: ts.gatewayID[:],
+	})
+	write(ts.start.Add(200*time.Millisecond), "stats", &gw.GatewayStats{
+		GatewayId: ts.gatewayID[:],
+	})
+
+	return f.Name()
+}
+
+func (ts *BackendTestSuite) writeProtobufFile() string {
+	assert := require.New(ts.T())
+
+	f, err := os.Create(filepath.Join(ts.tempDir, "replay.bin"))
+	assert.NoError(err)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+
+	write := func(msg proto.Message) {
+		a, err := ptypes.MarshalAny(msg)
+		assert.NoError(err)
+		b, err := proto.Marshal(a)
+		assert.NoError(err)
+
+		size := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(size, uint64(len(b)))
+		_, err = w.Write(size[:n])
+		assert.NoError(err)
+		_, err = w.Write(b)
+		assert.NoError(err)
+	}
+
+	t0, _ := ptypes.TimestampProto(ts.start)
+	t1, _ := ptypes.TimestampProto(ts.start.Add(200 * time.Millisecond))
+
+	write(&gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: ts.gatewayID[:],
+			Time:      t0,
+		},
+	})
+	write(&gw.GatewayStats{
+		GatewayId: ts.gatewayID[:],
+		Time:      t1,
+	})
+
+	return f.Name()
+}
+
+func (ts *BackendTestSuite) TestReplay() {
+	tests := []struct {
+		Name   string
+		Format string
+		File   func() string
+	}{
+		{
+			Name:   "json",
+			Format: "json",
+			File:   ts.writeJSONFile,
+		},
+		{
+			Name:   "protobuf",
+			Format: "protobuf",
+			File:   ts.writeProtobufFile,
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var conf config.Config
+			conf.Backend.Replay.File = tst.File()
+			conf.Backend.Replay.Format = tst.Format
+			conf.Backend.Replay.Speed = 1
+
+			b, err := NewBackend(conf)
+			assert.NoError(err)
+
+			subscribeChan := make(chan events.Subscribe, 1)
+			uplinkChan := make(chan gw.UplinkFrame, 1)
+			statsChan := make(chan gw.GatewayStats, 1)
+
+			b.SetSubscribeEventFunc(func(pl events.Subscribe) { subscribeChan <- pl })
+			b.SetUplinkFrameFunc(func(pl gw.UplinkFrame) { uplinkChan <- pl })
+			b.SetGatewayStatsFunc(func(pl gw.GatewayStats) { statsChan <- pl })
+
+			assert.NoError(b.Start())
+
+			assert.Equal(events.Subscribe{Subscribe: true, GatewayID: ts.gatewayID}, <-subscribeChan)
+
+			up := <-uplinkChan
+			upReceived := time.Now()
+			assert.Equal([]byte{1, 2, 3}, up.PhyPayload)
+			assert.Len(up.RxInfo.UplinkId, 16)
+
+			stats := <-statsChan
+			assert.True(time.Since(upReceived) >= 150*time.Millisecond)
+			assert.Equal(ts.gatewayID[:], stats.GatewayId)
+
+			assert.NoError(b.Stop())
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestLoopAndRewrite() {
+	assert := require.New(ts.T())
+
+	now := time.Now()
+	gatewayID := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	var conf config.Config
+	conf.Backend.Replay.File = ts.writeJSONFile()
+	conf.Backend.Replay.Format = "json"
+	conf.Backend.Replay.Loop = true
+	conf.Backend.Replay.GatewayID = gatewayID.String()
+	conf.Backend.Replay.RewriteTimestamps = true
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	uplinkChan := make(chan gw.UplinkFrame, 10)
+	b.SetUplinkFrameFunc(func(pl gw.UplinkFrame) {
+		select {
+		case uplinkChan <- pl:
+		default:
+		}
+	})
+
+	assert.NoError(b.Start())
+
+	for i := 0; i < 3; i++ {
+		up := <-uplinkChan
+		assert.Equal(gatewayID[:], up.RxInfo.GatewayId)
+
+		upTime, err := ptypes.Timestamp(up.RxInfo.Time)
+		assert.NoError(err)
+		assert.True(upTime.After(now))
+	}
+
+	assert.NoError(b.Stop())
+}
+
+func (ts *BackendTestSuite) TestDownlinkFile() {
+	assert := require.New(ts.T())
+
+	var conf config.Config
+	conf.Backend.Replay.File = ts.writeJSONFile()
+	conf.Backend.Replay.Format = "json"
+	conf.Backend.Replay.DownlinkFile = filepath.Join(ts.tempDir, "downlink.jsonl")
+	conf.Backend.Replay.DownlinkTxAck = true
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	txAckChan := make(chan gw.DownlinkTXAck, 1)
+	b.SetDownlinkTxAckFunc(func(pl gw.DownlinkTXAck) { txAckChan <- pl })
+
+	df := gw.DownlinkFrame{
+		GatewayId:  ts.gatewayID[:],
+		Token:      1234,
+		DownlinkId: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		Items: []*gw.DownlinkFrameItem{
+			{PhyPayload: []byte{1, 2, 3}},
+			{PhyPayload: []byte{4, 5, 6}},
+		},
+	}
+	assert.NoError(b.SendDownlinkFrame(df))
+	assert.NoError(b.ApplyConfiguration(gw.GatewayConfiguration{GatewayId: ts.gatewayID[:], Version: "1.2.3"}))
+
+	assert.Equal(gw.DownlinkTXAck{
+		GatewayId:  df.GatewayId,
+		Token:      df.Token,
+		DownlinkId: df.DownlinkId,
+		Items: []*gw.DownlinkTXAckItem{
+			{Status: gw.TxAckStatus_OK},
+			{Status: gw.TxAckStatus_IGNORED},
+		},
+	}, <-txAckChan)
+
+	assert.NoError(b.Stop())
+
+	f, err := os.Open(conf.Backend.Replay.DownlinkFile)
+	assert.NoError(err)
+	defer f.Close()
+
+	var m marshaler.JSON
+	var records []record.Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec record.Record
+		assert.NoError(json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+
+	assert.Len(records, 2)
+	assert.Equal("down", records[0].Type)
+	assert.Equal("config", records[1].Type)
+	assert.Equal(record.DirectionCommand, records[0].Direction)
+
+	var received gw.DownlinkFrame
+	assert.NoError(m.Unmarshal(records[0].Payload, &received))
+	assert.True(proto.Equal(&df, &received))
+}
+
+func TestProtobufReaderMaxMessageSize(t *testing.T) {
+	assert := require.New(t)
+
+	size := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(size, 1<<40)
+
+	r, err := newEventReader("protobuf", bytes.NewReader(size[:n]))
+	assert.NoError(err)
+
+	_, err = r.next()
+	assert.Error(err)
+	assert.Contains(err.Error(), "exceeds max. size")
+}
+
+func TestBackend(t *testing.T) {
+	suite.Run(t, new(BackendTestSuite))
+}
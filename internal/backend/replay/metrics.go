@@ -0,0 +1,26 @@
+package replay
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_replay_event_count",
+		Help: "The number of replayed events (per type).",
+	}, []string{"event"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_replay_command_count",
+		Help: "The number of recorded commands (per type).",
+	}, []string{"command"})
+)
+
+func eventCounter(typ string) prometheus.Counter {
+	return ec.With(prometheus.Labels{"event": typ})
+}
+
+func commandCounter(typ string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"command": typ})
+}
@@ -0,0 +1,143 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/record"
+)
+
+// event holds a single event to replay. Only one of the messages is set.
+type event struct {
+	time         time.Time
+	uplinkFrame  *gw.UplinkFrame
+	gatewayStats *gw.GatewayStats
+}
+
+// eventReader defines the interface for reading events from a file.
+// The next method must return io.EOF when there are no events left.
+type eventReader interface {
+	next() (event, error)
+}
+
+func newEventReader(format string, r io.Reader) (eventReader, error) {
+	switch format {
+	case "json":
+		rr, err := record.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonReader{
+			reader: rr,
+		}, nil
+	case "protobuf":
+		return &protobufReader{
+			reader: bufio.NewReader(r),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+// jsonReader reads events from JSON Lines records (optionally gzip
+// compressed). Records of other types than up and stats (e.g. recorded
+// downlinks) and commands are skipped.
+type jsonReader struct {
+	reader *record.Reader
+}
+
+func (r *jsonReader) next() (event, error) {
+	for {
+		rec, err := r.reader.Next()
+		if err != nil {
+			return event{}, err
+		}
+
+		if rec.Direction == record.DirectionCommand {
+			continue
+		}
+
+		ev := event{
+			time: rec.Time,
+		}
+
+		switch rec.Type {
+		case "up":
+			ev.uplinkFrame = &gw.UplinkFrame{}
+			if err := rec.Unmarshal(ev.uplinkFrame); err != nil {
+				return event{}, errors.Wrap(err, "unmarshal uplink frame error")
+			}
+		case "stats":
+			ev.gatewayStats = &gw.GatewayStats{}
+			if err := rec.Unmarshal(ev.gatewayStats); err != nil {
+				return event{}, errors.Wrap(err, "unmarshal gateway stats error")
+			}
+		default:
+			continue
+		}
+
+		return ev, nil
+	}
+}
+
+// maxMessageSize defines the max. size of a single protobuf message. This
+// protects against allocating huge buffers on corrupt or truncated files.
+const maxMessageSize = 1024 * 1024
+
+// protobufReader reads events from length-delimited (varint size prefix)
+// google.protobuf.Any messages, wrapping either a gw.UplinkFrame or
+// gw.GatewayStats message.
+type protobufReader struct {
+	reader *bufio.Reader
+}
+
+func (r *protobufReader) next() (event, error) {
+	for {
+		size, err := binary.ReadUvarint(r.reader)
+		if err != nil {
+			return event{}, err
+		}
+
+		if size > maxMessageSize {
+			return event{}, fmt.Errorf("message size %d exceeds max. size of %d bytes", size, maxMessageSize)
+		}
+
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r.reader, b); err != nil {
+			return event{}, errors.Wrap(err, "read message error")
+		}
+
+		var a any.Any
+		if err := proto.Unmarshal(b, &a); err != nil {
+			return event{}, errors.Wrap(err, "unmarshal any error")
+		}
+
+		var ev event
+
+		switch {
+		case ptypes.Is(&a, &gw.UplinkFrame{}):
+			ev.uplinkFrame = &gw.UplinkFrame{}
+			if err := ptypes.UnmarshalAny(&a, ev.uplinkFrame); err != nil {
+				return event{}, errors.Wrap(err, "unmarshal uplink frame error")
+			}
+		case ptypes.Is(&a, &gw.GatewayStats{}):
+			ev.gatewayStats = &gw.GatewayStats{}
+			if err := ptypes.UnmarshalAny(&a, ev.gatewayStats); err != nil {
+				return event{}, errors.Wrap(err, "unmarshal gateway stats error")
+			}
+		default:
+			continue
+		}
+
+		return ev, nil
+	}
+}
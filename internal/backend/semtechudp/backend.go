@@ -12,12 +12,15 @@ import (
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/brocaar/chirpstack-api/go/v3/gw"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/filters"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/tracing"
 	"github.com/brocaar/lorawan"
 )
 
@@ -176,7 +179,14 @@ func (b *Backend) SendDownlinkFrame(frame gw.DownlinkFrame) error {
 	return b.sendDownlinkFrame(frame, 0, acks)
 }
 
-func (b *Backend) sendDownlinkFrame(frame gw.DownlinkFrame, i int, txAckItems []*gw.DownlinkTXAckItem) error {
+func (b *Backend) sendDownlinkFrame(frame gw.DownlinkFrame, i int, txAckItems []*gw.DownlinkTXAckItem) (err error) {
+	span := tracing.Start(frame.DownlinkId, "semtechudp.pull_resp", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("gateway_id", fmt.Sprintf("%x", frame.GetGatewayId())),
+		attribute.Int64("token", int64(frame.Token)),
+		attribute.Int("item_index", i),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	if i > len(frame.Items)-1 {
 		return errors.New("invalid downlink frame item index")
 	}
@@ -390,6 +400,19 @@ func (b *Backend) handleTXACK(up udpPacket) error {
 		return fmt.Errorf("expected []gw.DownlinkTXAckItem, got: %T", items)
 	}
 
+	status := "OK"
+	if p.Payload != nil && p.Payload.TXPKACK.Error != "" && p.Payload.TXPKACK.Error != "NONE" {
+		status = p.Payload.TXPKACK.Error
+	}
+
+	span := tracing.Start(frame.DownlinkId, "semtechudp.tx_ack", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("gateway_id", p.GatewayMAC.String()),
+		attribute.Int64("token", int64(p.RandomToken)),
+		attribute.Int("item_index", itemIndex),
+		attribute.String("status", status),
+	))
+	defer span.End()
+
 	// validate that the data is sane
 	if itemIndex > len(txAckItems)-1 || len(txAckItems) != len(frame.Items) {
 		return errors.New("cache items are out of sync")
@@ -441,6 +464,8 @@ func (b *Backend) handleTXACK(up udpPacket) error {
 }
 
 func (b *Backend) handlePushData(up udpPacket) error {
+	received := time.Now()
+
 	var p packets.PushDataPacket
 	if err := p.UnmarshalBinary(up.data); err != nil {
 		return err
@@ -486,7 +511,7 @@ func (b *Backend) handlePushData(up udpPacket) error {
 	if err != nil {
 		return errors.Wrap(err, "get uplink frames error")
 	}
-	b.handleUplinkFrames(uplinkFrames)
+	b.handleUplinkFrames(uplinkFrames, received)
 
 	return nil
 }
@@ -497,17 +522,24 @@ func (b *Backend) handleStats(gatewayID lorawan.EUI64, stats gw.GatewayStats) {
 	}
 }
 
-func (b *Backend) handleUplinkFrames(uplinkFrames []gw.UplinkFrame) error {
+func (b *Backend) handleUplinkFrames(uplinkFrames []gw.UplinkFrame, received time.Time) error {
 	for i := range uplinkFrames {
+		span := tracing.Start(uplinkFrames[i].GetRxInfo().GetUplinkId(), "semtechudp.push_data", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithTimestamp(received), trace.WithAttributes(
+			attribute.String("gateway_id", fmt.Sprintf("%x", uplinkFrames[i].GetRxInfo().GetGatewayId())),
+		))
+
 		if filters.MatchFilters(uplinkFrames[i].PhyPayload) {
 			if b.uplinkFrameFunc != nil {
 				b.uplinkFrameFunc(uplinkFrames[i])
 			}
 		} else {
+			span.SetAttributes(attribute.Bool("filtered", true))
 			log.WithFields(log.Fields{
 				"data_base64": base64.StdEncoding.EncodeToString(uplinkFrames[i].PhyPayload),
 			}).Debug("backend/semtechudp: frame dropped because of configured filters")
 		}
+
+		span.End()
 	}
 
 	return nil
@@ -16,6 +16,8 @@ import (
 	"github.com/brocaar/chirpstack-api/go/v3/gw"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/record"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/recorder"
 	"github.com/brocaar/lorawan"
 )
 
@@ -68,7 +70,16 @@ func executeCommand(cmd gw.GatewayCommandExecRequest) {
 	var gatewayID lorawan.EUI64
 	copy(gatewayID[:], cmd.GatewayId)
 
-	stdout, stderr, err := execute(cmd.Command, cmd.Stdin, cmd.Environment)
+	recorder.Record(gatewayID, record.DirectionCommand, "exec", &cmd)
+
+	var stdout, stderr []byte
+	var err error
+	if cmd.Command == recorder.Command && recorder.CommandEnabled() {
+		stdout, err = recorder.ExecCommand(gatewayID, cmd.Stdin)
+	} else {
+		stdout, stderr, err = execute(cmd.Command, cmd.Stdin, cmd.Environment)
+	}
+
 	resp := gw.GatewayCommandExecResponse{
 		GatewayId: cmd.GatewayId,
 		ExecId:    cmd.ExecId,
@@ -79,6 +90,8 @@ func executeCommand(cmd gw.GatewayCommandExecRequest) {
 		resp.Error = err.Error()
 	}
 
+	recorder.Record(gatewayID, record.DirectionEvent, "exec", &resp)
+
 	var id uuid.UUID
 
 	if err := integration.GetIntegration().PublishEvent(gatewayID, "exec", id, &resp); err != nil {
@@ -50,55 +50,109 @@ type Config struct {
 			CommandURL string `mapstructure:"command_url"`
 			CRCCheck   bool   `mapstructure:"crc_check"`
 		} `mapstructure:"concentratord"`
+
+		MQTT struct {
+			Servers              []string      `mapstructure:"servers"`
+			Username             string        `mapstructure:"username"`
+			Password             string        `mapstructure:"password"`
+			CACert               string        `mapstructure:"ca_cert"`
+			TLSCert              string        `mapstructure:"tls_cert"`
+			TLSKey               string        `mapstructure:"tls_key"`
+			QOS                  uint8         `mapstructure:"qos"`
+			CleanSession         bool          `mapstructure:"clean_session"`
+			ClientID             string        `mapstructure:"client_id"`
+			KeepAlive            time.Duration `mapstructure:"keep_alive"`
+			MaxReconnectInterval time.Duration `mapstructure:"max_reconnect_interval"`
+			Marshaler            string        `mapstructure:"marshaler"`
+			EventTopic           string        `mapstructure:"event_topic"`
+			CommandTopicTemplate string        `mapstructure:"command_topic_template"`
+			GatewayCleanup       time.Duration `mapstructure:"gateway_cleanup"`
+		} `mapstructure:"mqtt"`
+
+		Replay struct {
+			File              string  `mapstructure:"file"`
+			Format            string  `mapstructure:"format"`
+			Speed             float64 `mapstructure:"speed"`
+			Loop              bool    `mapstructure:"loop"`
+			GatewayID         string  `mapstructure:"gateway_id"`
+			RewriteTimestamps bool    `mapstructure:"rewrite_timestamps"`
+			DownlinkFile      string  `mapstructure:"downlink_file"`
+			DownlinkTxAck     bool    `mapstructure:"downlink_tx_ack"`
+		} `mapstructure:"replay"`
+
+		GRPC struct {
+			Bind    string `mapstructure:"bind"`
+			TLSCert string `mapstructure:"tls_cert"`
+			TLSKey  string `mapstructure:"tls_key"`
+			CACert  string `mapstructure:"ca_cert"`
+		} `mapstructure:"grpc"`
+
+		Exec struct {
+			Command         string        `mapstructure:"command"`
+			RestartDelay    time.Duration `mapstructure:"restart_delay"`
+			MaxRestartDelay time.Duration `mapstructure:"max_restart_delay"`
+		} `mapstructure:"exec"`
 	} `mapstructure:"backend"`
 
+	Forwarder struct {
+		Workers    int    `mapstructure:"workers"`
+		QueueSize  int    `mapstructure:"queue_size"`
+		DropPolicy string `mapstructure:"drop_policy"`
+
+		Deduplication struct {
+			Enabled bool          `mapstructure:"enabled"`
+			Window  time.Duration `mapstructure:"window"`
+		} `mapstructure:"deduplication"`
+
+		Processors []Processor `mapstructure:"processors"`
+	} `mapstructure:"forwarder"`
+
 	Integration struct {
+		Type      string `mapstructure:"type"`
 		Marshaler string `mapstructure:"marshaler"`
 
 		MQTT struct {
-			EventTopicTemplate      string        `mapstructure:"event_topic_template"`
-			CommandTopicTemplate    string        `mapstructure:"command_topic_template"`
-			KeepAlive               time.Duration `mapstructure:"keep_alive"`
-			MaxReconnectInterval    time.Duration `mapstructure:"max_reconnect_interval"`
-			TerminateOnConnectError bool          `mapstructure:"terminate_on_connect_error"`
-
-			Auth struct {
-				Type string `mapstructure:"type"`
-
-				Generic struct {
-					Server       string   `mapstructure:"server"`
-					Servers      []string `mapstructure:"servers"`
-					Username     string   `mapstructure:"username"`
-					Password     string   `mapstrucure:"password"`
-					CACert       string   `mapstructure:"ca_cert"`
-					TLSCert      string   `mapstructure:"tls_cert"`
-					TLSKey       string   `mapstructure:"tls_key"`
-					QOS          uint8    `mapstructure:"qos"`
-					CleanSession bool     `mapstructure:"clean_session"`
-					ClientID     string   `mapstructure:"client_id"`
-				} `mapstructure:"generic"`
-
-				GCPCloudIoTCore struct {
-					Server        string        `mapstructure:"server"`
-					DeviceID      string        `mapstructure:"device_id"`
-					ProjectID     string        `mapstructure:"project_id"`
-					CloudRegion   string        `mapstructure:"cloud_region"`
-					RegistryID    string        `mapstructure:"registry_id"`
-					JWTExpiration time.Duration `mapstructure:"jwt_expiration"`
-					JWTKeyFile    string        `mapstructure:"jwt_key_file"`
-				} `mapstructure:"gcp_cloud_iot_core"`
-
-				AzureIoTHub struct {
-					DeviceConnectionString string        `mapstructure:"device_connection_string"`
-					DeviceID               string        `mapstructure:"device_id"`
-					Hostname               string        `mapstructure:"hostname"`
-					DeviceKey              string        `mapstructure:"-"`
-					SASTokenExpiration     time.Duration `mapstructure:"sas_token_expiration"`
-					TLSCert                string        `mapstructure:"tls_cert"`
-					TLSKey                 string        `mapstructure:"tls_key"`
-				} `mapstructure:"azure_iot_hub"`
-			} `mapstructure:"auth"`
+			MQTTIntegration `mapstructure:",squash"`
+
+			CommandPolicy      string   `mapstructure:"command_policy"`
+			CommandConnections []string `mapstructure:"command_connections"`
+			SessionPerGateway  bool     `mapstructure:"session_per_gateway"`
+
+			Connections []MQTTConnection `mapstructure:"connections"`
 		} `mapstructure:"mqtt"`
+
+		AMQP struct {
+			URL                       string `mapstructure:"url"`
+			Exchange                  string `mapstructure:"exchange"`
+			EventRoutingKeyTemplate   string `mapstructure:"event_routing_key_template"`
+			CommandRoutingKeyTemplate string `mapstructure:"command_routing_key_template"`
+			CommandQueueNameTemplate  string `mapstructure:"command_queue_name_template"`
+		} `mapstructure:"amqp"`
+
+		Kafka struct {
+			Brokers            []string `mapstructure:"brokers"`
+			Version            string   `mapstructure:"version"`
+			EventTopicTemplate string   `mapstructure:"event_topic_template"`
+			CommandTopic       string   `mapstructure:"command_topic"`
+			TLS                bool     `mapstructure:"tls"`
+			CACert             string   `mapstructure:"ca_cert"`
+			TLSCert            string   `mapstructure:"tls_cert"`
+			TLSKey             string   `mapstructure:"tls_key"`
+			SASLMechanism      string   `mapstructure:"sasl_mechanism"`
+			SASLUsername       string   `mapstructure:"sasl_username"`
+			SASLPassword       string   `mapstructure:"sasl_password"`
+		} `mapstructure:"kafka"`
+
+		HTTP struct {
+			EventURLs     []string      `mapstructure:"event_urls"`
+			Timeout       time.Duration `mapstructure:"timeout"`
+			MaxRetries    int           `mapstructure:"max_retries"`
+			RetryDelay    time.Duration `mapstructure:"retry_delay"`
+			SigningSecret string        `mapstructure:"signing_secret"`
+			Bind          string        `mapstructure:"bind"`
+			TLSCert       string        `mapstructure:"tls_cert"`
+			TLSKey        string        `mapstructure:"tls_key"`
+		} `mapstructure:"http"`
 	} `mapstructure:"integration"`
 
 	Metrics struct {
@@ -106,6 +160,15 @@ type Config struct {
 			EndpointEnabled bool   `mapstructure:"endpoint_enabled"`
 			Bind            string `mapstructure:"bind"`
 		} `mapstructure:"prometheus"`
+
+		Tracing struct {
+			Enabled     bool              `mapstructure:"enabled"`
+			Endpoint    string            `mapstructure:"endpoint"`
+			Headers     map[string]string `mapstructure:"headers"`
+			Timeout     time.Duration     `mapstructure:"timeout"`
+			ServiceName string            `mapstructure:"service_name"`
+			SampleRatio float64           `mapstructure:"sample_ratio"`
+		} `mapstructure:"tracing"`
 	} `mapstructure:"metrics"`
 
 	MetaData struct {
@@ -116,6 +179,7 @@ type Config struct {
 			SplitDelimiter       string            `mapstructure:"split_delimiter"`
 			Commands             map[string]string `mapstructure:"commands"`
 		} `mapstructure:"dynamic"`
+		Events map[string]MetaDataEvent `mapstructure:"events"`
 	} `mapstructure:"meta_data"`
 
 	Commands struct {
@@ -124,6 +188,165 @@ type Config struct {
 			Command              string        `mapstructure:"command"`
 		} `mapstructure:"commands"`
 	} `mapstructure:"commands"`
+
+	Recorder struct {
+		Enabled        bool   `mapstructure:"enabled"`
+		CommandEnabled bool   `mapstructure:"command_enabled"`
+		File           string `mapstructure:"file"`
+		MaxSize        int64  `mapstructure:"max_size"`
+		MaxFiles       int    `mapstructure:"max_files"`
+		Gzip           bool   `mapstructure:"gzip"`
+		QueueSize      int    `mapstructure:"queue_size"`
+	} `mapstructure:"recorder"`
+}
+
+// MQTTIntegration holds the configuration of a MQTT integration connection.
+// The settings of which the zero value is valid are pointers, so that a
+// named connection can override them with an explicit false or 0.
+type MQTTIntegration struct {
+	EventTopicTemplate       string        `mapstructure:"event_topic_template"`
+	CommandTopicTemplate     string        `mapstructure:"command_topic_template"`
+	StateTopicTemplate       string        `mapstructure:"state_topic_template"`
+	StateRetained            *bool         `mapstructure:"state_retained"`
+	BridgeStateTopicTemplate string        `mapstructure:"bridge_state_topic_template"`
+	KeepAlive                time.Duration `mapstructure:"keep_alive"`
+	MaxReconnectInterval     time.Duration `mapstructure:"max_reconnect_interval"`
+	TerminateOnConnectError  *bool         `mapstructure:"terminate_on_connect_error"`
+	ProtocolVersion          uint8         `mapstructure:"protocol_version"`
+	MessageExpiry            time.Duration `mapstructure:"message_expiry"`
+	CommandQOS               *uint8        `mapstructure:"command_qos"`
+
+	Events map[string]MQTTEvent `mapstructure:"events"`
+
+	SharedSubscription struct {
+		Enabled            bool   `mapstructure:"enabled"`
+		Group              string `mapstructure:"group"`
+		ForwardTopicPrefix string `mapstructure:"forward_topic_prefix"`
+	} `mapstructure:"shared_subscription"`
+
+	SparkplugB struct {
+		Enabled    bool   `mapstructure:"enabled"`
+		GroupID    string `mapstructure:"group_id"`
+		EdgeNodeID string `mapstructure:"edge_node_id"`
+	} `mapstructure:"sparkplug_b"`
+
+	Outbox struct {
+		Path    string        `mapstructure:"path"`
+		MaxSize int64         `mapstructure:"max_size"`
+		MaxAge  time.Duration `mapstructure:"max_age"`
+	} `mapstructure:"outbox"`
+
+	Auth struct {
+		Type string `mapstructure:"type"`
+
+		Generic struct {
+			Server       string   `mapstructure:"server"`
+			Servers      []string `mapstructure:"servers"`
+			Username     string   `mapstructure:"username"`
+			Password     string   `mapstrucure:"password"`
+			CACert       string   `mapstructure:"ca_cert"`
+			TLSCert      string   `mapstructure:"tls_cert"`
+			TLSKey       string   `mapstructure:"tls_key"`
+			QOS          *uint8   `mapstructure:"qos"`
+			CleanSession bool     `mapstructure:"clean_session"`
+			ClientID     string   `mapstructure:"client_id"`
+
+			CredentialHelper struct {
+				Command []string      `mapstructure:"command"`
+				File    string        `mapstructure:"file"`
+				Timeout time.Duration `mapstructure:"timeout"`
+			} `mapstructure:"credential_helper"`
+		} `mapstructure:"generic"`
+
+		GCPCloudIoTCore struct {
+			Server        string        `mapstructure:"server"`
+			DeviceID      string        `mapstructure:"device_id"`
+			ProjectID     string        `mapstructure:"project_id"`
+			CloudRegion   string        `mapstructure:"cloud_region"`
+			RegistryID    string        `mapstructure:"registry_id"`
+			JWTExpiration time.Duration `mapstructure:"jwt_expiration"`
+			JWTKeyFile    string        `mapstructure:"jwt_key_file"`
+		} `mapstructure:"gcp_cloud_iot_core"`
+
+		AzureIoTHub struct {
+			DeviceConnectionString string        `mapstructure:"device_connection_string"`
+			DeviceID               string        `mapstructure:"device_id"`
+			Hostname               string        `mapstructure:"hostname"`
+			DeviceKey              string        `mapstructure:"-"`
+			SASTokenExpiration     time.Duration `mapstructure:"sas_token_expiration"`
+			TLSCert                string        `mapstructure:"tls_cert"`
+			TLSKey                 string        `mapstructure:"tls_key"`
+		} `mapstructure:"azure_iot_hub"`
+
+		AWSIoTCore struct {
+			Server    string `mapstructure:"server"`
+			ThingName string `mapstructure:"thing_name"`
+			CACert    string `mapstructure:"ca_cert"`
+			TLSCert   string `mapstructure:"tls_cert"`
+			TLSKey    string `mapstructure:"tls_key"`
+		} `mapstructure:"aws_iot_core"`
+	} `mapstructure:"auth"`
+}
+
+// MQTTEvent holds the per event-type configuration of a MQTT integration
+// connection. Unset values fall back to the connection defaults.
+type MQTTEvent struct {
+	QOS           *uint8 `mapstructure:"qos"`
+	Retain        *bool  `mapstructure:"retain"`
+	TopicTemplate string `mapstructure:"topic_template"`
+}
+
+// Processor holds the configuration of an event processor.
+type Processor struct {
+	Type       string   `mapstructure:"type"`
+	Name       string   `mapstructure:"name"`
+	EventTypes []string `mapstructure:"event_types"`
+	GatewayIDs []string `mapstructure:"gateway_ids"`
+
+	Filter struct {
+		NetIDs   []string    `mapstructure:"net_ids"`
+		JoinEUIs [][2]string `mapstructure:"join_euis"`
+	} `mapstructure:"filter"`
+
+	MetaData struct {
+		Keys []string `mapstructure:"keys"`
+	} `mapstructure:"meta_data"`
+
+	Sample struct {
+		Rate float64 `mapstructure:"rate"`
+	} `mapstructure:"sample"`
+
+	Rewrite struct {
+		GatewayIDs map[string]string `mapstructure:"gateway_ids"`
+	} `mapstructure:"rewrite"`
+
+	Route struct {
+		Destinations []string `mapstructure:"destinations"`
+	} `mapstructure:"route"`
+
+	Script struct {
+		File                 string        `mapstructure:"file"`
+		MaxExecutionDuration time.Duration `mapstructure:"max_execution_duration"`
+		MaxCallStackSize     int           `mapstructure:"max_call_stack_size"`
+		MaxRegistrySize      int           `mapstructure:"max_registry_size"`
+		MaxMemorySize        int           `mapstructure:"max_memory_size"`
+	} `mapstructure:"script"`
+}
+
+// MetaDataEvent holds the per event-type meta-data configuration.
+type MetaDataEvent struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Keys    []string `mapstructure:"keys"`
+}
+
+// MQTTConnection holds the configuration of a named MQTT integration
+// connection.
+type MQTTConnection struct {
+	MQTTIntegration `mapstructure:",squash"`
+
+	Name       string   `mapstructure:"name"`
+	Marshaler  string   `mapstructure:"marshaler"`
+	EventTypes []string `mapstructure:"event_types"`
 }
 
 // BasicStationConcentrator holds the configuration for a BasicStation concentrator.
@@ -13,32 +13,58 @@ import (
 var netIDs []lorawan.NetID
 var joinEUIs [][2]lorawan.EUI64
 
-// Setup configures the filters package.
-func Setup(conf config.Config) error {
-	for _, netIDStr := range conf.Filters.NetIDs {
+// Filter implements a set of NetID and JoinEUI filters.
+type Filter struct {
+	netIDs   []lorawan.NetID
+	joinEUIs [][2]lorawan.EUI64
+}
+
+// NewFilter creates a new Filter, given the NetID and JoinEUI range filters.
+func NewFilter(netIDStrs []string, joinEUIStrs [][2]string) (*Filter, error) {
+	var f Filter
+
+	for _, netIDStr := range netIDStrs {
 		var netID lorawan.NetID
 		if err := netID.UnmarshalText([]byte(netIDStr)); err != nil {
-			return errors.Wrap(err, "unmarshal NetID error")
+			return nil, errors.Wrap(err, "unmarshal NetID error")
 		}
 
-		netIDs = append(netIDs, netID)
-		log.WithFields(log.Fields{
-			"net_id": netID,
-		}).Info("filters: NetID filter configured")
+		f.netIDs = append(f.netIDs, netID)
 	}
 
-	for _, set := range conf.Filters.JoinEUIs {
+	for _, set := range joinEUIStrs {
 		var joinEUISet [2]lorawan.EUI64
 
 		for i, s := range set {
 			var joinEUI lorawan.EUI64
 			if err := joinEUI.UnmarshalText([]byte(s)); err != nil {
-				return errors.Wrap(err, "unmarshal JoinEUI error")
+				return nil, errors.Wrap(err, "unmarshal JoinEUI error")
 			}
 
 			joinEUISet[i] = joinEUI
 		}
 
+		f.joinEUIs = append(f.joinEUIs, joinEUISet)
+	}
+
+	return &f, nil
+}
+
+// Setup configures the filters package.
+func Setup(conf config.Config) error {
+	f, err := NewFilter(conf.Filters.NetIDs, conf.Filters.JoinEUIs)
+	if err != nil {
+		return err
+	}
+
+	for _, netID := range f.netIDs {
+		netIDs = append(netIDs, netID)
+		log.WithFields(log.Fields{
+			"net_id": netID,
+		}).Info("filters: NetID filter configured")
+	}
+
+	for _, joinEUISet := range f.joinEUIs {
 		joinEUIs = append(joinEUIs, joinEUISet)
 
 		log.WithFields(log.Fields{
@@ -56,8 +82,19 @@ func Setup(conf config.Config) error {
 // * If no filters are configured
 // * In case the PHYPayload is not a valid LoRaWAN frame
 func MatchFilters(b []byte) bool {
+	f := Filter{
+		netIDs:   netIDs,
+		joinEUIs: joinEUIs,
+	}
+
+	return f.Match(b)
+}
+
+// Match matches the given LoRaWAN frame against the filters. See
+// MatchFilters for the cases in which this function returns true.
+func (f *Filter) Match(b []byte) bool {
 	// return true when no filters are configured
-	if len(netIDs) == 0 && len(joinEUIs) == 0 {
+	if len(f.netIDs) == 0 && len(f.joinEUIs) == 0 {
 		return true
 	}
 
@@ -70,22 +107,22 @@ func MatchFilters(b []byte) bool {
 
 	switch phy.MHDR.MType {
 	case lorawan.UnconfirmedDataUp, lorawan.ConfirmedDataUp:
-		return filterDevAddr(phy)
+		return f.filterDevAddr(phy)
 	case lorawan.JoinRequest:
-		return filterJoinRequest(phy)
+		return f.filterJoinRequest(phy)
 	case lorawan.RejoinRequest:
-		return filterRejoinRequest(phy)
+		return f.filterRejoinRequest(phy)
 	default:
 		return true
 	}
 }
 
-func matchNetIDFilter(netID lorawan.NetID) bool {
-	if len(netIDs) == 0 {
+func (f *Filter) matchNetIDFilter(netID lorawan.NetID) bool {
+	if len(f.netIDs) == 0 {
 		return true
 	}
 
-	for _, n := range netIDs {
+	for _, n := range f.netIDs {
 		if n == netID {
 			return true
 		}
@@ -94,12 +131,12 @@ func matchNetIDFilter(netID lorawan.NetID) bool {
 	return false
 }
 
-func matchNetIDFilterForDevAddr(devAddr lorawan.DevAddr) bool {
-	if len(netIDs) == 0 {
+func (f *Filter) matchNetIDFilterForDevAddr(devAddr lorawan.DevAddr) bool {
+	if len(f.netIDs) == 0 {
 		return true
 	}
 
-	for _, netID := range netIDs {
+	for _, netID := range f.netIDs {
 		if devAddr.IsNetID(netID) {
 			return true
 		}
@@ -108,14 +145,14 @@ func matchNetIDFilterForDevAddr(devAddr lorawan.DevAddr) bool {
 	return false
 }
 
-func matchJoinEUIFilter(joinEUI lorawan.EUI64) bool {
-	if len(joinEUIs) == 0 {
+func (f *Filter) matchJoinEUIFilter(joinEUI lorawan.EUI64) bool {
+	if len(f.joinEUIs) == 0 {
 		return true
 	}
 
 	joinEUIInt := binary.BigEndian.Uint64(joinEUI[:])
 
-	for _, pair := range joinEUIs {
+	for _, pair := range f.joinEUIs {
 		min := binary.BigEndian.Uint64(pair[0][:])
 		max := binary.BigEndian.Uint64(pair[1][:])
 
@@ -127,30 +164,30 @@ func matchJoinEUIFilter(joinEUI lorawan.EUI64) bool {
 	return false
 }
 
-func filterDevAddr(phy lorawan.PHYPayload) bool {
+func (f *Filter) filterDevAddr(phy lorawan.PHYPayload) bool {
 	mac, ok := phy.MACPayload.(*lorawan.MACPayload)
 	if !ok {
 		return true
 	}
 
-	return matchNetIDFilterForDevAddr(mac.FHDR.DevAddr)
+	return f.matchNetIDFilterForDevAddr(mac.FHDR.DevAddr)
 }
 
-func filterJoinRequest(phy lorawan.PHYPayload) bool {
+func (f *Filter) filterJoinRequest(phy lorawan.PHYPayload) bool {
 	jr, ok := phy.MACPayload.(*lorawan.JoinRequestPayload)
 	if !ok {
 		return true
 	}
 
-	return matchJoinEUIFilter(jr.JoinEUI)
+	return f.matchJoinEUIFilter(jr.JoinEUI)
 }
 
-func filterRejoinRequest(phy lorawan.PHYPayload) bool {
+func (f *Filter) filterRejoinRequest(phy lorawan.PHYPayload) bool {
 	switch v := phy.MACPayload.(type) {
 	case *lorawan.RejoinRequestType02Payload:
-		return matchNetIDFilter(v.NetID)
+		return f.matchNetIDFilter(v.NetID)
 	case *lorawan.RejoinRequestType1Payload:
-		return matchJoinEUIFilter(v.JoinEUI)
+		return f.matchJoinEUIFilter(v.JoinEUI)
 	default:
 		return true
 	}
@@ -0,0 +1,101 @@
+package forwarder
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/tracing"
+)
+
+// deduplicator merges the copies of an uplink frame, received by multiple
+// gateways (or by multiple boards of the same gateway) within the
+// de-duplication window, into a single uplink frame-set.
+type deduplicator struct {
+	mux     sync.Mutex
+	window  time.Duration
+	sets    map[[sha256.Size]byte]*gw.UplinkFrameSet
+	spans   map[[sha256.Size]byte][]trace.Span
+	publish func(gw.UplinkFrameSet)
+}
+
+// newDeduplicator creates a new deduplicator. The given publish func is
+// called with the merged frame-set once the de-duplication window of the
+// first received copy has expired.
+func newDeduplicator(window time.Duration, publish func(gw.UplinkFrameSet)) (*deduplicator, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("de-duplication window must be greater than 0: %s", window)
+	}
+
+	return &deduplicator{
+		window:  window,
+		sets:    make(map[[sha256.Size]byte]*gw.UplinkFrameSet),
+		spans:   make(map[[sha256.Size]byte][]trace.Span),
+		publish: publish,
+	}, nil
+}
+
+// add adds the given uplink frame. When this is the first copy, the
+// de-duplication window is started.
+func (d *deduplicator) add(pl gw.UplinkFrame) {
+	key := sha256.Sum256(pl.PhyPayload)
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	set, ok := d.sets[key]
+	if ok {
+		deduplicatedCounter().Inc()
+	} else {
+		set = &gw.UplinkFrameSet{
+			PhyPayload: pl.PhyPayload,
+			TxInfo:     pl.TxInfo,
+		}
+		d.sets[key] = set
+
+		time.AfterFunc(d.window, func() {
+			d.flush(key)
+		})
+	}
+
+	if pl.RxInfo != nil {
+		set.RxInfo = append(set.RxInfo, pl.RxInfo)
+	}
+
+	// the span ends when the window expires, the frame-set is published
+	// within the trace of the first copy
+	span := tracing.Start(pl.GetRxInfo().GetUplinkId(), "forwarder.deduplicate", trace.WithAttributes(
+		attribute.Bool("duplicate", ok),
+	))
+	if len(set.RxInfo) != 0 {
+		span.SetAttributes(attribute.String("first_uplink_id", uuid.FromBytesOrNil(set.RxInfo[0].UplinkId).String()))
+	}
+	d.spans[key] = append(d.spans[key], span)
+}
+
+// flush removes the frame-set with the given key and publishes it.
+func (d *deduplicator) flush(key [sha256.Size]byte) {
+	d.mux.Lock()
+	set, ok := d.sets[key]
+	spans := d.spans[key]
+	delete(d.sets, key)
+	delete(d.spans, key)
+	d.mux.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for _, span := range spans {
+		span.SetAttributes(attribute.Int("rx_info_count", len(set.RxInfo)))
+		span.End()
+	}
+
+	d.publish(*set)
+}
@@ -0,0 +1,78 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+)
+
+func TestDeduplicator(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := newDeduplicator(0, nil)
+	assert.Error(err)
+
+	sets := make(chan gw.UplinkFrameSet, 10)
+	d, err := newDeduplicator(50*time.Millisecond, func(pl gw.UplinkFrameSet) {
+		sets <- pl
+	})
+	assert.NoError(err)
+
+	txInfo := gw.UplinkTXInfo{Frequency: 868100000}
+	rxInfo := []*gw.UplinkRXInfo{
+		{GatewayId: []byte{1, 1, 1, 1, 1, 1, 1, 1}, Rssi: -50},
+		{GatewayId: []byte{2, 2, 2, 2, 2, 2, 2, 2}, Rssi: -60},
+		{GatewayId: []byte{2, 2, 2, 2, 2, 2, 2, 2}, Rssi: -70, Board: 1},
+	}
+
+	deduplicated := testutil.ToFloat64(deduplicatedCounter())
+
+	for _, rx := range rxInfo {
+		d.add(gw.UplinkFrame{
+			PhyPayload: []byte{1, 2, 3},
+			TxInfo:     &txInfo,
+			RxInfo:     rx,
+		})
+	}
+	d.add(gw.UplinkFrame{
+		PhyPayload: []byte{3, 2, 1},
+		TxInfo:     &txInfo,
+		RxInfo:     rxInfo[1],
+	})
+
+	var received []gw.UplinkFrameSet
+	for i := 0; i < 2; i++ {
+		select {
+		case pl := <-sets:
+			received = append(received, pl)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for uplink frame-set")
+		}
+	}
+
+	select {
+	case pl := <-sets:
+		t.Fatalf("unexpected uplink frame-set: %+v", pl)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for _, pl := range received {
+		assert.Equal(&txInfo, pl.TxInfo)
+
+		switch pl.PhyPayload[0] {
+		case 1:
+			assert.Equal(rxInfo, pl.RxInfo)
+		case 3:
+			assert.Equal(rxInfo[1:2], pl.RxInfo)
+		default:
+			t.Fatalf("unexpected phy payload: %v", pl.PhyPayload)
+		}
+	}
+
+	assert.Equal(deduplicated+2, testutil.ToFloat64(deduplicatedCounter()))
+	assert.Len(d.sets, 0)
+}
@@ -1,21 +1,55 @@
 package forwarder
 
 import (
+	"time"
+
 	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/brocaar/chirpstack-api/go/v3/gw"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/state"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/metadata"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/processor"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/record"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/recorder"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/tracing"
 	"github.com/brocaar/lorawan"
 )
 
+var (
+	backendType string
+	queue       *pool
+	dedup       *deduplicator
+	pipeline    *processor.Pipeline
+)
+
 // Setup configures the forwarder.
 func Setup(conf config.Config) error {
+	var err error
+
+	backendType = conf.Backend.Type
+
+	queue, err = newPool(conf.Forwarder.Workers, conf.Forwarder.QueueSize, conf.Forwarder.DropPolicy)
+	if err != nil {
+		return errors.Wrap(err, "new worker pool error")
+	}
+
+	dedup = nil
+	if conf.Forwarder.Deduplication.Enabled {
+		dedup, err = newDeduplicator(conf.Forwarder.Deduplication.Window, uplinkFrameSetFunc)
+		if err != nil {
+			return errors.Wrap(err, "new deduplicator error")
+		}
+	}
+
 	b := backend.GetBackend()
 	i := integration.GetIntegration()
 
@@ -39,64 +73,106 @@ func Setup(conf config.Config) error {
 	i.SetGatewayConfigurationFunc(gatewayConfigurationFunc)
 	i.SetRawPacketForwarderCommandFunc(rawPacketForwarderCommandFunc)
 
+	pipeline, err = newPipeline(conf, i)
+	if err != nil {
+		return errors.Wrap(err, "new processor pipeline error")
+	}
+
+	if mi, ok := i.(integration.MetaDataIntegration); ok {
+		mi.SetMetaDataFunc(metadata.Get)
+	}
+
 	return nil
 }
 
 func gatewaySubscribeFunc(pl events.Subscribe) {
-	go func(pl events.Subscribe) {
+	queue.submitNoDrop(pl.GatewayID, priorityNormal, integration.EventConn, func() {
 		if err := integration.GetIntegration().SetGatewaySubscription(pl.Subscribe, pl.GatewayID); err != nil {
 			log.WithError(err).Error("set gateway subscription error")
 		}
-	}(pl)
+
+		connState := state.ConnState{
+			GatewayId:   pl.GatewayID[:],
+			State:       state.ConnState_OFFLINE,
+			Time:        ptypes.TimestampNow(),
+			BackendType: backendType,
+		}
+		if pl.Subscribe {
+			connState.State = state.ConnState_ONLINE
+		}
+
+		publish(pl.GatewayID, integration.EventConn, "conn_id", uuid.Nil, &connState)
+	})
 }
 
 func uplinkFrameFunc(pl gw.UplinkFrame) {
-	go func(pl gw.UplinkFrame) {
-		var gatewayID lorawan.EUI64
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GetRxInfo().GatewayId)
+
+	recorder.Record(gatewayID, record.DirectionEvent, integration.EventUp, &pl)
+
+	if dedup != nil {
+		dedup.add(pl)
+		return
+	}
+
+	queued := time.Now()
+	queue.submit(gatewayID, priorityNormal, integration.EventUp, func() {
+		traceQueued(pl.GetRxInfo().GetUplinkId(), queued)
+
 		var uplinkID uuid.UUID
-		copy(gatewayID[:], pl.GetRxInfo().GatewayId)
 		copy(uplinkID[:], pl.GetRxInfo().UplinkId)
 
-		if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventUp, uplinkID, &pl); err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"gateway_id": gatewayID,
-				"event_type": integration.EventUp,
-				"uplink_id":  uplinkID,
-			}).Error("publish event error")
-		}
-	}(pl)
+		publish(gatewayID, integration.EventUp, "uplink_id", uplinkID, &pl)
+	})
+}
+
+// uplinkFrameSetFunc publishes the de-duplicated uplink as up_set event, using
+// the gateway ID and uplink ID of the first received copy.
+func uplinkFrameSetFunc(pl gw.UplinkFrameSet) {
+	if len(pl.RxInfo) == 0 {
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.RxInfo[0].GatewayId)
+
+	queued := time.Now()
+	queue.submit(gatewayID, priorityNormal, integration.EventUpSet, func() {
+		traceQueued(pl.RxInfo[0].UplinkId, queued)
+
+		var uplinkID uuid.UUID
+		copy(uplinkID[:], pl.RxInfo[0].UplinkId)
+
+		publish(gatewayID, integration.EventUpSet, "uplink_id", uplinkID, &pl)
+	})
 }
 
 func gatewayStatsFunc(pl gw.GatewayStats) {
-	go func(pl gw.GatewayStats) {
-		var gatewayID lorawan.EUI64
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
+
+	recorder.Record(gatewayID, record.DirectionEvent, integration.EventStats, &pl)
+
+	queue.submit(gatewayID, priorityLow, integration.EventStats, func() {
 		var statsID uuid.UUID
-		copy(gatewayID[:], pl.GatewayId)
 		copy(statsID[:], pl.StatsId)
 
-		// add meta-data to stats
-		if pl.MetaData == nil {
-			pl.MetaData = make(map[string]string)
-		}
-		for k, v := range metadata.Get() {
-			pl.MetaData[k] = v
-		}
-
-		if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventStats, statsID, &pl); err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"gateway_id": gatewayID,
-				"event_type": integration.EventStats,
-				"stats_id":   statsID,
-			}).Error("publish event error")
-		}
-	}(pl)
+		publish(gatewayID, integration.EventStats, "stats_id", statsID, &pl)
+	})
 }
 
 func downlinkTxAckFunc(pl gw.DownlinkTXAck) {
-	go func(pl gw.DownlinkTXAck) {
-		var gatewayID lorawan.EUI64
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
+
+	recorder.Record(gatewayID, record.DirectionEvent, integration.EventAck, &pl)
+
+	queued := time.Now()
+	queue.submit(gatewayID, priorityHigh, integration.EventAck, func() {
+		traceQueued(pl.DownlinkId, queued)
+
 		var downID uuid.UUID
-		copy(gatewayID[:], pl.GatewayId)
 		copy(downID[:], pl.DownlinkId)
 
 		// for backwards compatibility
@@ -109,53 +185,89 @@ func downlinkTxAckFunc(pl gw.DownlinkTXAck) {
 			pl.Error = err.String()
 		}
 
-		if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventAck, downID, &pl); err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"gateway_id":  gatewayID,
-				"event_type":  integration.EventAck,
-				"downlink_id": downID,
-			}).Error("publish event error")
-		}
-	}(pl)
+		publish(gatewayID, integration.EventAck, "downlink_id", downID, &pl)
+	})
 }
 
 func rawPacketForwarderEventFunc(pl gw.RawPacketForwarderEvent) {
-	go func(pl gw.RawPacketForwarderEvent) {
-		var gatewayID lorawan.EUI64
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
+
+	recorder.Record(gatewayID, record.DirectionEvent, integration.EventRaw, &pl)
+
+	queue.submit(gatewayID, priorityNormal, integration.EventRaw, func() {
 		var rawID uuid.UUID
-		copy(gatewayID[:], pl.GatewayId)
 		copy(rawID[:], pl.RawId)
 
-		if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventRaw, rawID, &pl); err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"gateway_id": gatewayID,
-				"event_type": integration.EventRaw,
-				"raw_id":     rawID,
-			}).Error("publish event error")
-		}
-	}(pl)
+		publish(gatewayID, integration.EventRaw, "raw_id", rawID, &pl)
+	})
 }
 
 func downlinkFrameFunc(pl gw.DownlinkFrame) {
-	go func(pl gw.DownlinkFrame) {
-		if err := backend.GetBackend().SendDownlinkFrame(pl); err != nil {
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
+
+	recorder.Record(gatewayID, record.DirectionCommand, processor.EventDown, &pl)
+
+	queued := time.Now()
+	queue.submit(gatewayID, priorityHigh, processor.EventDown, func() {
+		traceQueued(pl.DownlinkId, queued)
+
+		span := tracing.Start(pl.DownlinkId, "forwarder.downlink", trace.WithAttributes(
+			attribute.String("gateway_id", gatewayID.String()),
+			attribute.Int64("token", int64(pl.Token)),
+		))
+
+		if !process(gatewayID, processor.EventDown, &pl) {
+			span.SetAttributes(attribute.Bool("dropped", true))
+			span.End()
+			return
+		}
+
+		err := backend.GetBackend().SendDownlinkFrame(pl)
+		if err != nil {
 			log.WithError(err).Error("send downlink frame error")
 		}
-	}(pl)
+		tracing.End(span, err)
+	})
 }
 
 func gatewayConfigurationFunc(pl gw.GatewayConfiguration) {
-	go func(pl gw.GatewayConfiguration) {
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
+
+	recorder.Record(gatewayID, record.DirectionCommand, processor.EventConfig, &pl)
+
+	queue.submit(gatewayID, priorityHigh, processor.EventConfig, func() {
+		if !process(gatewayID, processor.EventConfig, &pl) {
+			return
+		}
+
 		if err := backend.GetBackend().ApplyConfiguration(pl); err != nil {
 			log.WithError(err).Error("apply gateway-configuration error")
 		}
-	}(pl)
+	})
 }
 
 func rawPacketForwarderCommandFunc(pl gw.RawPacketForwarderCommand) {
-	go func(pl gw.RawPacketForwarderCommand) {
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
+
+	recorder.Record(gatewayID, record.DirectionCommand, processor.EventRawCommand, &pl)
+
+	queue.submit(gatewayID, priorityHigh, processor.EventRawCommand, func() {
+		if !process(gatewayID, processor.EventRawCommand, &pl) {
+			return
+		}
+
 		if err := backend.GetBackend().RawPacketForwarderCommand(pl); err != nil {
 			log.WithError(err).Error("raw packet-forwarder command error")
 		}
-	}(pl)
+	})
+}
+
+// traceQueued records the time the uplink or downlink was waiting in the
+// queue of the gateway.
+func traceQueued(id []byte, queued time.Time) {
+	tracing.Start(id, "forwarder.queue", trace.WithTimestamp(queued)).End()
 }
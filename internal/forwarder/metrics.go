@@ -0,0 +1,44 @@
+package forwarder
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	qdc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "forwarder_queue_dropped_count",
+		Help: "The number of events and commands dropped by the forwarder because the gateway queue was full (per event and drop_policy).",
+	}, []string{"event", "drop_policy"})
+
+	qbc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "forwarder_queue_blocked_count",
+		Help: "The number of times the forwarder blocked because the gateway queue was full (per event).",
+	}, []string{"event"})
+
+	ql = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "forwarder_queue_length",
+		Help: "The number of events and commands queued by the forwarder (over all gateways).",
+	})
+
+	ddc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "forwarder_uplink_deduplicated_count",
+		Help: "The number of uplink frames merged into an uplink frame received by an other gateway (or board) within the de-duplication window.",
+	})
+)
+
+func droppedCounter(event, policy string) prometheus.Counter {
+	return qdc.With(prometheus.Labels{"event": event, "drop_policy": policy})
+}
+
+func blockedCounter(event string) prometheus.Counter {
+	return qbc.With(prometheus.Labels{"event": event})
+}
+
+func queueLengthGauge() prometheus.Gauge {
+	return ql
+}
+
+func deduplicatedCounter() prometheus.Counter {
+	return ddc
+}
@@ -0,0 +1,170 @@
+package forwarder
+
+import (
+	"fmt"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/processor"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/tracing"
+	"github.com/brocaar/lorawan"
+)
+
+// newPipeline creates the processor pipeline. The configured processors are
+// followed by the meta-data processors of the per event-type meta-data
+// configuration.
+func newPipeline(conf config.Config, i integration.Integration) (*processor.Pipeline, error) {
+	metaDataProcessors, err := metaDataProcessors(conf, i)
+	if err != nil {
+		return nil, err
+	}
+
+	var processors []config.Processor
+	processors = append(processors, conf.Forwarder.Processors...)
+	processors = append(processors, metaDataProcessors...)
+
+	for _, p := range conf.Forwarder.Processors {
+		switch p.Type {
+		case "route":
+			if err := validateRoute(p, i); err != nil {
+				return nil, err
+			}
+		case "meta_data":
+			if _, ok := i.(integration.EventMetaDataIntegration); !ok {
+				log.WithField("name", p.Name).Warning("forwarder: the integration only publishes meta-data with stats events")
+			}
+		}
+	}
+
+	return processor.New(processors)
+}
+
+// metaDataProcessors validates the per event-type meta-data configuration
+// and returns the matching meta-data processors.
+func metaDataProcessors(conf config.Config, i integration.Integration) ([]config.Processor, error) {
+	var out []config.Processor
+
+	for event, c := range conf.MetaData.Events {
+		switch event {
+		case integration.EventStats:
+		case integration.EventUp, integration.EventUpSet, integration.EventAck:
+			if _, ok := i.(integration.EventMetaDataIntegration); c.Enabled && !ok {
+				return nil, fmt.Errorf("meta-data with %s events is not supported by the integration", event)
+			}
+		default:
+			return nil, fmt.Errorf("meta-data is not supported for %s events", event)
+		}
+
+		if !c.Enabled {
+			continue
+		}
+
+		p := config.Processor{
+			Type:       "meta_data",
+			Name:       "meta_data_" + event,
+			EventTypes: []string{event},
+		}
+		p.MetaData.Keys = c.Keys
+
+		out = append(out, p)
+	}
+
+	return out, nil
+}
+
+// validateRoute validates that the destinations of the given route processor
+// are known by the integration.
+func validateRoute(p config.Processor, i integration.Integration) error {
+	ri, ok := i.(integration.RoutedIntegration)
+	if !ok {
+		return fmt.Errorf("route processor %s is not supported by the integration", p.Name)
+	}
+
+	destinations := make(map[string]struct{})
+	for _, d := range ri.Destinations() {
+		destinations[d] = struct{}{}
+	}
+
+	for _, d := range p.Route.Destinations {
+		if _, ok := destinations[d]; !ok {
+			return fmt.Errorf("route processor %s: unknown destination: %s", p.Name, d)
+		}
+	}
+
+	return nil
+}
+
+// process passes the given command through the pipeline. It returns false
+// when the command must be dropped.
+func process(gatewayID lorawan.EUI64, event string, pl proto.Message) bool {
+	ev := processor.Event{
+		Type:      event,
+		GatewayID: gatewayID,
+		Message:   pl,
+	}
+
+	return pipeline.Process(&ev)
+}
+
+// publish passes the given event through the pipeline and publishes it.
+func publish(gatewayID lorawan.EUI64, event string, idKey string, id uuid.UUID, pl proto.Message) {
+	ev := processor.Event{
+		Type:      event,
+		GatewayID: gatewayID,
+		Message:   pl,
+	}
+
+	// only the uplinks and the tx acks are part of a trace
+	traceID := uuid.Nil
+	if event == integration.EventUp || event == integration.EventUpSet || event == integration.EventAck {
+		traceID = id
+	}
+	span := tracing.Start(traceID[:], "forwarder.publish", trace.WithAttributes(
+		attribute.String("gateway_id", gatewayID.String()),
+		attribute.String("event_type", event),
+	))
+
+	if !pipeline.Process(&ev) {
+		span.SetAttributes(attribute.Bool("dropped", true))
+		span.End()
+		return
+	}
+
+	if len(ev.Destinations) != 0 {
+		span.SetAttributes(attribute.StringSlice("destinations", ev.Destinations))
+	}
+
+	err := publishEvent(ev, id)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": ev.GatewayID,
+			"event_type": event,
+			idKey:        id,
+		}).Error("publish event error")
+	}
+	tracing.End(span, err)
+}
+
+// publishEvent publishes the given event, together with its meta-data and to
+// its destinations when set.
+func publishEvent(ev processor.Event, id uuid.UUID) error {
+	i := integration.GetIntegration()
+
+	if len(ev.Destinations) != 0 {
+		if ri, ok := i.(integration.RoutedIntegration); ok {
+			return ri.PublishEventTo(ev.Destinations, ev.GatewayID, ev.Type, id, ev.Message, ev.MetaData)
+		}
+	}
+
+	if mi, ok := i.(integration.EventMetaDataIntegration); ok && len(ev.MetaData) != 0 {
+		return mi.PublishEventWithMetaData(ev.GatewayID, ev.Type, id, ev.Message, ev.MetaData)
+	}
+
+	return i.PublishEvent(ev.GatewayID, ev.Type, id, ev.Message)
+}
@@ -0,0 +1,128 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/metadata"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/processor"
+)
+
+// routedIntegration implements the optional integration interfaces.
+type routedIntegration struct {
+	integration.Integration
+	integration.EventMetaDataIntegration
+	integration.RoutedIntegration
+}
+
+func (i *routedIntegration) Destinations() []string {
+	return []string{"a", "b"}
+}
+
+func TestPipeline(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.MetaData.Static = map[string]string{
+		"site":    "hq",
+		"antenna": "north",
+		"serial":  "A1B21234",
+	}
+	conf.MetaData.Dynamic.ExecutionInterval = time.Minute
+	assert.NoError(metadata.Setup(conf))
+
+	for metadata.Get() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("Invalid meta-data event type", func(t *testing.T) {
+		assert := require.New(t)
+
+		c := conf
+		c.MetaData.Events = map[string]config.MetaDataEvent{
+			"conn": {Enabled: true},
+		}
+		_, err := newPipeline(c, nil)
+		assert.Error(err)
+	})
+
+	t.Run("Meta-data unsupported by integration", func(t *testing.T) {
+		assert := require.New(t)
+
+		c := conf
+		c.MetaData.Events = map[string]config.MetaDataEvent{
+			"up": {Enabled: true},
+		}
+		_, err := newPipeline(c, nil)
+		assert.Error(err)
+
+		// disabled events are not validated against the integration
+		c.MetaData.Events["up"] = config.MetaDataEvent{}
+		_, err = newPipeline(c, nil)
+		assert.NoError(err)
+	})
+
+	t.Run("Meta-data filtered by keys", func(t *testing.T) {
+		assert := require.New(t)
+
+		c := conf
+		c.MetaData.Events = map[string]config.MetaDataEvent{
+			"stats":  {Enabled: true},
+			"ack":    {Enabled: false},
+			"up":     {Enabled: true, Keys: []string{"site", "antenna", "tenant"}},
+			"up_set": {Enabled: true, Keys: []string{"site"}},
+		}
+
+		p, err := newPipeline(c, &routedIntegration{})
+		assert.NoError(err)
+
+		stats := processor.Event{Type: integration.EventStats, Message: &gw.GatewayStats{}}
+		assert.True(p.Process(&stats))
+		assert.Equal(conf.MetaData.Static, stats.Message.(*gw.GatewayStats).MetaData)
+		assert.Nil(stats.MetaData)
+
+		up := processor.Event{Type: integration.EventUp, Message: &gw.UplinkFrame{}}
+		assert.True(p.Process(&up))
+		assert.Equal(map[string]string{
+			"site":    "hq",
+			"antenna": "north",
+		}, up.MetaData)
+
+		upSet := processor.Event{Type: integration.EventUpSet, Message: &gw.UplinkFrameSet{}}
+		assert.True(p.Process(&upSet))
+		assert.Equal(map[string]string{
+			"site": "hq",
+		}, upSet.MetaData)
+
+		ack := processor.Event{Type: integration.EventAck, Message: &gw.DownlinkTXAck{}}
+		assert.True(p.Process(&ack))
+		assert.Nil(ack.MetaData)
+	})
+
+	t.Run("Route", func(t *testing.T) {
+		assert := require.New(t)
+
+		c := conf
+		c.Forwarder.Processors = []config.Processor{{Type: "route"}}
+		c.Forwarder.Processors[0].Route.Destinations = []string{"b"}
+
+		_, err := newPipeline(c, nil)
+		assert.Error(err)
+
+		p, err := newPipeline(c, &routedIntegration{})
+		assert.NoError(err)
+
+		up := processor.Event{Type: integration.EventUp, Message: &gw.UplinkFrame{}}
+		assert.True(p.Process(&up))
+		assert.Equal([]string{"b"}, up.Destinations)
+
+		c.Forwarder.Processors[0].Route.Destinations = []string{"c"}
+		_, err = newPipeline(c, &routedIntegration{})
+		assert.Error(err)
+	})
+}
@@ -0,0 +1,312 @@
+package forwarder
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/brocaar/lorawan"
+)
+
+// Task priorities (a lower value has a higher priority).
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+
+	numPriorities
+)
+
+// Drop policies.
+const (
+	dropOldest = "drop_oldest"
+	dropNewest = "drop_newest"
+	block      = "block"
+)
+
+// task holds a single unit of work.
+type task struct {
+	event string
+	fn    func()
+
+	// noDrop is set for tasks which are not subject to the queue size and
+	// drop policy.
+	noDrop bool
+}
+
+// gatewayQueue holds the queued tasks of a single gateway (per priority).
+type gatewayQueue struct {
+	gatewayID lorawan.EUI64
+	tasks     [numPriorities][]task
+
+	// active is set while a worker is executing a task of this gateway.
+	active bool
+
+	// ready holds the element in the ready list (nil when not ready).
+	ready         *list.Element
+	readyPriority int
+}
+
+func (q *gatewayQueue) len() int {
+	var n int
+	for _, t := range q.tasks {
+		n += len(t)
+	}
+	return n
+}
+
+// droppable returns the number of tasks which count towards the queue size.
+func (q *gatewayQueue) droppable() int {
+	var n int
+	for _, tasks := range q.tasks {
+		for _, t := range tasks {
+			if !t.noDrop {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// dropOldest removes the oldest droppable task with the lowest priority,
+// ignoring the priorities higher than the given minimum. It returns false
+// when there is no such task.
+func (q *gatewayQueue) dropOldest(min int) (task, bool) {
+	for p := numPriorities - 1; p >= min; p-- {
+		for i, t := range q.tasks[p] {
+			if t.noDrop {
+				continue
+			}
+
+			copy(q.tasks[p][i:], q.tasks[p][i+1:])
+			q.tasks[p][len(q.tasks[p])-1] = task{}
+			q.tasks[p] = q.tasks[p][:len(q.tasks[p])-1]
+			return t, true
+		}
+	}
+	return task{}, false
+}
+
+// priority returns the priority of the next task.
+func (q *gatewayQueue) priority() int {
+	for p, t := range q.tasks {
+		if len(t) != 0 {
+			return p
+		}
+	}
+	return numPriorities
+}
+
+func (q *gatewayQueue) pop() task {
+	p := q.priority()
+	t := q.tasks[p][0]
+	q.tasks[p][0] = task{}
+	q.tasks[p] = q.tasks[p][1:]
+	return t
+}
+
+// pool implements a bounded worker pool. Tasks are queued per gateway and
+// the tasks of a single gateway are executed one at a time, in order of
+// priority and (within the same priority) in order of submission. Gateways
+// with a pending high-priority task are served first.
+type pool struct {
+	mux  sync.Mutex
+	cond *sync.Cond
+
+	queueSize  int
+	dropPolicy string
+
+	queues map[lorawan.EUI64]*gatewayQueue
+	ready  [numPriorities]*list.List
+	queued int
+}
+
+// newPool creates a new pool and starts the given number of workers. The
+// queue size is the max. number of queued tasks per gateway. The drop policy
+// defines what happens when a queue is full.
+func newPool(workers, queueSize int, dropPolicy string) (*pool, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("number of workers must be at least 1: %d", workers)
+	}
+	if queueSize < 1 {
+		return nil, fmt.Errorf("queue size must be at least 1: %d", queueSize)
+	}
+
+	switch dropPolicy {
+	case dropOldest, dropNewest, block:
+	default:
+		return nil, fmt.Errorf("unknown drop policy: %s", dropPolicy)
+	}
+
+	p := pool{
+		queueSize:  queueSize,
+		dropPolicy: dropPolicy,
+		queues:     make(map[lorawan.EUI64]*gatewayQueue),
+	}
+	p.cond = sync.NewCond(&p.mux)
+
+	for i := range p.ready {
+		p.ready[i] = list.New()
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+
+	return &p, nil
+}
+
+// submit queues the given func for the given gateway. In case the queue of
+// the gateway is full, the drop policy is applied. The block policy does not
+// apply to high-priority tasks, as these are submitted by goroutines which
+// must not be blocked (e.g. the MQTT command handler), the drop_oldest
+// policy is applied instead.
+func (p *pool) submit(gatewayID lorawan.EUI64, priority int, event string, fn func()) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	q := p.queue(gatewayID)
+
+	if q.droppable() >= p.queueSize {
+		dropPolicy := p.dropPolicy
+		if dropPolicy == block && priority == priorityHigh {
+			dropPolicy = dropOldest
+		}
+
+		switch dropPolicy {
+		case block:
+			blockedCounter(event).Inc()
+			for q.droppable() >= p.queueSize {
+				p.cond.Wait()
+
+				// the queue might have been removed while waiting
+				q = p.queue(gatewayID)
+			}
+		case dropNewest:
+			droppedCounter(event, dropPolicy).Inc()
+			return
+		case dropOldest:
+			// Drop the oldest task of the lowest priority. When the task
+			// to submit has a lower priority itself, it is dropped instead.
+			t, ok := q.dropOldest(priority)
+			if !ok {
+				droppedCounter(event, dropPolicy).Inc()
+				return
+			}
+
+			droppedCounter(t.event, dropPolicy).Inc()
+			p.queued--
+		}
+	}
+
+	p.enqueue(q, priority, task{event: event, fn: fn})
+}
+
+// submitNoDrop queues the given func for the given gateway. Unlike submit,
+// the queue size and drop policy do not apply, this is used for the tasks
+// that must never be lost (e.g. the gateway (un)subscribe).
+func (p *pool) submitNoDrop(gatewayID lorawan.EUI64, priority int, event string, fn func()) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.enqueue(p.queue(gatewayID), priority, task{event: event, fn: fn, noDrop: true})
+}
+
+// enqueue adds the given task to the given queue. The caller must hold the
+// lock.
+func (p *pool) enqueue(q *gatewayQueue, priority int, t task) {
+	q.tasks[priority] = append(q.tasks[priority], t)
+	p.queued++
+	queueLengthGauge().Set(float64(p.queued))
+
+	if !q.active {
+		p.setReady(q)
+	}
+
+	p.cond.Broadcast()
+}
+
+// queue returns the queue of the given gateway, it is created when it does
+// not yet exist.
+func (p *pool) queue(gatewayID lorawan.EUI64) *gatewayQueue {
+	q, ok := p.queues[gatewayID]
+	if !ok {
+		q = &gatewayQueue{gatewayID: gatewayID}
+		p.queues[gatewayID] = q
+	}
+	return q
+}
+
+// setReady adds the given queue to the ready list matching its next task
+// (or moves it when the priority has changed).
+func (p *pool) setReady(q *gatewayQueue) {
+	priority := q.priority()
+
+	if q.ready != nil {
+		if q.readyPriority == priority {
+			return
+		}
+		p.ready[q.readyPriority].Remove(q.ready)
+	}
+
+	q.ready = p.ready[priority].PushBack(q)
+	q.readyPriority = priority
+}
+
+// cleanup removes the given queue when it is empty and inactive.
+func (p *pool) cleanup(q *gatewayQueue) {
+	if !q.active && q.len() == 0 {
+		delete(p.queues, q.gatewayID)
+	}
+}
+
+// next blocks until a task is ready and returns it, together with its queue.
+func (p *pool) next() (*gatewayQueue, task) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for {
+		for _, l := range p.ready {
+			if e := l.Front(); e != nil {
+				q := l.Remove(e).(*gatewayQueue)
+				q.ready = nil
+				q.active = true
+
+				t := q.pop()
+				p.queued--
+				queueLengthGauge().Set(float64(p.queued))
+
+				// wake-up the blocked submitters
+				p.cond.Broadcast()
+
+				return q, t
+			}
+		}
+
+		p.cond.Wait()
+	}
+}
+
+// done marks the execution of the task of the given queue as done.
+func (p *pool) done(q *gatewayQueue) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	q.active = false
+
+	if q.len() != 0 {
+		p.setReady(q)
+		p.cond.Broadcast()
+		return
+	}
+
+	p.cleanup(q)
+}
+
+func (p *pool) worker() {
+	for {
+		q, t := p.next()
+		t.fn()
+		p.done(q)
+	}
+}
@@ -0,0 +1,228 @@
+package forwarder
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+// orderRecorder records the order in which the tasks are executed.
+type orderRecorder struct {
+	sync.Mutex
+	wg    sync.WaitGroup
+	items []string
+}
+
+func (r *orderRecorder) task(name string) func() {
+	r.wg.Add(1)
+	return func() {
+		r.Lock()
+		r.items = append(r.items, name)
+		r.Unlock()
+		r.wg.Done()
+	}
+}
+
+// blockPool submits a task which blocks the single worker (and the queue of
+// the given gateway) until the returned func is called.
+func blockPool(p *pool, gatewayID lorawan.EUI64) func() {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	p.submit(gatewayID, priorityHigh, "block", func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	return func() { close(release) }
+}
+
+func TestPool(t *testing.T) {
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	t.Run("Invalid config", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := newPool(0, 10, dropOldest)
+		assert.Error(err)
+		_, err = newPool(1, 0, dropOldest)
+		assert.Error(err)
+		_, err = newPool(1, 10, "foo")
+		assert.Error(err)
+	})
+
+	t.Run("Ordering per gateway", func(t *testing.T) {
+		assert := require.New(t)
+
+		p, err := newPool(8, 100, dropOldest)
+		assert.NoError(err)
+
+		var r orderRecorder
+		var expected []string
+		for i := 0; i < 100; i++ {
+			name := string(rune('a' + i%26))
+			expected = append(expected, name)
+			p.submit(gatewayID, priorityNormal, "up", r.task(name))
+		}
+
+		r.wg.Wait()
+		assert.Equal(expected, r.items)
+	})
+
+	t.Run("Priority", func(t *testing.T) {
+		assert := require.New(t)
+
+		p, err := newPool(1, 10, dropOldest)
+		assert.NoError(err)
+
+		release := blockPool(p, gatewayID)
+
+		var r orderRecorder
+		p.submit(gatewayID, priorityLow, "stats", r.task("stats"))
+		p.submit(gatewayID, priorityNormal, "up", r.task("up1"))
+		p.submit(gatewayID, priorityHigh, "down", r.task("down"))
+		p.submit(gatewayID, priorityNormal, "up", r.task("up2"))
+
+		// the high priority task of an other gateway is served first
+		p.submit(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, priorityHigh, "ack", r.task("other"))
+
+		release()
+		r.wg.Wait()
+
+		assert.Equal([]string{"other", "down", "up1", "up2", "stats"}, r.items)
+	})
+
+	t.Run("Drop oldest", func(t *testing.T) {
+		assert := require.New(t)
+
+		p, err := newPool(1, 2, dropOldest)
+		assert.NoError(err)
+
+		release := blockPool(p, gatewayID)
+		dropped := testutil.ToFloat64(droppedCounter("stats", dropOldest))
+
+		var r orderRecorder
+		p.submit(gatewayID, priorityLow, "stats", func() { t.Error("stats must be dropped") })
+		p.submit(gatewayID, priorityNormal, "up", r.task("up1"))
+		p.submit(gatewayID, priorityNormal, "up", r.task("up2"))
+
+		// the queue contains items with a higher priority only
+		p.submit(gatewayID, priorityLow, "stats", func() { t.Error("stats must be dropped") })
+
+		release()
+		r.wg.Wait()
+
+		assert.Equal([]string{"up1", "up2"}, r.items)
+		assert.Equal(dropped+2, testutil.ToFloat64(droppedCounter("stats", dropOldest)))
+	})
+
+	t.Run("Drop newest", func(t *testing.T) {
+		assert := require.New(t)
+
+		p, err := newPool(1, 1, dropNewest)
+		assert.NoError(err)
+
+		release := blockPool(p, gatewayID)
+		dropped := testutil.ToFloat64(droppedCounter("up", dropNewest))
+
+		var r orderRecorder
+		p.submit(gatewayID, priorityNormal, "up", r.task("up1"))
+		p.submit(gatewayID, priorityNormal, "up", func() { t.Error("up2 must be dropped") })
+
+		release()
+		r.wg.Wait()
+
+		assert.Equal([]string{"up1"}, r.items)
+		assert.Equal(dropped+1, testutil.ToFloat64(droppedCounter("up", dropNewest)))
+	})
+
+	t.Run("No drop", func(t *testing.T) {
+		for _, policy := range []string{dropOldest, dropNewest, block} {
+			t.Run(policy, func(t *testing.T) {
+				assert := require.New(t)
+
+				p, err := newPool(1, 1, policy)
+				assert.NoError(err)
+
+				release := blockPool(p, gatewayID)
+
+				var r orderRecorder
+				p.submitNoDrop(gatewayID, priorityNormal, "conn", r.task("conn1"))
+				p.submit(gatewayID, priorityNormal, "up", r.task("up"))
+
+				// neither dropped nor blocking, while the queue is full
+				p.submitNoDrop(gatewayID, priorityNormal, "conn", r.task("conn2"))
+
+				release()
+				r.wg.Wait()
+
+				assert.Equal([]string{"conn1", "up", "conn2"}, r.items)
+			})
+		}
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		assert := require.New(t)
+
+		p, err := newPool(1, 1, block)
+		assert.NoError(err)
+
+		release := blockPool(p, gatewayID)
+
+		var r orderRecorder
+		p.submit(gatewayID, priorityNormal, "up", r.task("up1"))
+
+		submitted := make(chan struct{})
+		go func() {
+			p.submit(gatewayID, priorityNormal, "up", r.task("up2"))
+			close(submitted)
+		}()
+
+		select {
+		case <-submitted:
+			t.Fatal("submit must block while the queue is full")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		release()
+		<-submitted
+		r.wg.Wait()
+
+		assert.Equal([]string{"up1", "up2"}, r.items)
+
+		t.Run("Command", func(t *testing.T) {
+			assert := require.New(t)
+
+			dropped := testutil.ToFloat64(droppedCounter("up", dropOldest))
+			release := blockPool(p, gatewayID)
+
+			var r orderRecorder
+			p.submit(gatewayID, priorityNormal, "up", func() { t.Error("up must be dropped") })
+
+			// the command is not blocked, the oldest task is dropped instead
+			submitted := make(chan struct{})
+			go func() {
+				p.submit(gatewayID, priorityHigh, "down", r.task("down"))
+				close(submitted)
+			}()
+
+			select {
+			case <-submitted:
+			case <-time.After(time.Second):
+				t.Fatal("submit of a command must not block")
+			}
+
+			release()
+			r.wg.Wait()
+
+			assert.Equal([]string{"down"}, r.items)
+			assert.Equal(dropped+1, testutil.ToFloat64(droppedCounter("up", dropOldest)))
+		})
+	})
+}
@@ -0,0 +1,539 @@
+package amqp
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+var errNotConnected = errors.New("not connected")
+
+// Backend implements an AMQP integration.
+type Backend struct {
+	sync.RWMutex
+
+	url      string
+	exchange string
+	closed   bool
+
+	conn      *amqp.Connection
+	pubCh     *amqp.Channel
+	cmdCh     *amqp.Channel
+	publisher *publisher
+
+	// These are closed by the AMQP client when the connection or one of
+	// the channels has been closed.
+	connClose chan *amqp.Error
+	pubClose  chan *amqp.Error
+	cmdClose  chan *amqp.Error
+
+	downlinkFrameFunc             func(gw.DownlinkFrame)
+	gatewayConfigurationFunc      func(gw.GatewayConfiguration)
+	gatewayCommandExecRequestFunc func(gw.GatewayCommandExecRequest)
+	rawPacketForwarderCommandFunc func(gw.RawPacketForwarderCommand)
+
+	gateways map[lorawan.EUI64]struct{}
+
+	eventRoutingKeyTemplate   *template.Template
+	commandRoutingKeyTemplate *template.Template
+	commandQueueNameTemplate  *template.Template
+
+	marshaler marshaler.Marshaler
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.Config) (*Backend, error) {
+	var err error
+
+	b := Backend{
+		url:      conf.Integration.AMQP.URL,
+		exchange: conf.Integration.AMQP.Exchange,
+		gateways: make(map[lorawan.EUI64]struct{}),
+	}
+
+	b.marshaler, err = marshaler.New(conf.Integration.Marshaler)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/amqp: new marshaler error")
+	}
+
+	b.eventRoutingKeyTemplate, err = template.New("event").Parse(conf.Integration.AMQP.EventRoutingKeyTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/amqp: parse event routing-key template error")
+	}
+
+	b.commandRoutingKeyTemplate, err = template.New("command").Parse(conf.Integration.AMQP.CommandRoutingKeyTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/amqp: parse command routing-key template error")
+	}
+
+	b.commandQueueNameTemplate, err = template.New("queue").Parse(conf.Integration.AMQP.CommandQueueNameTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/amqp: parse command queue-name template error")
+	}
+
+	return &b, nil
+}
+
+// Start starts the integration.
+func (b *Backend) Start() error {
+	b.connectLoop()
+	go b.reconnectLoop()
+	return nil
+}
+
+// Stop stops the integration.
+func (b *Backend) Stop() error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.closed = true
+
+	if b.conn != nil {
+		return b.conn.Close()
+	}
+
+	return nil
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func.
+func (b *Backend) SetDownlinkFrameFunc(f func(gw.DownlinkFrame)) {
+	b.downlinkFrameFunc = f
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func.
+func (b *Backend) SetGatewayConfigurationFunc(f func(gw.GatewayConfiguration)) {
+	b.gatewayConfigurationFunc = f
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler func.
+func (b *Backend) SetGatewayCommandExecRequestFunc(f func(gw.GatewayCommandExecRequest)) {
+	b.gatewayCommandExecRequestFunc = f
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler func.
+func (b *Backend) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderCommand)) {
+	b.rawPacketForwarderCommandFunc = f
+}
+
+// SetGatewaySubscription creates and consumes (subscribe) or deletes
+// (unsubscribe) the command queue of the given gateway. When this fails
+// because of a connection error, the subscription will be retried after
+// re-connecting.
+func (b *Backend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	b.Lock()
+	defer b.Unlock()
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"subscribe":  subscribe,
+	}).Debug("integration/amqp: set gateway subscription called")
+
+	_, ok := b.gateways[gatewayID]
+	if ok == subscribe {
+		return nil
+	}
+
+	if subscribe {
+		b.gateways[gatewayID] = struct{}{}
+		if err := b.subscribeGateway(gatewayID); err != nil {
+			return errors.Wrap(err, "integration/amqp: subscribe gateway error")
+		}
+	} else {
+		delete(b.gateways, gatewayID)
+		if err := b.unsubscribeGateway(gatewayID); err != nil {
+			return errors.Wrap(err, "integration/amqp: unsubscribe gateway error")
+		}
+	}
+
+	return nil
+}
+
+// PublishEvent publishes the given event and waits for the publisher
+// confirmation. Events can be published concurrently, the confirmations are
+// tracked by delivery tag.
+func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	amqpEventCounter(event).Inc()
+	idPrefix := map[string]string{
+		"up":     "uplink_",
+		"up_set": "uplink_",
+		"ack":    "downlink_",
+		"stats":  "stats_",
+		"exec":   "exec_",
+		"raw":    "raw_",
+		"conn":   "conn_",
+	}
+
+	routingKey := bytes.NewBuffer(nil)
+	if err := b.eventRoutingKeyTemplate.Execute(routingKey, struct {
+		GatewayID lorawan.EUI64
+		EventType string
+	}{gatewayID, event}); err != nil {
+		return errors.Wrap(err, "execute event routing-key template error")
+	}
+
+	body, err := b.marshaler.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal message error")
+	}
+
+	log.WithFields(log.Fields{
+		idPrefix[event] + "id": id,
+		"exchange":             b.exchange,
+		"routing_key":          routingKey.String(),
+		"event":                event,
+	}).Info("integration/amqp: publishing event")
+
+	b.RLock()
+	pub := b.publisher
+	b.RUnlock()
+
+	if pub == nil {
+		return errNotConnected
+	}
+
+	confirmed, err := pub.publish(b.exchange, routingKey.String(), amqp.Publishing{
+		ContentType:  b.marshaler.ContentType(),
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	if err != nil {
+		return errors.Wrap(err, "publish event error")
+	}
+
+	if ack := <-confirmed; !ack {
+		return errors.New("event was not confirmed by the server")
+	}
+
+	return nil
+}
+
+func (b *Backend) connect() error {
+	b.Lock()
+	defer b.Unlock()
+
+	conn, err := amqp.Dial(b.url)
+	if err != nil {
+		return errors.Wrap(err, "dial error")
+	}
+
+	pubCh, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "open publish channel error")
+	}
+
+	if err := pubCh.Confirm(false); err != nil {
+		conn.Close()
+		return errors.Wrap(err, "enable publisher confirms error")
+	}
+
+	if err := pubCh.ExchangeDeclare(b.exchange, "topic", true, false, false, false, nil); err != nil {
+		conn.Close()
+		return errors.Wrap(err, "declare exchange error")
+	}
+
+	cmdCh, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "open command channel error")
+	}
+
+	b.conn = conn
+	b.pubCh = pubCh
+	b.cmdCh = cmdCh
+	b.publisher = newPublisher(pubCh, pubCh.NotifyPublish(make(chan amqp.Confirmation, 1)))
+	b.connClose = conn.NotifyClose(make(chan *amqp.Error, 1))
+	b.pubClose = pubCh.NotifyClose(make(chan *amqp.Error, 1))
+	b.cmdClose = cmdCh.NotifyClose(make(chan *amqp.Error, 1))
+
+	amqpConnectCounter().Inc()
+	log.WithField("exchange", b.exchange).Info("integration/amqp: connected to amqp server")
+
+	for gatewayID := range b.gateways {
+		if err := b.subscribeGateway(gatewayID); err != nil {
+			conn.Close()
+			return errors.Wrap(err, "subscribe gateway error")
+		}
+	}
+
+	return nil
+}
+
+// connectLoop blocks until the client is connected or the integration
+// has been stopped.
+func (b *Backend) connectLoop() {
+	for {
+		if b.isClosed() {
+			return
+		}
+
+		if err := b.connect(); err != nil {
+			log.WithError(err).Error("integration/amqp: connection error")
+			time.Sleep(time.Second * 2)
+			continue
+		}
+
+		return
+	}
+}
+
+// reconnectLoop re-connects when the connection or one of the channels
+// has been closed. A closed channel (e.g. because of a channel exception)
+// closes the connection as well, so that everything is set up again.
+func (b *Backend) reconnectLoop() {
+	for {
+		if b.isClosed() {
+			return
+		}
+
+		b.RLock()
+		connClose, pubClose, cmdClose := b.connClose, b.pubClose, b.cmdClose
+		b.RUnlock()
+
+		var err *amqp.Error
+		select {
+		case err = <-connClose:
+		case err = <-pubClose:
+		case err = <-cmdClose:
+		}
+
+		if b.isClosed() {
+			return
+		}
+
+		amqpDisconnectCounter().Inc()
+		log.WithError(err).Error("integration/amqp: connection closed")
+
+		b.Lock()
+		b.conn.Close()
+		b.pubCh = nil
+		b.cmdCh = nil
+		b.publisher = nil
+		b.Unlock()
+
+		b.connectLoop()
+	}
+}
+
+func (b *Backend) isClosed() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.closed
+}
+
+func (b *Backend) executeTemplate(t *template.Template, gatewayID lorawan.EUI64) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := t.Execute(buf, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// subscribeGateway declares and binds the command queue of the given
+// gateway and starts consuming it. It must be called while holding the lock.
+func (b *Backend) subscribeGateway(gatewayID lorawan.EUI64) error {
+	if b.cmdCh == nil {
+		return errNotConnected
+	}
+
+	queueName, err := b.executeTemplate(b.commandQueueNameTemplate, gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "execute command queue-name template error")
+	}
+
+	routingKey, err := b.executeTemplate(b.commandRoutingKeyTemplate, gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "execute command routing-key template error")
+	}
+
+	log.WithFields(log.Fields{
+		"queue":       queueName,
+		"routing_key": routingKey,
+	}).Info("integration/amqp: consuming command queue")
+
+	if _, err := b.cmdCh.QueueDeclare(queueName, true, false, false, false, nil); err != nil {
+		return errors.Wrap(err, "declare queue error")
+	}
+
+	if err := b.cmdCh.QueueBind(queueName, routingKey, b.exchange, false, nil); err != nil {
+		return errors.Wrap(err, "bind queue error")
+	}
+
+	deliveries, err := b.cmdCh.Consume(queueName, queueName, true, false, false, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "consume queue error")
+	}
+
+	go func() {
+		for d := range deliveries {
+			b.handleCommand(d.RoutingKey, d.Body)
+		}
+	}()
+
+	return nil
+}
+
+// unsubscribeGateway stops consuming and deletes the command queue of the
+// given gateway. It must be called while holding the lock.
+func (b *Backend) unsubscribeGateway(gatewayID lorawan.EUI64) error {
+	if b.cmdCh == nil {
+		return errNotConnected
+	}
+
+	queueName, err := b.executeTemplate(b.commandQueueNameTemplate, gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "execute command queue-name template error")
+	}
+
+	log.WithFields(log.Fields{
+		"queue": queueName,
+	}).Info("integration/amqp: deleting command queue")
+
+	if err := b.cmdCh.Cancel(queueName, false); err != nil {
+		return errors.Wrap(err, "cancel consumer error")
+	}
+
+	if _, err := b.cmdCh.QueueDelete(queueName, false, false, false); err != nil {
+		return errors.Wrap(err, "delete queue error")
+	}
+
+	return nil
+}
+
+func (b *Backend) handleCommand(routingKey string, body []byte) {
+	switch getCommandType(routingKey) {
+	case "down":
+		amqpCommandCounter("down").Inc()
+		b.handleDownlinkFrame(routingKey, body)
+	case "config":
+		amqpCommandCounter("config").Inc()
+		b.handleGatewayConfiguration(routingKey, body)
+	case "exec":
+		amqpCommandCounter("exec").Inc()
+		b.handleGatewayCommandExecRequest(routingKey, body)
+	case "raw":
+		amqpCommandCounter("raw").Inc()
+		b.handleRawPacketForwarderCommand(routingKey, body)
+	default:
+		log.WithFields(log.Fields{
+			"routing_key": routingKey,
+		}).Warning("integration/amqp: unexpected command received")
+	}
+}
+
+func (b *Backend) handleDownlinkFrame(routingKey string, body []byte) {
+	var downlinkFrame gw.DownlinkFrame
+	if err := b.marshaler.Unmarshal(body, &downlinkFrame); err != nil {
+		log.WithFields(log.Fields{
+			"routing_key": routingKey,
+		}).WithError(err).Error("integration/amqp: unmarshal downlink frame error")
+		return
+	}
+
+	var downID uuid.UUID
+	copy(downID[:], downlinkFrame.GetDownlinkId())
+
+	if len(downlinkFrame.Items) == 0 {
+		log.WithFields(log.Fields{
+			"downlink_id": downID,
+		}).Error("integration/amqp: downlink must have at least one item")
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], downlinkFrame.GatewayId)
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": downID,
+	}).Info("integration/amqp: downlink frame received")
+
+	if b.downlinkFrameFunc != nil {
+		b.downlinkFrameFunc(downlinkFrame)
+	}
+}
+
+func (b *Backend) handleGatewayConfiguration(routingKey string, body []byte) {
+	log.WithFields(log.Fields{
+		"routing_key": routingKey,
+	}).Info("integration/amqp: gateway configuration received")
+
+	var gatewayConfig gw.GatewayConfiguration
+	if err := b.marshaler.Unmarshal(body, &gatewayConfig); err != nil {
+		log.WithError(err).Error("integration/amqp: unmarshal gateway configuration error")
+		return
+	}
+
+	if b.gatewayConfigurationFunc != nil {
+		b.gatewayConfigurationFunc(gatewayConfig)
+	}
+}
+
+func (b *Backend) handleGatewayCommandExecRequest(routingKey string, body []byte) {
+	var gatewayCommandExecRequest gw.GatewayCommandExecRequest
+	if err := b.marshaler.Unmarshal(body, &gatewayCommandExecRequest); err != nil {
+		log.WithFields(log.Fields{
+			"routing_key": routingKey,
+		}).WithError(err).Error("integration/amqp: unmarshal gateway command execution request error")
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	var execID uuid.UUID
+	copy(gatewayID[:], gatewayCommandExecRequest.GetGatewayId())
+	copy(execID[:], gatewayCommandExecRequest.GetExecId())
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"exec_id":    execID,
+	}).Info("integration/amqp: gateway command execution request received")
+
+	if b.gatewayCommandExecRequestFunc != nil {
+		b.gatewayCommandExecRequestFunc(gatewayCommandExecRequest)
+	}
+}
+
+func (b *Backend) handleRawPacketForwarderCommand(routingKey string, body []byte) {
+	var rawPacketForwarderCommand gw.RawPacketForwarderCommand
+	if err := b.marshaler.Unmarshal(body, &rawPacketForwarderCommand); err != nil {
+		log.WithFields(log.Fields{
+			"routing_key": routingKey,
+		}).WithError(err).Error("integration/amqp: unmarshal raw packet-forwarder command error")
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	var rawID uuid.UUID
+	copy(gatewayID[:], rawPacketForwarderCommand.GetGatewayId())
+	copy(rawID[:], rawPacketForwarderCommand.GetRawId())
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"raw_id":     rawID,
+	}).Info("integration/amqp: raw packet-forwarder command received")
+
+	if b.rawPacketForwarderCommandFunc != nil {
+		b.rawPacketForwarderCommandFunc(rawPacketForwarderCommand)
+	}
+}
+
+// getCommandType returns the command type, which is the last part of the
+// (dot separated) routing-key.
+func getCommandType(routingKey string) string {
+	parts := strings.Split(routingKey, ".")
+	return parts[len(parts)-1]
+}
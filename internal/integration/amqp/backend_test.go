@@ -0,0 +1,217 @@
+package amqp
+
+import (
+	"os"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+type AMQPBackendTestSuite struct {
+	suite.Suite
+
+	amqpConn  *amqp.Connection
+	amqpCh    *amqp.Channel
+	backend   *Backend
+	gatewayID lorawan.EUI64
+	json      marshaler.JSON
+}
+
+func (ts *AMQPBackendTestSuite) SetupSuite() {
+	assert := require.New(ts.T())
+
+	log.SetLevel(log.ErrorLevel)
+
+	// The AMQP tests require a RabbitMQ server, e.g. the one from the
+	// docker-compose.yml file.
+	url := os.Getenv("TEST_AMQP_URL")
+	if url == "" {
+		ts.T().Skip("TEST_AMQP_URL is not set")
+	}
+
+	var err error
+	ts.amqpConn, err = amqp.Dial(url)
+	assert.NoError(err)
+
+	ts.amqpCh, err = ts.amqpConn.Channel()
+	assert.NoError(err)
+
+	ts.gatewayID = lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.AMQP.URL = url
+	conf.Integration.AMQP.Exchange = "amq.topic"
+	conf.Integration.AMQP.EventRoutingKeyTemplate = "gateway.{{ .GatewayID }}.event.{{ .EventType }}"
+	conf.Integration.AMQP.CommandRoutingKeyTemplate = "gateway.{{ .GatewayID }}.command.*"
+	conf.Integration.AMQP.CommandQueueNameTemplate = "gateway.{{ .GatewayID }}.command"
+
+	ts.backend, err = NewBackend(conf)
+	assert.NoError(err)
+	assert.NoError(ts.backend.Start())
+	assert.NoError(ts.backend.SetGatewaySubscription(true, ts.gatewayID))
+}
+
+func (ts *AMQPBackendTestSuite) TearDownSuite() {
+	if ts.backend == nil {
+		return
+	}
+
+	assert := require.New(ts.T())
+	assert.NoError(ts.backend.SetGatewaySubscription(false, ts.gatewayID))
+	assert.NoError(ts.backend.Stop())
+	ts.amqpConn.Close()
+}
+
+func (ts *AMQPBackendTestSuite) publishCommand(command string, msg proto.Message) {
+	assert := require.New(ts.T())
+
+	b, err := ts.json.Marshal(msg)
+	assert.NoError(err)
+
+	assert.NoError(ts.amqpCh.Publish("amq.topic", "gateway.0807060504030201.command."+command, false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        b,
+	}))
+}
+
+func (ts *AMQPBackendTestSuite) TestPublishEvent() {
+	assert := require.New(ts.T())
+
+	q, err := ts.amqpCh.QueueDeclare("", false, true, true, false, nil)
+	assert.NoError(err)
+	assert.NoError(ts.amqpCh.QueueBind(q.Name, "gateway.*.event.*", "amq.topic", false, nil))
+
+	deliveries, err := ts.amqpCh.Consume(q.Name, "", true, true, false, false, nil)
+	assert.NoError(err)
+
+	id, err := uuid.NewV4()
+	assert.NoError(err)
+
+	uplink := gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3, 4},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: ts.gatewayID[:],
+			UplinkId:  id[:],
+		},
+	}
+	assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "up", id, &uplink))
+
+	d := <-deliveries
+	assert.Equal("gateway.0807060504030201.event.up", d.RoutingKey)
+	assert.Equal("application/json", d.ContentType)
+
+	var received gw.UplinkFrame
+	assert.NoError(ts.json.Unmarshal(d.Body, &received))
+	assert.True(proto.Equal(&uplink, &received))
+}
+
+func (ts *AMQPBackendTestSuite) TestDownlinkFrame() {
+	assert := require.New(ts.T())
+
+	downlinkFrameChan := make(chan gw.DownlinkFrame, 1)
+	ts.backend.SetDownlinkFrameFunc(func(pl gw.DownlinkFrame) {
+		downlinkFrameChan <- pl
+	})
+
+	downlink := gw.DownlinkFrame{
+		GatewayId: ts.gatewayID[:],
+		Token:     1234,
+		Items: []*gw.DownlinkFrameItem{
+			{PhyPayload: []byte{1, 2, 3, 4}},
+		},
+	}
+	ts.publishCommand("down", &downlink)
+
+	received := <-downlinkFrameChan
+	assert.True(proto.Equal(&downlink, &received))
+}
+
+func (ts *AMQPBackendTestSuite) TestGatewayConfiguration() {
+	assert := require.New(ts.T())
+
+	gatewayConfigurationChan := make(chan gw.GatewayConfiguration, 1)
+	ts.backend.SetGatewayConfigurationFunc(func(pl gw.GatewayConfiguration) {
+		gatewayConfigurationChan <- pl
+	})
+
+	gatewayConfig := gw.GatewayConfiguration{
+		GatewayId: ts.gatewayID[:],
+		Version:   "1.2.3",
+	}
+	ts.publishCommand("config", &gatewayConfig)
+
+	received := <-gatewayConfigurationChan
+	assert.True(proto.Equal(&gatewayConfig, &received))
+}
+
+func (ts *AMQPBackendTestSuite) TestGatewayCommandExecRequest() {
+	assert := require.New(ts.T())
+
+	execChan := make(chan gw.GatewayCommandExecRequest, 1)
+	ts.backend.SetGatewayCommandExecRequestFunc(func(pl gw.GatewayCommandExecRequest) {
+		execChan <- pl
+	})
+
+	execReq := gw.GatewayCommandExecRequest{
+		GatewayId: ts.gatewayID[:],
+		Command:   "reboot",
+		ExecId:    []byte{1, 2, 3, 4},
+	}
+	ts.publishCommand("exec", &execReq)
+
+	received := <-execChan
+	assert.True(proto.Equal(&execReq, &received))
+}
+
+func (ts *AMQPBackendTestSuite) TestRawPacketForwarderCommand() {
+	assert := require.New(ts.T())
+
+	rawChan := make(chan gw.RawPacketForwarderCommand, 1)
+	ts.backend.SetRawPacketForwarderCommandFunc(func(pl gw.RawPacketForwarderCommand) {
+		rawChan <- pl
+	})
+
+	raw := gw.RawPacketForwarderCommand{
+		GatewayId: ts.gatewayID[:],
+		RawId:     []byte{1, 2, 3, 4},
+		Payload:   []byte{5, 6, 7, 8},
+	}
+	ts.publishCommand("raw", &raw)
+
+	received := <-rawChan
+	assert.True(proto.Equal(&raw, &received))
+}
+
+func TestAMQPBackend(t *testing.T) {
+	suite.Run(t, new(AMQPBackendTestSuite))
+}
+
+func TestGetCommandType(t *testing.T) {
+	tests := []struct {
+		RoutingKey string
+		Expected   string
+	}{
+		{"gateway.0102030405060708.command.down", "down"},
+		{"gateway.0102030405060708.command.config", "config"},
+		{"gateway.0102030405060708.command.exec", "exec"},
+		{"raw", "raw"},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.RoutingKey, func(t *testing.T) {
+			assert := require.New(t)
+			assert.Equal(tst.Expected, getCommandType(tst.RoutingKey))
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package amqp
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// publishChannel defines the interface of the AMQP channel used for
+// publishing.
+type publishChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// publisher publishes messages to a channel in confirm mode. It keeps track
+// of the publisher confirmations by delivery tag, so that a publish does not
+// have to wait for the confirmation of the previous publish.
+type publisher struct {
+	// pubMux guards the publishing and the delivery tag, so that the
+	// delivery tags are assigned in the same order as the publishes.
+	pubMux      sync.Mutex
+	ch          publishChannel
+	deliveryTag uint64
+
+	// pendingMux guards the pending confirmations. It is never held while
+	// publishing, as the AMQP client blocks a publish until the previous
+	// confirmation has been read.
+	pendingMux sync.Mutex
+	pending    map[uint64]chan bool
+	closed     bool
+}
+
+// newPublisher creates a new publisher. The confirms channel must be the
+// channel returned by NotifyPublish of the given channel.
+func newPublisher(ch publishChannel, confirms chan amqp.Confirmation) *publisher {
+	p := publisher{
+		ch:      ch,
+		pending: make(map[uint64]chan bool),
+	}
+
+	go p.handleConfirms(confirms)
+
+	return &p
+}
+
+// publish publishes the given message and returns a channel which receives
+// true when the message has been confirmed by the server and false when the
+// message was not confirmed or the channel has been closed.
+func (p *publisher) publish(exchange, key string, msg amqp.Publishing) (chan bool, error) {
+	p.pubMux.Lock()
+	defer p.pubMux.Unlock()
+
+	// the confirmation is registered before publishing, as it might
+	// arrive before Publish returns
+	tag := p.deliveryTag + 1
+	confirmed := make(chan bool, 1)
+
+	p.pendingMux.Lock()
+	if p.closed {
+		p.pendingMux.Unlock()
+		return nil, errNotConnected
+	}
+	p.pending[tag] = confirmed
+	p.pendingMux.Unlock()
+
+	if err := p.ch.Publish(exchange, key, false, false, msg); err != nil {
+		p.pendingMux.Lock()
+		delete(p.pending, tag)
+		p.pendingMux.Unlock()
+		return nil, err
+	}
+
+	// the delivery tag is only incremented by the AMQP client on a
+	// successful publish
+	p.deliveryTag = tag
+
+	return confirmed, nil
+}
+
+// handleConfirms dispatches the confirmations until the confirms channel
+// has been closed, after which all pending publishes are not confirmed.
+func (p *publisher) handleConfirms(confirms chan amqp.Confirmation) {
+	for c := range confirms {
+		p.pendingMux.Lock()
+		confirmed, ok := p.pending[c.DeliveryTag]
+		delete(p.pending, c.DeliveryTag)
+		p.pendingMux.Unlock()
+
+		if ok {
+			confirmed <- c.Ack
+		}
+	}
+
+	p.pendingMux.Lock()
+	defer p.pendingMux.Unlock()
+
+	p.closed = true
+	for tag, confirmed := range p.pending {
+		confirmed <- false
+		delete(p.pending, tag)
+	}
+}
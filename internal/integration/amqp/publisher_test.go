@@ -0,0 +1,67 @@
+package amqp
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+)
+
+type testChannel struct {
+	sync.Mutex
+	keys []string
+	err  error
+}
+
+func (c *testChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	c.keys = append(c.keys, key)
+	return nil
+}
+
+func TestPublisher(t *testing.T) {
+	assert := require.New(t)
+
+	ch := testChannel{}
+	confirms := make(chan amqp.Confirmation)
+	p := newPublisher(&ch, confirms)
+
+	// publishes do not wait for the confirmation of the previous publish
+	c1, err := p.publish("exchange", "a", amqp.Publishing{})
+	assert.NoError(err)
+	c2, err := p.publish("exchange", "b", amqp.Publishing{})
+	assert.NoError(err)
+	c3, err := p.publish("exchange", "c", amqp.Publishing{})
+	assert.NoError(err)
+	assert.Equal([]string{"a", "b", "c"}, ch.keys)
+
+	// a failed publish does not consume a delivery tag
+	ch.err = errors.New("publish error")
+	_, err = p.publish("exchange", "d", amqp.Publishing{})
+	assert.Error(err)
+	ch.err = nil
+
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	assert.True(<-c1)
+	assert.False(<-c2)
+
+	c4, err := p.publish("exchange", "e", amqp.Publishing{})
+	assert.NoError(err)
+	confirms <- amqp.Confirmation{DeliveryTag: 4, Ack: true}
+	assert.True(<-c4)
+
+	// closing the channel does not confirm the pending publishes
+	close(confirms)
+	assert.False(<-c3)
+
+	_, err = p.publish("exchange", "f", amqp.Publishing{})
+	assert.Equal(errNotConnected, err)
+}
@@ -0,0 +1,583 @@
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+// maxBodySize defines the max. size of a command request body.
+const maxBodySize = 1024 * 1024
+
+// maxRequestAge defines the max. age (based on the X-Timestamp header) of a
+// command request. Older requests are rejected, as are requests with a
+// signature that has already been seen. As the timestamp can also be up to
+// maxRequestAge in the future, signatures are remembered for twice this
+// interval.
+const maxRequestAge = 5 * time.Minute
+
+// maxPendingRetries defines the max. number of event requests that are
+// being retried in the background. When exceeded, failed requests are not
+// retried.
+const maxPendingRetries = 1000
+
+// Backend implements a HTTP integration. Events are posted to the
+// configured URLs and commands are received through a HTTP endpoint.
+type Backend struct {
+	sync.RWMutex
+
+	eventURLs     []string
+	maxRetries    int
+	retryDelay    time.Duration
+	signingSecret []byte
+	tlsCert       string
+	tlsKey        string
+
+	client   *http.Client
+	server   *http.Server
+	ln       net.Listener
+	isClosed bool
+	done     chan struct{}
+	retries  chan struct{}
+	wg       sync.WaitGroup
+
+	downlinkFrameFunc             func(gw.DownlinkFrame)
+	gatewayConfigurationFunc      func(gw.GatewayConfiguration)
+	gatewayCommandExecRequestFunc func(gw.GatewayCommandExecRequest)
+	rawPacketForwarderCommandFunc func(gw.RawPacketForwarderCommand)
+
+	gateways   map[lorawan.EUI64]struct{}
+	signatures *cache.Cache
+	marshaler  marshaler.Marshaler
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.Config) (*Backend, error) {
+	var err error
+
+	b := Backend{
+		eventURLs:     conf.Integration.HTTP.EventURLs,
+		maxRetries:    conf.Integration.HTTP.MaxRetries,
+		retryDelay:    conf.Integration.HTTP.RetryDelay,
+		signingSecret: []byte(conf.Integration.HTTP.SigningSecret),
+		tlsCert:       conf.Integration.HTTP.TLSCert,
+		tlsKey:        conf.Integration.HTTP.TLSKey,
+		client: &http.Client{
+			Timeout: conf.Integration.HTTP.Timeout,
+		},
+		done:       make(chan struct{}),
+		retries:    make(chan struct{}, maxPendingRetries),
+		gateways:   make(map[lorawan.EUI64]struct{}),
+		signatures: cache.New(2*maxRequestAge, maxRequestAge),
+	}
+
+	b.marshaler, err = marshaler.New(conf.Integration.Marshaler)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/http: new marshaler error")
+	}
+
+	if conf.Integration.HTTP.Bind != "" {
+		// the command endpoint must never be exposed without authentication
+		if len(b.signingSecret) == 0 {
+			return nil, errors.New("integration/http: signing_secret must be set when bind is set")
+		}
+
+		b.ln, err = net.Listen("tcp", conf.Integration.HTTP.Bind)
+		if err != nil {
+			return nil, errors.Wrap(err, "integration/http: create listener error")
+		}
+
+		b.server = &http.Server{
+			Handler: &b,
+		}
+	}
+
+	return &b, nil
+}
+
+// Start starts the command endpoint (if configured).
+func (b *Backend) Start() error {
+	if b.server == nil {
+		return nil
+	}
+
+	go func() {
+		log.WithFields(log.Fields{
+			"bind":     b.ln.Addr(),
+			"tls_cert": b.tlsCert,
+			"tls_key":  b.tlsKey,
+		}).Info("integration/http: starting command endpoint")
+
+		var err error
+		if b.tlsCert == "" && b.tlsKey == "" {
+			err = b.server.Serve(b.ln)
+		} else {
+			err = b.server.ServeTLS(b.ln, b.tlsCert, b.tlsKey)
+		}
+
+		if err != nil && !b.closed() {
+			log.WithError(err).Fatal("integration/http: server error")
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the integration. Pending retries are aborted.
+func (b *Backend) Stop() error {
+	b.Lock()
+	if !b.isClosed {
+		b.isClosed = true
+		close(b.done)
+	}
+	b.Unlock()
+
+	var err error
+	if b.server != nil {
+		err = b.server.Close()
+	}
+
+	b.wg.Wait()
+
+	return err
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func.
+func (b *Backend) SetDownlinkFrameFunc(f func(gw.DownlinkFrame)) {
+	b.downlinkFrameFunc = f
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func.
+func (b *Backend) SetGatewayConfigurationFunc(f func(gw.GatewayConfiguration)) {
+	b.gatewayConfigurationFunc = f
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler func.
+func (b *Backend) SetGatewayCommandExecRequestFunc(f func(gw.GatewayCommandExecRequest)) {
+	b.gatewayCommandExecRequestFunc = f
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler func.
+func (b *Backend) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderCommand)) {
+	b.rawPacketForwarderCommandFunc = f
+}
+
+// SetGatewaySubscription (un)subscribes the given gateway. Commands are only
+// accepted for subscribed gateways.
+func (b *Backend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	b.Lock()
+	defer b.Unlock()
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"subscribe":  subscribe,
+	}).Debug("integration/http: set gateway subscription called")
+
+	if subscribe {
+		b.gateways[gatewayID] = struct{}{}
+	} else {
+		delete(b.gateways, gatewayID)
+	}
+
+	return nil
+}
+
+// PublishEvent posts the given event to each of the configured event URLs.
+// Failed requests that can be retried are retried in the background, so
+// that the publishing of the following events is not blocked.
+func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	httpEventCounter(event).Inc()
+	idPrefix := map[string]string{
+		"up":     "uplink_",
+		"up_set": "uplink_",
+		"ack":    "downlink_",
+		"stats":  "stats_",
+		"exec":   "exec_",
+		"raw":    "raw_",
+		"conn":   "conn_",
+	}
+
+	body, err := b.marshaler.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal message error")
+	}
+
+	var errs []string
+	for _, url := range b.eventURLs {
+		log.WithFields(log.Fields{
+			idPrefix[event] + "id": id,
+			"gateway_id":           gatewayID,
+			"event":                event,
+			"url":                  url,
+		}).Info("integration/http: publishing event")
+
+		retry, err := b.post(url, gatewayID, event, body)
+		if err == nil {
+			continue
+		}
+
+		if retry && b.retryInBackground(url, gatewayID, event, body, err) {
+			continue
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: %s", url, err))
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("post event error: %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// retryInBackground retries posting the given body to the given URL in
+// the background, with an increasing delay between the retries. It returns
+// false when the request can not be retried, e.g. because the max. number
+// of pending retries has been reached.
+func (b *Backend) retryInBackground(url string, gatewayID lorawan.EUI64, event string, body []byte, err error) bool {
+	if b.maxRetries <= 0 {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.isClosed {
+		return false
+	}
+
+	select {
+	case b.retries <- struct{}{}:
+	default:
+		return false
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() { <-b.retries }()
+
+		delay := b.retryDelay
+
+		for i := 0; i < b.maxRetries; i++ {
+			log.WithError(err).WithFields(log.Fields{
+				"url":   url,
+				"delay": delay,
+			}).Warning("integration/http: post event error, retrying")
+
+			select {
+			case <-b.done:
+				return
+			case <-time.After(delay):
+			}
+
+			httpRetryCounter().Inc()
+
+			var retry bool
+			retry, err = b.post(url, gatewayID, event, body)
+			if err == nil {
+				return
+			}
+			if !retry {
+				break
+			}
+
+			delay = delay * 2
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"url":        url,
+			"gateway_id": gatewayID,
+			"event":      event,
+		}).Error("integration/http: post event error")
+	}()
+
+	return true
+}
+
+// post posts the given body to the given URL. It returns true when the
+// request can be retried.
+func (b *Backend) post(url string, gatewayID lorawan.EUI64, event string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "new request error")
+	}
+
+	// the path as seen by the receiver
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", b.marshaler.ContentType())
+	req.Header.Set("X-Gateway-ID", gatewayID.String())
+	req.Header.Set("X-Event", event)
+	if len(b.signingSecret) != 0 {
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set("X-Signature", sign(b.signingSecret, req.Method, path, gatewayID, timestamp, body))
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "http request error")
+	}
+	defer resp.Body.Close()
+
+	// read the response body, so that the connection can be re-used
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("expected 2xx response, got: %d", resp.StatusCode)
+	}
+
+	return false, nil
+}
+
+// ServeHTTP handles the command requests. The expected path is
+// /gateway/{GatewayID}/command/{CommandType}. Each request must be signed
+// and must not be older than maxRequestAge.
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "gateway" || parts[2] != "command" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(parts[1])); err != nil {
+		http.Error(w, "invalid gateway id", http.StatusBadRequest)
+		return
+	}
+	command := parts[3]
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "read body error", http.StatusBadRequest)
+		return
+	}
+
+	if err := b.validateSignature(r, gatewayID, body); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Warning("integration/http: command with invalid signature received")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	b.RLock()
+	_, ok := b.gateways[gatewayID]
+	b.RUnlock()
+	if !ok {
+		http.Error(w, "gateway is not connected", http.StatusNotFound)
+		return
+	}
+
+	switch command {
+	case "down":
+		err = b.handleDownlinkFrame(gatewayID, body)
+	case "config":
+		err = b.handleGatewayConfiguration(gatewayID, body)
+	case "exec":
+		err = b.handleGatewayCommandExecRequest(gatewayID, body)
+	case "raw":
+		err = b.handleRawPacketForwarderCommand(gatewayID, body)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"command":    command,
+		}).Error("integration/http: handle command error")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	httpCommandCounter(command).Inc()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (b *Backend) handleDownlinkFrame(gatewayID lorawan.EUI64, body []byte) error {
+	var downlinkFrame gw.DownlinkFrame
+	if err := b.marshaler.Unmarshal(body, &downlinkFrame); err != nil {
+		return errors.Wrap(err, "unmarshal downlink frame error")
+	}
+
+	if err := setGatewayID(gatewayID, &downlinkFrame.GatewayId); err != nil {
+		return err
+	}
+
+	if len(downlinkFrame.Items) == 0 {
+		return errors.New("downlink must have at least one item")
+	}
+
+	var downID uuid.UUID
+	copy(downID[:], downlinkFrame.GetDownlinkId())
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": downID,
+	}).Info("integration/http: downlink frame received")
+
+	if b.downlinkFrameFunc != nil {
+		b.downlinkFrameFunc(downlinkFrame)
+	}
+
+	return nil
+}
+
+func (b *Backend) handleGatewayConfiguration(gatewayID lorawan.EUI64, body []byte) error {
+	var gatewayConfig gw.GatewayConfiguration
+	if err := b.marshaler.Unmarshal(body, &gatewayConfig); err != nil {
+		return errors.Wrap(err, "unmarshal gateway configuration error")
+	}
+
+	if err := setGatewayID(gatewayID, &gatewayConfig.GatewayId); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+	}).Info("integration/http: gateway configuration received")
+
+	if b.gatewayConfigurationFunc != nil {
+		b.gatewayConfigurationFunc(gatewayConfig)
+	}
+
+	return nil
+}
+
+func (b *Backend) handleGatewayCommandExecRequest(gatewayID lorawan.EUI64, body []byte) error {
+	var gatewayCommandExecRequest gw.GatewayCommandExecRequest
+	if err := b.marshaler.Unmarshal(body, &gatewayCommandExecRequest); err != nil {
+		return errors.Wrap(err, "unmarshal gateway command execution request error")
+	}
+
+	if err := setGatewayID(gatewayID, &gatewayCommandExecRequest.GatewayId); err != nil {
+		return err
+	}
+
+	var execID uuid.UUID
+	copy(execID[:], gatewayCommandExecRequest.GetExecId())
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"exec_id":    execID,
+	}).Info("integration/http: gateway command execution request received")
+
+	if b.gatewayCommandExecRequestFunc != nil {
+		b.gatewayCommandExecRequestFunc(gatewayCommandExecRequest)
+	}
+
+	return nil
+}
+
+func (b *Backend) handleRawPacketForwarderCommand(gatewayID lorawan.EUI64, body []byte) error {
+	var rawPacketForwarderCommand gw.RawPacketForwarderCommand
+	if err := b.marshaler.Unmarshal(body, &rawPacketForwarderCommand); err != nil {
+		return errors.Wrap(err, "unmarshal raw packet-forwarder command error")
+	}
+
+	if err := setGatewayID(gatewayID, &rawPacketForwarderCommand.GatewayId); err != nil {
+		return err
+	}
+
+	var rawID uuid.UUID
+	copy(rawID[:], rawPacketForwarderCommand.GetRawId())
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"raw_id":     rawID,
+	}).Info("integration/http: raw packet-forwarder command received")
+
+	if b.rawPacketForwarderCommandFunc != nil {
+		b.rawPacketForwarderCommandFunc(rawPacketForwarderCommand)
+	}
+
+	return nil
+}
+
+func (b *Backend) closed() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.isClosed
+}
+
+// setGatewayID sets the Gateway ID of the command to the Gateway ID from
+// the request path when not set. It returns an error when both are set,
+// but do not match.
+func setGatewayID(gatewayID lorawan.EUI64, id *[]byte) error {
+	if len(*id) == 0 {
+		*id = gatewayID[:]
+		return nil
+	}
+
+	if !bytes.Equal(*id, gatewayID[:]) {
+		return errors.New("gateway id does not match the gateway id of the request path")
+	}
+
+	return nil
+}
+
+// validateSignature validates the X-Timestamp and X-Signature headers of the
+// given command request. A signature is only accepted once, so that a
+// captured request can not be replayed.
+func (b *Backend) validateSignature(r *http.Request, gatewayID lorawan.EUI64, body []byte) error {
+	timestamp := r.Header.Get("X-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+
+	age := time.Since(time.Unix(ts, 0))
+	if age > maxRequestAge || age < -maxRequestAge {
+		return errors.New("request expired")
+	}
+
+	signature := r.Header.Get("X-Signature")
+	if !hmac.Equal([]byte(signature), []byte(sign(b.signingSecret, r.Method, r.URL.Path, gatewayID, timestamp, body))) {
+		return errors.New("invalid signature")
+	}
+
+	if err := b.signatures.Add(signature, struct{}{}, cache.DefaultExpiration); err != nil {
+		return errors.New("request replayed")
+	}
+
+	return nil
+}
+
+// sign returns the HEX encoded HMAC-SHA256 of the request method, path,
+// Gateway ID, timestamp and body, each separated by a newline.
+func sign(secret []byte, method, path string, gatewayID lorawan.EUI64, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", method, path, gatewayID, timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,405 @@
+package http
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+type request struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+type HTTPBackendTestSuite struct {
+	suite.Suite
+
+	backend   *Backend
+	server    *httptest.Server
+	gatewayID lorawan.EUI64
+	json      marshaler.JSON
+
+	mu            sync.Mutex
+	requests      []request
+	responseCodes []int
+}
+
+func (ts *HTTPBackendTestSuite) SetupSuite() {
+	log.SetLevel(log.ErrorLevel)
+	ts.gatewayID = lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	ts.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+
+		ts.requests = append(ts.requests, request{path: r.URL.Path, header: r.Header, body: b})
+
+		code := http.StatusOK
+		if len(ts.responseCodes) != 0 {
+			code = ts.responseCodes[0]
+			ts.responseCodes = ts.responseCodes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+}
+
+func (ts *HTTPBackendTestSuite) TearDownSuite() {
+	ts.server.Close()
+}
+
+func (ts *HTTPBackendTestSuite) SetupTest() {
+	assert := require.New(ts.T())
+
+	ts.requests = nil
+	ts.responseCodes = nil
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.HTTP.EventURLs = []string{ts.server.URL}
+	conf.Integration.HTTP.Timeout = time.Second
+	conf.Integration.HTTP.MaxRetries = 2
+	conf.Integration.HTTP.RetryDelay = time.Millisecond
+	conf.Integration.HTTP.SigningSecret = "secret"
+
+	var err error
+	ts.backend, err = NewBackend(conf)
+	assert.NoError(err)
+	assert.NoError(ts.backend.Start())
+	assert.NoError(ts.backend.SetGatewaySubscription(true, ts.gatewayID))
+}
+
+func (ts *HTTPBackendTestSuite) TearDownTest() {
+	assert := require.New(ts.T())
+	assert.NoError(ts.backend.Stop())
+}
+
+func (ts *HTTPBackendTestSuite) requestCount() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.requests)
+}
+
+func (ts *HTTPBackendTestSuite) postCommand(path string, msg proto.Message, signature string) *httptest.ResponseRecorder {
+	return ts.postCommandWithTimestamp(path, msg, signature, time.Now())
+}
+
+func (ts *HTTPBackendTestSuite) postCommandWithTimestamp(path string, msg proto.Message, signature string, t time.Time) *httptest.ResponseRecorder {
+	assert := require.New(ts.T())
+
+	b, err := ts.json.Marshal(msg)
+	assert.NoError(err)
+
+	// the gateway id is signed as HEX string
+	var gatewayID lorawan.EUI64
+	parts := bytes.Split([]byte(path), []byte("/"))
+	if len(parts) > 2 {
+		_ = gatewayID.UnmarshalText(parts[2])
+	}
+
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	if signature == "" {
+		signature = sign([]byte("secret"), http.MethodPost, path, gatewayID, timestamp, b)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+	r.Header.Set("X-Timestamp", timestamp)
+	r.Header.Set("X-Signature", signature)
+	w := httptest.NewRecorder()
+	ts.backend.ServeHTTP(w, r)
+
+	return w
+}
+
+func (ts *HTTPBackendTestSuite) TestPublishEvent() {
+	id, err := uuid.NewV4()
+	require.NoError(ts.T(), err)
+
+	uplink := gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3, 4},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: ts.gatewayID[:],
+			UplinkId:  id[:],
+		},
+	}
+
+	ts.T().Run("Success", func(t *testing.T) {
+		assert := require.New(t)
+		ts.requests = nil
+
+		assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "up", id, &uplink))
+		assert.Len(ts.requests, 1)
+
+		req := ts.requests[0]
+		assert.Equal("application/json", req.header.Get("Content-Type"))
+		assert.Equal("0807060504030201", req.header.Get("X-Gateway-ID"))
+		assert.Equal("up", req.header.Get("X-Event"))
+		assert.Equal(sign([]byte("secret"), http.MethodPost, "/", ts.gatewayID, req.header.Get("X-Timestamp"), req.body), req.header.Get("X-Signature"))
+
+		var received gw.UplinkFrame
+		assert.NoError(ts.json.Unmarshal(req.body, &received))
+		assert.True(proto.Equal(&uplink, &received))
+	})
+
+	ts.T().Run("Retry on 5xx", func(t *testing.T) {
+		assert := require.New(t)
+		ts.mu.Lock()
+		ts.requests = nil
+		ts.responseCodes = []int{http.StatusInternalServerError, http.StatusServiceUnavailable}
+		ts.mu.Unlock()
+
+		// the retries are performed in the background
+		assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "up", id, &uplink))
+		assert.Eventually(func() bool { return ts.requestCount() == 3 }, time.Second, time.Millisecond)
+	})
+
+	ts.T().Run("Max retries", func(t *testing.T) {
+		assert := require.New(t)
+		ts.mu.Lock()
+		ts.requests = nil
+		ts.responseCodes = []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}
+		ts.mu.Unlock()
+
+		assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "up", id, &uplink))
+		assert.Eventually(func() bool { return ts.requestCount() == 3 }, time.Second, time.Millisecond)
+
+		// no further requests are made after the max. number of retries
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(3, ts.requestCount())
+	})
+
+	ts.T().Run("No retry on 4xx", func(t *testing.T) {
+		assert := require.New(t)
+		ts.requests = nil
+		ts.responseCodes = []int{http.StatusBadRequest}
+
+		assert.Error(ts.backend.PublishEvent(ts.gatewayID, "up", id, &uplink))
+		assert.Len(ts.requests, 1)
+	})
+
+	ts.T().Run("Stop aborts retries", func(t *testing.T) {
+		assert := require.New(t)
+		ts.mu.Lock()
+		ts.requests = nil
+		ts.responseCodes = []int{http.StatusInternalServerError}
+		ts.mu.Unlock()
+
+		ts.backend.retryDelay = time.Hour
+		assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "up", id, &uplink))
+
+		stopped := make(chan error, 1)
+		go func() { stopped <- ts.backend.Stop() }()
+
+		select {
+		case err := <-stopped:
+			assert.NoError(err)
+		case <-time.After(time.Second):
+			t.Fatal("stop blocked by retry")
+		}
+		assert.Equal(1, ts.requestCount())
+	})
+}
+
+func (ts *HTTPBackendTestSuite) TestDownlinkFrame() {
+	downlinkFrameChan := make(chan gw.DownlinkFrame, 1)
+	ts.backend.SetDownlinkFrameFunc(func(pl gw.DownlinkFrame) {
+		downlinkFrameChan <- pl
+	})
+
+	downlink := gw.DownlinkFrame{
+		Token: 1234,
+		Items: []*gw.DownlinkFrameItem{
+			{PhyPayload: []byte{1, 2, 3, 4}},
+		},
+	}
+
+	ts.T().Run("Valid", func(t *testing.T) {
+		assert := require.New(t)
+
+		w := ts.postCommand("/gateway/0807060504030201/command/down", &downlink, "")
+		assert.Equal(http.StatusAccepted, w.Code)
+
+		received := <-downlinkFrameChan
+		assert.Equal(ts.gatewayID[:], received.GatewayId)
+		assert.EqualValues(1234, received.Token)
+	})
+
+	ts.T().Run("Invalid signature", func(t *testing.T) {
+		assert := require.New(t)
+
+		w := ts.postCommand("/gateway/0807060504030201/command/down", &downlink, "invalid")
+		assert.Equal(http.StatusUnauthorized, w.Code)
+	})
+
+	ts.T().Run("Replayed", func(t *testing.T) {
+		assert := require.New(t)
+
+		// the same timestamp results in the same signature
+		now := time.Now().Add(-time.Minute)
+		w := ts.postCommandWithTimestamp("/gateway/0807060504030201/command/down", &downlink, "", now)
+		assert.Equal(http.StatusAccepted, w.Code)
+		<-downlinkFrameChan
+
+		w = ts.postCommandWithTimestamp("/gateway/0807060504030201/command/down", &downlink, "", now)
+		assert.Equal(http.StatusUnauthorized, w.Code)
+	})
+
+	ts.T().Run("Replayed with future timestamp", func(t *testing.T) {
+		assert := require.New(t)
+
+		// the signature must be remembered until the timestamp is expired
+		future := time.Now().Add(maxRequestAge - time.Second)
+		w := ts.postCommandWithTimestamp("/gateway/0807060504030201/command/down", &downlink, "", future)
+		assert.Equal(http.StatusAccepted, w.Code)
+		<-downlinkFrameChan
+
+		for _, exp := range ts.backend.signatures.Items() {
+			assert.True(time.Unix(0, exp.Expiration).After(future.Add(maxRequestAge)))
+		}
+	})
+
+	ts.T().Run("Expired", func(t *testing.T) {
+		assert := require.New(t)
+
+		w := ts.postCommandWithTimestamp("/gateway/0807060504030201/command/down", &downlink, "", time.Now().Add(-2*maxRequestAge))
+		assert.Equal(http.StatusUnauthorized, w.Code)
+	})
+
+	ts.T().Run("Signature for other gateway", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(ts.backend.SetGatewaySubscription(true, lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}))
+
+		b, err := ts.json.Marshal(&downlink)
+		assert.NoError(err)
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+		r := httptest.NewRequest(http.MethodPost, "/gateway/0101010101010101/command/down", bytes.NewReader(b))
+		r.Header.Set("X-Timestamp", timestamp)
+		r.Header.Set("X-Signature", sign([]byte("secret"), http.MethodPost, "/gateway/0807060504030201/command/down", ts.gatewayID, timestamp, b))
+		w := httptest.NewRecorder()
+		ts.backend.ServeHTTP(w, r)
+		assert.Equal(http.StatusUnauthorized, w.Code)
+		assert.NoError(ts.backend.SetGatewaySubscription(false, lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}))
+	})
+
+	ts.T().Run("Gateway not subscribed", func(t *testing.T) {
+		assert := require.New(t)
+
+		w := ts.postCommand("/gateway/0101010101010101/command/down", &downlink, "")
+		assert.Equal(http.StatusNotFound, w.Code)
+	})
+
+	ts.T().Run("Gateway ID mismatch", func(t *testing.T) {
+		assert := require.New(t)
+
+		w := ts.postCommand("/gateway/0807060504030201/command/down", &gw.DownlinkFrame{
+			GatewayId: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			Items: []*gw.DownlinkFrameItem{
+				{PhyPayload: []byte{1, 2, 3, 4}},
+			},
+		}, "")
+		assert.Equal(http.StatusBadRequest, w.Code)
+	})
+
+	ts.T().Run("Unknown command", func(t *testing.T) {
+		assert := require.New(t)
+
+		w := ts.postCommand("/gateway/0807060504030201/command/foo", &downlink, "")
+		assert.Equal(http.StatusNotFound, w.Code)
+	})
+}
+
+func (ts *HTTPBackendTestSuite) TestGatewayConfiguration() {
+	assert := require.New(ts.T())
+
+	gatewayConfigurationChan := make(chan gw.GatewayConfiguration, 1)
+	ts.backend.SetGatewayConfigurationFunc(func(pl gw.GatewayConfiguration) {
+		gatewayConfigurationChan <- pl
+	})
+
+	gatewayConfig := gw.GatewayConfiguration{
+		GatewayId: ts.gatewayID[:],
+		Version:   "1.2.3",
+	}
+
+	w := ts.postCommand("/gateway/0807060504030201/command/config", &gatewayConfig, "")
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	received := <-gatewayConfigurationChan
+	assert.True(proto.Equal(&gatewayConfig, &received))
+}
+
+func (ts *HTTPBackendTestSuite) TestGatewayCommandExecRequest() {
+	assert := require.New(ts.T())
+
+	execChan := make(chan gw.GatewayCommandExecRequest, 1)
+	ts.backend.SetGatewayCommandExecRequestFunc(func(pl gw.GatewayCommandExecRequest) {
+		execChan <- pl
+	})
+
+	execReq := gw.GatewayCommandExecRequest{
+		GatewayId: ts.gatewayID[:],
+		Command:   "reboot",
+		ExecId:    []byte{1, 2, 3, 4},
+	}
+
+	w := ts.postCommand("/gateway/0807060504030201/command/exec", &execReq, "")
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	received := <-execChan
+	assert.True(proto.Equal(&execReq, &received))
+}
+
+func (ts *HTTPBackendTestSuite) TestRawPacketForwarderCommand() {
+	assert := require.New(ts.T())
+
+	rawChan := make(chan gw.RawPacketForwarderCommand, 1)
+	ts.backend.SetRawPacketForwarderCommandFunc(func(pl gw.RawPacketForwarderCommand) {
+		rawChan <- pl
+	})
+
+	raw := gw.RawPacketForwarderCommand{
+		GatewayId: ts.gatewayID[:],
+		RawId:     []byte{1, 2, 3, 4},
+		Payload:   []byte{5, 6, 7, 8},
+	}
+
+	w := ts.postCommand("/gateway/0807060504030201/command/raw", &raw, "")
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	received := <-rawChan
+	assert.True(proto.Equal(&raw, &received))
+}
+
+func TestHTTPBackend(t *testing.T) {
+	suite.Run(t, new(HTTPBackendTestSuite))
+}
+
+func TestBindWithoutSigningSecret(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.HTTP.Bind = "127.0.0.1:0"
+
+	_, err := NewBackend(conf)
+	assert.EqualError(err, "integration/http: signing_secret must be set when bind is set")
+}
@@ -0,0 +1,35 @@
+package http
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_http_event_count",
+		Help: "The number of gateway events published by the HTTP integration (per event).",
+	}, []string{"event"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_http_command_count",
+		Help: "The number of commands received by the HTTP integration (per command).",
+	}, []string{"command"})
+
+	rc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integration_http_retry_count",
+		Help: "The number of times posting an event was retried.",
+	})
+)
+
+func httpEventCounter(e string) prometheus.Counter {
+	return pc.With(prometheus.Labels{"event": e})
+}
+
+func httpCommandCounter(c string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"command": c})
+}
+
+func httpRetryCounter() prometheus.Counter {
+	return rc
+}
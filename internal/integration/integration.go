@@ -1,12 +1,17 @@
 package integration
 
 import (
+	"fmt"
+
 	"github.com/gofrs/uuid"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 
 	"github.com/brocaar/chirpstack-api/go/v3/gw"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/amqp"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/http"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/kafka"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/mqtt"
 	"github.com/brocaar/lorawan"
 )
@@ -14,9 +19,11 @@ import (
 // Event types.
 const (
 	EventUp    = "up"
+	EventUpSet = "up_set"
 	EventStats = "stats"
 	EventAck   = "ack"
 	EventRaw   = "raw"
+	EventConn  = "conn"
 )
 
 var integration Integration
@@ -24,9 +31,28 @@ var integration Integration
 // Setup configures the integration.
 func Setup(conf config.Config) error {
 	var err error
-	integration, err = mqtt.NewBackend(conf)
+
+	switch conf.Integration.Type {
+	case "mqtt":
+		if conf.Integration.MQTT.SessionPerGateway {
+			integration, err = mqtt.NewGatewayBackend(conf)
+		} else if len(conf.Integration.MQTT.Connections) != 0 {
+			integration, err = mqtt.NewMultiBackend(conf)
+		} else {
+			integration, err = mqtt.NewBackend(conf)
+		}
+	case "amqp":
+		integration, err = amqp.NewBackend(conf)
+	case "kafka":
+		integration, err = kafka.NewBackend(conf)
+	case "http":
+		integration, err = http.NewBackend(conf)
+	default:
+		return fmt.Errorf("unknown integration type: %s", conf.Integration.Type)
+	}
+
 	if err != nil {
-		return errors.Wrap(err, "setup mqtt integration error")
+		return errors.Wrapf(err, "setup %s integration error", conf.Integration.Type)
 	}
 
 	return nil
@@ -65,3 +91,31 @@ type Integration interface {
 	// Stop stops the integration.
 	Stop() error
 }
+
+// MetaDataIntegration is implemented by integrations which publish the
+// gateway meta-data outside the stats events.
+type MetaDataIntegration interface {
+	// SetMetaDataFunc sets the func returning the gateway meta-data.
+	SetMetaDataFunc(func() map[string]string)
+}
+
+// EventMetaDataIntegration is implemented by integrations which are able to
+// publish the gateway meta-data with events which do not have a meta-data
+// field (e.g. uplinks and acks).
+type EventMetaDataIntegration interface {
+	// PublishEventWithMetaData publishes the given event together with the
+	// given meta-data.
+	PublishEventWithMetaData(lorawan.EUI64, string, uuid.UUID, proto.Message, map[string]string) error
+}
+
+// RoutedIntegration is implemented by integrations publishing to multiple
+// named destinations (e.g. connections), of which the destinations can be
+// selected per event.
+type RoutedIntegration interface {
+	// PublishEventTo publishes the given event together with the given
+	// meta-data to the given destinations.
+	PublishEventTo([]string, lorawan.EUI64, string, uuid.UUID, proto.Message, map[string]string) error
+
+	// Destinations returns the names of the destinations.
+	Destinations() []string
+}
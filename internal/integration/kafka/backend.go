@@ -0,0 +1,642 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+// partitionRefreshInterval defines the interval in which the partitions of
+// the command topic are refreshed, to pick up added partitions.
+const partitionRefreshInterval = 30 * time.Second
+
+// Backend implements a Kafka integration.
+type Backend struct {
+	sync.RWMutex
+
+	brokers      []string
+	config       *sarama.Config
+	commandTopic string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	client             sarama.Client
+	producer           sarama.SyncProducer
+	consumer           sarama.Consumer
+	partitionConsumers []sarama.PartitionConsumer
+	wg                 sync.WaitGroup
+
+	downlinkFrameFunc             func(gw.DownlinkFrame)
+	gatewayConfigurationFunc      func(gw.GatewayConfiguration)
+	gatewayCommandExecRequestFunc func(gw.GatewayCommandExecRequest)
+	rawPacketForwarderCommandFunc func(gw.RawPacketForwarderCommand)
+
+	gateways map[lorawan.EUI64]struct{}
+
+	eventTopicTemplate *template.Template
+	marshaler          marshaler.Marshaler
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.Config) (*Backend, error) {
+	var err error
+
+	b := Backend{
+		brokers:      conf.Integration.Kafka.Brokers,
+		commandTopic: conf.Integration.Kafka.CommandTopic,
+		gateways:     make(map[lorawan.EUI64]struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	b.marshaler, err = marshaler.New(conf.Integration.Marshaler)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/kafka: new marshaler error")
+	}
+
+	b.eventTopicTemplate, err = template.New("event").Parse(conf.Integration.Kafka.EventTopicTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/kafka: parse event-topic template error")
+	}
+
+	b.config, err = newSaramaConfig(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/kafka: new kafka config error")
+	}
+
+	return &b, nil
+}
+
+// Start starts the integration.
+func (b *Backend) Start() error {
+	b.connectLoop()
+
+	b.RLock()
+	connected := b.consumer != nil
+	b.RUnlock()
+
+	// the integration was stopped before it was connected
+	if !connected {
+		return nil
+	}
+
+	b.consumeCommands()
+
+	return nil
+}
+
+// Stop stops the integration. It can be called when the integration never
+// connected.
+func (b *Backend) Stop() error {
+	b.cancel()
+
+	// The lock must not be held while waiting for the consumers, as the
+	// handling of a command acquires the lock.
+	b.Lock()
+	partitionConsumers := b.partitionConsumers
+	consumer := b.consumer
+	producer := b.producer
+	client := b.client
+	b.partitionConsumers = nil
+	b.Unlock()
+
+	for _, pc := range partitionConsumers {
+		pc.AsyncClose()
+	}
+	b.wg.Wait()
+
+	if consumer != nil {
+		if err := consumer.Close(); err != nil {
+			return errors.Wrap(err, "integration/kafka: close consumer error")
+		}
+	}
+
+	if producer != nil {
+		if err := producer.Close(); err != nil {
+			return errors.Wrap(err, "integration/kafka: close producer error")
+		}
+	}
+
+	if client != nil {
+		return client.Close()
+	}
+
+	return nil
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func.
+func (b *Backend) SetDownlinkFrameFunc(f func(gw.DownlinkFrame)) {
+	b.downlinkFrameFunc = f
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func.
+func (b *Backend) SetGatewayConfigurationFunc(f func(gw.GatewayConfiguration)) {
+	b.gatewayConfigurationFunc = f
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler func.
+func (b *Backend) SetGatewayCommandExecRequestFunc(f func(gw.GatewayCommandExecRequest)) {
+	b.gatewayCommandExecRequestFunc = f
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler func.
+func (b *Backend) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderCommand)) {
+	b.rawPacketForwarderCommandFunc = f
+}
+
+// SetGatewaySubscription (un)subscribes the given gateway. As all commands
+// are consumed from a single topic, this only updates the set of gateways
+// for which commands are handled.
+func (b *Backend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	b.Lock()
+	defer b.Unlock()
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"subscribe":  subscribe,
+	}).Debug("integration/kafka: set gateway subscription called")
+
+	if subscribe {
+		b.gateways[gatewayID] = struct{}{}
+	} else {
+		delete(b.gateways, gatewayID)
+	}
+
+	return nil
+}
+
+// PublishEvent publishes the given event.
+func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	kafkaEventCounter(event).Inc()
+	idPrefix := map[string]string{
+		"up":     "uplink_",
+		"up_set": "uplink_",
+		"ack":    "downlink_",
+		"stats":  "stats_",
+		"exec":   "exec_",
+		"raw":    "raw_",
+		"conn":   "conn_",
+	}
+
+	topic := bytes.NewBuffer(nil)
+	if err := b.eventTopicTemplate.Execute(topic, struct {
+		GatewayID lorawan.EUI64
+		EventType string
+	}{gatewayID, event}); err != nil {
+		return errors.Wrap(err, "execute event template error")
+	}
+
+	value, err := b.marshaler.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal message error")
+	}
+
+	msg := sarama.ProducerMessage{
+		Topic: topic.String(),
+		Key:   sarama.StringEncoder(gatewayID.String()),
+		Value: sarama.ByteEncoder(value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("event"), Value: []byte(event)},
+			{Key: []byte("content-type"), Value: []byte(b.marshaler.ContentType())},
+		},
+	}
+
+	b.RLock()
+	producer := b.producer
+	b.RUnlock()
+
+	if producer == nil {
+		return errors.New("not connected")
+	}
+
+	partition, offset, err := producer.SendMessage(&msg)
+	if err != nil {
+		return errors.Wrap(err, "send message error")
+	}
+
+	log.WithFields(log.Fields{
+		idPrefix[event] + "id": id,
+		"topic":                topic.String(),
+		"partition":            partition,
+		"offset":               offset,
+		"event":                event,
+	}).Info("integration/kafka: event published")
+
+	return nil
+}
+
+func (b *Backend) connect() error {
+	client, err := sarama.NewClient(b.brokers, b.config)
+	if err != nil {
+		return errors.Wrap(err, "new client error")
+	}
+
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return errors.Wrap(err, "new producer error")
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		producer.Close()
+		client.Close()
+		return errors.Wrap(err, "new consumer error")
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	// the integration was stopped while connecting
+	if b.ctx.Err() != nil {
+		consumer.Close()
+		producer.Close()
+		client.Close()
+		return nil
+	}
+
+	b.client = client
+	b.producer = producer
+	b.consumer = consumer
+
+	kafkaConnectCounter().Inc()
+	log.WithField("brokers", b.brokers).Info("integration/kafka: connected to kafka cluster")
+
+	return nil
+}
+
+// connectLoop blocks until the client is connected or the integration has
+// been stopped. Once connected, the sarama client takes care of
+// re-connecting to the brokers.
+func (b *Backend) connectLoop() {
+	for {
+		if b.ctx.Err() != nil {
+			return
+		}
+
+		if err := b.connect(); err != nil {
+			log.WithError(err).Error("integration/kafka: connection error")
+
+			select {
+			case <-b.ctx.Done():
+			case <-time.After(time.Second * 2):
+			}
+			continue
+		}
+
+		return
+	}
+}
+
+// consumeCommands consumes all the partitions of the command topic,
+// starting at the newest offset, until the integration is stopped. No
+// consumer group is used and no offsets are committed, as every instance
+// must receive the commands for the gateways connected to it. Partitions
+// that are added to the topic are picked up periodically.
+func (b *Backend) consumeCommands() {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		consumed := make(map[int32]struct{})
+
+		for {
+			if err := b.consumePartitions(consumed); err != nil {
+				log.WithError(err).Error("integration/kafka: consume commands error")
+			}
+
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-time.After(partitionRefreshInterval):
+			}
+		}
+	}()
+}
+
+// consumePartitions starts consuming the partitions of the command topic
+// which are not yet in the given set of consumed partitions.
+func (b *Backend) consumePartitions(consumed map[int32]struct{}) error {
+	partitions, err := b.consumer.Partitions(b.commandTopic)
+	if err != nil {
+		return errors.Wrap(err, "get partitions error")
+	}
+
+	for _, partition := range partitions {
+		if _, ok := consumed[partition]; ok {
+			continue
+		}
+
+		pc, err := b.consumer.ConsumePartition(b.commandTopic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return errors.Wrap(err, "consume partition error")
+		}
+		consumed[partition] = struct{}{}
+
+		// The partition consumer is registered while holding the lock, so
+		// that Stop either closes it or it is closed here.
+		b.Lock()
+		if b.ctx.Err() != nil {
+			b.Unlock()
+			pc.Close()
+			return nil
+		}
+		b.partitionConsumers = append(b.partitionConsumers, pc)
+		b.wg.Add(2)
+		b.Unlock()
+
+		log.WithFields(log.Fields{
+			"topic":     b.commandTopic,
+			"partition": partition,
+		}).Info("integration/kafka: consuming command partition")
+
+		go func() {
+			defer b.wg.Done()
+			for msg := range pc.Messages() {
+				b.handleCommand(msg)
+			}
+		}()
+		go func() {
+			defer b.wg.Done()
+			for err := range pc.Errors() {
+				log.WithError(err).Error("integration/kafka: consume command error")
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (b *Backend) handleCommand(msg *sarama.ConsumerMessage) {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText(msg.Key); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+		}).Error("integration/kafka: unmarshal gateway id from command key error")
+		return
+	}
+
+	b.RLock()
+	_, ok := b.gateways[gatewayID]
+	b.RUnlock()
+	if !ok {
+		log.WithField("gateway_id", gatewayID).Debug("integration/kafka: ignoring command for unknown gateway")
+		return
+	}
+
+	var command string
+	for _, h := range msg.Headers {
+		if string(h.Key) == "command" {
+			command = string(h.Value)
+		}
+	}
+
+	switch command {
+	case "down":
+		kafkaCommandCounter("down").Inc()
+		b.handleDownlinkFrame(gatewayID, msg.Value)
+	case "config":
+		kafkaCommandCounter("config").Inc()
+		b.handleGatewayConfiguration(gatewayID, msg.Value)
+	case "exec":
+		kafkaCommandCounter("exec").Inc()
+		b.handleGatewayCommandExecRequest(gatewayID, msg.Value)
+	case "raw":
+		kafkaCommandCounter("raw").Inc()
+		b.handleRawPacketForwarderCommand(gatewayID, msg.Value)
+	default:
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"command":    command,
+		}).Warning("integration/kafka: unexpected command received")
+	}
+}
+
+func (b *Backend) handleDownlinkFrame(keyGatewayID lorawan.EUI64, value []byte) {
+	var downlinkFrame gw.DownlinkFrame
+	if err := b.marshaler.Unmarshal(value, &downlinkFrame); err != nil {
+		log.WithError(err).Error("integration/kafka: unmarshal downlink frame error")
+		return
+	}
+
+	var downID uuid.UUID
+	copy(downID[:], downlinkFrame.GetDownlinkId())
+
+	if len(downlinkFrame.Items) == 0 {
+		log.WithFields(log.Fields{
+			"downlink_id": downID,
+		}).Error("integration/kafka: downlink must have at least one item")
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], downlinkFrame.GatewayId)
+
+	if gatewayID != keyGatewayID {
+		log.WithFields(log.Fields{
+			"gateway_id":     gatewayID,
+			"key_gateway_id": keyGatewayID,
+		}).Error("integration/kafka: gateway id of downlink frame does not match message key")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": downID,
+	}).Info("integration/kafka: downlink frame received")
+
+	if b.downlinkFrameFunc != nil {
+		b.downlinkFrameFunc(downlinkFrame)
+	}
+}
+
+func (b *Backend) handleGatewayConfiguration(keyGatewayID lorawan.EUI64, value []byte) {
+	var gatewayConfig gw.GatewayConfiguration
+	if err := b.marshaler.Unmarshal(value, &gatewayConfig); err != nil {
+		log.WithError(err).Error("integration/kafka: unmarshal gateway configuration error")
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], gatewayConfig.GetGatewayId())
+
+	if gatewayID != keyGatewayID {
+		log.WithFields(log.Fields{
+			"gateway_id":     gatewayID,
+			"key_gateway_id": keyGatewayID,
+		}).Error("integration/kafka: gateway id of gateway configuration does not match message key")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+	}).Info("integration/kafka: gateway configuration received")
+
+	if b.gatewayConfigurationFunc != nil {
+		b.gatewayConfigurationFunc(gatewayConfig)
+	}
+}
+
+func (b *Backend) handleGatewayCommandExecRequest(keyGatewayID lorawan.EUI64, value []byte) {
+	var gatewayCommandExecRequest gw.GatewayCommandExecRequest
+	if err := b.marshaler.Unmarshal(value, &gatewayCommandExecRequest); err != nil {
+		log.WithError(err).Error("integration/kafka: unmarshal gateway command execution request error")
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	var execID uuid.UUID
+	copy(gatewayID[:], gatewayCommandExecRequest.GetGatewayId())
+	copy(execID[:], gatewayCommandExecRequest.GetExecId())
+
+	if gatewayID != keyGatewayID {
+		log.WithFields(log.Fields{
+			"gateway_id":     gatewayID,
+			"key_gateway_id": keyGatewayID,
+		}).Error("integration/kafka: gateway id of gateway command execution request does not match message key")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"exec_id":    execID,
+	}).Info("integration/kafka: gateway command execution request received")
+
+	if b.gatewayCommandExecRequestFunc != nil {
+		b.gatewayCommandExecRequestFunc(gatewayCommandExecRequest)
+	}
+}
+
+func (b *Backend) handleRawPacketForwarderCommand(keyGatewayID lorawan.EUI64, value []byte) {
+	var rawPacketForwarderCommand gw.RawPacketForwarderCommand
+	if err := b.marshaler.Unmarshal(value, &rawPacketForwarderCommand); err != nil {
+		log.WithError(err).Error("integration/kafka: unmarshal raw packet-forwarder command error")
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	var rawID uuid.UUID
+	copy(gatewayID[:], rawPacketForwarderCommand.GetGatewayId())
+	copy(rawID[:], rawPacketForwarderCommand.GetRawId())
+
+	if gatewayID != keyGatewayID {
+		log.WithFields(log.Fields{
+			"gateway_id":     gatewayID,
+			"key_gateway_id": keyGatewayID,
+		}).Error("integration/kafka: gateway id of raw packet-forwarder command does not match message key")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"raw_id":     rawID,
+	}).Info("integration/kafka: raw packet-forwarder command received")
+
+	if b.rawPacketForwarderCommandFunc != nil {
+		b.rawPacketForwarderCommandFunc(rawPacketForwarderCommand)
+	}
+}
+
+// newSaramaConfig returns the Kafka client configuration. The producer is
+// configured to be idempotent, so that retries do not result in duplicated
+// events.
+func newSaramaConfig(conf config.Config) (*sarama.Config, error) {
+	c := sarama.NewConfig()
+
+	version, err := sarama.ParseKafkaVersion(conf.Integration.Kafka.Version)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse kafka version error")
+	}
+	c.Version = version
+
+	c.Producer.Idempotent = true
+	c.Producer.RequiredAcks = sarama.WaitForAll
+	c.Producer.Retry.Max = 5
+	c.Producer.Return.Successes = true
+	c.Net.MaxOpenRequests = 1
+
+	c.Consumer.Return.Errors = true
+
+	if conf.Integration.Kafka.TLS {
+		tlsConfig, err := newTLSConfig(conf.Integration.Kafka.CACert, conf.Integration.Kafka.TLSCert, conf.Integration.Kafka.TLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "new tls config error")
+		}
+
+		c.Net.TLS.Enable = true
+		c.Net.TLS.Config = tlsConfig
+	}
+
+	switch conf.Integration.Kafka.SASLMechanism {
+	case "":
+	case "plain":
+		c.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case "scram_sha256":
+		c.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha256HashGenerator}
+		}
+	case "scram_sha512":
+		c.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha512HashGenerator}
+		}
+	default:
+		return nil, fmt.Errorf("unknown sasl mechanism: %s", conf.Integration.Kafka.SASLMechanism)
+	}
+
+	if c.Net.SASL.Mechanism != "" {
+		c.Net.SASL.Enable = true
+		c.Net.SASL.User = conf.Integration.Kafka.SASLUsername
+		c.Net.SASL.Password = conf.Integration.Kafka.SASLPassword
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validate config error")
+	}
+
+	return c, nil
+}
+
+func newTLSConfig(cafile, certFile, certKeyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if cafile != "" {
+		cacert, err := ioutil.ReadFile(cafile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load ca-cert error")
+		}
+		certpool := x509.NewCertPool()
+		certpool.AppendCertsFromPEM(cacert)
+
+		tlsConfig.RootCAs = certpool
+	}
+
+	if certFile != "" && certKeyFile != "" {
+		kp, err := tls.LoadX509KeyPair(certFile, certKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls key-pair error")
+		}
+		tlsConfig.Certificates = []tls.Certificate{kp}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,289 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+type KafkaBackendTestSuite struct {
+	suite.Suite
+
+	backend           *Backend
+	producer          *mocks.SyncProducer
+	consumer          *mocks.Consumer
+	partitionConsumer *mocks.PartitionConsumer
+	gatewayID         lorawan.EUI64
+	json              marshaler.JSON
+}
+
+func (ts *KafkaBackendTestSuite) SetupTest() {
+	assert := require.New(ts.T())
+
+	log.SetLevel(log.ErrorLevel)
+	ts.gatewayID = lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.Kafka.Version = "1.0.0"
+	conf.Integration.Kafka.EventTopicTemplate = "gateway.{{ .EventType }}"
+	conf.Integration.Kafka.CommandTopic = "gateway.command"
+
+	var err error
+	ts.backend, err = NewBackend(conf)
+	assert.NoError(err)
+
+	ts.producer = mocks.NewSyncProducer(ts.T(), ts.backend.config)
+	ts.backend.producer = ts.producer
+
+	ts.consumer = mocks.NewConsumer(ts.T(), ts.backend.config)
+	ts.consumer.SetTopicMetadata(map[string][]int32{
+		"gateway.command": {0},
+	})
+	ts.partitionConsumer = ts.consumer.ExpectConsumePartition("gateway.command", 0, sarama.OffsetNewest)
+	ts.backend.consumer = ts.consumer
+	ts.backend.consumeCommands()
+
+	assert.NoError(ts.backend.SetGatewaySubscription(true, ts.gatewayID))
+}
+
+func (ts *KafkaBackendTestSuite) TearDownTest() {
+	assert := require.New(ts.T())
+	assert.NoError(ts.backend.Stop())
+}
+
+func (ts *KafkaBackendTestSuite) yieldCommand(gatewayID lorawan.EUI64, command string, msg proto.Message) {
+	assert := require.New(ts.T())
+
+	b, err := ts.json.Marshal(msg)
+	assert.NoError(err)
+
+	ts.partitionConsumer.YieldMessage(&sarama.ConsumerMessage{
+		Key:   []byte(gatewayID.String()),
+		Value: b,
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("command"), Value: []byte(command)},
+		},
+	})
+}
+
+func (ts *KafkaBackendTestSuite) TestPublishEvent() {
+	assert := require.New(ts.T())
+
+	id, err := uuid.NewV4()
+	assert.NoError(err)
+
+	uplink := gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3, 4},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: ts.gatewayID[:],
+			UplinkId:  id[:],
+		},
+	}
+
+	ts.producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+		var received gw.UplinkFrame
+		assert.NoError(ts.json.Unmarshal(val, &received))
+		assert.True(proto.Equal(&uplink, &received))
+		return nil
+	})
+
+	assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "up", id, &uplink))
+}
+
+func (ts *KafkaBackendTestSuite) TestDownlinkFrame() {
+	assert := require.New(ts.T())
+
+	downlinkFrameChan := make(chan gw.DownlinkFrame, 1)
+	ts.backend.SetDownlinkFrameFunc(func(pl gw.DownlinkFrame) {
+		downlinkFrameChan <- pl
+	})
+
+	downlink := gw.DownlinkFrame{
+		GatewayId: ts.gatewayID[:],
+		Token:     1234,
+		Items: []*gw.DownlinkFrameItem{
+			{PhyPayload: []byte{1, 2, 3, 4}},
+		},
+	}
+
+	// the first command is for a gateway which is not subscribed and must
+	// be ignored
+	ts.yieldCommand(lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}, "down", &gw.DownlinkFrame{Token: 1})
+	ts.yieldCommand(ts.gatewayID, "down", &downlink)
+
+	received := <-downlinkFrameChan
+	assert.True(proto.Equal(&downlink, &received))
+}
+
+func (ts *KafkaBackendTestSuite) TestGatewayIDMismatch() {
+	assert := require.New(ts.T())
+
+	downlinkFrameChan := make(chan gw.DownlinkFrame, 2)
+	ts.backend.SetDownlinkFrameFunc(func(pl gw.DownlinkFrame) {
+		downlinkFrameChan <- pl
+	})
+
+	otherGatewayID := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+	ts.yieldCommand(ts.gatewayID, "down", &gw.DownlinkFrame{
+		GatewayId: otherGatewayID[:],
+		Token:     1,
+		Items: []*gw.DownlinkFrameItem{
+			{PhyPayload: []byte{1, 2, 3, 4}},
+		},
+	})
+	ts.yieldCommand(ts.gatewayID, "down", &gw.DownlinkFrame{
+		GatewayId: ts.gatewayID[:],
+		Token:     2,
+		Items: []*gw.DownlinkFrameItem{
+			{PhyPayload: []byte{1, 2, 3, 4}},
+		},
+	})
+
+	// the command with the mismatching gateway id is rejected
+	received := <-downlinkFrameChan
+	assert.EqualValues(2, received.Token)
+}
+
+func (ts *KafkaBackendTestSuite) TestGatewayConfiguration() {
+	assert := require.New(ts.T())
+
+	gatewayConfigurationChan := make(chan gw.GatewayConfiguration, 1)
+	ts.backend.SetGatewayConfigurationFunc(func(pl gw.GatewayConfiguration) {
+		gatewayConfigurationChan <- pl
+	})
+
+	gatewayConfig := gw.GatewayConfiguration{
+		GatewayId: ts.gatewayID[:],
+		Version:   "1.2.3",
+	}
+	ts.yieldCommand(ts.gatewayID, "config", &gatewayConfig)
+
+	received := <-gatewayConfigurationChan
+	assert.True(proto.Equal(&gatewayConfig, &received))
+}
+
+func (ts *KafkaBackendTestSuite) TestGatewayCommandExecRequest() {
+	assert := require.New(ts.T())
+
+	execChan := make(chan gw.GatewayCommandExecRequest, 1)
+	ts.backend.SetGatewayCommandExecRequestFunc(func(pl gw.GatewayCommandExecRequest) {
+		execChan <- pl
+	})
+
+	execReq := gw.GatewayCommandExecRequest{
+		GatewayId: ts.gatewayID[:],
+		Command:   "reboot",
+		ExecId:    []byte{1, 2, 3, 4},
+	}
+	ts.yieldCommand(ts.gatewayID, "exec", &execReq)
+
+	received := <-execChan
+	assert.True(proto.Equal(&execReq, &received))
+}
+
+func (ts *KafkaBackendTestSuite) TestRawPacketForwarderCommand() {
+	assert := require.New(ts.T())
+
+	rawChan := make(chan gw.RawPacketForwarderCommand, 1)
+	ts.backend.SetRawPacketForwarderCommandFunc(func(pl gw.RawPacketForwarderCommand) {
+		rawChan <- pl
+	})
+
+	raw := gw.RawPacketForwarderCommand{
+		GatewayId: ts.gatewayID[:],
+		RawId:     []byte{1, 2, 3, 4},
+		Payload:   []byte{5, 6, 7, 8},
+	}
+	ts.yieldCommand(ts.gatewayID, "raw", &raw)
+
+	received := <-rawChan
+	assert.True(proto.Equal(&raw, &received))
+}
+
+func TestKafkaBackend(t *testing.T) {
+	suite.Run(t, new(KafkaBackendTestSuite))
+}
+
+func TestStopNotConnected(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.Kafka.Version = "1.0.0"
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	assert.NoError(b.Stop())
+
+	// Start returns once the integration has been stopped
+	assert.NoError(b.Start())
+}
+
+func TestNewSaramaConfig(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Version       string
+		SASLMechanism string
+		ExpectedError bool
+	}{
+		{
+			Name:    "no sasl",
+			Version: "1.0.0",
+		},
+		{
+			Name:          "sasl plain",
+			Version:       "1.0.0",
+			SASLMechanism: "plain",
+		},
+		{
+			Name:          "sasl scram",
+			Version:       "1.0.0",
+			SASLMechanism: "scram_sha512",
+		},
+		{
+			Name:          "unknown sasl mechanism",
+			Version:       "1.0.0",
+			SASLMechanism: "foo",
+			ExpectedError: true,
+		},
+		{
+			Name:          "version does not support idempotent producer",
+			Version:       "0.10.2.0",
+			ExpectedError: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var conf config.Config
+			conf.Integration.Kafka.Version = tst.Version
+			conf.Integration.Kafka.SASLMechanism = tst.SASLMechanism
+			conf.Integration.Kafka.SASLUsername = "user"
+			conf.Integration.Kafka.SASLPassword = "secret"
+
+			c, err := newSaramaConfig(conf)
+			if tst.ExpectedError {
+				assert.Error(err)
+				return
+			}
+
+			assert.NoError(err)
+			assert.True(c.Producer.Idempotent)
+			assert.Equal(tst.SASLMechanism != "", c.Net.SASL.Enable)
+		})
+	}
+}
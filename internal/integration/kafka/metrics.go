@@ -0,0 +1,35 @@
+package kafka
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_kafka_event_count",
+		Help: "The number of gateway events published by the Kafka integration (per event).",
+	}, []string{"event"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_kafka_command_count",
+		Help: "The number of commands received by the Kafka integration (per command).",
+	}, []string{"command"})
+
+	kafkac = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integration_kafka_connect_count",
+		Help: "The number of times the integration connected to the Kafka cluster.",
+	})
+)
+
+func kafkaEventCounter(e string) prometheus.Counter {
+	return pc.With(prometheus.Labels{"event": e})
+}
+
+func kafkaCommandCounter(c string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"command": c})
+}
+
+func kafkaConnectCounter() prometheus.Counter {
+	return kafkac
+}
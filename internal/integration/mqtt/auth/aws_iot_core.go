@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/tls"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+// awsALPNProtocol defines the ALPN protocol name which must be used when
+// connecting with MQTT over TLS on port 443.
+// See: https://docs.aws.amazon.com/iot/latest/developerguide/protocols.html
+const awsALPNProtocol = "x-amzn-mqtt-ca"
+
+// AWSIoTCoreAuthentication implements the AWS IoT Core (X.509 client
+// certificate) authentication.
+type AWSIoTCoreAuthentication struct {
+	server    string
+	thingName string
+	tlsConfig *tls.Config
+}
+
+// NewAWSIoTCoreAuthentication creates an AWSIoTCoreAuthentication.
+func NewAWSIoTCoreAuthentication(c config.Config) (Authentication, error) {
+	conf := c.Integration.MQTT.Auth.AWSIoTCore
+
+	if conf.ThingName == "" {
+		return nil, errors.New("thing_name must be set")
+	}
+
+	if conf.TLSCert == "" || conf.TLSKey == "" {
+		return nil, errors.New("tls_cert and tls_key must be set")
+	}
+
+	u, err := url.Parse(conf.Server)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse server error")
+	}
+
+	tlsConfig, err := newTLSConfig(conf.CACert, conf.TLSCert, conf.TLSKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "new tls config error")
+	}
+
+	// On port 443, AWS IoT Core requires the ALPN extension to distinguish
+	// MQTT from HTTPS traffic.
+	if u.Port() == "443" {
+		tlsConfig.NextProtos = []string{awsALPNProtocol}
+	}
+
+	return &AWSIoTCoreAuthentication{
+		server:    conf.Server,
+		thingName: conf.ThingName,
+		tlsConfig: tlsConfig,
+	}, nil
+}
+
+// Init applies the initial configuration.
+func (a *AWSIoTCoreAuthentication) Init(opts *mqtt.ClientOptions) error {
+	opts.AddBroker(a.server)
+	opts.SetClientID(a.thingName)
+	opts.SetTLSConfig(a.tlsConfig)
+
+	return nil
+}
+
+// Update updates the authentication options.
+func (a *AWSIoTCoreAuthentication) Update(opts *mqtt.ClientOptions) error {
+	return nil
+}
+
+// ReconnectAfter returns a time.Duration after which the MQTT client must re-connect.
+// Note: return 0 to disable the periodical re-connect feature.
+func (a *AWSIoTCoreAuthentication) ReconnectAfter() time.Duration {
+	return 0
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+// testCert holds a generated certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(assert *require.Assertions, template *x509.Certificate, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+
+	parentCert := template
+	parentKey := key
+	if parent != nil {
+		parentCert = parent.cert
+		parentKey = parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	assert.NoError(err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(err)
+
+	return testCert{cert: cert, key: key, der: der}
+}
+
+func writeTestCert(assert *require.Assertions, dir, name string, c testCert) (string, string) {
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(err)
+
+	assert.NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	assert.NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return certFile, keyFile
+}
+
+func TestAWSIoTCoreAuthentication(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "aws")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	notAfter := time.Now().Add(time.Hour)
+
+	ca := newTestCert(assert, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCert(assert, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := newTestCert(assert, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "gateway-thing"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	caFile, _ := writeTestCert(assert, dir, "ca", ca)
+	certFile, keyFile := writeTestCert(assert, dir, "client", client)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	// The local TLS server takes the role of the AWS IoT Core broker.
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{awsALPNProtocol},
+	})
+	assert.NoError(err)
+	defer ln.Close()
+
+	peers := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			peers <- ""
+			return
+		}
+		peers <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}()
+
+	var conf config.Config
+	conf.Integration.MQTT.Auth.AWSIoTCore.Server = fmt.Sprintf("ssl://%s", ln.Addr())
+	conf.Integration.MQTT.Auth.AWSIoTCore.ThingName = "gateway-thing"
+	conf.Integration.MQTT.Auth.AWSIoTCore.CACert = caFile
+	conf.Integration.MQTT.Auth.AWSIoTCore.TLSCert = certFile
+	conf.Integration.MQTT.Auth.AWSIoTCore.TLSKey = keyFile
+
+	t.Run("Init", func(t *testing.T) {
+		assert := require.New(t)
+
+		a, err := NewAWSIoTCoreAuthentication(conf)
+		assert.NoError(err)
+
+		opts := mqtt.NewClientOptions()
+		assert.NoError(a.Init(opts))
+		assert.NoError(a.Update(opts))
+
+		assert.Equal("gateway-thing", opts.ClientID)
+		assert.Len(opts.Servers, 1)
+		assert.Equal(ln.Addr().String(), opts.Servers[0].Host)
+		assert.Nil(opts.TLSConfig.NextProtos)
+
+		conn, err := tls.Dial("tcp", opts.Servers[0].Host, opts.TLSConfig)
+		assert.NoError(err)
+		defer conn.Close()
+
+		select {
+		case cn := <-peers:
+			assert.Equal("gateway-thing", cn)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for tls handshake")
+		}
+	})
+
+	t.Run("ALPN on port 443", func(t *testing.T) {
+		assert := require.New(t)
+
+		c := conf
+		c.Integration.MQTT.Auth.AWSIoTCore.Server = "ssl://example-ats.iot.eu-west-1.amazonaws.com:443"
+
+		a, err := NewAWSIoTCoreAuthentication(c)
+		assert.NoError(err)
+
+		opts := mqtt.NewClientOptions()
+		assert.NoError(a.Init(opts))
+		assert.Equal([]string{"x-amzn-mqtt-ca"}, opts.TLSConfig.NextProtos)
+	})
+
+	t.Run("Missing thing name", func(t *testing.T) {
+		assert := require.New(t)
+
+		c := conf
+		c.Integration.MQTT.Auth.AWSIoTCore.ThingName = ""
+
+		_, err := NewAWSIoTCoreAuthentication(c)
+		assert.Error(err)
+	})
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// credentials holds the credentials returned by the credential helper.
+//
+// Note: the password must never be logged.
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// ExpiresAt (optional) holds the expiration time (RFC3339).
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// ExpiresIn (optional) holds the lifetime in seconds.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// credentialHelper obtains the MQTT credentials by executing a command or
+// by reading a file. Both must return a JSON object, e.g.:
+//
+//	{"username": "gateway", "password": "eyJhbGciOi...", "expires_in": 3600}
+type credentialHelper struct {
+	command []string
+	file    string
+	timeout time.Duration
+}
+
+// get returns the credentials and the time at which these expire (zero when
+// the credentials do not expire).
+func (h *credentialHelper) get() (credentials, time.Time, error) {
+	var b []byte
+	var err error
+
+	if len(h.command) != 0 {
+		b, err = h.run()
+	} else {
+		b, err = ioutil.ReadFile(h.file)
+		if err != nil {
+			err = errors.Wrap(err, "read credential file error")
+		}
+	}
+	if err != nil {
+		return credentials{}, time.Time{}, err
+	}
+
+	var c credentials
+	// The decode error is not returned as it might contain parts of the
+	// secret.
+	if err := json.Unmarshal(b, &c); err != nil {
+		return credentials{}, time.Time{}, errors.New("decode credentials error: invalid json object")
+	}
+
+	expiresAt := c.ExpiresAt
+	if c.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(c.ExpiresIn) * time.Second)
+	}
+
+	return c, expiresAt, nil
+}
+
+// run executes the credential helper command and returns its output. The
+// stderr of the command is not returned as it might contain secrets.
+func (h *credentialHelper) run() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrap(err, "execute credential helper error")
+	}
+
+	return stdout.Bytes(), nil
+}
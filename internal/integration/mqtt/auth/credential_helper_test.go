@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+func TestGenericAuthenticationCredentialHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	credentialFile := filepath.Join(dir, "credentials.json")
+	require.NoError(t, ioutil.WriteFile(credentialFile, []byte(`{"username": "file-user", "password": "file-secret", "expires_at": "`+expiresAt.Format(time.RFC3339)+`"}`), 0600))
+
+	tests := []struct {
+		name             string
+		command          []string
+		file             string
+		expectedUsername string
+		expectedPassword string
+		minReconnect     time.Duration
+		maxReconnect     time.Duration
+		expectedError    bool
+	}{
+		{
+			name:             "command",
+			command:          []string{"sh", "-c", `echo '{"username": "cmd-user", "password": "cmd-secret", "expires_in": 100}'`},
+			expectedUsername: "cmd-user",
+			expectedPassword: "cmd-secret",
+			minReconnect:     89 * time.Second,
+			maxReconnect:     90 * time.Second,
+		},
+		{
+			name:             "command without expiration",
+			command:          []string{"sh", "-c", `echo '{"username": "cmd-user", "password": "cmd-secret"}'`},
+			expectedUsername: "cmd-user",
+			expectedPassword: "cmd-secret",
+		},
+		{
+			name:             "file",
+			file:             credentialFile,
+			expectedUsername: "file-user",
+			expectedPassword: "file-secret",
+			minReconnect:     53 * time.Minute,
+			maxReconnect:     54 * time.Minute,
+		},
+		{
+			name:          "command error",
+			command:       []string{"sh", "-c", "echo secret >&2; exit 1"},
+			expectedError: true,
+		},
+		{
+			name:          "invalid json",
+			command:       []string{"sh", "-c", "echo secret"},
+			expectedError: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var conf config.Config
+			conf.Integration.MQTT.Auth.Generic.Servers = []string{"tcp://127.0.0.1:1883"}
+			conf.Integration.MQTT.Auth.Generic.CredentialHelper.Command = tst.command
+			conf.Integration.MQTT.Auth.Generic.CredentialHelper.File = tst.file
+
+			a, err := NewGenericAuthentication(conf)
+			assert.NoError(err)
+
+			opts := mqtt.NewClientOptions()
+			assert.NoError(a.Init(opts))
+
+			err = a.Update(opts)
+			if tst.expectedError {
+				assert.Error(err)
+				assert.NotContains(err.Error(), "secret")
+				return
+			}
+			assert.NoError(err)
+
+			assert.Equal(tst.expectedUsername, opts.Username)
+			assert.Equal(tst.expectedPassword, opts.Password)
+
+			d := a.ReconnectAfter()
+			assert.True(d >= tst.minReconnect && d <= tst.maxReconnect, "reconnect after: %s", d)
+		})
+	}
+
+	t.Run("command and file", func(t *testing.T) {
+		assert := require.New(t)
+
+		var conf config.Config
+		conf.Integration.MQTT.Auth.Generic.CredentialHelper.Command = []string{"true"}
+		conf.Integration.MQTT.Auth.Generic.CredentialHelper.File = credentialFile
+
+		_, err := NewGenericAuthentication(conf)
+		assert.Error(err)
+	})
+}
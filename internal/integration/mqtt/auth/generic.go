@@ -2,10 +2,12 @@ package auth
 
 import (
 	"crypto/tls"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 )
@@ -19,8 +21,17 @@ type GenericAuthentication struct {
 	clientID     string
 
 	tlsConfig *tls.Config
+
+	credentialHelper *credentialHelper
+
+	mux       sync.RWMutex
+	expiresAt time.Time
 }
 
+// credentialRefreshRatio defines after which part of the credential lifetime
+// the client re-connects with fresh credentials.
+const credentialRefreshRatio = 0.9
+
 // NewGenericAuthentication creates a GenericAuthentication.
 func NewGenericAuthentication(conf config.Config) (Authentication, error) {
 	tlsConfig, err := newTLSConfig(
@@ -32,14 +43,33 @@ func NewGenericAuthentication(conf config.Config) (Authentication, error) {
 		return nil, errors.Wrap(err, "mqtt/auth: new tls config error")
 	}
 
-	return &GenericAuthentication{
+	a := GenericAuthentication{
 		tlsConfig:    tlsConfig,
 		servers:      conf.Integration.MQTT.Auth.Generic.Servers,
 		username:     conf.Integration.MQTT.Auth.Generic.Username,
 		password:     conf.Integration.MQTT.Auth.Generic.Password,
 		cleanSession: conf.Integration.MQTT.Auth.Generic.CleanSession,
 		clientID:     conf.Integration.MQTT.Auth.Generic.ClientID,
-	}, nil
+	}
+
+	helperConf := conf.Integration.MQTT.Auth.Generic.CredentialHelper
+	if len(helperConf.Command) != 0 || helperConf.File != "" {
+		if len(helperConf.Command) != 0 && helperConf.File != "" {
+			return nil, errors.New("mqtt/auth: credential helper command and file can not be used together")
+		}
+
+		a.credentialHelper = &credentialHelper{
+			command: helperConf.Command,
+			file:    helperConf.File,
+			timeout: helperConf.Timeout,
+		}
+
+		if a.credentialHelper.timeout == 0 {
+			a.credentialHelper.timeout = 10 * time.Second
+		}
+	}
+
+	return &a, nil
 }
 
 // Init applies the initial configuration.
@@ -59,13 +89,47 @@ func (a *GenericAuthentication) Init(opts *mqtt.ClientOptions) error {
 	return nil
 }
 
-// Update updates the authentication options.
+// Update updates the authentication options. When a credential helper is
+// configured, this obtains fresh credentials.
 func (a *GenericAuthentication) Update(opts *mqtt.ClientOptions) error {
+	if a.credentialHelper == nil {
+		return nil
+	}
+
+	creds, expiresAt, err := a.credentialHelper.get()
+	if err != nil {
+		return errors.Wrap(err, "get credentials error")
+	}
+
+	opts.SetUsername(creds.Username)
+	opts.SetPassword(creds.Password)
+
+	a.mux.Lock()
+	a.expiresAt = expiresAt
+	a.mux.Unlock()
+
+	log.WithFields(log.Fields{
+		"username":   creds.Username,
+		"expires_at": expiresAt,
+	}).Info("mqtt/auth: credentials obtained from credential helper")
+
 	return nil
 }
 
 // ReconnectAfter returns a time.Duration after which the MQTT client must re-connect.
 // Note: return 0 to disable the periodical re-connect feature.
 func (a *GenericAuthentication) ReconnectAfter() time.Duration {
-	return 0
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+
+	if a.expiresAt.IsZero() {
+		return 0
+	}
+
+	// Re-connect before the credentials expire.
+	d := time.Duration(float64(time.Until(a.expiresAt)) * credentialRefreshRatio)
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
 }
@@ -8,16 +8,23 @@ import (
 	"text/template"
 	"time"
 
+	paho5 "github.com/eclipse/paho.golang/paho"
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gofrs/uuid"
-	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/brocaar/chirpstack-api/go/v3/gw"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/mqtt/auth"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/mqtt/outbox"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/state"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/tracing"
 	"github.com/brocaar/lorawan"
 )
 
@@ -27,23 +34,60 @@ type Backend struct {
 
 	auth       auth.Authentication
 	conn       paho.Client
+	connV5     *paho5.Client
 	closed     bool
 	clientOpts *paho.ClientOptions
 
+	protocolVersion uint8
+	messageExpiry   time.Duration
+	execResponses   *cache.Cache
+
 	downlinkFrameFunc             func(gw.DownlinkFrame)
 	gatewayConfigurationFunc      func(gw.GatewayConfiguration)
 	gatewayCommandExecRequestFunc func(gw.GatewayCommandExecRequest)
 	rawPacketForwarderCommandFunc func(gw.RawPacketForwarderCommand)
+	metaDataFunc                  func() map[string]string
 
 	gateways                map[lorawan.EUI64]struct{}
 	terminateOnConnectError bool
 
 	qos                  uint8
+	commandQOS           uint8
+	events               map[string]eventConfig
 	eventTopicTemplate   *template.Template
 	commandTopicTemplate *template.Template
+	stateTopicTemplate   *template.Template
+	stateRetained        bool
+	bridgeStateTopic     string
+	sessionGatewayID     *lorawan.EUI64
+	backendType          string
+	will                 *message
+
+	marshal     func(msg proto.Message) ([]byte, error)
+	unmarshal   func(b []byte, msg proto.Message) error
+	contentType string
+
+	outbox       *outbox.Outbox
+	outboxNotify chan struct{}
+
+	sparkplug *sparkplugNode
+	shared    *sharedSubscription
+	limits    providerLimits
+}
 
-	marshal   func(msg proto.Message) ([]byte, error)
-	unmarshal func(b []byte, msg proto.Message) error
+// message holds an event which is ready to be published.
+type message struct {
+	Topic           string            `json:"topic"`
+	Payload         []byte            `json:"payload"`
+	GatewayID       lorawan.EUI64     `json:"gatewayID"`
+	Event           string            `json:"event"`
+	IDKey           string            `json:"idKey"`
+	ID              uuid.UUID         `json:"id"`
+	CorrelationData []byte            `json:"correlationData,omitempty"`
+	ResponseTopic   string            `json:"responseTopic,omitempty"`
+	MetaData        map[string]string `json:"metaData,omitempty"`
+	QOS             uint8             `json:"qos"`
+	Retain          bool              `json:"retain,omitempty"`
 }
 
 // NewBackend creates a new Backend.
@@ -51,10 +95,30 @@ func NewBackend(conf config.Config) (*Backend, error) {
 	var err error
 
 	b := Backend{
-		qos:                     conf.Integration.MQTT.Auth.Generic.QOS,
-		terminateOnConnectError: conf.Integration.MQTT.TerminateOnConnectError,
-		clientOpts:              paho.NewClientOptions(),
-		gateways:                make(map[lorawan.EUI64]struct{}),
+		clientOpts:      paho.NewClientOptions(),
+		gateways:        make(map[lorawan.EUI64]struct{}),
+		protocolVersion: conf.Integration.MQTT.ProtocolVersion,
+		messageExpiry:   conf.Integration.MQTT.MessageExpiry,
+		execResponses:   cache.New(execResponseExpiration, execResponseExpiration),
+		backendType:     conf.Backend.Type,
+		limits:          providerLimits{maxQOS: 2},
+	}
+
+	if conf.Integration.MQTT.Auth.Generic.QOS != nil {
+		b.qos = *conf.Integration.MQTT.Auth.Generic.QOS
+	}
+	if conf.Integration.MQTT.TerminateOnConnectError != nil {
+		b.terminateOnConnectError = *conf.Integration.MQTT.TerminateOnConnectError
+	}
+	if conf.Integration.MQTT.StateRetained != nil {
+		b.stateRetained = *conf.Integration.MQTT.StateRetained
+	}
+
+	if b.protocolVersion == 0 {
+		b.protocolVersion = 4
+	}
+	if b.protocolVersion != 4 && b.protocolVersion != 5 {
+		return nil, fmt.Errorf("integration/mqtt: unsupported protocol version: %d", b.protocolVersion)
 	}
 
 	switch conf.Integration.MQTT.Auth.Type {
@@ -71,6 +135,10 @@ func NewBackend(conf config.Config) (*Backend, error) {
 
 		conf.Integration.MQTT.EventTopicTemplate = "/devices/gw-{{ .GatewayID }}/events/{{ .EventType }}"
 		conf.Integration.MQTT.CommandTopicTemplate = "/devices/gw-{{ .GatewayID }}/commands/#"
+		conf.Integration.MQTT.StateTopicTemplate = "/devices/gw-{{ .GatewayID }}/state"
+		conf.Integration.MQTT.BridgeStateTopicTemplate = ""
+		b.stateRetained = false
+		b.limits = providerLimits{forcedTopics: true, maxQOS: 1, noRetain: true}
 	case "azure_iot_hub":
 		b.auth, err = auth.NewAzureIoTHubAuthentication(conf)
 		if err != nil {
@@ -79,37 +147,45 @@ func NewBackend(conf config.Config) (*Backend, error) {
 
 		conf.Integration.MQTT.EventTopicTemplate = "devices/{{ .GatewayID }}/messages/events/{{ .EventType }}"
 		conf.Integration.MQTT.CommandTopicTemplate = "devices/{{ .GatewayID }}/messages/devicebound/#"
+		conf.Integration.MQTT.StateTopicTemplate = "devices/{{ .GatewayID }}/messages/events/{{ .StateType }}"
+		conf.Integration.MQTT.BridgeStateTopicTemplate = ""
+		b.stateRetained = false
+		b.limits = providerLimits{forcedTopics: true, maxQOS: 1, noRetain: true}
+	case "aws_iot_core":
+		b.auth, err = auth.NewAWSIoTCoreAuthentication(conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "integration/mqtt: new AWS IoT Core authentication error")
+		}
+
+		// AWS IoT Core does not support QoS 2. Retained messages are not
+		// supported on all accounts and result in a disconnect when not.
+		b.limits = providerLimits{maxQOS: 1, noRetain: true, validateTopic: validateAWSTopic}
 	default:
 		return nil, fmt.Errorf("integration/mqtt: unknown auth type: %s", conf.Integration.MQTT.Auth.Type)
 	}
 
-	switch conf.Integration.Marshaler {
-	case "json":
-		b.marshal = func(msg proto.Message) ([]byte, error) {
-			marshaler := &jsonpb.Marshaler{
-				EnumsAsInts:  false,
-				EmitDefaults: true,
-			}
-			str, err := marshaler.MarshalToString(msg)
-			return []byte(str), err
-		}
+	m, err := marshaler.New(conf.Integration.Marshaler)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/mqtt: new marshaler error")
+	}
+	b.marshal = m.Marshal
+	b.unmarshal = m.Unmarshal
+	b.contentType = m.ContentType()
 
-		b.unmarshal = func(b []byte, msg proto.Message) error {
-			unmarshaler := &jsonpb.Unmarshaler{
-				AllowUnknownFields: true, // we don't want to fail on unknown fields
+	if b.protocolVersion != 5 && b.contentType != "application/json" {
+		for _, event := range []string{"up", "up_set", "ack"} {
+			if conf.MetaData.Events[event].Enabled {
+				log.WithField("event", event).Warning("integration/mqtt: meta-data requires MQTT v5 or a json marshaler, it is not published")
 			}
-			return unmarshaler.Unmarshal(bytes.NewReader(b), msg)
-		}
-	case "protobuf":
-		b.marshal = func(msg proto.Message) ([]byte, error) {
-			return proto.Marshal(msg)
 		}
+	}
 
-		b.unmarshal = func(b []byte, msg proto.Message) error {
-			return proto.Unmarshal(b, msg)
+	if conf.Integration.MQTT.Outbox.Path != "" {
+		b.outbox, err = outbox.New(conf.Integration.MQTT.Outbox.Path, conf.Integration.MQTT.Outbox.MaxSize, conf.Integration.MQTT.Outbox.MaxAge)
+		if err != nil {
+			return nil, errors.Wrap(err, "integration/mqtt: new outbox error")
 		}
-	default:
-		return nil, fmt.Errorf("integration/mqtt: unknown marshaler: %s", conf.Integration.Marshaler)
+		b.outboxNotify = make(chan struct{}, 1)
 	}
 
 	b.eventTopicTemplate, err = template.New("event").Parse(conf.Integration.MQTT.EventTopicTemplate)
@@ -122,6 +198,36 @@ func NewBackend(conf config.Config) (*Backend, error) {
 		return nil, errors.Wrap(err, "integration/mqtt: parse event-topic template error")
 	}
 
+	b.stateTopicTemplate, err = template.New("state").Parse(conf.Integration.MQTT.StateTopicTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/mqtt: parse state-topic template error")
+	}
+
+	b.commandQOS = b.qos
+	if conf.Integration.MQTT.CommandQOS != nil {
+		b.commandQOS = *conf.Integration.MQTT.CommandQOS
+	}
+	if b.commandQOS > 2 {
+		return nil, fmt.Errorf("integration/mqtt: invalid command qos: %d", b.commandQOS)
+	}
+
+	b.qos = b.capQOS("qos", b.qos)
+	b.commandQOS = b.capQOS("command qos", b.commandQOS)
+
+	if err = b.initEvents(conf.Integration.MQTT.Events, b.limits); err != nil {
+		return nil, errors.Wrap(err, "integration/mqtt: init events error")
+	}
+
+	if conf.Integration.MQTT.SharedSubscription.Enabled {
+		if b.limits.forcedTopics || conf.Integration.MQTT.SparkplugB.Enabled {
+			return nil, errors.New("integration/mqtt: shared subscription requires the generic auth type and can not be used with sparkplug b")
+		}
+
+		if err = b.initSharedSubscription(conf.Integration.MQTT.SharedSubscription.Group, conf.Integration.MQTT.SharedSubscription.ForwardTopicPrefix); err != nil {
+			return nil, errors.Wrap(err, "integration/mqtt: init shared subscription error")
+		}
+	}
+
 	b.clientOpts.SetProtocolVersion(4)
 	b.clientOpts.SetAutoReconnect(true) // this is required for buffering messages in case offline!
 	b.clientOpts.SetOnConnectHandler(b.onConnected)
@@ -133,23 +239,62 @@ func NewBackend(conf config.Config) (*Backend, error) {
 		return nil, errors.Wrap(err, "mqtt: init authentication error")
 	}
 
+	if conf.Integration.MQTT.SparkplugB.Enabled {
+		if err = b.initSparkplug(conf); err != nil {
+			return nil, errors.Wrap(err, "integration/mqtt: init sparkplug b error")
+		}
+	} else {
+		// The client ID is known after the authentication has been initialized.
+		if err = b.initBridgeState(conf.Integration.MQTT.BridgeStateTopicTemplate); err != nil {
+			return nil, errors.Wrap(err, "integration/mqtt: init bridge state error")
+		}
+	}
+
+	if err = b.validateTopics(); err != nil {
+		return nil, errors.Wrap(err, "integration/mqtt: validate topics error")
+	}
+
 	return &b, nil
 }
 
 // Start starts the integration.
 func (b *Backend) Start() error {
 	b.connectLoop()
+
+	// the integration was stopped while connecting
+	if b.isClosed() {
+		if b.isConnected() {
+			b.disconnect()
+		}
+		return nil
+	}
 	go b.reconnectLoop()
+
+	if b.outbox != nil {
+		go b.outboxLoop()
+	}
+
 	return nil
 }
 
 // Stop stops the integration.
 func (b *Backend) Stop() error {
+	b.publishOfflineState()
+
 	b.Lock()
 	b.closed = true
+	conn := b.conn
 	b.Unlock()
 
-	b.conn.Disconnect(250)
+	if b.protocolVersion == 5 {
+		b.disconnectV5()
+		return nil
+	}
+
+	// the client is not set when the integration never connected
+	if conn != nil {
+		conn.Disconnect(250)
+	}
 	return nil
 }
 
@@ -173,76 +318,114 @@ func (b *Backend) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderC
 	b.rawPacketForwarderCommandFunc = f
 }
 
+// SetMetaDataFunc sets the func returning the gateway meta-data, which is
+// published in the Sparkplug B birth certificates.
+func (b *Backend) SetMetaDataFunc(f func() map[string]string) {
+	b.metaDataFunc = f
+}
+
 // SetGatewaySubscription (un)subscribes the given gateway.
 func (b *Backend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
-	b.Lock()
-	defer b.Unlock()
-
 	log.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"subscribe":  subscribe,
 	}).Debug("integration/mqtt: set gateway subscription called")
 
+	// With Sparkplug B, the commands are received through the DCMD topic of
+	// the edge node.
+	if b.sparkplug != nil {
+		return b.setSparkplugDevice(subscribe, gatewayID)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
 	_, ok := b.gateways[gatewayID]
 	if ok == subscribe {
 		return nil
 	}
 
-	for {
-		if subscribe {
-			if err := b.subscribeGateway(gatewayID); err != nil {
-				log.WithError(err).WithFields(log.Fields{
-					"gateway_id": gatewayID,
-				}).Error("integration/mqtt: subscribe gateway error")
-				time.Sleep(time.Second)
-				continue
-			}
+	// The set of gateways is updated first, so that onConnected subscribes
+	// the gateway after a (re)connect. The (un)subscribe is not retried, as
+	// that would block the re-connect which requires the lock.
+	if subscribe {
+		b.gateways[gatewayID] = struct{}{}
+	} else {
+		delete(b.gateways, gatewayID)
+	}
 
-			b.gateways[gatewayID] = struct{}{}
-		} else {
-			if err := b.unsubscribeGateway(gatewayID); err != nil {
-				log.WithError(err).WithFields(log.Fields{
-					"gateway_id": gatewayID,
-				}).Error("integration/mqtt: unsubscribe gateway error")
-				time.Sleep(time.Second)
-				continue
-			}
+	if !b.connected() {
+		return nil
+	}
 
-			delete(b.gateways, gatewayID)
+	if subscribe {
+		if err := b.subscribeGateway(gatewayID); err != nil {
+			return errors.Wrap(err, "subscribe gateway error")
+		}
+	} else {
+		if err := b.unsubscribeGateway(gatewayID); err != nil {
+			return errors.Wrap(err, "unsubscribe gateway error")
 		}
-
-		break
 	}
 
 	return nil
 }
 
 func (b *Backend) subscribeGateway(gatewayID lorawan.EUI64) error {
+	topic, err := b.commandTopic(gatewayID)
+	if err != nil {
+		return err
+	}
+
+	return b.subscribeTopic(topic)
+}
+
+// commandTopic returns the command topic of the given gateway. With a shared
+// subscription, this returns the topic to which the commands are forwarded.
+func (b *Backend) commandTopic(gatewayID lorawan.EUI64) (string, error) {
 	topic := bytes.NewBuffer(nil)
 	if err := b.commandTopicTemplate.Execute(topic, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
-		return errors.Wrap(err, "execute command topic template error")
+		return "", errors.Wrap(err, "execute command topic template error")
 	}
+
+	if b.shared != nil {
+		return b.shared.forwardTopicPrefix + "/" + topic.String(), nil
+	}
+
+	return topic.String(), nil
+}
+
+// subscribeTopic subscribes to the given command topic.
+func (b *Backend) subscribeTopic(topic string) error {
 	log.WithFields(log.Fields{
-		"topic": topic.String(),
-		"qos":   b.qos,
+		"topic": topic,
+		"qos":   b.commandQOS,
 	}).Info("integration/mqtt: subscribing to topic")
 
-	if token := b.conn.Subscribe(topic.String(), b.qos, b.handleCommand); token.Wait() && token.Error() != nil {
+	if b.protocolVersion == 5 {
+		return b.subscribeV5(topic)
+	}
+
+	if token := b.conn.Subscribe(topic, b.commandQOS, b.handleCommand); token.Wait() && token.Error() != nil {
 		return errors.Wrap(token.Error(), "subscribe topic error")
 	}
 	return nil
 }
 
 func (b *Backend) unsubscribeGateway(gatewayID lorawan.EUI64) error {
-	topic := bytes.NewBuffer(nil)
-	if err := b.commandTopicTemplate.Execute(topic, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
-		return errors.Wrap(err, "execute command topic template error")
+	topic, err := b.commandTopic(gatewayID)
+	if err != nil {
+		return err
 	}
 	log.WithFields(log.Fields{
-		"topic": topic.String(),
+		"topic": topic,
 	}).Info("integration/mqtt: unsubscribing from topic")
 
-	if token := b.conn.Unsubscribe(topic.String()); token.Wait() && token.Error() != nil {
+	if b.protocolVersion == 5 {
+		return b.unsubscribeV5(topic)
+	}
+
+	if token := b.conn.Unsubscribe(topic); token.Wait() && token.Error() != nil {
 		return errors.Wrap(token.Error(), "unsubscribe topic error")
 	}
 
@@ -251,17 +434,39 @@ func (b *Backend) unsubscribeGateway(gatewayID lorawan.EUI64) error {
 
 // PublishEvent publishes the given event.
 func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	return b.PublishEventWithMetaData(gatewayID, event, id, v, nil)
+}
+
+// PublishEventWithMetaData publishes the given event together with the given
+// gateway meta-data.
+func (b *Backend) PublishEventWithMetaData(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message, metaData map[string]string) (err error) {
+	// only the uplinks and the tx acks are part of a trace
+	traceID := uuid.Nil
+	if event == "up" || event == "up_set" || event == "ack" {
+		traceID = id
+	}
+	span := tracing.Start(traceID[:], "mqtt.publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("gateway_id", gatewayID.String()),
+		attribute.String("event_type", event),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	mqttEventCounter(event).Inc()
 	idPrefix := map[string]string{
-		"up":    "uplink_",
-		"ack":   "downlink_",
-		"stats": "stats_",
-		"exec":  "exec_",
-		"raw":   "raw_",
+		"up":     "uplink_",
+		"up_set": "uplink_",
+		"ack":    "downlink_",
+		"stats":  "stats_",
+		"exec":   "exec_",
+		"raw":    "raw_",
+		"conn":   "conn_",
+	}
+
+	if b.sparkplug != nil {
+		return b.publishSparkplugEvent(gatewayID, event, idPrefix[event]+"id", id, v)
 	}
-	return b.publish(gatewayID, event, log.Fields{
-		idPrefix[event] + "id": id,
-	}, v)
+
+	return b.publish(gatewayID, event, idPrefix[event]+"id", id, v, metaData)
 }
 
 func (b *Backend) connect() error {
@@ -272,6 +477,16 @@ func (b *Backend) connect() error {
 		return errors.Wrap(err, "integration/mqtt: update authentication error")
 	}
 
+	if b.sparkplug != nil {
+		if err := b.setSparkplugWill(); err != nil {
+			return errors.Wrap(err, "integration/mqtt: set sparkplug will error")
+		}
+	}
+
+	if b.protocolVersion == 5 {
+		return b.connectV5()
+	}
+
 	b.conn = paho.NewClient(b.clientOpts)
 	if token := b.conn.Connect(); token.Wait() && token.Error() != nil {
 		return token.Error()
@@ -280,9 +495,14 @@ func (b *Backend) connect() error {
 	return nil
 }
 
-// connectLoop blocks until the client is connected
+// connectLoop blocks until the client is connected or the integration has
+// been stopped.
 func (b *Backend) connectLoop() {
 	for {
+		if b.isClosed() {
+			return
+		}
+
 		if err := b.connect(); err != nil {
 			if b.terminateOnConnectError {
 				log.Fatal(err)
@@ -297,9 +517,20 @@ func (b *Backend) connectLoop() {
 	}
 }
 
+func (b *Backend) isClosed() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.closed
+}
+
 func (b *Backend) disconnect() error {
 	mqttDisconnectCounter().Inc()
 
+	if b.protocolVersion == 5 {
+		b.disconnectV5()
+		return nil
+	}
+
 	b.Lock()
 	defer b.Unlock()
 
@@ -327,21 +558,73 @@ func (b *Backend) reconnectLoop() {
 func (b *Backend) onConnected(c paho.Client) {
 	mqttConnectCounter().Inc()
 
-	b.RLock()
-	defer b.RUnlock()
-
 	log.Info("integration/mqtt: connected to mqtt broker")
 
+	if b.sparkplug != nil {
+		b.sparkplugBirth()
+		return
+	}
+
+	go b.publishBridgeState(state.ConnState_ONLINE)
+	go b.publishSessionGatewayState(state.ConnState_ONLINE)
+
+	if b.outbox != nil {
+		b.notifyOutbox()
+	}
+
+	if b.shared != nil {
+		b.retrySubscribe(func() error {
+			if err := b.subscribeShared(); err != nil {
+				return errors.Wrap(err, "subscribe shared subscription error")
+			}
+			return nil
+		})
+	}
+
+	b.RLock()
+	var gatewayIDs []lorawan.EUI64
 	for gatewayID := range b.gateways {
-		for {
+		gatewayIDs = append(gatewayIDs, gatewayID)
+	}
+	b.RUnlock()
+
+	for _, gatewayID := range gatewayIDs {
+		gatewayID := gatewayID
+		b.retrySubscribe(func() error {
+			// the gateway was unsubscribed in the meantime
+			if _, ok := b.gateways[gatewayID]; !ok {
+				return nil
+			}
+
 			if err := b.subscribeGateway(gatewayID); err != nil {
-				log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: subscribe gateway error")
-				time.Sleep(time.Second)
-				continue
+				return errors.Wrapf(err, "subscribe gateway %s error", gatewayID)
 			}
+			return nil
+		})
+	}
+}
 
-			break
+// retrySubscribe calls the given subscribe func, with the read-lock held,
+// until it succeeds. The lock is released while waiting for the next
+// attempt, so that a lost connection can be re-connected. The retrying stops
+// when the integration has been closed or the connection has been lost, as
+// onConnected subscribes again after the re-connect.
+func (b *Backend) retrySubscribe(subscribe func() error) {
+	for {
+		b.RLock()
+		if b.closed || !b.connected() {
+			b.RUnlock()
+			return
 		}
+		err := subscribe()
+		b.RUnlock()
+
+		if err == nil {
+			return
+		}
+
+		log.WithError(err).Error("integration/mqtt: subscribe error")
+		time.Sleep(time.Second)
 	}
 }
 
@@ -351,6 +634,8 @@ func (b *Backend) onConnectionLost(c paho.Client, err error) {
 }
 
 func (b *Backend) handleDownlinkFrame(c paho.Client, msg paho.Message) {
+	received := time.Now()
+
 	var downlinkFrame gw.DownlinkFrame
 	if err := b.unmarshal(msg.Payload(), &downlinkFrame); err != nil {
 		log.WithFields(log.Fields{
@@ -382,6 +667,13 @@ func (b *Backend) handleDownlinkFrame(c paho.Client, msg paho.Message) {
 	var gatewayID lorawan.EUI64
 	copy(gatewayID[:], downlinkFrame.GatewayId)
 
+	span := tracing.Start(downID[:], "mqtt.down", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithTimestamp(received), trace.WithAttributes(
+		attribute.String("gateway_id", gatewayID.String()),
+		attribute.Int64("token", int64(downlinkFrame.Token)),
+		attribute.String("topic", msg.Topic()),
+	))
+	defer span.End()
+
 	log.WithFields(log.Fields{
 		"gateway_id":  gatewayID,
 		"downlink_id": downID,
@@ -422,6 +714,15 @@ func (b *Backend) handleGatewayCommandExecRequest(c paho.Client, msg paho.Messag
 	copy(gatewayID[:], gatewayCommandExecRequest.GetGatewayId())
 	copy(execID[:], gatewayCommandExecRequest.GetExecId())
 
+	// With MQTT v5, the response is published to the response topic of the
+	// request (if set).
+	if m, ok := msg.(v5Message); ok && m.Properties != nil && m.Properties.ResponseTopic != "" {
+		b.execResponses.SetDefault(execID.String(), execResponse{
+			topic:           m.Properties.ResponseTopic,
+			correlationData: m.Properties.CorrelationData,
+		})
+	}
+
 	log.WithFields(log.Fields{
 		"gateway_id": gatewayID,
 		"exec_id":    execID,
@@ -457,6 +758,22 @@ func (b *Backend) handleRawPacketForwarderCommand(c paho.Client, msg paho.Messag
 }
 
 func (b *Backend) handleCommand(c paho.Client, msg paho.Message) {
+	if b.sparkplug != nil {
+		b.handleSparkplugCommand(c, msg)
+		return
+	}
+
+	if b.shared != nil && !b.isForwardedCommand(msg.Topic()) {
+		go b.routeSharedCommand(c, msg)
+		return
+	}
+
+	b.dispatchCommand(c, msg)
+}
+
+// dispatchCommand dispatches the given command to its handler, based on the
+// command type in the topic.
+func (b *Backend) dispatchCommand(c paho.Client, msg paho.Message) {
 	if strings.HasSuffix(msg.Topic(), "down") || strings.Contains(msg.Topic(), "command=down") {
 		mqttCommandCounter("down").Inc()
 		b.handleDownlinkFrame(c, msg)
@@ -474,26 +791,107 @@ func (b *Backend) handleCommand(c paho.Client, msg paho.Message) {
 	}
 }
 
-func (b *Backend) publish(gatewayID lorawan.EUI64, event string, fields log.Fields, msg proto.Message) error {
+func (b *Backend) publish(gatewayID lorawan.EUI64, event string, idKey string, id uuid.UUID, msg proto.Message, metaData map[string]string) error {
+	m, err := b.newMessage(gatewayID, event, idKey, id, msg)
+	if err != nil {
+		return err
+	}
+
+	if err := b.setMetaData(&m, metaData); err != nil {
+		return errors.Wrap(err, "set meta-data error")
+	}
+
+	if b.outbox != nil {
+		return b.sendOrEnqueue(m)
+	}
+
+	return b.send(m)
+}
+
+// newMessage returns the message for the given event.
+func (b *Backend) newMessage(gatewayID lorawan.EUI64, event string, idKey string, id uuid.UUID, msg proto.Message) (message, error) {
+	qos := b.qos
+	retain := false
+	tmpl := b.eventTopicTemplate
+
+	// Connection-state events are published to the state topic.
+	if event == "conn" {
+		retain = b.stateRetained
+		tmpl = b.stateTopicTemplate
+	}
+
+	if ec, ok := b.events[event]; ok {
+		if ec.qos != nil {
+			qos = *ec.qos
+		}
+		if ec.retain != nil {
+			retain = *ec.retain
+		}
+		if ec.topicTemplate != nil {
+			tmpl = ec.topicTemplate
+		}
+	}
+
+	if b.limits.noRetain {
+		retain = false
+	}
+
 	topic := bytes.NewBuffer(nil)
-	if err := b.eventTopicTemplate.Execute(topic, struct {
-		GatewayID lorawan.EUI64
-		EventType string
-	}{gatewayID, event}); err != nil {
-		return errors.Wrap(err, "execute event template error")
+	if err := tmpl.Execute(topic, topicData{
+		GatewayID: gatewayID,
+		EventType: event,
+		StateType: event,
+	}); err != nil {
+		return message{}, errors.Wrap(err, "execute topic template error")
 	}
 
 	bytes, err := b.marshal(msg)
 	if err != nil {
-		return errors.Wrap(err, "marshal message error")
+		return message{}, errors.Wrap(err, "marshal message error")
 	}
 
-	fields["topic"] = topic.String()
-	fields["qos"] = b.qos
-	fields["event"] = event
+	m := message{
+		Topic:     topic.String(),
+		Payload:   bytes,
+		GatewayID: gatewayID,
+		Event:     event,
+		IDKey:     idKey,
+		ID:        id,
+		QOS:       qos,
+		Retain:    retain,
+	}
+
+	// Reply to the requester of the gateway command execution (MQTT v5).
+	if resp, ok := msg.(*gw.GatewayCommandExecResponse); ok {
+		var execID uuid.UUID
+		copy(execID[:], resp.GetExecId())
+
+		if v, ok := b.execResponses.Get(execID.String()); ok {
+			b.execResponses.Delete(execID.String())
+
+			er := v.(execResponse)
+			m.Topic = er.topic
+			m.CorrelationData = er.correlationData
+		}
+	}
+
+	return m, nil
+}
+
+// send publishes the given message.
+func (b *Backend) send(m message) error {
+	log.WithFields(log.Fields{
+		m.IDKey: m.ID,
+		"topic": m.Topic,
+		"qos":   m.QOS,
+		"event": m.Event,
+	}).Info("integration/mqtt: publishing event")
+
+	if b.protocolVersion == 5 {
+		return b.publishV5(m)
+	}
 
-	log.WithFields(fields).Info("integration/mqtt: publishing event")
-	if token := b.conn.Publish(topic.String(), b.qos, false, bytes); token.Wait() && token.Error() != nil {
+	if token := b.conn.Publish(m.Topic, m.QOS, m.Retain, m.Payload); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 	return nil
@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"fmt"
+	"text/template"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// eventConfig holds the per event-type overrides. Nil values fall back to
+// the connection defaults.
+type eventConfig struct {
+	qos           *uint8
+	retain        *bool
+	topicTemplate *template.Template
+}
+
+// topicData holds the data used for executing the event and state topic
+// templates.
+type topicData struct {
+	GatewayID lorawan.EUI64
+	EventType string
+	StateType string
+}
+
+// initEvents initializes the per event-type configuration. Overrides which
+// are not supported by the authentication provider (e.g. GCP Cloud IoT Core)
+// are ignored or limited, as these would be rejected by the broker.
+func (b *Backend) initEvents(events map[string]config.MQTTEvent, limits providerLimits) error {
+	b.events = make(map[string]eventConfig)
+
+	for event, c := range events {
+		var ec eventConfig
+
+		if c.QOS != nil {
+			qos := *c.QOS
+			if qos > 2 {
+				return fmt.Errorf("invalid qos %d for event %s", qos, event)
+			}
+
+			if qos > limits.maxQOS {
+				log.WithField("event", event).Warningf("integration/mqtt: qos %d is not supported by the auth provider, using qos %d", qos, limits.maxQOS)
+				qos = limits.maxQOS
+			}
+
+			ec.qos = &qos
+		}
+
+		if c.Retain != nil {
+			if limits.noRetain {
+				log.WithField("event", event).Warning("integration/mqtt: retain is not supported by the auth provider, ignoring")
+			} else {
+				ec.retain = c.Retain
+			}
+		}
+
+		if c.TopicTemplate != "" {
+			if limits.forcedTopics {
+				log.WithField("event", event).Warning("integration/mqtt: topic template is forced by the auth provider, ignoring")
+			} else {
+				var err error
+				ec.topicTemplate, err = template.New(event).Parse(c.TopicTemplate)
+				if err != nil {
+					return errors.Wrapf(err, "parse topic template for event %s error", event)
+				}
+			}
+		}
+
+		b.events[event] = ec
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestEventConfig(t *testing.T) {
+	assert := require.New(t)
+
+	qos1 := uint8(1)
+	qos2 := uint8(2)
+	retain := true
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.StateTopicTemplate = "gateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.Integration.MQTT.StateRetained = &retain
+	conf.Integration.MQTT.CommandQOS = &qos1
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{"tcp://127.0.0.1:1883"}
+	conf.Integration.MQTT.Events = map[string]config.MQTTEvent{
+		"stats": {
+			QOS:           &qos2,
+			Retain:        &retain,
+			TopicTemplate: "gateway/{{ .GatewayID }}/stats",
+		},
+		"up": {
+			QOS: &qos1,
+		},
+	}
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	assert.Equal(uint8(1), b.commandQOS)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	tests := []struct {
+		event  string
+		topic  string
+		qos    uint8
+		retain bool
+	}{
+		{"stats", "gateway/0102030405060708/stats", 2, true},
+		{"up", "gateway/0102030405060708/event/up", 1, false},
+		{"ack", "gateway/0102030405060708/event/ack", 0, false},
+		{"conn", "gateway/0102030405060708/state/conn", 0, true},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.event, func(t *testing.T) {
+			assert := require.New(t)
+
+			m, err := b.newMessage(gatewayID, tst.event, "id", uuid.Nil, &gw.GatewayStats{})
+			assert.NoError(err)
+			assert.Equal(tst.topic, m.Topic)
+			assert.Equal(tst.qos, m.QOS)
+			assert.Equal(tst.retain, m.Retain)
+		})
+	}
+
+	t.Run("Invalid QoS", func(t *testing.T) {
+		assert := require.New(t)
+
+		qos := uint8(3)
+		var b Backend
+		assert.Error(b.initEvents(map[string]config.MQTTEvent{
+			"up": {QOS: &qos},
+		}, providerLimits{maxQOS: 2}))
+	})
+
+	t.Run("Forced topics", func(t *testing.T) {
+		assert := require.New(t)
+
+		var b Backend
+		assert.NoError(b.initEvents(conf.Integration.MQTT.Events, providerLimits{forcedTopics: true, maxQOS: 1, noRetain: true}))
+
+		ec := b.events["stats"]
+		assert.Equal(uint8(1), *ec.qos)
+		assert.Nil(ec.retain)
+		assert.Nil(ec.topicTemplate)
+	})
+}
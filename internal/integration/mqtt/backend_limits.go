@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+)
+
+// AWS IoT Core topic restrictions.
+// See: https://docs.aws.amazon.com/general/latest/gr/iot-core.html#message-broker-limits
+const (
+	awsMaxTopicLength  = 256
+	awsMaxTopicSlashes = 7
+)
+
+// providerLimits holds the restrictions of the MQTT broker of the
+// authentication provider.
+type providerLimits struct {
+	// forcedTopics is set when the topics are fixed by the provider.
+	forcedTopics bool
+
+	// maxQOS holds the highest supported QoS level.
+	maxQOS uint8
+
+	// noRetain is set when retained messages are not supported.
+	noRetain bool
+
+	// validateTopic (optional) validates the topics against the provider
+	// restrictions.
+	validateTopic func(topic string) error
+}
+
+// capQOS returns the given QoS, limited to the highest QoS level supported
+// by the provider.
+func (b *Backend) capQOS(name string, qos uint8) uint8 {
+	if qos <= b.limits.maxQOS {
+		return qos
+	}
+
+	log.WithFields(log.Fields{
+		"qos":     qos,
+		"max_qos": b.limits.maxQOS,
+	}).Warningf("integration/mqtt: %s is not supported by the auth provider, using max. qos", name)
+
+	return b.limits.maxQOS
+}
+
+// validateTopics validates the event, state and command topics against the
+// provider restrictions.
+func (b *Backend) validateTopics() error {
+	if b.limits.validateTopic == nil {
+		return nil
+	}
+
+	// The longest topics are generated by the longest event type.
+	data := topicData{
+		GatewayID: lorawan.EUI64{},
+		EventType: "up_set",
+		StateType: "conn",
+	}
+
+	tmpls := []*template.Template{b.eventTopicTemplate, b.commandTopicTemplate, b.stateTopicTemplate}
+	for _, ec := range b.events {
+		if ec.topicTemplate != nil {
+			tmpls = append(tmpls, ec.topicTemplate)
+		}
+	}
+
+	var topics []string
+	for _, tmpl := range tmpls {
+		topic := bytes.NewBuffer(nil)
+		if err := tmpl.Execute(topic, data); err != nil {
+			return errors.Wrapf(err, "execute %s topic template error", tmpl.Name())
+		}
+		topics = append(topics, topic.String())
+	}
+
+	if b.bridgeStateTopic != "" {
+		topics = append(topics, b.bridgeStateTopic)
+	}
+
+	for _, topic := range topics {
+		if err := b.limits.validateTopic(topic); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateAWSTopic validates the given topic against the AWS IoT Core topic
+// restrictions.
+func validateAWSTopic(topic string) error {
+	if strings.HasPrefix(topic, "$") {
+		return fmt.Errorf("topic %s must not start with '$', which is reserved by aws iot core", topic)
+	}
+	if len(topic) > awsMaxTopicLength {
+		return fmt.Errorf("topic %s exceeds the max. length of %d bytes", topic, awsMaxTopicLength)
+	}
+	if n := strings.Count(topic, "/"); n > awsMaxTopicSlashes {
+		return fmt.Errorf("topic %s exceeds the max. number of %d forward slashes", topic, awsMaxTopicSlashes)
+	}
+	return nil
+}
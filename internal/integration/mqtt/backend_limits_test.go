@@ -0,0 +1,87 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestValidateAWSTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		valid bool
+	}{
+		{"gateway/0102030405060708/event/up", true},
+		{"a/b/c/d/e/f/g/h", true},
+		{"a/b/c/d/e/f/g/h/i", false},
+		{"$aws/things/gateway/shadow/update", false},
+		{strings.Repeat("a", 257), false},
+	}
+
+	for _, tst := range tests {
+		err := validateAWSTopic(tst.topic)
+		if tst.valid {
+			require.NoError(t, err, tst.topic)
+		} else {
+			require.Error(t, err, tst.topic)
+		}
+	}
+}
+
+func TestProviderLimits(t *testing.T) {
+	assert := require.New(t)
+
+	retain := true
+	qos := uint8(2)
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.StateTopicTemplate = "gateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.Integration.MQTT.StateRetained = &retain
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{"tcp://127.0.0.1:1883"}
+	conf.Integration.MQTT.Auth.Generic.QOS = &qos
+	conf.Integration.MQTT.Events = map[string]config.MQTTEvent{
+		"stats": {
+			Retain: &retain,
+		},
+	}
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	// Apply the AWS IoT Core limits.
+	b.limits = providerLimits{maxQOS: 1, noRetain: true, validateTopic: validateAWSTopic}
+	assert.Equal(uint8(1), b.capQOS("qos", b.qos))
+	assert.NoError(b.initEvents(conf.Integration.MQTT.Events, b.limits))
+	assert.NoError(b.validateTopics())
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	for _, event := range []string{"stats", "conn"} {
+		m, err := b.newMessage(gatewayID, event, "id", uuid.Nil, &gw.GatewayStats{})
+		assert.NoError(err)
+		assert.False(m.Retain, event)
+	}
+
+	t.Run("Invalid topic", func(t *testing.T) {
+		assert := require.New(t)
+
+		c := conf
+		c.Integration.MQTT.EventTopicTemplate = "a/b/c/d/e/f/g/{{ .GatewayID }}/{{ .EventType }}"
+
+		b, err := NewBackend(c)
+		assert.NoError(err)
+
+		b.limits.validateTopic = validateAWSTopic
+		assert.Error(b.validateTopics())
+	})
+}
@@ -0,0 +1,61 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sort"
+
+	paho5 "github.com/eclipse/paho.golang/paho"
+	"github.com/pkg/errors"
+)
+
+// metaDataPropertyPrefix defines the prefix of the MQTT v5 user properties
+// holding the gateway meta-data.
+const metaDataPropertyPrefix = "meta_data."
+
+// setMetaData adds the given gateway meta-data to the given message. With
+// MQTT v5, the meta-data is published as user properties. Otherwise it is
+// added to the payload as metaData object, which requires a JSON marshaler.
+func (b *Backend) setMetaData(m *message, metaData map[string]string) error {
+	if len(metaData) == 0 {
+		return nil
+	}
+
+	if b.protocolVersion == 5 {
+		m.MetaData = metaData
+		return nil
+	}
+
+	if b.contentType != "application/json" {
+		return nil
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(m.Payload, &obj); err != nil {
+		return errors.Wrap(err, "unmarshal json error")
+	}
+	obj["metaData"] = metaData
+
+	payload, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrap(err, "marshal json error")
+	}
+	m.Payload = payload
+
+	return nil
+}
+
+// metaDataProperties returns the given meta-data as MQTT v5 user properties
+// (sorted by key).
+func metaDataProperties(metaData map[string]string) paho5.UserProperties {
+	var keys []string
+	for k := range metaData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var props paho5.UserProperties
+	for _, k := range keys {
+		props = append(props, paho5.UserProperty{Key: metaDataPropertyPrefix + k, Value: metaData[k]})
+	}
+	return props
+}
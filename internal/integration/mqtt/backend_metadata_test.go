@@ -0,0 +1,82 @@
+package mqtt
+
+import (
+	"testing"
+
+	paho5 "github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetMetaData(t *testing.T) {
+	metaData := map[string]string{
+		"site":    "hq",
+		"antenna": "north",
+	}
+
+	tests := []struct {
+		name            string
+		protocolVersion uint8
+		contentType     string
+		metaData        map[string]string
+		expectedPayload string
+		expectedMeta    map[string]string
+	}{
+		{
+			name:            "no meta-data",
+			protocolVersion: 4,
+			contentType:     "application/json",
+			expectedPayload: `{"rxInfo":{}}`,
+		},
+		{
+			name:            "json payload",
+			protocolVersion: 4,
+			contentType:     "application/json",
+			metaData:        metaData,
+			expectedPayload: `{"metaData":{"antenna":"north","site":"hq"},"rxInfo":{}}`,
+		},
+		{
+			name:            "protobuf payload",
+			protocolVersion: 4,
+			contentType:     "application/octet-stream",
+			metaData:        metaData,
+			expectedPayload: `{"rxInfo":{}}`,
+		},
+		{
+			name:            "mqtt v5",
+			protocolVersion: 5,
+			contentType:     "application/json",
+			metaData:        metaData,
+			expectedPayload: `{"rxInfo":{}}`,
+			expectedMeta:    metaData,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			b := Backend{
+				protocolVersion: tst.protocolVersion,
+				contentType:     tst.contentType,
+			}
+
+			m := message{Payload: []byte(`{"rxInfo":{}}`)}
+			assert.NoError(b.setMetaData(&m, tst.metaData))
+			assert.Equal(tst.expectedPayload, string(m.Payload))
+			assert.Equal(tst.expectedMeta, m.MetaData)
+		})
+	}
+}
+
+func TestMetaDataProperties(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal(paho5.UserProperties{
+		{Key: "meta_data.antenna", Value: "north"},
+		{Key: "meta_data.site", Value: "hq"},
+	}, metaDataProperties(map[string]string{
+		"site":    "hq",
+		"antenna": "north",
+	}))
+	assert.Nil(metaDataProperties(nil))
+}
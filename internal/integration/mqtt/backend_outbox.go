@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// outboxRetryInterval defines the interval in which the outbox is drained
+// when no (re)connect has been signaled.
+const outboxRetryInterval = 5 * time.Second
+
+// sendOrEnqueue publishes the given message directly when connected and
+// the outbox is empty (so that the order is kept). When not connected or
+// when the publish fails, the message is stored in the outbox. This avoids
+// writing each message to disk while connected.
+func (b *Backend) sendOrEnqueue(m message) error {
+	if b.isConnected() && b.outbox.Len() == 0 {
+		err := b.send(m)
+		if err == nil {
+			return nil
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			m.IDKey: m.ID,
+			"event": m.Event,
+		}).Warning("integration/mqtt: publish event error, storing event in outbox")
+	}
+
+	return b.enqueue(m)
+}
+
+// enqueue stores the given message in the outbox. The message is published
+// by the outbox loop.
+func (b *Backend) enqueue(m message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "marshal outbox message error")
+	}
+
+	if err := b.outbox.Push(data); err != nil {
+		return errors.Wrap(err, "store message in outbox error")
+	}
+
+	log.WithFields(log.Fields{
+		m.IDKey: m.ID,
+		"event": m.Event,
+	}).Debug("integration/mqtt: event stored in outbox")
+
+	b.notifyOutbox()
+
+	return nil
+}
+
+// notifyOutbox signals the outbox loop that the outbox must be drained.
+func (b *Backend) notifyOutbox() {
+	select {
+	case b.outboxNotify <- struct{}{}:
+	default:
+	}
+}
+
+// outboxLoop drains the outbox on every notify, or periodically.
+func (b *Backend) outboxLoop() {
+	for {
+		select {
+		case <-b.outboxNotify:
+		case <-time.After(outboxRetryInterval):
+		}
+
+		b.RLock()
+		closed := b.closed
+		b.RUnlock()
+
+		if closed {
+			return
+		}
+
+		b.drainOutbox()
+	}
+}
+
+// drainOutbox publishes the messages stored in the outbox, in order. It
+// returns when the outbox is empty or on the first publish error.
+func (b *Backend) drainOutbox() {
+	for b.isConnected() {
+		item, err := b.outbox.Peek()
+		if err != nil {
+			log.WithError(err).Error("integration/mqtt: read outbox error")
+			return
+		}
+
+		if item == nil {
+			return
+		}
+
+		var m message
+		if err := json.Unmarshal(item.Data, &m); err != nil {
+			log.WithError(err).Error("integration/mqtt: unmarshal outbox message error")
+		} else if err := b.send(m); err != nil {
+			log.WithError(err).Warning("integration/mqtt: publish outbox message error")
+			return
+		}
+
+		if err := b.outbox.Remove(item.ID); err != nil {
+			log.WithError(err).Error("integration/mqtt: remove outbox message error")
+			return
+		}
+	}
+}
+
+// isConnected returns true when the client is connected to the MQTT broker.
+func (b *Backend) isConnected() bool {
+	b.RLock()
+	defer b.RUnlock()
+
+	return b.connected()
+}
+
+// connected returns true when the integration is connected. It must be
+// called with the lock held.
+func (b *Backend) connected() bool {
+	if b.protocolVersion == 5 {
+		return b.connV5 != nil
+	}
+
+	return b.conn != nil && b.conn.IsConnectionOpen()
+}
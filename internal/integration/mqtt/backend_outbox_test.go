@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+func TestOutbox(t *testing.T) {
+	assert := require.New(t)
+
+	log.SetLevel(log.ErrorLevel)
+
+	server := "tcp://127.0.0.1:1883/1"
+	var username string
+	var password string
+
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		server = v
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		username = v
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		password = v
+	}
+
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	opts := paho.NewClientOptions().AddBroker(server).SetUsername(username).SetPassword(password)
+	mqttClient := paho.NewClient(opts)
+	token := mqttClient.Connect()
+	token.Wait()
+	assert.NoError(token.Error())
+	defer mqttClient.Disconnect(0)
+
+	var json marshaler.JSON
+	statsIDs := make(chan []byte, 10)
+	token = mqttClient.Subscribe("outbox/gateway/+/event/stats", 0, func(c paho.Client, msg paho.Message) {
+		var pl gw.GatewayStats
+		if err := json.Unmarshal(msg.Payload(), &pl); err == nil {
+			statsIDs <- pl.StatsId
+		}
+	})
+	token.Wait()
+	assert.NoError(token.Error())
+
+	gatewayID := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 4}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "outbox/gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "outbox/gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.Outbox.Path = dir
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{server}
+	conf.Integration.MQTT.Auth.Generic.Username = username
+	conf.Integration.MQTT.Auth.Generic.Password = password
+	conf.Integration.MQTT.Auth.Generic.CleanSession = true
+
+	// events published before the backend is connected are stored in the
+	// outbox and must survive a restart
+	backend, err := NewBackend(conf)
+	assert.NoError(err)
+
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id, err := uuid.NewV4()
+		assert.NoError(err)
+		ids = append(ids, id[:])
+
+		assert.NoError(backend.PublishEvent(gatewayID, "stats", id, &gw.GatewayStats{
+			GatewayId: gatewayID[:],
+			StatsId:   id[:],
+		}))
+	}
+	assert.Equal(3, backend.outbox.Len())
+
+	backend, err = NewBackend(conf)
+	assert.NoError(err)
+	assert.Equal(3, backend.outbox.Len())
+	assert.NoError(backend.Start())
+	defer backend.Stop()
+
+	for _, id := range ids {
+		select {
+		case received := <-statsIDs:
+			assert.Equal(id, received)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}
+
+	assert.Equal(0, backend.outbox.Len())
+
+	// events are published directly when connected
+	id, err := uuid.NewV4()
+	assert.NoError(err)
+	assert.NoError(backend.PublishEvent(gatewayID, "stats", id, &gw.GatewayStats{
+		GatewayId: gatewayID[:],
+		StatsId:   id[:],
+	}))
+	assert.Equal(0, backend.outbox.Len())
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	for _, f := range files {
+		assert.True(f.IsDir(), "unexpected outbox file: %s", f.Name())
+	}
+
+	select {
+	case received := <-statsIDs:
+		assert.Equal(id[:], received)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
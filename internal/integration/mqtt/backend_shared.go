@@ -0,0 +1,150 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+)
+
+// sharedSubscription holds the shared-subscription state of the backend.
+type sharedSubscription struct {
+	// topic holds the shared subscription topic, covering the commands of
+	// all gateways.
+	topic string
+
+	// gatewayIDLevel holds the topic level containing the gateway ID.
+	gatewayIDLevel int
+
+	// forwardTopicPrefix holds the prefix of the topics to which commands
+	// are re-published for the instance holding the gateway.
+	forwardTopicPrefix string
+}
+
+// initSharedSubscription initializes the shared subscription. The command
+// topic template is executed with a single-level wildcard as gateway ID, so
+// that one subscription covers the commands of all gateways.
+func (b *Backend) initSharedSubscription(group, forwardTopicPrefix string) error {
+	if group == "" || strings.ContainsAny(group, "/+#") {
+		return fmt.Errorf("invalid shared subscription group: %s", group)
+	}
+
+	forwardTopicPrefix = strings.TrimSuffix(forwardTopicPrefix, "/")
+	if forwardTopicPrefix == "" {
+		return errors.New("forward topic prefix must be set")
+	}
+
+	topic := bytes.NewBuffer(nil)
+	if err := b.commandTopicTemplate.Execute(topic, struct{ GatewayID string }{"+"}); err != nil {
+		return errors.Wrap(err, "execute command topic template error")
+	}
+
+	level := -1
+	for i, l := range strings.Split(topic.String(), "/") {
+		if l != "+" {
+			continue
+		}
+		if level != -1 {
+			return fmt.Errorf("command topic must contain a single wildcard level: %s", topic.String())
+		}
+		level = i
+	}
+	if level == -1 {
+		return fmt.Errorf("command topic must contain the gateway ID as topic level: %s", topic.String())
+	}
+
+	b.shared = &sharedSubscription{
+		topic:              "$share/" + group + "/" + topic.String(),
+		gatewayIDLevel:     level,
+		forwardTopicPrefix: forwardTopicPrefix,
+	}
+
+	return nil
+}
+
+// subscribeShared subscribes to the shared subscription topic.
+func (b *Backend) subscribeShared() error {
+	return b.subscribeTopic(b.shared.topic)
+}
+
+// isForwardedCommand returns true when the given topic is a command
+// forwarded by an other instance.
+func (b *Backend) isForwardedCommand(topic string) bool {
+	return strings.HasPrefix(topic, b.shared.forwardTopicPrefix+"/")
+}
+
+// routeSharedCommand handles the command received through the shared
+// subscription when the gateway is held by this instance. Otherwise it
+// re-publishes the command on the forward topic, to which the instance
+// holding the gateway is subscribed.
+//
+// This is called from a separate goroutine as the lock can not be acquired
+// from within the message handler of the MQTT client.
+func (b *Backend) routeSharedCommand(c paho.Client, msg paho.Message) {
+	levels := strings.Split(msg.Topic(), "/")
+	if len(levels) <= b.shared.gatewayIDLevel {
+		log.WithField("topic", msg.Topic()).Warning("integration/mqtt: unexpected shared command topic")
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(levels[b.shared.gatewayIDLevel])); err != nil {
+		log.WithError(err).WithField("topic", msg.Topic()).Error("integration/mqtt: parse gateway id from command topic error")
+		return
+	}
+
+	b.RLock()
+	_, ok := b.gateways[gatewayID]
+	b.RUnlock()
+
+	if ok {
+		b.dispatchCommand(c, msg)
+		return
+	}
+
+	topic := b.shared.forwardTopicPrefix + "/" + msg.Topic()
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"topic":      topic,
+	}).Info("integration/mqtt: forwarding command to instance holding gateway")
+
+	mqttCommandCounter("forward").Inc()
+
+	if err := b.forwardCommand(gatewayID, topic, msg); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"topic":      topic,
+		}).Error("integration/mqtt: forward command error")
+	}
+}
+
+// forwardCommand re-publishes the given command to the given topic. With
+// MQTT v5, the response topic and correlation data are retained.
+func (b *Backend) forwardCommand(gatewayID lorawan.EUI64, topic string, msg paho.Message) error {
+	if b.protocolVersion == 5 {
+		m := message{
+			Topic:     topic,
+			Payload:   msg.Payload(),
+			GatewayID: gatewayID,
+			QOS:       b.commandQOS,
+		}
+
+		if v5, ok := msg.(v5Message); ok && v5.Properties != nil {
+			m.ResponseTopic = v5.Properties.ResponseTopic
+			m.CorrelationData = v5.Properties.CorrelationData
+		}
+
+		return b.publishV5(m)
+	}
+
+	if token := b.conn.Publish(topic, b.commandQOS, false, msg.Payload()); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"os"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestSharedSubscription(t *testing.T) {
+	assert := require.New(t)
+
+	log.SetLevel(log.ErrorLevel)
+
+	server := "tcp://127.0.0.1:1883/1"
+	var username string
+	var password string
+
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		server = v
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		username = v
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		password = v
+	}
+
+	opts := paho.NewClientOptions().AddBroker(server).SetUsername(username).SetPassword(password)
+	mqttClient := paho.NewClient(opts)
+	token := mqttClient.Connect()
+	token.Wait()
+	assert.NoError(token.Error())
+	defer mqttClient.Disconnect(0)
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "shared/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "shared/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.SharedSubscription.Enabled = true
+	conf.Integration.MQTT.SharedSubscription.Group = "test"
+	conf.Integration.MQTT.SharedSubscription.ForwardTopicPrefix = "shared-forward"
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{server}
+	conf.Integration.MQTT.Auth.Generic.Username = username
+	conf.Integration.MQTT.Auth.Generic.Password = password
+	conf.Integration.MQTT.Auth.Generic.CleanSession = true
+
+	gatewayIDs := []lorawan.EUI64{
+		{1, 1, 1, 1, 1, 1, 1, 1},
+		{2, 2, 2, 2, 2, 2, 2, 2},
+	}
+
+	// Each backend holds one of the gateways.
+	var configs []chan gw.GatewayConfiguration
+
+	for _, gatewayID := range gatewayIDs {
+		b, err := NewBackend(conf)
+		assert.NoError(err)
+		assert.Equal("$share/test/shared/+/command/#", b.shared.topic)
+
+		configChan := make(chan gw.GatewayConfiguration, 10)
+		b.SetGatewayConfigurationFunc(func(pl gw.GatewayConfiguration) {
+			configChan <- pl
+		})
+
+		assert.NoError(b.Start())
+		defer b.Stop()
+
+		assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+
+		configs = append(configs, configChan)
+	}
+
+	// Make sure the shared subscriptions are set up.
+	time.Sleep(100 * time.Millisecond)
+
+	for i, gatewayID := range gatewayIDs {
+		// The broker distributes the commands over the instances, all of these
+		// must be handled by the instance holding the gateway.
+		for j := 0; j < 4; j++ {
+			token := mqttClient.Publish("shared/"+gatewayID.String()+"/command/config", 0, false, []byte(`{"gatewayID": "`+base64.StdEncoding.EncodeToString(gatewayID[:])+`", "version": "1.2.3"}`))
+			token.Wait()
+			assert.NoError(token.Error())
+
+			select {
+			case pl := <-configs[i]:
+				assert.Equal(gatewayID[:], pl.GatewayId)
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for configuration of gateway %s", gatewayID)
+			}
+		}
+	}
+
+	for _, c := range configs {
+		select {
+		case pl := <-c:
+			t.Fatalf("unexpected configuration: %+v", pl)
+		default:
+		}
+	}
+
+	t.Run("Invalid command topic", func(t *testing.T) {
+		assert := require.New(t)
+
+		c := conf
+		c.Integration.MQTT.CommandTopicTemplate = "gateway/command/#"
+		_, err := NewBackend(c)
+		assert.Error(err)
+	})
+}
@@ -0,0 +1,481 @@
+package mqtt
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/mqtt/sparkplug"
+	"github.com/brocaar/lorawan"
+)
+
+// Sparkplug B metric names.
+const (
+	metricBDSeq               = "bdSeq"
+	metricNodeRebirth         = "Node Control/Rebirth"
+	metricDeviceRebirth       = "Device Control/Rebirth"
+	metricPropertiesPrefix    = "Properties/"
+	metricRXPacketsReceived   = "Stats/RX Packets Received"
+	metricRXPacketsReceivedOK = "Stats/RX Packets Received OK"
+	metricTXPacketsReceived   = "Stats/TX Packets Received"
+	metricTXPacketsEmitted    = "Stats/TX Packets Emitted"
+	metricUplinkID            = "Uplink/Uplink ID"
+	metricUplinkPHYPayload    = "Uplink/PHYPayload"
+	metricUplinkFrequency     = "Uplink/Frequency"
+	metricUplinkRSSI          = "Uplink/RSSI"
+	metricUplinkLoRaSNR       = "Uplink/LoRa SNR"
+	metricUplinkReceivers     = "Uplink/Receivers"
+	metricCommandExec         = "Command/Exec"
+	metricCommandConfig       = "Command/Config"
+	metricCommandExecResponse = "Command/Exec Response"
+)
+
+// sparkplugNode holds the Sparkplug B edge node state. The bridge is the
+// edge node and each gateway is a device of this edge node. As the MQTT last
+// will can only be set for a single topic, this is the only mapping which
+// allows the broker to publish the NDEATH.
+type sparkplugNode struct {
+	sync.Mutex
+
+	groupID    string
+	edgeNodeID string
+
+	// connects is incremented (atomically) on each connect and is used to
+	// derive the bdSeq.
+	connects uint64
+
+	// seq holds the sequence number of the next message.
+	seq uint64
+}
+
+// initSparkplug initializes the Sparkplug B mode.
+func (b *Backend) initSparkplug(conf config.Config) error {
+	if conf.Integration.MQTT.Auth.Type != "generic" {
+		return fmt.Errorf("sparkplug b requires the generic auth type, got: %s", conf.Integration.MQTT.Auth.Type)
+	}
+
+	node := sparkplugNode{
+		groupID:    conf.Integration.MQTT.SparkplugB.GroupID,
+		edgeNodeID: conf.Integration.MQTT.SparkplugB.EdgeNodeID,
+	}
+
+	if node.edgeNodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "get hostname error")
+		}
+		node.edgeNodeID = hostname
+	}
+
+	if err := sparkplug.ValidateID(node.groupID); err != nil {
+		return errors.Wrap(err, "invalid group id")
+	}
+	if err := sparkplug.ValidateID(node.edgeNodeID); err != nil {
+		return errors.Wrap(err, "invalid edge node id")
+	}
+
+	b.sparkplug = &node
+
+	return nil
+}
+
+// setSparkplugWill sets the NDEATH as last will, using the bdSeq of the
+// new connection. It must be called before each connect.
+func (b *Backend) setSparkplugWill() error {
+	n := atomic.AddUint64(&b.sparkplug.connects, 1)
+
+	payload, err := sparkplug.Marshal(sparkplug.Payload{
+		Timestamp: sparkplugTimestamp(),
+		Metrics: []sparkplug.Metric{
+			{Name: metricBDSeq, DataType: sparkplug.UInt64, Value: (n - 1) % 256},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal ndeath error")
+	}
+
+	b.setWill(message{
+		Topic:   sparkplug.Topic(b.sparkplug.groupID, sparkplug.NDEATH, b.sparkplug.edgeNodeID, ""),
+		Payload: payload,
+		Event:   sparkplug.NDEATH,
+		IDKey:   "id",
+		QOS:     1,
+	})
+
+	return nil
+}
+
+// sparkplugBirth subscribes to the NCMD and DCMD topics and publishes the
+// NBIRTH, followed by a DBIRTH for each gateway.
+func (b *Backend) sparkplugBirth() {
+	node := b.sparkplug
+
+	for _, topic := range []string{
+		sparkplug.Topic(node.groupID, sparkplug.NCMD, node.edgeNodeID, ""),
+		sparkplug.Topic(node.groupID, sparkplug.DCMD, node.edgeNodeID, "+"),
+	} {
+		if err := b.subscribeTopic(topic); err != nil {
+			log.WithError(err).WithField("topic", topic).Error("integration/mqtt: subscribe sparkplug command topic error")
+		}
+	}
+
+	b.RLock()
+	var gatewayIDs []lorawan.EUI64
+	for gatewayID := range b.gateways {
+		gatewayIDs = append(gatewayIDs, gatewayID)
+	}
+	b.RUnlock()
+
+	node.Lock()
+	defer node.Unlock()
+
+	// The NBIRTH resets the sequence number.
+	node.seq = 0
+
+	metrics := []sparkplug.Metric{
+		{Name: metricBDSeq, DataType: sparkplug.UInt64, Value: (atomic.LoadUint64(&node.connects) - 1) % 256},
+		{Name: metricNodeRebirth, DataType: sparkplug.Boolean, Value: false},
+	}
+	metrics = append(metrics, metadataMetrics(b.getMetaData())...)
+
+	if err := b.publishSparkplug(sparkplug.NBIRTH, lorawan.EUI64{}, "id", uuid.Nil, metrics); err != nil {
+		log.WithError(err).Error("integration/mqtt: publish sparkplug nbirth error")
+		return
+	}
+
+	for _, gatewayID := range gatewayIDs {
+		if err := b.publishSparkplug(sparkplug.DBIRTH, gatewayID, "id", uuid.Nil, b.deviceBirthMetrics()); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: publish sparkplug dbirth error")
+		}
+	}
+}
+
+// setSparkplugDevice publishes the DBIRTH or DDEATH of the given gateway.
+// When not connected, the DBIRTH is published on connect.
+func (b *Backend) setSparkplugDevice(subscribe bool, gatewayID lorawan.EUI64) error {
+	b.Lock()
+	_, ok := b.gateways[gatewayID]
+	if subscribe {
+		b.gateways[gatewayID] = struct{}{}
+	} else {
+		delete(b.gateways, gatewayID)
+	}
+	b.Unlock()
+
+	if ok == subscribe || !b.isConnected() {
+		return nil
+	}
+
+	messageType := sparkplug.DDEATH
+	var metrics []sparkplug.Metric
+	if subscribe {
+		messageType = sparkplug.DBIRTH
+		metrics = b.deviceBirthMetrics()
+	}
+
+	b.sparkplug.Lock()
+	defer b.sparkplug.Unlock()
+
+	if err := b.publishSparkplug(messageType, gatewayID, "id", uuid.Nil, metrics); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id":   gatewayID,
+			"message_type": messageType,
+		}).Error("integration/mqtt: publish sparkplug device state error")
+	}
+
+	return nil
+}
+
+// publishSparkplugEvent publishes the given event as DDATA. Events which
+// have no Sparkplug B representation are ignored.
+func (b *Backend) publishSparkplugEvent(gatewayID lorawan.EUI64, event string, idKey string, id uuid.UUID, v proto.Message) error {
+	var metrics []sparkplug.Metric
+
+	switch pl := v.(type) {
+	case *gw.GatewayStats:
+		metrics = []sparkplug.Metric{
+			{Name: metricRXPacketsReceived, DataType: sparkplug.UInt32, Value: pl.RxPacketsReceived},
+			{Name: metricRXPacketsReceivedOK, DataType: sparkplug.UInt32, Value: pl.RxPacketsReceivedOk},
+			{Name: metricTXPacketsReceived, DataType: sparkplug.UInt32, Value: pl.TxPacketsReceived},
+			{Name: metricTXPacketsEmitted, DataType: sparkplug.UInt32, Value: pl.TxPacketsEmitted},
+		}
+		metrics = append(metrics, metadataMetrics(pl.MetaData)...)
+	case *gw.UplinkFrame:
+		metrics = uplinkMetrics(pl.PhyPayload, pl.GetTxInfo(), pl.GetRxInfo())
+		metrics = append(metrics, sparkplug.Metric{Name: metricUplinkReceivers, DataType: sparkplug.UInt32, Value: uint32(1)})
+	case *gw.UplinkFrameSet:
+		// The metrics hold a single RX meta-data set, the first copy (of
+		// the gateway publishing the event) is used.
+		var rxInfo *gw.UplinkRXInfo
+		if len(pl.RxInfo) != 0 {
+			rxInfo = pl.RxInfo[0]
+		}
+
+		metrics = uplinkMetrics(pl.PhyPayload, pl.GetTxInfo(), rxInfo)
+		metrics = append(metrics, sparkplug.Metric{Name: metricUplinkReceivers, DataType: sparkplug.UInt32, Value: uint32(len(pl.RxInfo))})
+	case *gw.GatewayCommandExecResponse:
+		payload, err := b.marshal(pl)
+		if err != nil {
+			return errors.Wrap(err, "marshal message error")
+		}
+
+		metrics = []sparkplug.Metric{b.commandMetric(metricCommandExecResponse, payload)}
+	default:
+		log.WithField("event", event).Debug("integration/mqtt: event type not supported by sparkplug b, ignoring")
+		return nil
+	}
+
+	b.sparkplug.Lock()
+	defer b.sparkplug.Unlock()
+
+	return b.publishSparkplug(sparkplug.DDATA, gatewayID, idKey, id, metrics)
+}
+
+// uplinkMetrics returns the DDATA metrics of an uplink.
+func uplinkMetrics(phyPayload []byte, txInfo *gw.UplinkTXInfo, rxInfo *gw.UplinkRXInfo) []sparkplug.Metric {
+	var uplinkID uuid.UUID
+	copy(uplinkID[:], rxInfo.GetUplinkId())
+
+	return []sparkplug.Metric{
+		{Name: metricUplinkID, DataType: sparkplug.UUID, Value: uplinkID.String()},
+		{Name: metricUplinkPHYPayload, DataType: sparkplug.Bytes, Value: phyPayload},
+		{Name: metricUplinkFrequency, DataType: sparkplug.UInt32, Value: txInfo.GetFrequency()},
+		{Name: metricUplinkRSSI, DataType: sparkplug.Int32, Value: uint32(rxInfo.GetRssi())},
+		{Name: metricUplinkLoRaSNR, DataType: sparkplug.Double, Value: rxInfo.GetLoraSnr()},
+	}
+}
+
+// publishSparkplug publishes the given Sparkplug B message. It must be
+// called with the sparkplug node lock held, to guarantee that the messages
+// are published in sequence order.
+func (b *Backend) publishSparkplug(messageType string, gatewayID lorawan.EUI64, idKey string, id uuid.UUID, metrics []sparkplug.Metric) error {
+	node := b.sparkplug
+	ts := sparkplugTimestamp()
+	seq := node.seq
+
+	var deviceID string
+	if messageType != sparkplug.NBIRTH {
+		deviceID = gatewayID.String()
+	}
+
+	payload, err := sparkplug.Marshal(sparkplug.Payload{
+		Timestamp: ts,
+		Metrics:   metrics,
+		Seq:       &seq,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal sparkplug payload error")
+	}
+
+	if err := b.send(message{
+		Topic:     sparkplug.Topic(node.groupID, messageType, node.edgeNodeID, deviceID),
+		Payload:   payload,
+		GatewayID: gatewayID,
+		Event:     messageType,
+		IDKey:     idKey,
+		ID:        id,
+		QOS:       b.qos,
+	}); err != nil {
+		return err
+	}
+
+	node.seq = (seq + 1) % 256
+
+	return nil
+}
+
+// deviceBirthMetrics returns the metrics of the DBIRTH. This contains all
+// the metrics which can be published or received for a gateway.
+func (b *Backend) deviceBirthMetrics() []sparkplug.Metric {
+	commandDataType := sparkplug.String
+	if b.contentType == "application/octet-stream" {
+		commandDataType = sparkplug.Bytes
+	}
+
+	metrics := []sparkplug.Metric{
+		{Name: metricDeviceRebirth, DataType: sparkplug.Boolean, Value: false},
+		{Name: metricRXPacketsReceived, DataType: sparkplug.UInt32, Value: uint32(0)},
+		{Name: metricRXPacketsReceivedOK, DataType: sparkplug.UInt32, Value: uint32(0)},
+		{Name: metricTXPacketsReceived, DataType: sparkplug.UInt32, Value: uint32(0)},
+		{Name: metricTXPacketsEmitted, DataType: sparkplug.UInt32, Value: uint32(0)},
+		{Name: metricUplinkID, DataType: sparkplug.UUID, IsNull: true},
+		{Name: metricUplinkPHYPayload, DataType: sparkplug.Bytes, IsNull: true},
+		{Name: metricUplinkFrequency, DataType: sparkplug.UInt32, IsNull: true},
+		{Name: metricUplinkRSSI, DataType: sparkplug.Int32, IsNull: true},
+		{Name: metricUplinkLoRaSNR, DataType: sparkplug.Double, IsNull: true},
+		{Name: metricUplinkReceivers, DataType: sparkplug.UInt32, IsNull: true},
+		{Name: metricCommandExec, DataType: commandDataType, IsNull: true},
+		{Name: metricCommandConfig, DataType: commandDataType, IsNull: true},
+		{Name: metricCommandExecResponse, DataType: commandDataType, IsNull: true},
+	}
+
+	return append(metrics, metadataMetrics(b.getMetaData())...)
+}
+
+// commandMetric returns the metric for the given marshaled command payload.
+// The String data-type is used for the JSON marshalers, Bytes for Protobuf.
+func (b *Backend) commandMetric(name string, payload []byte) sparkplug.Metric {
+	if b.contentType == "application/octet-stream" {
+		return sparkplug.Metric{Name: name, DataType: sparkplug.Bytes, Value: payload}
+	}
+	return sparkplug.Metric{Name: name, DataType: sparkplug.String, Value: string(payload)}
+}
+
+// handleSparkplugCommand handles the NCMD and DCMD messages.
+func (b *Backend) handleSparkplugCommand(c paho.Client, msg paho.Message) {
+	groupID, messageType, edgeNodeID, deviceID, err := sparkplug.ParseTopic(msg.Topic())
+	if err != nil || groupID != b.sparkplug.groupID || edgeNodeID != b.sparkplug.edgeNodeID {
+		log.WithField("topic", msg.Topic()).Warning("integration/mqtt: unexpected sparkplug command received")
+		return
+	}
+
+	pl, err := sparkplug.Unmarshal(msg.Payload())
+	if err != nil {
+		log.WithError(err).WithField("topic", msg.Topic()).Error("integration/mqtt: unmarshal sparkplug payload error")
+		return
+	}
+
+	switch messageType {
+	case sparkplug.NCMD:
+		for _, m := range pl.Metrics {
+			if m.Name == metricNodeRebirth && m.Value == true {
+				log.Info("integration/mqtt: sparkplug node rebirth requested")
+				go b.sparkplugBirth()
+			}
+		}
+	case sparkplug.DCMD:
+		var gatewayID lorawan.EUI64
+		if err := gatewayID.UnmarshalText([]byte(deviceID)); err != nil {
+			log.WithError(err).WithField("topic", msg.Topic()).Error("integration/mqtt: invalid sparkplug device id")
+			return
+		}
+
+		for _, m := range pl.Metrics {
+			b.handleSparkplugDeviceCommand(gatewayID, m)
+		}
+	}
+}
+
+// handleSparkplugDeviceCommand handles a single DCMD metric.
+func (b *Backend) handleSparkplugDeviceCommand(gatewayID lorawan.EUI64, m sparkplug.Metric) {
+	var payload []byte
+	switch v := m.Value.(type) {
+	case string:
+		payload = []byte(v)
+	case []byte:
+		payload = v
+	}
+
+	switch m.Name {
+	case metricDeviceRebirth:
+		if m.Value != true {
+			return
+		}
+
+		log.WithField("gateway_id", gatewayID).Info("integration/mqtt: sparkplug device rebirth requested")
+
+		b.RLock()
+		_, ok := b.gateways[gatewayID]
+		b.RUnlock()
+
+		if ok {
+			go func() {
+				b.sparkplug.Lock()
+				defer b.sparkplug.Unlock()
+
+				if err := b.publishSparkplug(sparkplug.DBIRTH, gatewayID, "id", uuid.Nil, b.deviceBirthMetrics()); err != nil {
+					log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: publish sparkplug dbirth error")
+				}
+			}()
+		}
+	case metricCommandExec:
+		mqttCommandCounter("exec").Inc()
+
+		var req gw.GatewayCommandExecRequest
+		if err := b.unmarshal(payload, &req); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: unmarshal gateway command execution request error")
+			return
+		}
+		if len(req.GatewayId) == 0 {
+			req.GatewayId = gatewayID[:]
+		}
+
+		var execID uuid.UUID
+		copy(execID[:], req.GetExecId())
+
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"exec_id":    execID,
+		}).Info("integration/mqtt: gateway command execution request received")
+
+		if b.gatewayCommandExecRequestFunc != nil {
+			b.gatewayCommandExecRequestFunc(req)
+		}
+	case metricCommandConfig:
+		mqttCommandCounter("config").Inc()
+
+		var gatewayConfig gw.GatewayConfiguration
+		if err := b.unmarshal(payload, &gatewayConfig); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: unmarshal gateway configuration error")
+			return
+		}
+		if len(gatewayConfig.GatewayId) == 0 {
+			gatewayConfig.GatewayId = gatewayID[:]
+		}
+
+		log.WithField("gateway_id", gatewayID).Info("integration/mqtt: gateway configuration received")
+
+		if b.gatewayConfigurationFunc != nil {
+			b.gatewayConfigurationFunc(gatewayConfig)
+		}
+	default:
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"metric":     m.Name,
+		}).Warning("integration/mqtt: unexpected sparkplug device command received")
+	}
+}
+
+// getMetaData returns the gateway meta-data, when the meta-data func is set.
+func (b *Backend) getMetaData() map[string]string {
+	if b.metaDataFunc == nil {
+		return nil
+	}
+	return b.metaDataFunc()
+}
+
+// metadataMetrics returns the given meta-data as String metrics, sorted by
+// key.
+func metadataMetrics(md map[string]string) []sparkplug.Metric {
+	var keys []string
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out []sparkplug.Metric
+	for _, k := range keys {
+		out = append(out, sparkplug.Metric{
+			Name:     metricPropertiesPrefix + k,
+			DataType: sparkplug.String,
+			Value:    md[k],
+		})
+	}
+	return out
+}
+
+// sparkplugTimestamp returns the current time in ms since epoch.
+func sparkplugTimestamp() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
@@ -0,0 +1,219 @@
+package mqtt
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/mqtt/sparkplug"
+	"github.com/brocaar/lorawan"
+)
+
+func TestSparkplug(t *testing.T) {
+	assert := require.New(t)
+
+	log.SetLevel(log.ErrorLevel)
+
+	server := "tcp://127.0.0.1:1883/1"
+	var username string
+	var password string
+
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		server = v
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		username = v
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		password = v
+	}
+
+	opts := paho.NewClientOptions().AddBroker(server).SetUsername(username).SetPassword(password)
+	mqttClient := paho.NewClient(opts)
+	token := mqttClient.Connect()
+	token.Wait()
+	assert.NoError(token.Error())
+	defer mqttClient.Disconnect(0)
+
+	type sparkplugMessage struct {
+		topic   string
+		payload sparkplug.Payload
+	}
+
+	messages := make(chan sparkplugMessage, 10)
+	token = mqttClient.Subscribe("spBv1.0/test/+/bridge/#", 0, func(c paho.Client, msg paho.Message) {
+		// skip the commands published by this test
+		_, messageType, _, _, _ := sparkplug.ParseTopic(msg.Topic())
+		if messageType == sparkplug.NCMD || messageType == sparkplug.DCMD {
+			return
+		}
+
+		pl, err := sparkplug.Unmarshal(msg.Payload())
+		if err == nil {
+			messages <- sparkplugMessage{msg.Topic(), pl}
+		}
+	})
+	token.Wait()
+	assert.NoError(token.Error())
+
+	metrics := func(pl sparkplug.Payload) map[string]interface{} {
+		out := make(map[string]interface{})
+		for _, m := range pl.Metrics {
+			out[m.Name] = m.Value
+		}
+		return out
+	}
+
+	receive := func() sparkplugMessage {
+		select {
+		case msg := <-messages:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for sparkplug message")
+		}
+		return sparkplugMessage{}
+	}
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.SparkplugB.Enabled = true
+	conf.Integration.MQTT.SparkplugB.GroupID = "test"
+	conf.Integration.MQTT.SparkplugB.EdgeNodeID = "bridge"
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{server}
+	conf.Integration.MQTT.Auth.Generic.Username = username
+	conf.Integration.MQTT.Auth.Generic.Password = password
+	conf.Integration.MQTT.Auth.Generic.CleanSession = true
+
+	backend, err := NewBackend(conf)
+	assert.NoError(err)
+
+	execRequests := make(chan gw.GatewayCommandExecRequest, 1)
+	backend.SetGatewayCommandExecRequestFunc(func(pl gw.GatewayCommandExecRequest) {
+		execRequests <- pl
+	})
+	backend.SetMetaDataFunc(func() map[string]string {
+		return map[string]string{"serial": "1234"}
+	})
+
+	assert.NoError(backend.Start())
+
+	t.Run("NBIRTH", func(t *testing.T) {
+		assert := require.New(t)
+
+		msg := receive()
+		assert.Equal("spBv1.0/test/NBIRTH/bridge", msg.topic)
+		assert.Equal(uint64(0), *msg.payload.Seq)
+		assert.Equal(map[string]interface{}{
+			"bdSeq":                uint64(0),
+			"Node Control/Rebirth": false,
+			"Properties/serial":    "1234",
+		}, metrics(msg.payload))
+
+		assert.Equal("spBv1.0/test/NDEATH/bridge", backend.clientOpts.WillTopic)
+		assert.EqualValues(1, backend.clientOpts.WillQos)
+	})
+
+	t.Run("DBIRTH", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(backend.SetGatewaySubscription(true, gatewayID))
+
+		msg := receive()
+		assert.Equal("spBv1.0/test/DBIRTH/bridge/0102030405060708", msg.topic)
+		assert.Equal(uint64(1), *msg.payload.Seq)
+		assert.Equal("1234", metrics(msg.payload)["Properties/serial"])
+		assert.Contains(metrics(msg.payload), "Command/Exec")
+	})
+
+	t.Run("DDATA", func(t *testing.T) {
+		assert := require.New(t)
+
+		id, err := uuid.NewV4()
+		assert.NoError(err)
+
+		assert.NoError(backend.PublishEvent(gatewayID, "stats", id, &gw.GatewayStats{
+			GatewayId:         gatewayID[:],
+			StatsId:           id[:],
+			RxPacketsReceived: 10,
+		}))
+
+		msg := receive()
+		assert.Equal("spBv1.0/test/DDATA/bridge/0102030405060708", msg.topic)
+		assert.Equal(uint64(2), *msg.payload.Seq)
+		assert.Equal(uint32(10), metrics(msg.payload)["Stats/RX Packets Received"])
+
+		// de-duplicated uplink, the first copy is used
+		assert.NoError(backend.PublishEvent(gatewayID, "up_set", id, &gw.UplinkFrameSet{
+			PhyPayload: []byte{1, 2, 3},
+			RxInfo: []*gw.UplinkRXInfo{
+				{GatewayId: gatewayID[:], Rssi: -60},
+				{GatewayId: []byte{8, 7, 6, 5, 4, 3, 2, 1}, Rssi: -80},
+			},
+		}))
+
+		msg = receive()
+		assert.Equal("spBv1.0/test/DDATA/bridge/0102030405060708", msg.topic)
+		assert.Equal(uint64(3), *msg.payload.Seq)
+		assert.Equal([]byte{1, 2, 3}, metrics(msg.payload)["Uplink/PHYPayload"])
+		assert.Equal(int32(-60), int32(metrics(msg.payload)["Uplink/RSSI"].(uint32)))
+		assert.Equal(uint32(2), metrics(msg.payload)["Uplink/Receivers"])
+
+		// events without sparkplug representation are ignored
+		assert.NoError(backend.PublishEvent(gatewayID, "ack", id, &gw.DownlinkTXAck{}))
+	})
+
+	t.Run("DCMD", func(t *testing.T) {
+		assert := require.New(t)
+
+		payload, err := sparkplug.Marshal(sparkplug.Payload{
+			Metrics: []sparkplug.Metric{
+				{Name: "Command/Exec", DataType: sparkplug.String, Value: `{"command": "reboot", "execID": "AQIDBA=="}`},
+			},
+		})
+		assert.NoError(err)
+
+		token := mqttClient.Publish("spBv1.0/test/DCMD/bridge/0102030405060708", 0, false, payload)
+		token.Wait()
+		assert.NoError(token.Error())
+
+		select {
+		case req := <-execRequests:
+			assert.Equal("reboot", req.Command)
+			assert.Equal(gatewayID[:], req.GatewayId)
+			assert.Equal([]byte{1, 2, 3, 4}, req.ExecId)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for exec request")
+		}
+	})
+
+	t.Run("DDEATH", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(backend.SetGatewaySubscription(false, gatewayID))
+
+		msg := receive()
+		assert.Equal("spBv1.0/test/DDEATH/bridge/0102030405060708", msg.topic)
+		assert.Equal(uint64(4), *msg.payload.Seq)
+	})
+
+	t.Run("NDEATH", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(backend.Stop())
+
+		msg := receive()
+		assert.Equal("spBv1.0/test/NDEATH/bridge", msg.topic)
+		assert.Nil(msg.payload.Seq)
+		assert.Equal(uint64(0), metrics(msg.payload)["bdSeq"])
+	})
+}
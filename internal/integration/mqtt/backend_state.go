@@ -0,0 +1,201 @@
+package mqtt
+
+import (
+	"bytes"
+	"os"
+	"text/template"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/state"
+	"github.com/brocaar/lorawan"
+)
+
+// initBridgeState sets the bridge state topic and the last will. When the
+// bridge disconnects unexpectedly, the broker publishes the OFFLINE state of
+// the bridge to the bridge state topic. As a last will can only be published
+// to a single topic, consumers must consider all the gateways of this bridge
+// offline in this case.
+func (b *Backend) initBridgeState(topicTemplate string) error {
+	if topicTemplate == "" {
+		return nil
+	}
+
+	tmpl, err := template.New("bridge_state").Parse(topicTemplate)
+	if err != nil {
+		return errors.Wrap(err, "parse bridge state-topic template error")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return errors.Wrap(err, "get hostname error")
+	}
+
+	topic := bytes.NewBuffer(nil)
+	if err := tmpl.Execute(topic, struct {
+		ClientID string
+		Hostname string
+	}{b.clientOpts.ClientID, hostname}); err != nil {
+		return errors.Wrap(err, "execute bridge state-topic template error")
+	}
+	b.bridgeStateTopic = topic.String()
+
+	// The time of the last will is unknown at connect time, therefore it
+	// is omitted.
+	payload, err := b.marshal(&state.ConnState{
+		State:       state.ConnState_OFFLINE,
+		BackendType: b.backendType,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal last will error")
+	}
+
+	b.setWill(message{
+		Topic:   b.bridgeStateTopic,
+		Payload: payload,
+		QOS:     b.qos,
+		Retain:  !b.limits.noRetain,
+	})
+
+	return nil
+}
+
+// initGatewayState sets the OFFLINE state of the given gateway as last will
+// and publishes its ONLINE state on connect. This is used when the session
+// is dedicated to a single gateway. It is not set when the topics are forced
+// by the authentication provider, as these providers report the connection
+// state of the device themselves.
+func (b *Backend) initGatewayState(gatewayID lorawan.EUI64) error {
+	if b.limits.forcedTopics {
+		return nil
+	}
+	b.sessionGatewayID = &gatewayID
+
+	m, err := b.newMessage(gatewayID, "conn", "conn_id", uuid.Nil, &state.ConnState{
+		GatewayId:   gatewayID[:],
+		State:       state.ConnState_OFFLINE,
+		BackendType: b.backendType,
+	})
+	if err != nil {
+		return errors.Wrap(err, "gateway state message error")
+	}
+
+	b.setWill(m)
+
+	return nil
+}
+
+// publishBridgeState publishes the given state of the bridge (retained).
+func (b *Backend) publishBridgeState(st state.ConnState_State) {
+	if b.bridgeStateTopic == "" {
+		return
+	}
+
+	pl := state.ConnState{
+		State:       st,
+		Time:        ptypes.TimestampNow(),
+		BackendType: b.backendType,
+	}
+
+	payload, err := b.marshal(&pl)
+	if err != nil {
+		log.WithError(err).Error("integration/mqtt: marshal bridge state error")
+		return
+	}
+
+	if err := b.send(message{
+		Topic:   b.bridgeStateTopic,
+		Payload: payload,
+		Event:   "conn",
+		IDKey:   "conn_id",
+		QOS:     b.qos,
+		Retain:  !b.limits.noRetain,
+	}); err != nil {
+		log.WithError(err).Error("integration/mqtt: publish bridge state error")
+	}
+}
+
+// publishSessionGatewayState publishes the given state of the gateway to
+// which the session is dedicated (see initGatewayState). The state event of
+// the forwarder can not be used for the ONLINE state, as it is published
+// before the session has connected.
+func (b *Backend) publishSessionGatewayState(st state.ConnState_State) {
+	if b.sessionGatewayID == nil {
+		return
+	}
+	gatewayID := *b.sessionGatewayID
+
+	m, err := b.newMessage(gatewayID, "conn", "conn_id", uuid.Nil, &state.ConnState{
+		GatewayId:   gatewayID[:],
+		State:       st,
+		Time:        ptypes.TimestampNow(),
+		BackendType: b.backendType,
+	})
+	if err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: gateway state message error")
+		return
+	}
+
+	if err := b.send(m); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: publish gateway state error")
+	}
+}
+
+// publishOfflineState publishes the OFFLINE state of the subscribed gateways
+// and of the bridge. This is called on a graceful shutdown, in which case
+// the broker does not publish the last will.
+func (b *Backend) publishOfflineState() {
+	if !b.isConnected() {
+		return
+	}
+
+	// With Sparkplug B, the NDEATH is published instead.
+	if b.sparkplug != nil {
+		b.RLock()
+		will := b.will
+		b.RUnlock()
+
+		if will != nil {
+			if err := b.send(*will); err != nil {
+				log.WithError(err).Error("integration/mqtt: publish sparkplug ndeath error")
+			}
+		}
+		return
+	}
+
+	b.RLock()
+	var gatewayIDs []lorawan.EUI64
+	for gatewayID := range b.gateways {
+		gatewayIDs = append(gatewayIDs, gatewayID)
+	}
+	b.RUnlock()
+
+	for _, gatewayID := range gatewayIDs {
+		m, err := b.newMessage(gatewayID, "conn", "conn_id", uuid.Nil, &state.ConnState{
+			GatewayId:   gatewayID[:],
+			State:       state.ConnState_OFFLINE,
+			Time:        ptypes.TimestampNow(),
+			BackendType: b.backendType,
+		})
+		if err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: gateway state message error")
+			continue
+		}
+
+		if err := b.send(m); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: publish gateway state error")
+		}
+	}
+
+	b.publishBridgeState(state.ConnState_OFFLINE)
+}
+
+// setWill sets the last will, which is published by the broker when the
+// connection is lost unexpectedly.
+func (b *Backend) setWill(m message) {
+	b.will = &m
+	b.clientOpts.SetBinaryWill(m.Topic, m.Payload, m.QOS, m.Retain)
+}
@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/state"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+func TestConnState(t *testing.T) {
+	assert := require.New(t)
+
+	log.SetLevel(log.ErrorLevel)
+
+	server := "tcp://127.0.0.1:1883/1"
+	var username string
+	var password string
+
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		server = v
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		username = v
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		password = v
+	}
+
+	opts := paho.NewClientOptions().AddBroker(server).SetUsername(username).SetPassword(password)
+	mqttClient := paho.NewClient(opts)
+	token := mqttClient.Connect()
+	token.Wait()
+	assert.NoError(token.Error())
+	defer mqttClient.Disconnect(0)
+
+	type stateMessage struct {
+		topic    string
+		retained bool
+		state    state.ConnState
+	}
+
+	var json marshaler.JSON
+	states := make(chan stateMessage, 10)
+	onState := func(c paho.Client, msg paho.Message) {
+		var pl state.ConnState
+		if err := json.Unmarshal(msg.Payload(), &pl); err == nil {
+			states <- stateMessage{msg.Topic(), msg.Retained(), pl}
+		}
+	}
+
+	// clear retained states of previous runs
+	for _, topic := range []string{"connstate/bridge/test", "connstate/gateway/0102030405060708/state/conn"} {
+		token = mqttClient.Publish(topic, 0, true, []byte{})
+		token.Wait()
+		assert.NoError(token.Error())
+	}
+
+	token = mqttClient.Subscribe("connstate/#", 0, onState)
+	token.Wait()
+	assert.NoError(token.Error())
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	retained := true
+
+	var conf config.Config
+	conf.Backend.Type = "semtech_udp"
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "connstate/gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "connstate/gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.StateTopicTemplate = "connstate/gateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.Integration.MQTT.StateRetained = &retained
+	conf.Integration.MQTT.BridgeStateTopicTemplate = "connstate/bridge/{{ .ClientID }}"
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{server}
+	conf.Integration.MQTT.Auth.Generic.Username = username
+	conf.Integration.MQTT.Auth.Generic.Password = password
+	conf.Integration.MQTT.Auth.Generic.ClientID = "test"
+	conf.Integration.MQTT.Auth.Generic.CleanSession = true
+
+	backend, err := NewBackend(conf)
+	assert.NoError(err)
+
+	t.Run("LastWill", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.True(backend.clientOpts.WillEnabled)
+		assert.True(backend.clientOpts.WillRetained)
+		assert.Equal("connstate/bridge/test", backend.clientOpts.WillTopic)
+
+		var pl state.ConnState
+		assert.NoError(json.Unmarshal(backend.clientOpts.WillPayload, &pl))
+		assert.Equal(state.ConnState_OFFLINE, pl.State)
+		assert.Equal("semtech_udp", pl.BackendType)
+	})
+
+	assert.NoError(backend.Start())
+
+	t.Run("BridgeOnline", func(t *testing.T) {
+		assert := require.New(t)
+
+		msg := <-states
+		assert.Equal("connstate/bridge/test", msg.topic)
+		assert.Equal(state.ConnState_ONLINE, msg.state.State)
+		assert.NotNil(msg.state.Time)
+	})
+
+	t.Run("GatewayOnline", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(backend.SetGatewaySubscription(true, gatewayID))
+		assert.NoError(backend.PublishEvent(gatewayID, "conn", uuid.Nil, &state.ConnState{
+			GatewayId:   gatewayID[:],
+			State:       state.ConnState_ONLINE,
+			Time:        ptypes.TimestampNow(),
+			BackendType: "semtech_udp",
+		}))
+
+		msg := <-states
+		assert.Equal("connstate/gateway/0102030405060708/state/conn", msg.topic)
+		assert.Equal(state.ConnState_ONLINE, msg.state.State)
+		assert.Equal(gatewayID[:], msg.state.GatewayId)
+
+		// a new subscriber receives the retained state
+		retained := make(chan stateMessage, 1)
+		client := paho.NewClient(paho.NewClientOptions().AddBroker(server).SetUsername(username).SetPassword(password))
+		token := client.Connect()
+		token.Wait()
+		assert.NoError(token.Error())
+		defer client.Disconnect(0)
+
+		token = client.Subscribe("connstate/gateway/+/state/conn", 0, func(c paho.Client, msg paho.Message) {
+			var pl state.ConnState
+			if err := json.Unmarshal(msg.Payload(), &pl); err == nil {
+				retained <- stateMessage{msg.Topic(), msg.Retained(), pl}
+			}
+		})
+		token.Wait()
+		assert.NoError(token.Error())
+
+		select {
+		case msg := <-retained:
+			assert.True(msg.retained)
+			assert.Equal(state.ConnState_ONLINE, msg.state.State)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for retained state")
+		}
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(backend.Stop())
+
+		msg := <-states
+		assert.Equal("connstate/gateway/0102030405060708/state/conn", msg.topic)
+		assert.Equal(state.ConnState_OFFLINE, msg.state.State)
+
+		msg = <-states
+		assert.Equal("connstate/bridge/test", msg.topic)
+		assert.Equal(state.ConnState_OFFLINE, msg.state.State)
+	})
+}
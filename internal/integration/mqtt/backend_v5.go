@@ -0,0 +1,296 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	paho5 "github.com/eclipse/paho.golang/paho"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// v5RequestTimeout defines the timeout for MQTT v5 requests which are
+// awaiting a response from the broker (e.g. connect, subscribe, QoS > 0
+// publish).
+const v5RequestTimeout = 10 * time.Second
+
+// execResponseExpiration defines how long the response-topic of a gateway
+// command execution request is kept.
+const execResponseExpiration = 5 * time.Minute
+
+// execResponse holds the MQTT v5 response-topic and correlation-data of a
+// gateway command execution request.
+type execResponse struct {
+	topic           string
+	correlationData []byte
+}
+
+// v5Message wraps a MQTT v5 publish packet so that it implements the
+// paho.Message interface used by the command handlers.
+type v5Message struct {
+	*paho5.Publish
+}
+
+func (m v5Message) Duplicate() bool   { return false }
+func (m v5Message) Qos() byte         { return m.QoS }
+func (m v5Message) Retained() bool    { return m.Retain }
+func (m v5Message) Topic() string     { return m.Publish.Topic }
+func (m v5Message) MessageID() uint16 { return m.PacketID }
+func (m v5Message) Payload() []byte   { return m.Publish.Payload }
+func (m v5Message) Ack()              {}
+
+// connectV5 connects to the first reachable MQTT broker using MQTT v5. It
+// must be called with the lock held.
+func (b *Backend) connectV5() error {
+	conn, err := b.dialV5()
+	if err != nil {
+		return err
+	}
+
+	var c *paho5.Client
+	c = paho5.NewClient(paho5.ClientConfig{
+		Conn: conn,
+		Router: paho5.NewSingleHandlerRouter(func(pb *paho5.Publish) {
+			b.handleCommand(nil, v5Message{pb})
+		}),
+		OnServerDisconnect: func(d *paho5.Disconnect) {
+			fields := log.Fields{
+				"reason_code": d.ReasonCode,
+			}
+			if d.Properties != nil && d.Properties.ReasonString != "" {
+				fields["reason_string"] = d.Properties.ReasonString
+			}
+			log.WithFields(fields).Error("integration/mqtt: disconnected by mqtt broker")
+
+			b.onConnectionLostV5(c)
+		},
+		OnClientError: func(err error) {
+			log.WithError(err).Error("integration/mqtt: connection error")
+			b.onConnectionLostV5(c)
+		},
+	})
+
+	cp := &paho5.Connect{
+		ClientID:     b.clientOpts.ClientID,
+		KeepAlive:    uint16(b.clientOpts.KeepAlive),
+		CleanStart:   b.clientOpts.CleanSession,
+		Username:     b.clientOpts.Username,
+		UsernameFlag: b.clientOpts.Username != "",
+		Password:     []byte(b.clientOpts.Password),
+		PasswordFlag: b.clientOpts.Password != "",
+	}
+
+	if b.will != nil {
+		cp.WillMessage = &paho5.WillMessage{
+			Retain:  b.will.Retain,
+			QoS:     b.will.QOS,
+			Topic:   b.will.Topic,
+			Payload: b.will.Payload,
+		}
+	}
+
+	// Without a session expiry interval, the session would end on
+	// disconnect, which is the opposite of what clean_session=false implies.
+	if !b.clientOpts.CleanSession {
+		sessionExpiry := uint32(math.MaxUint32)
+		cp.Properties = &paho5.ConnectProperties{
+			SessionExpiryInterval: &sessionExpiry,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), v5RequestTimeout)
+	defer cancel()
+
+	ca, err := c.Connect(ctx, cp)
+	if err != nil {
+		if ca != nil && ca.Properties != nil {
+			return fmt.Errorf("connect error, reason code: %d, reason string: %s", ca.ReasonCode, ca.Properties.ReasonString)
+		}
+		return errors.Wrap(err, "connect error")
+	}
+
+	b.connV5 = c
+
+	// The v3 client calls the on-connect handler from its own goroutine.
+	go b.onConnected(nil)
+
+	return nil
+}
+
+// dialV5 opens a network connection to the first reachable server.
+func (b *Backend) dialV5() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: b.clientOpts.ConnectTimeout}
+
+	var errs []error
+	for _, server := range b.clientOpts.Servers {
+		var conn net.Conn
+		var err error
+
+		switch server.Scheme {
+		case "tcp":
+			conn, err = dialer.Dial("tcp", server.Host)
+		case "ssl", "tls", "tcps":
+			tlsConfig := b.clientOpts.TLSConfig
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			}
+			conn, err = tls.DialWithDialer(dialer, "tcp", server.Host, tlsConfig)
+		default:
+			err = fmt.Errorf("unsupported scheme: %s", server.Scheme)
+		}
+
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, server.String()))
+			continue
+		}
+
+		// tls.Conn is not safe for concurrent writes
+		return packets.NewThreadSafeConn(conn), nil
+	}
+
+	return nil, fmt.Errorf("dial error: %v", errs)
+}
+
+// onConnectionLostV5 re-connects when the current connection is lost. As
+// the v5 client does not re-connect itself, this implements the
+// auto-reconnect of the v3 client.
+func (b *Backend) onConnectionLostV5(c *paho5.Client) {
+	b.Lock()
+	current := b.connV5 == c && !b.closed
+	if current {
+		// the client must not be used anymore, e.g. for (re)subscribing
+		b.connV5 = nil
+	}
+	b.Unlock()
+
+	// the connection was closed on purpose, or it has already been replaced
+	if !current {
+		return
+	}
+
+	mqttDisconnectCounter().Inc()
+	b.connectLoop()
+}
+
+func (b *Backend) disconnectV5() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.connV5 == nil {
+		return
+	}
+
+	if err := b.connV5.Disconnect(&paho5.Disconnect{ReasonCode: 0}); err != nil {
+		log.WithError(err).Error("integration/mqtt: disconnect error")
+	}
+	b.connV5 = nil
+}
+
+func (b *Backend) subscribeV5(topic string) error {
+	if b.connV5 == nil {
+		return errors.New("not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), v5RequestTimeout)
+	defer cancel()
+
+	sa, err := b.connV5.Subscribe(ctx, &paho5.Subscribe{
+		Subscriptions: map[string]paho5.SubscribeOptions{
+			topic: {QoS: b.commandQOS},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "subscribe topic error")
+	}
+
+	for _, reason := range sa.Reasons {
+		if reason >= 0x80 {
+			return fmt.Errorf("subscribe topic error, reason code: %d", reason)
+		}
+	}
+
+	return nil
+}
+
+func (b *Backend) unsubscribeV5(topic string) error {
+	if b.connV5 == nil {
+		return errors.New("not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), v5RequestTimeout)
+	defer cancel()
+
+	ua, err := b.connV5.Unsubscribe(ctx, &paho5.Unsubscribe{
+		Topics: []string{topic},
+	})
+	if err != nil {
+		return errors.Wrap(err, "unsubscribe topic error")
+	}
+
+	for _, reason := range ua.Reasons {
+		if reason >= 0x80 {
+			return fmt.Errorf("unsubscribe topic error, reason code: %d", reason)
+		}
+	}
+
+	return nil
+}
+
+func (b *Backend) publishV5(m message) error {
+	props := paho5.PublishProperties{
+		ContentType:     b.contentType,
+		CorrelationData: m.CorrelationData,
+		ResponseTopic:   m.ResponseTopic,
+		User: paho5.UserProperties{
+			{Key: "gateway_id", Value: m.GatewayID.String()},
+		},
+	}
+
+	// Forwarded commands are not events.
+	if m.Event != "" {
+		props.User = append(props.User,
+			paho5.UserProperty{Key: "event", Value: m.Event},
+			paho5.UserProperty{Key: m.IDKey, Value: m.ID.String()},
+		)
+	}
+
+	props.User = append(props.User, metaDataProperties(m.MetaData)...)
+
+	if b.messageExpiry != 0 {
+		messageExpiry := uint32(b.messageExpiry / time.Second)
+		props.MessageExpiry = &messageExpiry
+	}
+
+	b.RLock()
+	c := b.connV5
+	b.RUnlock()
+
+	if c == nil {
+		return errors.New("not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), v5RequestTimeout)
+	defer cancel()
+
+	pr, err := c.Publish(ctx, &paho5.Publish{
+		Topic:      m.Topic,
+		QoS:        m.QOS,
+		Retain:     m.Retain,
+		Payload:    m.Payload,
+		Properties: &props,
+	})
+	if err != nil {
+		return errors.Wrap(err, "publish error")
+	}
+
+	if pr != nil && pr.ReasonCode >= 0x80 {
+		return fmt.Errorf("publish error, reason code: %d", pr.ReasonCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	paho5 "github.com/eclipse/paho.golang/paho"
+	"github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+type MQTTV5BackendTestSuite struct {
+	suite.Suite
+
+	mqttClient *paho5.Client
+	messages   chan *paho5.Publish
+	backend    *Backend
+	gatewayID  lorawan.EUI64
+
+	downlinkFrameChan             chan gw.DownlinkFrame
+	gatewayCommandExecRequestChan chan gw.GatewayCommandExecRequest
+}
+
+func (ts *MQTTV5BackendTestSuite) SetupSuite() {
+	assert := require.New(ts.T())
+
+	log.SetLevel(log.ErrorLevel)
+
+	server := "tcp://127.0.0.1:1883/1"
+	var username string
+	var password string
+
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		server = v
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		username = v
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		password = v
+	}
+
+	u, err := url.Parse(server)
+	assert.NoError(err)
+
+	conn, err := net.Dial("tcp", u.Host)
+	assert.NoError(err)
+
+	ts.messages = make(chan *paho5.Publish, 10)
+	ts.mqttClient = paho5.NewClient(paho5.ClientConfig{
+		Conn: conn,
+		Router: paho5.NewSingleHandlerRouter(func(pb *paho5.Publish) {
+			ts.messages <- pb
+		}),
+	})
+
+	_, err = ts.mqttClient.Connect(context.Background(), &paho5.Connect{
+		ClientID:     "test-client-v5",
+		CleanStart:   true,
+		KeepAlive:    30,
+		Username:     username,
+		UsernameFlag: username != "",
+		Password:     []byte(password),
+		PasswordFlag: password != "",
+	})
+	assert.NoError(err)
+
+	_, err = ts.mqttClient.Subscribe(context.Background(), &paho5.Subscribe{
+		Subscriptions: map[string]paho5.SubscribeOptions{
+			"gateway/+/event/+": {QoS: 0},
+			"v5-test/response":  {QoS: 0},
+		},
+	})
+	assert.NoError(err)
+
+	ts.gatewayID = lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 2}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.KeepAlive = 30 * time.Second
+	conf.Integration.MQTT.ProtocolVersion = 5
+	conf.Integration.MQTT.MessageExpiry = time.Minute
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{server}
+	conf.Integration.MQTT.Auth.Generic.Username = username
+	conf.Integration.MQTT.Auth.Generic.Password = password
+	conf.Integration.MQTT.Auth.Generic.CleanSession = true
+	conf.Integration.MQTT.Auth.Generic.ClientID = "test-backend-v5"
+
+	ts.backend, err = NewBackend(conf)
+	assert.NoError(err)
+
+	// the handlers are called from the MQTT client goroutine, therefore
+	// they must be set before the backend is started
+	ts.downlinkFrameChan = make(chan gw.DownlinkFrame, 1)
+	ts.gatewayCommandExecRequestChan = make(chan gw.GatewayCommandExecRequest, 1)
+	downlinkFrameChan := ts.downlinkFrameChan
+	gatewayCommandExecRequestChan := ts.gatewayCommandExecRequestChan
+	ts.backend.SetDownlinkFrameFunc(func(pl gw.DownlinkFrame) {
+		downlinkFrameChan <- pl
+	})
+	ts.backend.SetGatewayCommandExecRequestFunc(func(pl gw.GatewayCommandExecRequest) {
+		gatewayCommandExecRequestChan <- pl
+	})
+
+	assert.NoError(ts.backend.Start())
+	assert.NoError(ts.backend.SetGatewaySubscription(true, ts.gatewayID))
+	time.Sleep(100 * time.Millisecond)
+}
+
+func (ts *MQTTV5BackendTestSuite) TearDownSuite() {
+	ts.mqttClient.Disconnect(&paho5.Disconnect{})
+	ts.backend.Stop()
+}
+
+func (ts *MQTTV5BackendTestSuite) TestPublishUplinkFrame() {
+	assert := require.New(ts.T())
+	id, err := uuid.NewV4()
+	assert.NoError(err)
+
+	uplink := gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3, 4},
+		RxInfo: &gw.UplinkRXInfo{
+			UplinkId: id[:],
+		},
+	}
+
+	assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "up", id, &uplink))
+
+	pb := <-ts.messages
+	assert.Equal("gateway/0807060504030202/event/up", pb.Topic)
+	assert.NotNil(pb.Properties)
+	assert.Equal("application/json", pb.Properties.ContentType)
+	assert.Equal("0807060504030202", pb.Properties.User.Get("gateway_id"))
+	assert.Equal("up", pb.Properties.User.Get("event"))
+	assert.Equal(id.String(), pb.Properties.User.Get("uplink_id"))
+	assert.NotNil(pb.Properties.MessageExpiry)
+
+	var received gw.UplinkFrame
+	assert.NoError(ts.backend.unmarshal(pb.Payload, &received))
+	assert.Equal(uplink, received)
+}
+
+func (ts *MQTTV5BackendTestSuite) TestDownlinkFrameHandler() {
+	assert := require.New(ts.T())
+
+	downlink := gw.DownlinkFrame{
+		GatewayId: ts.gatewayID[:],
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+			},
+		},
+	}
+
+	b, err := ts.backend.marshal(&downlink)
+	assert.NoError(err)
+
+	_, err = ts.mqttClient.Publish(context.Background(), &paho5.Publish{
+		Topic:   "gateway/0807060504030202/command/down",
+		Payload: b,
+	})
+	assert.NoError(err)
+
+	receivedDownlink := <-ts.downlinkFrameChan
+	assert.Equal(downlink, receivedDownlink)
+}
+
+func (ts *MQTTV5BackendTestSuite) TestGatewayCommandExecRequestResponse() {
+	assert := require.New(ts.T())
+
+	id, err := uuid.NewV4()
+	assert.NoError(err)
+
+	execReq := gw.GatewayCommandExecRequest{
+		GatewayId: ts.gatewayID[:],
+		ExecId:    id[:],
+		Command:   "reboot",
+		Environment: map[string]string{
+			"FOO": "bar",
+		},
+	}
+
+	b, err := ts.backend.marshal(&execReq)
+	assert.NoError(err)
+
+	_, err = ts.mqttClient.Publish(context.Background(), &paho5.Publish{
+		Topic:   "gateway/0807060504030202/command/exec",
+		Payload: b,
+		Properties: &paho5.PublishProperties{
+			ResponseTopic:   "v5-test/response",
+			CorrelationData: []byte{1, 2, 3},
+		},
+	})
+	assert.NoError(err)
+
+	receivedExecReq := <-ts.gatewayCommandExecRequestChan
+	assert.Equal(execReq, receivedExecReq)
+
+	assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "exec", uuid.Nil, &gw.GatewayCommandExecResponse{
+		GatewayId: ts.gatewayID[:],
+		ExecId:    id[:],
+		Stdout:    []byte("ok"),
+	}))
+
+	pb := <-ts.messages
+	assert.Equal("v5-test/response", pb.Topic)
+	assert.NotNil(pb.Properties)
+	assert.Equal([]byte{1, 2, 3}, pb.Properties.CorrelationData)
+
+	var resp gw.GatewayCommandExecResponse
+	assert.NoError(ts.backend.unmarshal(pb.Payload, &resp))
+	assert.Equal([]byte("ok"), resp.Stdout)
+}
+
+func TestMQTTV5Backend(t *testing.T) {
+	suite.Run(t, new(MQTTV5BackendTestSuite))
+}
+
+func TestMQTTV5SetGatewaySubscriptionNotConnected(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.ProtocolVersion = 5
+	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{"tcp://127.0.0.1:1883"}
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	// the gateway is subscribed by onConnected once connected
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+	assert.Contains(b.gateways, gatewayID)
+
+	assert.NoError(b.SetGatewaySubscription(false, gatewayID))
+	assert.NotContains(b.gateways, gatewayID)
+}
@@ -0,0 +1,331 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"text/template"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// GatewayBackend implements a MQTT integration which opens a separate MQTT
+// session per gateway. The session is created when the gateway is
+// subscribed and is closed when the gateway is unsubscribed. This makes it
+// possible to use a (cloud) device identity per gateway.
+type GatewayBackend struct {
+	sync.RWMutex
+
+	conf config.Config
+
+	// sessions holds the connected session per gateway.
+	sessions map[lorawan.EUI64]*Backend
+
+	// pending holds the sessions which are still connecting. A session is
+	// removed (and stopped) when the gateway is unsubscribed meanwhile.
+	pending map[lorawan.EUI64]*Backend
+
+	// wg tracks the sessions which are connecting in the background.
+	wg sync.WaitGroup
+
+	downlinkFrameFunc             func(gw.DownlinkFrame)
+	gatewayConfigurationFunc      func(gw.GatewayConfiguration)
+	gatewayCommandExecRequestFunc func(gw.GatewayCommandExecRequest)
+	rawPacketForwarderCommandFunc func(gw.RawPacketForwarderCommand)
+}
+
+// NewGatewayBackend creates a new GatewayBackend.
+func NewGatewayBackend(conf config.Config) (*GatewayBackend, error) {
+	if len(conf.Integration.MQTT.Connections) != 0 {
+		return nil, errors.New("integration/mqtt: session per gateway can not be used with multiple connections")
+	}
+	if conf.Integration.MQTT.SparkplugB.Enabled || conf.Integration.MQTT.SharedSubscription.Enabled {
+		return nil, errors.New("integration/mqtt: session per gateway can not be used with sparkplug b or shared subscription")
+	}
+
+	// Validate the templates.
+	if _, err := gatewayConfig(conf, lorawan.EUI64{}); err != nil {
+		return nil, errors.Wrap(err, "integration/mqtt: gateway config error")
+	}
+
+	return &GatewayBackend{
+		conf:     conf,
+		sessions: make(map[lorawan.EUI64]*Backend),
+		pending:  make(map[lorawan.EUI64]*Backend),
+	}, nil
+}
+
+// gatewayConfig returns the configuration for the session of the given
+// gateway. The authentication options identifying the gateway (client and
+// device IDs, certificate and key files) are executed as template, e.g.
+// tls_cert="/etc/certs/{{ .GatewayID }}.pem".
+func gatewayConfig(conf config.Config, gatewayID lorawan.EUI64) (config.Config, error) {
+	a := &conf.Integration.MQTT.Auth
+
+	// copy the slice, as its elements are replaced
+	a.Generic.CredentialHelper.Command = append([]string{}, a.Generic.CredentialHelper.Command...)
+
+	fields := []*string{
+		&a.Generic.Username,
+		&a.Generic.ClientID,
+		&a.Generic.TLSCert,
+		&a.Generic.TLSKey,
+		&a.Generic.CredentialHelper.File,
+		&a.GCPCloudIoTCore.DeviceID,
+		&a.GCPCloudIoTCore.JWTKeyFile,
+		&a.AzureIoTHub.DeviceID,
+		&a.AzureIoTHub.TLSCert,
+		&a.AzureIoTHub.TLSKey,
+		&a.AWSIoTCore.ThingName,
+		&a.AWSIoTCore.TLSCert,
+		&a.AWSIoTCore.TLSKey,
+	}
+	for i := range a.Generic.CredentialHelper.Command {
+		fields = append(fields, &a.Generic.CredentialHelper.Command[i])
+	}
+
+	for _, f := range fields {
+		tmpl, err := template.New("auth").Parse(*f)
+		if err != nil {
+			return conf, errors.Wrapf(err, "parse template %s error", *f)
+		}
+
+		out := bytes.NewBuffer(nil)
+		if err := tmpl.Execute(out, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
+			return conf, errors.Wrapf(err, "execute template %s error", *f)
+		}
+		*f = out.String()
+	}
+
+	// The state of the gateway is published by the last will of its own
+	// session.
+	conf.Integration.MQTT.BridgeStateTopicTemplate = ""
+
+	if conf.Integration.MQTT.Outbox.Path != "" {
+		conf.Integration.MQTT.Outbox.Path = filepath.Join(conf.Integration.MQTT.Outbox.Path, gatewayID.String())
+	}
+
+	// A gateway which can not connect must not terminate the bridge, the
+	// session keeps retrying until the gateway is unsubscribed.
+	terminateOnConnectError := false
+	conf.Integration.MQTT.TerminateOnConnectError = &terminateOnConnectError
+
+	return conf, nil
+}
+
+// Start starts the integration. The sessions are started when the gateways
+// are subscribed.
+func (b *GatewayBackend) Start() error {
+	return nil
+}
+
+// Stop closes all the sessions, including the sessions which are still
+// connecting.
+func (b *GatewayBackend) Stop() error {
+	b.Lock()
+	sessions := b.sessions
+	pending := b.pending
+	b.sessions = make(map[lorawan.EUI64]*Backend)
+	b.pending = make(map[lorawan.EUI64]*Backend)
+	b.Unlock()
+
+	// Stopping a connecting session cancels its connect loop.
+	for _, s := range pending {
+		s.Stop()
+	}
+	b.wg.Wait()
+
+	for gatewayID, s := range sessions {
+		if err := s.Stop(); err != nil {
+			return errors.Wrapf(err, "stop session for gateway %s error", gatewayID)
+		}
+	}
+
+	return nil
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func.
+func (b *GatewayBackend) SetDownlinkFrameFunc(f func(gw.DownlinkFrame)) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.downlinkFrameFunc = f
+	for _, s := range b.sessions {
+		s.SetDownlinkFrameFunc(f)
+	}
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func.
+func (b *GatewayBackend) SetGatewayConfigurationFunc(f func(gw.GatewayConfiguration)) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.gatewayConfigurationFunc = f
+	for _, s := range b.sessions {
+		s.SetGatewayConfigurationFunc(f)
+	}
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler func.
+func (b *GatewayBackend) SetGatewayCommandExecRequestFunc(f func(gw.GatewayCommandExecRequest)) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.gatewayCommandExecRequestFunc = f
+	for _, s := range b.sessions {
+		s.SetGatewayCommandExecRequestFunc(f)
+	}
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler func.
+func (b *GatewayBackend) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderCommand)) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.rawPacketForwarderCommandFunc = f
+	for _, s := range b.sessions {
+		s.SetRawPacketForwarderCommandFunc(f)
+	}
+}
+
+// SetGatewaySubscription opens (subscribe) or closes (unsubscribe) the
+// session of the given gateway. The session connects in the background, so
+// that a gateway which can not connect does not block the caller.
+func (b *GatewayBackend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"subscribe":  subscribe,
+	}).Debug("integration/mqtt: set gateway subscription called")
+
+	if !subscribe {
+		b.Lock()
+		s, ok := b.pending[gatewayID]
+		if ok {
+			delete(b.pending, gatewayID)
+		} else {
+			s, ok = b.sessions[gatewayID]
+			delete(b.sessions, gatewayID)
+		}
+		b.Unlock()
+
+		if !ok {
+			return nil
+		}
+
+		// In case the session is still connecting, this cancels the
+		// connect loop.
+		log.WithField("gateway_id", gatewayID).Info("integration/mqtt: closing gateway session")
+		return s.Stop()
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if _, ok := b.sessions[gatewayID]; ok {
+		return nil
+	}
+	if _, ok := b.pending[gatewayID]; ok {
+		return nil
+	}
+
+	s, err := b.newSession(gatewayID)
+	if err != nil {
+		return errors.Wrapf(err, "new session for gateway %s error", gatewayID)
+	}
+	b.pending[gatewayID] = s
+
+	b.wg.Add(1)
+	go b.connectSession(gatewayID, s)
+
+	return nil
+}
+
+// newSession creates the session for the given gateway. The caller must hold
+// the lock.
+func (b *GatewayBackend) newSession(gatewayID lorawan.EUI64) (*Backend, error) {
+	log.WithField("gateway_id", gatewayID).Info("integration/mqtt: opening gateway session")
+
+	conf, err := gatewayConfig(b.conf, gatewayID)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewBackend(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.initGatewayState(gatewayID); err != nil {
+		return nil, errors.Wrap(err, "init gateway state error")
+	}
+
+	s.SetDownlinkFrameFunc(b.downlinkFrameFunc)
+	s.SetGatewayConfigurationFunc(b.gatewayConfigurationFunc)
+	s.SetGatewayCommandExecRequestFunc(b.gatewayCommandExecRequestFunc)
+	s.SetRawPacketForwarderCommandFunc(b.rawPacketForwarderCommandFunc)
+
+	// The session is not yet connected, the command topic is subscribed
+	// once it connects.
+	if err := s.SetGatewaySubscription(true, gatewayID); err != nil {
+		return nil, errors.Wrap(err, "set gateway subscription error")
+	}
+
+	return s, nil
+}
+
+// connectSession connects the given pending session. The connect loop is
+// cancelled by stopping the session, which is done when the gateway is
+// unsubscribed while connecting.
+func (b *GatewayBackend) connectSession(gatewayID lorawan.EUI64, s *Backend) {
+	defer b.wg.Done()
+
+	// Start returns when the session is connected or has been stopped.
+	err := s.Start()
+	if err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: start gateway session error")
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.pending[gatewayID] != s {
+		return
+	}
+	delete(b.pending, gatewayID)
+	if err == nil {
+		b.sessions[gatewayID] = s
+	}
+}
+
+// PublishEvent publishes the given event using the session of the gateway.
+func (b *GatewayBackend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	return b.PublishEventWithMetaData(gatewayID, event, id, v, nil)
+}
+
+// PublishEventWithMetaData publishes the given event together with the given
+// gateway meta-data using the session of the gateway.
+func (b *GatewayBackend) PublishEventWithMetaData(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message, metaData map[string]string) error {
+	b.RLock()
+	s, ok := b.sessions[gatewayID]
+	b.RUnlock()
+
+	if !ok {
+		// The session publishes the ONLINE state once connected and the
+		// OFFLINE state when closed.
+		if event == "conn" {
+			return nil
+		}
+
+		return fmt.Errorf("no session for gateway %s", gatewayID)
+	}
+
+	return s.PublishEventWithMetaData(gatewayID, event, id, v, metaData)
+}
@@ -0,0 +1,249 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"os"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/state"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+func TestGatewayConfig(t *testing.T) {
+	assert := require.New(t)
+
+	terminateOnConnectError := true
+
+	var conf config.Config
+	conf.Integration.MQTT.BridgeStateTopicTemplate = "gateway-bridge/{{ .Hostname }}/state/conn"
+	conf.Integration.MQTT.Outbox.Path = "/var/lib/outbox"
+	conf.Integration.MQTT.Auth.Generic.ClientID = "gw-{{ .GatewayID }}"
+	conf.Integration.MQTT.Auth.Generic.Password = "{{ secret }}"
+	conf.Integration.MQTT.Auth.Generic.CredentialHelper.Command = []string{"token-agent", "--device", "{{ .GatewayID }}"}
+	conf.Integration.MQTT.Auth.AzureIoTHub.TLSCert = "/etc/certs/{{ .GatewayID }}.pem"
+	conf.Integration.MQTT.Auth.AWSIoTCore.ThingName = "{{ .GatewayID }}"
+	conf.Integration.MQTT.TerminateOnConnectError = &terminateOnConnectError
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	c, err := gatewayConfig(conf, gatewayID)
+	assert.NoError(err)
+
+	assert.Equal("", c.Integration.MQTT.BridgeStateTopicTemplate)
+	assert.Equal("/var/lib/outbox/0102030405060708", c.Integration.MQTT.Outbox.Path)
+	assert.Equal("gw-0102030405060708", c.Integration.MQTT.Auth.Generic.ClientID)
+	assert.Equal("{{ secret }}", c.Integration.MQTT.Auth.Generic.Password)
+	assert.Equal([]string{"token-agent", "--device", "0102030405060708"}, c.Integration.MQTT.Auth.Generic.CredentialHelper.Command)
+	assert.Equal("/etc/certs/0102030405060708.pem", c.Integration.MQTT.Auth.AzureIoTHub.TLSCert)
+	assert.Equal("0102030405060708", c.Integration.MQTT.Auth.AWSIoTCore.ThingName)
+	assert.False(*c.Integration.MQTT.TerminateOnConnectError)
+
+	// the original config is not modified
+	assert.Equal("{{ .GatewayID }}", conf.Integration.MQTT.Auth.Generic.CredentialHelper.Command[2])
+	assert.True(*conf.Integration.MQTT.TerminateOnConnectError)
+}
+
+func TestGatewayBackendUnsubscribeWhileConnecting(t *testing.T) {
+	assert := require.New(t)
+
+	log.SetLevel(log.ErrorLevel)
+
+	// no broker is listening on this port, the session keeps retrying
+	terminateOnConnectError := true
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "pergateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "pergateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.StateTopicTemplate = "pergateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.Integration.MQTT.SessionPerGateway = true
+	conf.Integration.MQTT.TerminateOnConnectError = &terminateOnConnectError
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{"tcp://127.0.0.1:1"}
+	conf.Integration.MQTT.Auth.Generic.ClientID = "gw-{{ .GatewayID }}"
+
+	b, err := NewGatewayBackend(conf)
+	assert.NoError(err)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+
+	b.RLock()
+	assert.Len(b.pending, 1)
+	b.RUnlock()
+
+	// the connect loop is cancelled
+	assert.NoError(b.SetGatewaySubscription(false, gatewayID))
+	b.wg.Wait()
+
+	b.RLock()
+	assert.Len(b.pending, 0)
+	assert.Len(b.sessions, 0)
+	b.RUnlock()
+}
+
+func TestGatewayBackend(t *testing.T) {
+	assert := require.New(t)
+
+	log.SetLevel(log.ErrorLevel)
+
+	server := "tcp://127.0.0.1:1883/1"
+	var username string
+	var password string
+
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		server = v
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		username = v
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		password = v
+	}
+
+	opts := paho.NewClientOptions().AddBroker(server).SetUsername(username).SetPassword(password)
+	mqttClient := paho.NewClient(opts)
+	token := mqttClient.Connect()
+	token.Wait()
+	assert.NoError(token.Error())
+	defer mqttClient.Disconnect(0)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// clear retained state of previous runs
+	token = mqttClient.Publish("pergateway/0102030405060708/state/conn", 0, true, []byte{})
+	token.Wait()
+	assert.NoError(token.Error())
+
+	messages := make(chan paho.Message, 10)
+	token = mqttClient.Subscribe("pergateway/+/event/+", 0, func(c paho.Client, msg paho.Message) {
+		messages <- msg
+	})
+	token.Wait()
+	assert.NoError(token.Error())
+
+	states := make(chan state.ConnState, 10)
+	token = mqttClient.Subscribe("pergateway/+/state/conn", 0, func(c paho.Client, msg paho.Message) {
+		var pl state.ConnState
+		if err := (&marshaler.JSON{}).Unmarshal(msg.Payload(), &pl); err == nil {
+			states <- pl
+		}
+	})
+	token.Wait()
+	assert.NoError(token.Error())
+
+	retained := true
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "pergateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "pergateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.StateTopicTemplate = "pergateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.Integration.MQTT.StateRetained = &retained
+	conf.Integration.MQTT.BridgeStateTopicTemplate = "pergateway/bridge/state"
+	conf.Integration.MQTT.SessionPerGateway = true
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{server}
+	conf.Integration.MQTT.Auth.Generic.Username = username
+	conf.Integration.MQTT.Auth.Generic.Password = password
+	conf.Integration.MQTT.Auth.Generic.ClientID = "gw-{{ .GatewayID }}"
+	conf.Integration.MQTT.Auth.Generic.CleanSession = true
+
+	backend, err := NewGatewayBackend(conf)
+	assert.NoError(err)
+	assert.NoError(backend.Start())
+	defer backend.Stop()
+
+	configs := make(chan gw.GatewayConfiguration, 1)
+	backend.SetGatewayConfigurationFunc(func(pl gw.GatewayConfiguration) {
+		configs <- pl
+	})
+
+	t.Run("Subscribe", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(backend.SetGatewaySubscription(true, gatewayID))
+		assert.NoError(backend.SetGatewaySubscription(true, gatewayID))
+
+		// the session connects in the background
+		var s *Backend
+		assert.Eventually(func() bool {
+			backend.RLock()
+			defer backend.RUnlock()
+			s = backend.sessions[gatewayID]
+			return s != nil
+		}, 10*time.Second, 10*time.Millisecond)
+
+		assert.Equal("gw-0102030405060708", s.clientOpts.ClientID)
+		assert.Equal("pergateway/0102030405060708/state/conn", s.clientOpts.WillTopic)
+		assert.True(s.clientOpts.WillRetained)
+
+		// the session publishes the ONLINE state once connected
+		select {
+		case pl := <-states:
+			assert.Equal(gatewayID[:], pl.GatewayId)
+			assert.Equal(state.ConnState_ONLINE, pl.State)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for state")
+		}
+	})
+
+	t.Run("PublishEvent", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(backend.PublishEvent(gatewayID, "up", uuid.Nil, &gw.UplinkFrame{PhyPayload: []byte{1, 2, 3}}))
+
+		select {
+		case msg := <-messages:
+			assert.Equal("pergateway/0102030405060708/event/up", msg.Topic())
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+
+		// unknown gateway
+		assert.Error(backend.PublishEvent(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, "up", uuid.Nil, &gw.UplinkFrame{}))
+		assert.NoError(backend.PublishEvent(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, "conn", uuid.Nil, &state.ConnState{}))
+	})
+
+	t.Run("Command", func(t *testing.T) {
+		assert := require.New(t)
+
+		token := mqttClient.Publish("pergateway/0102030405060708/command/config", 0, false, []byte(`{"gatewayID": "`+base64.StdEncoding.EncodeToString(gatewayID[:])+`", "version": "1.2.3"}`))
+		token.Wait()
+		assert.NoError(token.Error())
+
+		select {
+		case pl := <-configs:
+			assert.Equal("1.2.3", pl.Version)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for configuration")
+		}
+	})
+
+	t.Run("Unsubscribe", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(backend.SetGatewaySubscription(false, gatewayID))
+
+		select {
+		case pl := <-states:
+			assert.Equal(gatewayID[:], pl.GatewayId)
+			assert.Equal(state.ConnState_OFFLINE, pl.State)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for state")
+		}
+
+		backend.RLock()
+		assert.Len(backend.sessions, 0)
+		backend.RUnlock()
+	})
+}
@@ -0,0 +1,405 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// connection holds a single named MQTT connection of the MultiBackend.
+type connection struct {
+	name       string
+	backend    *Backend
+	eventTypes map[string]struct{}
+	commands   bool
+
+	// mux guards started and serializes the gateway subscriptions of the
+	// connection.
+	mux     sync.RWMutex
+	started bool
+}
+
+func (c *connection) isStarted() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.started
+}
+
+// canQueue returns true when the events can be published before the
+// connection has been started, in which case these are stored in the outbox
+// and published once connected.
+func (c *connection) canQueue() bool {
+	return c.backend.outbox != nil && c.backend.sparkplug == nil
+}
+
+// MultiBackend implements a MQTT integration which publishes the events
+// to multiple MQTT connections.
+type MultiBackend struct {
+	connections []*connection
+
+	// gateways holds the subscribed gateways, these are subscribed on the
+	// connections which are started after the gateway was subscribed.
+	mux      sync.RWMutex
+	gateways map[lorawan.EUI64]struct{}
+}
+
+// NewMultiBackend creates a new MultiBackend, using the configured
+// connections.
+func NewMultiBackend(conf config.Config) (*MultiBackend, error) {
+	b := MultiBackend{
+		gateways: make(map[lorawan.EUI64]struct{}),
+	}
+
+	commandConnections := make(map[string]struct{})
+	for _, name := range conf.Integration.MQTT.CommandConnections {
+		commandConnections[name] = struct{}{}
+	}
+
+	names := make(map[string]struct{})
+
+	for i, c := range conf.Integration.MQTT.Connections {
+		if c.Name == "" {
+			return nil, fmt.Errorf("integration/mqtt: connection %d must have a name", i)
+		}
+		if _, ok := names[c.Name]; ok {
+			return nil, fmt.Errorf("integration/mqtt: duplicate connection name: %s", c.Name)
+		}
+		names[c.Name] = struct{}{}
+
+		conn := &connection{
+			name:       c.Name,
+			eventTypes: make(map[string]struct{}),
+		}
+
+		for _, t := range c.EventTypes {
+			conn.eventTypes[t] = struct{}{}
+		}
+
+		switch conf.Integration.MQTT.CommandPolicy {
+		case "", "all":
+			conn.commands = true
+		case "first":
+			conn.commands = i == 0
+		case "list":
+			_, conn.commands = commandConnections[c.Name]
+		default:
+			return nil, fmt.Errorf("integration/mqtt: unknown command policy: %s", conf.Integration.MQTT.CommandPolicy)
+		}
+
+		var err error
+		conn.backend, err = NewBackend(connectionConfig(conf, i))
+		if err != nil {
+			return nil, errors.Wrapf(err, "integration/mqtt: new backend for connection %s error", c.Name)
+		}
+
+		b.connections = append(b.connections, conn)
+	}
+
+	if conf.Integration.MQTT.CommandPolicy == "list" {
+		for name := range commandConnections {
+			if _, ok := names[name]; !ok {
+				return nil, fmt.Errorf("integration/mqtt: unknown command connection: %s", name)
+			}
+		}
+	}
+
+	return &b, nil
+}
+
+// connectionConfig returns the configuration for the connection with the
+// given index. Unset fields fall back to the values of the top-level MQTT
+// integration configuration. Fields of which the zero value is a valid
+// setting are unset when they are not explicitly set and have the zero
+// value.
+func connectionConfig(conf config.Config, i int) config.Config {
+	c := conf.Integration.MQTT.Connections[i]
+	defaults := conf.Integration.MQTT.MQTTIntegration
+
+	if c.Marshaler != "" {
+		conf.Integration.Marshaler = c.Marshaler
+	}
+
+	if c.EventTopicTemplate == "" {
+		c.EventTopicTemplate = defaults.EventTopicTemplate
+	}
+	if c.CommandTopicTemplate == "" {
+		c.CommandTopicTemplate = defaults.CommandTopicTemplate
+	}
+	if c.StateTopicTemplate == "" {
+		c.StateTopicTemplate = defaults.StateTopicTemplate
+	}
+	if c.BridgeStateTopicTemplate == "" {
+		c.BridgeStateTopicTemplate = defaults.BridgeStateTopicTemplate
+	}
+	if c.StateRetained == nil {
+		c.StateRetained = defaults.StateRetained
+	}
+	if c.KeepAlive == 0 {
+		c.KeepAlive = defaults.KeepAlive
+	}
+	if c.MaxReconnectInterval == 0 {
+		c.MaxReconnectInterval = defaults.MaxReconnectInterval
+	}
+	if c.ProtocolVersion == 0 {
+		c.ProtocolVersion = defaults.ProtocolVersion
+	}
+	if c.CommandQOS == nil {
+		c.CommandQOS = defaults.CommandQOS
+	}
+	if c.Events == nil {
+		c.Events = defaults.Events
+	}
+	if c.SharedSubscription.Group == "" {
+		c.SharedSubscription.Group = defaults.SharedSubscription.Group
+	}
+	if c.SharedSubscription.ForwardTopicPrefix == "" {
+		c.SharedSubscription.ForwardTopicPrefix = defaults.SharedSubscription.ForwardTopicPrefix
+	}
+	if c.Auth.Type == "" {
+		c.Auth.Type = defaults.Auth.Type
+	}
+	if c.Outbox.MaxSize == 0 {
+		c.Outbox.MaxSize = defaults.Outbox.MaxSize
+	}
+	if c.Outbox.MaxAge == 0 {
+		c.Outbox.MaxAge = defaults.Outbox.MaxAge
+	}
+	if c.MessageExpiry == 0 {
+		c.MessageExpiry = defaults.MessageExpiry
+	}
+	if c.TerminateOnConnectError == nil {
+		c.TerminateOnConnectError = defaults.TerminateOnConnectError
+	}
+	if c.Auth.Generic.QOS == nil {
+		c.Auth.Generic.QOS = defaults.Auth.Generic.QOS
+	}
+
+	// the (deprecated) server setting takes precedence over servers, as it
+	// does for the top-level configuration
+	if c.Auth.Generic.Server != "" {
+		c.Auth.Generic.Servers = []string{c.Auth.Generic.Server}
+	}
+	if len(c.Auth.Generic.Servers) == 0 {
+		c.Auth.Generic.Servers = defaults.Auth.Generic.Servers
+	}
+
+	conf.Integration.MQTT.MQTTIntegration = c.MQTTIntegration
+	conf.Integration.MQTT.Connections = nil
+
+	return conf
+}
+
+// Start starts all the connections. Each connection is started in its own
+// goroutine, so that a connection which can not connect does not block the
+// other connections. Events for a connection which has not been started yet
+// are stored in the outbox of the connection (if configured), else these are
+// not published.
+func (b *MultiBackend) Start() error {
+	for _, c := range b.connections {
+		log.WithField("connection", c.name).Info("integration/mqtt: starting connection")
+
+		go b.start(c)
+	}
+
+	return nil
+}
+
+// start starts the given connection and subscribes the gateways which were
+// subscribed before the connection was started.
+func (b *MultiBackend) start(c *connection) {
+	if err := c.backend.Start(); err != nil {
+		log.WithError(err).WithField("connection", c.name).Error("integration/mqtt: start connection error")
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.backend.isClosed() {
+		return
+	}
+	c.started = true
+
+	log.WithField("connection", c.name).Info("integration/mqtt: connection started")
+
+	if !c.commands {
+		return
+	}
+
+	b.mux.RLock()
+	var gatewayIDs []lorawan.EUI64
+	for gatewayID := range b.gateways {
+		gatewayIDs = append(gatewayIDs, gatewayID)
+	}
+	b.mux.RUnlock()
+
+	for _, gatewayID := range gatewayIDs {
+		if err := c.backend.SetGatewaySubscription(true, gatewayID); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"connection": c.name,
+				"gateway_id": gatewayID,
+			}).Error("integration/mqtt: set gateway subscription error")
+		}
+	}
+}
+
+// Stop stops all the connections.
+func (b *MultiBackend) Stop() error {
+	for _, c := range b.connections {
+		if err := c.backend.Stop(); err != nil {
+			return errors.Wrapf(err, "stop connection %s error", c.name)
+		}
+	}
+
+	return nil
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func.
+func (b *MultiBackend) SetDownlinkFrameFunc(f func(gw.DownlinkFrame)) {
+	for _, c := range b.connections {
+		c.backend.SetDownlinkFrameFunc(f)
+	}
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func.
+func (b *MultiBackend) SetGatewayConfigurationFunc(f func(gw.GatewayConfiguration)) {
+	for _, c := range b.connections {
+		c.backend.SetGatewayConfigurationFunc(f)
+	}
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler func.
+func (b *MultiBackend) SetGatewayCommandExecRequestFunc(f func(gw.GatewayCommandExecRequest)) {
+	for _, c := range b.connections {
+		c.backend.SetGatewayCommandExecRequestFunc(f)
+	}
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler func.
+func (b *MultiBackend) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderCommand)) {
+	for _, c := range b.connections {
+		c.backend.SetRawPacketForwarderCommandFunc(f)
+	}
+}
+
+// SetMetaDataFunc sets the meta-data func.
+func (b *MultiBackend) SetMetaDataFunc(f func() map[string]string) {
+	for _, c := range b.connections {
+		c.backend.SetMetaDataFunc(f)
+	}
+}
+
+// SetGatewaySubscription (un)subscribes the given gateway on the connections
+// from which commands are accepted. Connections which have not been started
+// yet subscribe the gateway once started.
+func (b *MultiBackend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	b.mux.Lock()
+	if subscribe {
+		b.gateways[gatewayID] = struct{}{}
+	} else {
+		delete(b.gateways, gatewayID)
+	}
+	b.mux.Unlock()
+
+	for _, c := range b.connections {
+		if !c.commands {
+			continue
+		}
+
+		if err := b.setGatewaySubscription(c, subscribe, gatewayID); err != nil {
+			return errors.Wrapf(err, "set gateway subscription for connection %s error", c.name)
+		}
+	}
+
+	return nil
+}
+
+func (b *MultiBackend) setGatewaySubscription(c *connection, subscribe bool, gatewayID lorawan.EUI64) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if !c.started {
+		return nil
+	}
+
+	return c.backend.SetGatewaySubscription(subscribe, gatewayID)
+}
+
+// PublishEvent publishes the given event to all the connections matching
+// the event type.
+func (b *MultiBackend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	return b.PublishEventWithMetaData(gatewayID, event, id, v, nil)
+}
+
+// PublishEventWithMetaData publishes the given event together with the given
+// gateway meta-data to all the connections matching the event type.
+func (b *MultiBackend) PublishEventWithMetaData(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message, metaData map[string]string) error {
+	return b.publishEvent(nil, gatewayID, event, id, v, metaData)
+}
+
+// PublishEventTo publishes the given event together with the given gateway
+// meta-data to the given connections, regardless the configured event types.
+func (b *MultiBackend) PublishEventTo(destinations []string, gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message, metaData map[string]string) error {
+	return b.publishEvent(destinations, gatewayID, event, id, v, metaData)
+}
+
+// Destinations returns the names of the connections.
+func (b *MultiBackend) Destinations() []string {
+	var out []string
+	for _, c := range b.connections {
+		out = append(out, c.name)
+	}
+	return out
+}
+
+// publishEvent publishes the event to the given connections. When no
+// connections are given, it is published to the connections matching the
+// event type.
+func (b *MultiBackend) publishEvent(destinations []string, gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message, metaData map[string]string) error {
+	var errs []string
+
+	for _, c := range b.connections {
+		if len(destinations) != 0 {
+			if !contains(destinations, c.name) {
+				continue
+			}
+		} else if len(c.eventTypes) != 0 {
+			if _, ok := c.eventTypes[event]; !ok {
+				continue
+			}
+		}
+
+		if !c.isStarted() && !c.canQueue() {
+			errs = append(errs, fmt.Sprintf("%s: connection not started", c.name))
+			continue
+		}
+
+		if err := c.backend.PublishEventWithMetaData(gatewayID, event, id, v, metaData); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", c.name, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("publish event error: %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
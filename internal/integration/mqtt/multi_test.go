@@ -0,0 +1,384 @@
+package mqtt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofrs/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+type MQTTMultiBackendTestSuite struct {
+	suite.Suite
+
+	mqttClient paho.Client
+	backend    *MultiBackend
+	gatewayID  lorawan.EUI64
+
+	downlinkFrameChan chan gw.DownlinkFrame
+}
+
+func (ts *MQTTMultiBackendTestSuite) SetupSuite() {
+	assert := require.New(ts.T())
+
+	log.SetLevel(log.ErrorLevel)
+
+	server := "tcp://127.0.0.1:1883/1"
+	var username string
+	var password string
+
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		server = v
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		username = v
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		password = v
+	}
+
+	opts := paho.NewClientOptions().AddBroker(server).SetUsername(username).SetPassword(password)
+	ts.mqttClient = paho.NewClient(opts)
+	token := ts.mqttClient.Connect()
+	token.Wait()
+	assert.NoError(token.Error())
+
+	ts.gatewayID = lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 3}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.CommandPolicy = "first"
+	conf.Integration.MQTT.Auth.Type = "generic"
+
+	for _, name := range []string{"a", "b"} {
+		var c config.MQTTIntegration
+		c.EventTopicTemplate = name + "/gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+		c.CommandTopicTemplate = name + "/gateway/{{ .GatewayID }}/command/#"
+		c.Auth.Generic.Servers = []string{server}
+		c.Auth.Generic.Username = username
+		c.Auth.Generic.Password = password
+		c.Auth.Generic.CleanSession = true
+		c.Auth.Generic.ClientID = "test-multi-" + name
+
+		conf.Integration.MQTT.Connections = append(conf.Integration.MQTT.Connections, config.MQTTConnection{
+			MQTTIntegration: c,
+			Name:            name,
+		})
+	}
+
+	// connection b only receives the stats events
+	conf.Integration.MQTT.Connections[1].EventTypes = []string{"stats"}
+
+	var err error
+	ts.backend, err = NewMultiBackend(conf)
+	assert.NoError(err)
+
+	ts.downlinkFrameChan = make(chan gw.DownlinkFrame, 2)
+	downlinkFrameChan := ts.downlinkFrameChan
+	ts.backend.SetDownlinkFrameFunc(func(pl gw.DownlinkFrame) {
+		downlinkFrameChan <- pl
+	})
+
+	// the gateway is subscribed once the connections are started
+	assert.NoError(ts.backend.SetGatewaySubscription(true, ts.gatewayID))
+	assert.NoError(ts.backend.Start())
+	for _, c := range ts.backend.connections {
+		for !c.isStarted() {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+}
+
+func (ts *MQTTMultiBackendTestSuite) TearDownSuite() {
+	ts.mqttClient.Disconnect(0)
+	ts.backend.Stop()
+}
+
+func (ts *MQTTMultiBackendTestSuite) TestPublishEvent() {
+	assert := require.New(ts.T())
+
+	topics := make(chan string, 10)
+	token := ts.mqttClient.Subscribe("+/gateway/0807060504030203/event/+", 0, func(c paho.Client, msg paho.Message) {
+		topics <- msg.Topic()
+	})
+	token.Wait()
+	assert.NoError(token.Error())
+	defer func() {
+		ts.mqttClient.Unsubscribe("+/gateway/0807060504030203/event/+").Wait()
+	}()
+
+	id, err := uuid.NewV4()
+	assert.NoError(err)
+
+	ts.T().Run("All connections", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "stats", id, &gw.GatewayStats{
+			GatewayId: ts.gatewayID[:],
+		}))
+
+		received := []string{<-topics, <-topics}
+		assert.ElementsMatch([]string{
+			"a/gateway/0807060504030203/event/stats",
+			"b/gateway/0807060504030203/event/stats",
+		}, received)
+	})
+
+	ts.T().Run("Filtered by event type", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "up", id, &gw.UplinkFrame{
+			PhyPayload: []byte{1, 2, 3},
+		}))
+
+		assert.Equal("a/gateway/0807060504030203/event/up", <-topics)
+
+		select {
+		case topic := <-topics:
+			t.Fatalf("unexpected event received on topic: %s", topic)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	ts.T().Run("Routed to destination", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.Equal([]string{"a", "b"}, ts.backend.Destinations())
+
+		// the route overrides the event types of the connection
+		assert.NoError(ts.backend.PublishEventTo([]string{"b"}, ts.gatewayID, "up", id, &gw.UplinkFrame{
+			PhyPayload: []byte{1, 2, 3},
+		}, nil))
+
+		assert.Equal("b/gateway/0807060504030203/event/up", <-topics)
+
+		select {
+		case topic := <-topics:
+			t.Fatalf("unexpected event received on topic: %s", topic)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func (ts *MQTTMultiBackendTestSuite) TestCommandPolicy() {
+	assert := require.New(ts.T())
+
+	downlink := gw.DownlinkFrame{
+		GatewayId: ts.gatewayID[:],
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+			},
+		},
+	}
+
+	b, err := ts.backend.connections[0].backend.marshal(&downlink)
+	assert.NoError(err)
+
+	// connection b is not the first connection, commands must be ignored
+	token := ts.mqttClient.Publish("b/gateway/0807060504030203/command/down", 0, false, b)
+	token.Wait()
+	assert.NoError(token.Error())
+
+	token = ts.mqttClient.Publish("a/gateway/0807060504030203/command/down", 0, false, b)
+	token.Wait()
+	assert.NoError(token.Error())
+
+	assert.Equal(downlink, <-ts.downlinkFrameChan)
+
+	select {
+	case <-ts.downlinkFrameChan:
+		ts.T().Fatal("unexpected downlink received")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMQTTMultiBackend(t *testing.T) {
+	suite.Run(t, new(MQTTMultiBackendTestSuite))
+}
+
+func TestMultiBackendUnreachableConnection(t *testing.T) {
+	assert := require.New(t)
+
+	server := "tcp://127.0.0.1:1883"
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		server = v
+	}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+
+	// connection a is unreachable and must not block connection b
+	for _, s := range []string{"tcp://127.0.0.1:1", server} {
+		var c config.MQTTIntegration
+		c.Auth.Generic.Servers = []string{s}
+		c.Auth.Generic.Username = os.Getenv("TEST_MQTT_USERNAME")
+		c.Auth.Generic.Password = os.Getenv("TEST_MQTT_PASSWORD")
+		c.Auth.Generic.CleanSession = true
+
+		conf.Integration.MQTT.Connections = append(conf.Integration.MQTT.Connections, config.MQTTConnection{
+			MQTTIntegration: c,
+			Name:            string(rune('a' + len(conf.Integration.MQTT.Connections))),
+		})
+	}
+
+	b, err := NewMultiBackend(conf)
+	assert.NoError(err)
+	assert.NoError(b.Start())
+
+	assert.Eventually(b.connections[1].isStarted, 10*time.Second, 10*time.Millisecond)
+	assert.False(b.connections[0].isStarted())
+
+	err = b.PublishEvent(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, "stats", uuid.Nil, &gw.GatewayStats{})
+	assert.EqualError(err, "publish event error: a: connection not started")
+
+	assert.NoError(b.Stop())
+}
+
+func TestConnectionConfig(t *testing.T) {
+	assert := require.New(t)
+
+	tr := true
+
+	var conf config.Config
+	conf.Integration.MQTT.MessageExpiry = time.Minute
+	conf.Integration.MQTT.TerminateOnConnectError = &tr
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{"tcp://127.0.0.1:1883"}
+	conf.Integration.MQTT.Connections = []config.MQTTConnection{
+		{Name: "a"},
+		{Name: "b"},
+	}
+	conf.Integration.MQTT.Connections[1].MessageExpiry = time.Second
+	conf.Integration.MQTT.Connections[1].Auth.Generic.Server = "tcp://example.com:1883"
+
+	a := connectionConfig(conf, 0)
+	assert.Equal(time.Minute, a.Integration.MQTT.MessageExpiry)
+	assert.True(*a.Integration.MQTT.TerminateOnConnectError)
+	assert.Equal([]string{"tcp://127.0.0.1:1883"}, a.Integration.MQTT.Auth.Generic.Servers)
+
+	b := connectionConfig(conf, 1)
+	assert.Equal(time.Second, b.Integration.MQTT.MessageExpiry)
+	assert.Equal([]string{"tcp://example.com:1883"}, b.Integration.MQTT.Auth.Generic.Servers)
+
+	t.Run("Explicit zero values", func(t *testing.T) {
+		assert := require.New(t)
+
+		f := false
+		qos0 := uint8(0)
+		qos1 := uint8(1)
+
+		conf.Integration.MQTT.StateRetained = &tr
+		conf.Integration.MQTT.Auth.Generic.QOS = &qos1
+		conf.Integration.MQTT.Connections[1].StateRetained = &f
+		conf.Integration.MQTT.Connections[1].TerminateOnConnectError = &f
+		conf.Integration.MQTT.Connections[1].Auth.Generic.QOS = &qos0
+
+		a := connectionConfig(conf, 0)
+		assert.True(*a.Integration.MQTT.StateRetained)
+		assert.True(*a.Integration.MQTT.TerminateOnConnectError)
+		assert.EqualValues(1, *a.Integration.MQTT.Auth.Generic.QOS)
+
+		b := connectionConfig(conf, 1)
+		assert.False(*b.Integration.MQTT.StateRetained)
+		assert.False(*b.Integration.MQTT.TerminateOnConnectError)
+		assert.EqualValues(0, *b.Integration.MQTT.Auth.Generic.QOS)
+	})
+}
+
+func TestMultiBackendQueueBeforeStart(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.Connections = []config.MQTTConnection{
+		{Name: "a"},
+		{Name: "b"},
+	}
+	conf.Integration.MQTT.Connections[0].Outbox.Path = filepath.Join(tempDir, "a")
+
+	b, err := NewMultiBackend(conf)
+	assert.NoError(err)
+
+	// the event is stored in the outbox of connection a, connection b does
+	// not have an outbox
+	err = b.PublishEvent(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, "stats", uuid.Nil, &gw.GatewayStats{})
+	assert.EqualError(err, "publish event error: b: connection not started")
+	assert.Equal(1, b.connections[0].backend.outbox.Len())
+}
+
+func TestNewMultiBackendValidation(t *testing.T) {
+	tests := []struct {
+		Name               string
+		Names              []string
+		CommandPolicy      string
+		CommandConnections []string
+		ExpectedError      string
+	}{
+		{
+			Name:          "missing name",
+			Names:         []string{""},
+			ExpectedError: "integration/mqtt: connection 0 must have a name",
+		},
+		{
+			Name:          "duplicate name",
+			Names:         []string{"a", "a"},
+			ExpectedError: "integration/mqtt: duplicate connection name: a",
+		},
+		{
+			Name:          "unknown command policy",
+			Names:         []string{"a"},
+			CommandPolicy: "foo",
+			ExpectedError: "integration/mqtt: unknown command policy: foo",
+		},
+		{
+			Name:               "unknown command connection",
+			Names:              []string{"a"},
+			CommandPolicy:      "list",
+			CommandConnections: []string{"b"},
+			ExpectedError:      "integration/mqtt: unknown command connection: b",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var conf config.Config
+			conf.Integration.Marshaler = "json"
+			conf.Integration.MQTT.Auth.Type = "generic"
+			conf.Integration.MQTT.CommandPolicy = tst.CommandPolicy
+			conf.Integration.MQTT.CommandConnections = tst.CommandConnections
+
+			for _, name := range tst.Names {
+				conf.Integration.MQTT.Connections = append(conf.Integration.MQTT.Connections, config.MQTTConnection{
+					Name: name,
+				})
+			}
+
+			_, err := NewMultiBackend(conf)
+			assert.EqualError(err, tst.ExpectedError)
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package outbox
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	od = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "integration_mqtt_outbox_depth",
+		Help: "The number of events stored in the MQTT outbox.",
+	})
+
+	odc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_mqtt_outbox_drop_count",
+		Help: "The number of events dropped from the MQTT outbox (per reason).",
+	}, []string{"reason"})
+)
+
+func outboxDepthGauge() prometheus.Gauge {
+	return od
+}
+
+func outboxDropCounter(r string) prometheus.Counter {
+	return odc.With(prometheus.Labels{"reason": r})
+}
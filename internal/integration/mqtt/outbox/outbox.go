@@ -0,0 +1,243 @@
+// Package outbox implements a persistent FIFO queue, storing each item as a
+// file in a directory. It is used to buffer events while the MQTT
+// connection is down.
+package outbox
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// headerSize defines the size of the item header (the unix nano timestamp
+// of the item).
+const headerSize = 8
+
+// Item contains an item of the outbox.
+type Item struct {
+	ID   uint64
+	Time time.Time
+	Data []byte
+}
+
+type entry struct {
+	id   uint64
+	size int64
+}
+
+// Outbox implements a persistent FIFO queue. When the max. size is exceeded,
+// the oldest items are dropped. Items older than the max. age are dropped
+// on read.
+type Outbox struct {
+	sync.Mutex
+
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	entries []entry
+	size    int64
+	nextID  uint64
+}
+
+// New creates a new Outbox, using the given directory. Items stored in this
+// directory by a previous process are loaded. A max. size or max. age of 0
+// disables the corresponding limit.
+func New(path string, maxSize int64, maxAge time.Duration) (*Outbox, error) {
+	o := Outbox{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, errors.Wrap(err, "create directory error")
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read directory error")
+	}
+
+	for _, f := range files {
+		// left-over from an interrupted write
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			os.Remove(filepath.Join(path, f.Name()))
+			continue
+		}
+
+		id, err := strconv.ParseUint(f.Name(), 10, 64)
+		if err != nil || f.IsDir() {
+			log.WithField("file", f.Name()).Warning("integration/mqtt/outbox: ignoring unexpected file")
+			continue
+		}
+
+		o.entries = append(o.entries, entry{id: id, size: f.Size()})
+		o.size += f.Size()
+	}
+
+	sort.Slice(o.entries, func(i, j int) bool {
+		return o.entries[i].id < o.entries[j].id
+	})
+
+	if len(o.entries) != 0 {
+		o.nextID = o.entries[len(o.entries)-1].id + 1
+
+		log.WithFields(log.Fields{
+			"path":  path,
+			"items": len(o.entries),
+		}).Info("integration/mqtt/outbox: loaded stored items")
+	}
+
+	outboxDepthGauge().Add(float64(len(o.entries)))
+
+	return &o, nil
+}
+
+// Push appends the given data to the outbox. When the max. size would be
+// exceeded, the oldest items are dropped.
+func (o *Outbox) Push(data []byte) error {
+	o.Lock()
+	defer o.Unlock()
+
+	b := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	copy(b[headerSize:], data)
+	size := int64(len(b))
+
+	if o.maxSize != 0 {
+		if size > o.maxSize {
+			outboxDropCounter("size").Inc()
+			return fmt.Errorf("item size %d exceeds max. size %d", size, o.maxSize)
+		}
+
+		for len(o.entries) != 0 && o.size+size > o.maxSize {
+			if err := o.remove(); err != nil {
+				return err
+			}
+			outboxDropCounter("size").Inc()
+		}
+	}
+
+	id := o.nextID
+	name := o.filename(id)
+
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return errors.Wrap(err, "create file error")
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return errors.Wrap(err, "write file error")
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "sync file error")
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close file error")
+	}
+
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return errors.Wrap(err, "rename file error")
+	}
+
+	o.nextID++
+	o.entries = append(o.entries, entry{id: id, size: size})
+	o.size += size
+	outboxDepthGauge().Inc()
+
+	return nil
+}
+
+// Peek returns the oldest item, without removing it from the outbox. It
+// returns nil when the outbox is empty. Items exceeding the max. age are
+// dropped.
+func (o *Outbox) Peek() (*Item, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	for len(o.entries) != 0 {
+		b, err := ioutil.ReadFile(o.filename(o.entries[0].id))
+		if err != nil || len(b) < headerSize {
+			log.WithError(err).WithField("id", o.entries[0].id).Error("integration/mqtt/outbox: read item error")
+
+			if err := o.remove(); err != nil {
+				return nil, err
+			}
+			outboxDropCounter("invalid").Inc()
+			continue
+		}
+
+		item := Item{
+			ID:   o.entries[0].id,
+			Time: time.Unix(0, int64(binary.BigEndian.Uint64(b))),
+			Data: b[headerSize:],
+		}
+
+		if o.maxAge != 0 && time.Since(item.Time) > o.maxAge {
+			if err := o.remove(); err != nil {
+				return nil, err
+			}
+			outboxDropCounter("age").Inc()
+			continue
+		}
+
+		return &item, nil
+	}
+
+	return nil, nil
+}
+
+// Remove removes the item with the given ID, when it is the oldest item of
+// the outbox. This is a no-op when the item has already been dropped.
+func (o *Outbox) Remove(id uint64) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if len(o.entries) == 0 || o.entries[0].id != id {
+		return nil
+	}
+
+	return o.remove()
+}
+
+// Len returns the number of items in the outbox.
+func (o *Outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+
+	return len(o.entries)
+}
+
+// remove removes the oldest item. It must be called with the lock held.
+func (o *Outbox) remove() error {
+	e := o.entries[0]
+
+	if err := os.Remove(o.filename(e.id)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove file error")
+	}
+
+	o.entries = o.entries[1:]
+	o.size -= e.size
+	outboxDepthGauge().Dec()
+
+	return nil
+}
+
+func (o *Outbox) filename(id uint64) string {
+	return filepath.Join(o.path, fmt.Sprintf("%020d", id))
+}
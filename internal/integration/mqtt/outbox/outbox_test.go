@@ -0,0 +1,114 @@
+package outbox
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	o, err := New(dir, 0, 0)
+	assert.NoError(err)
+
+	t.Run("Empty", func(t *testing.T) {
+		assert := require.New(t)
+
+		item, err := o.Peek()
+		assert.NoError(err)
+		assert.Nil(item)
+	})
+
+	t.Run("FIFO", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(o.Push([]byte("a")))
+		assert.NoError(o.Push([]byte("b")))
+		assert.Equal(2, o.Len())
+
+		item, err := o.Peek()
+		assert.NoError(err)
+		assert.Equal([]byte("a"), item.Data)
+		assert.NoError(o.Remove(item.ID))
+
+		// removing an item which is not the oldest is a no-op
+		assert.NoError(o.Remove(item.ID))
+		assert.Equal(1, o.Len())
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(o.Push([]byte("c")))
+
+		o, err := New(dir, 0, 0)
+		assert.NoError(err)
+		assert.Equal(2, o.Len())
+
+		for _, exp := range []string{"b", "c"} {
+			item, err := o.Peek()
+			assert.NoError(err)
+			assert.Equal([]byte(exp), item.Data)
+			assert.NoError(o.Remove(item.ID))
+		}
+
+		assert.NoError(o.Push([]byte("d")))
+		item, err := o.Peek()
+		assert.NoError(err)
+		assert.Equal([]byte("d"), item.Data)
+	})
+}
+
+func TestOutboxMaxSize(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// each item takes headerSize + 1 bytes
+	o, err := New(dir, 2*(headerSize+1), 0)
+	assert.NoError(err)
+
+	assert.NoError(o.Push([]byte("a")))
+	assert.NoError(o.Push([]byte("b")))
+	assert.NoError(o.Push([]byte("c")))
+	assert.Equal(2, o.Len())
+
+	// the oldest item has been dropped
+	item, err := o.Peek()
+	assert.NoError(err)
+	assert.Equal([]byte("b"), item.Data)
+
+	// an item exceeding the max. size is rejected
+	assert.Error(o.Push(make([]byte, 2*(headerSize+1))))
+	assert.Equal(2, o.Len())
+}
+
+func TestOutboxMaxAge(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	o, err := New(dir, 0, 50*time.Millisecond)
+	assert.NoError(err)
+
+	assert.NoError(o.Push([]byte("a")))
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(o.Push([]byte("b")))
+
+	item, err := o.Peek()
+	assert.NoError(err)
+	assert.Equal([]byte("b"), item.Data)
+	assert.Equal(1, o.Len())
+}
@@ -0,0 +1,445 @@
+// Package sparkplug implements the Sparkplug B topic namespace and the
+// encoding of the Sparkplug B payload.
+//
+// Only the subset of the Sparkplug B payload which is used by the MQTT
+// integration is implemented (scalar metric values). Unsupported fields are
+// skipped on decoding.
+package sparkplug
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// Namespace defines the Sparkplug B topic namespace.
+const Namespace = "spBv1.0"
+
+// Message types.
+const (
+	NBIRTH = "NBIRTH"
+	NDEATH = "NDEATH"
+	DBIRTH = "DBIRTH"
+	DDEATH = "DDEATH"
+	NDATA  = "NDATA"
+	DDATA  = "DDATA"
+	NCMD   = "NCMD"
+	DCMD   = "DCMD"
+)
+
+// DataType defines the metric data-type.
+type DataType uint32
+
+// Data types.
+const (
+	Int8     DataType = 1
+	Int16    DataType = 2
+	Int32    DataType = 3
+	Int64    DataType = 4
+	UInt8    DataType = 5
+	UInt16   DataType = 6
+	UInt32   DataType = 7
+	UInt64   DataType = 8
+	Float    DataType = 9
+	Double   DataType = 10
+	Boolean  DataType = 11
+	String   DataType = 12
+	DateTime DataType = 13
+	Text     DataType = 14
+	UUID     DataType = 15
+	Bytes    DataType = 17
+)
+
+// Payload field numbers.
+const (
+	payloadTimestamp = 1
+	payloadMetrics   = 2
+	payloadSeq       = 3
+)
+
+// Metric field numbers.
+const (
+	metricName         = 1
+	metricTimestamp    = 3
+	metricDataType     = 4
+	metricIsNull       = 7
+	metricIntValue     = 10
+	metricLongValue    = 11
+	metricFloatValue   = 12
+	metricDoubleValue  = 13
+	metricBooleanValue = 14
+	metricStringValue  = 15
+	metricBytesValue   = 16
+)
+
+// Wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Payload implements the Sparkplug B payload.
+type Payload struct {
+	// Timestamp (ms since epoch).
+	Timestamp uint64
+	// Metrics.
+	Metrics []Metric
+	// Sequence number (nil for NDEATH payloads).
+	Seq *uint64
+}
+
+// Metric implements a Sparkplug B metric.
+//
+// The value type must match the data-type:
+//
+//	Int8, Int16, Int32, UInt8, UInt16, UInt32: uint32
+//	Int64, UInt64, DateTime: uint64
+//	Float: float32
+//	Double: float64
+//	Boolean: bool
+//	String, Text, UUID: string
+//	Bytes: []byte
+//
+// Signed values are stored as their two's complement.
+type Metric struct {
+	Name      string
+	Timestamp uint64
+	DataType  DataType
+	IsNull    bool
+	Value     interface{}
+}
+
+// Topic returns the Sparkplug B topic for the given message type. The device
+// ID is omitted when empty.
+func Topic(groupID, messageType, edgeNodeID, deviceID string) string {
+	parts := []string{Namespace, groupID, messageType, edgeNodeID}
+	if deviceID != "" {
+		parts = append(parts, deviceID)
+	}
+	return strings.Join(parts, "/")
+}
+
+// ParseTopic parses the given Sparkplug B topic. The device ID is empty for
+// node-level message types.
+func ParseTopic(topic string) (groupID, messageType, edgeNodeID, deviceID string, err error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != Namespace {
+		return "", "", "", "", fmt.Errorf("invalid sparkplug topic: %s", topic)
+	}
+
+	if len(parts) == 5 {
+		deviceID = parts[4]
+	}
+
+	return parts[1], parts[2], parts[3], deviceID, nil
+}
+
+// ValidateID returns an error when the given group, edge node or device ID
+// can not be used as Sparkplug B topic element.
+func ValidateID(id string) error {
+	if id == "" {
+		return errors.New("id must not be empty")
+	}
+	if strings.ContainsAny(id, "/+#") {
+		return fmt.Errorf("id must not contain '/', '+' or '#': %s", id)
+	}
+	return nil
+}
+
+// Marshal encodes the given payload.
+func Marshal(p Payload) ([]byte, error) {
+	b := proto.NewBuffer(nil)
+
+	if p.Timestamp != 0 {
+		b.EncodeVarint(payloadTimestamp<<3 | wireVarint)
+		b.EncodeVarint(p.Timestamp)
+	}
+
+	for _, m := range p.Metrics {
+		mb, err := marshalMetric(m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshal metric %s error", m.Name)
+		}
+
+		b.EncodeVarint(payloadMetrics<<3 | wireBytes)
+		b.EncodeRawBytes(mb)
+	}
+
+	if p.Seq != nil {
+		b.EncodeVarint(payloadSeq<<3 | wireVarint)
+		b.EncodeVarint(*p.Seq)
+	}
+
+	return b.Bytes(), nil
+}
+
+// Unmarshal decodes the given payload.
+func Unmarshal(data []byte) (Payload, error) {
+	var p Payload
+	b := &reader{data: data}
+
+	for !b.eof() {
+		field, wire, err := decodeKey(b)
+		if err != nil {
+			return p, err
+		}
+
+		switch {
+		case field == payloadTimestamp && wire == wireVarint:
+			if p.Timestamp, err = b.varint(); err != nil {
+				return p, errors.Wrap(err, "decode timestamp error")
+			}
+		case field == payloadMetrics && wire == wireBytes:
+			mb, err := b.bytes()
+			if err != nil {
+				return p, errors.Wrap(err, "decode metric error")
+			}
+
+			m, err := unmarshalMetric(mb)
+			if err != nil {
+				return p, errors.Wrap(err, "unmarshal metric error")
+			}
+			p.Metrics = append(p.Metrics, m)
+		case field == payloadSeq && wire == wireVarint:
+			seq, err := b.varint()
+			if err != nil {
+				return p, errors.Wrap(err, "decode seq error")
+			}
+			p.Seq = &seq
+		default:
+			if err := skip(b, wire); err != nil {
+				return p, err
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func marshalMetric(m Metric) ([]byte, error) {
+	b := proto.NewBuffer(nil)
+
+	b.EncodeVarint(metricName<<3 | wireBytes)
+	b.EncodeStringBytes(m.Name)
+
+	if m.Timestamp != 0 {
+		b.EncodeVarint(metricTimestamp<<3 | wireVarint)
+		b.EncodeVarint(m.Timestamp)
+	}
+
+	b.EncodeVarint(metricDataType<<3 | wireVarint)
+	b.EncodeVarint(uint64(m.DataType))
+
+	if m.IsNull {
+		b.EncodeVarint(metricIsNull<<3 | wireVarint)
+		b.EncodeVarint(1)
+		return b.Bytes(), nil
+	}
+
+	var ok bool
+
+	switch m.DataType {
+	case Int8, Int16, Int32, UInt8, UInt16, UInt32:
+		var v uint32
+		if v, ok = m.Value.(uint32); ok {
+			b.EncodeVarint(metricIntValue<<3 | wireVarint)
+			b.EncodeVarint(uint64(v))
+		}
+	case Int64, UInt64, DateTime:
+		var v uint64
+		if v, ok = m.Value.(uint64); ok {
+			b.EncodeVarint(metricLongValue<<3 | wireVarint)
+			b.EncodeVarint(v)
+		}
+	case Float:
+		var v float32
+		if v, ok = m.Value.(float32); ok {
+			b.EncodeVarint(metricFloatValue<<3 | wireFixed32)
+			b.EncodeFixed32(uint64(math.Float32bits(v)))
+		}
+	case Double:
+		var v float64
+		if v, ok = m.Value.(float64); ok {
+			b.EncodeVarint(metricDoubleValue<<3 | wireFixed64)
+			b.EncodeFixed64(math.Float64bits(v))
+		}
+	case Boolean:
+		var v bool
+		if v, ok = m.Value.(bool); ok {
+			b.EncodeVarint(metricBooleanValue<<3 | wireVarint)
+			if v {
+				b.EncodeVarint(1)
+			} else {
+				b.EncodeVarint(0)
+			}
+		}
+	case String, Text, UUID:
+		var v string
+		if v, ok = m.Value.(string); ok {
+			b.EncodeVarint(metricStringValue<<3 | wireBytes)
+			b.EncodeStringBytes(v)
+		}
+	case Bytes:
+		var v []byte
+		if v, ok = m.Value.([]byte); ok {
+			b.EncodeVarint(metricBytesValue<<3 | wireBytes)
+			b.EncodeRawBytes(v)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported data-type: %d", m.DataType)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("invalid value type %T for data-type %d", m.Value, m.DataType)
+	}
+
+	return b.Bytes(), nil
+}
+
+func unmarshalMetric(data []byte) (Metric, error) {
+	var m Metric
+	b := &reader{data: data}
+
+	for !b.eof() {
+		field, wire, err := decodeKey(b)
+		if err != nil {
+			return m, err
+		}
+
+		switch {
+		case field == metricName && wire == wireBytes:
+			m.Name, err = b.string()
+		case field == metricTimestamp && wire == wireVarint:
+			m.Timestamp, err = b.varint()
+		case field == metricDataType && wire == wireVarint:
+			var v uint64
+			v, err = b.varint()
+			m.DataType = DataType(v)
+		case field == metricIsNull && wire == wireVarint:
+			var v uint64
+			v, err = b.varint()
+			m.IsNull = v != 0
+		case field == metricIntValue && wire == wireVarint:
+			var v uint64
+			v, err = b.varint()
+			m.Value = uint32(v)
+		case field == metricLongValue && wire == wireVarint:
+			m.Value, err = b.varint()
+		case field == metricFloatValue && wire == wireFixed32:
+			var v uint32
+			v, err = b.fixed32()
+			m.Value = math.Float32frombits(v)
+		case field == metricDoubleValue && wire == wireFixed64:
+			var v uint64
+			v, err = b.fixed64()
+			m.Value = math.Float64frombits(v)
+		case field == metricBooleanValue && wire == wireVarint:
+			var v uint64
+			v, err = b.varint()
+			m.Value = v != 0
+		case field == metricStringValue && wire == wireBytes:
+			m.Value, err = b.string()
+		case field == metricBytesValue && wire == wireBytes:
+			var v []byte
+			v, err = b.bytes()
+			m.Value = append([]byte{}, v...)
+		default:
+			err = skip(b, wire)
+		}
+
+		if err != nil {
+			return m, errors.Wrapf(err, "decode field %d error", field)
+		}
+	}
+
+	return m, nil
+}
+
+func decodeKey(b *reader) (uint64, uint64, error) {
+	key, err := b.varint()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "decode key error")
+	}
+	return key >> 3, key & 7, nil
+}
+
+func skip(b *reader, wire uint64) error {
+	var err error
+
+	switch wire {
+	case wireVarint:
+		_, err = b.varint()
+	case wireFixed64:
+		_, err = b.fixed64()
+	case wireBytes:
+		_, err = b.bytes()
+	case wireFixed32:
+		_, err = b.fixed32()
+	default:
+		err = fmt.Errorf("unsupported wire type: %d", wire)
+	}
+
+	return err
+}
+
+// reader implements the decoding of the protobuf wire format.
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) eof() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *reader) varint() (uint64, error) {
+	v, n := proto.DecodeVarint(r.data[r.pos:])
+	if n == 0 {
+		return 0, errors.New("invalid varint")
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *reader) fixed32() (uint32, error) {
+	if len(r.data)-r.pos < 4 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	v := binary.LittleEndian.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *reader) fixed64() (uint64, error) {
+	if len(r.data)-r.pos < 8 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	v := binary.LittleEndian.Uint64(r.data[r.pos:])
+	r.pos += 8
+	return v, nil
+}
+
+func (r *reader) bytes() ([]byte, error) {
+	l, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.data)-r.pos) < l {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.data[r.pos : r.pos+int(l)]
+	r.pos += int(l)
+	return b, nil
+}
+
+func (r *reader) string() (string, error) {
+	b, err := r.bytes()
+	return string(b), err
+}
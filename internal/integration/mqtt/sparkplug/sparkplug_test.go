@@ -0,0 +1,69 @@
+package sparkplug
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayload(t *testing.T) {
+	assert := require.New(t)
+
+	seq := uint64(3)
+	in := Payload{
+		Timestamp: 1577836800000,
+		Seq:       &seq,
+		Metrics: []Metric{
+			{Name: "int", DataType: Int32, Value: uint32(123)},
+			{Name: "long", DataType: UInt64, Value: uint64(1 << 40)},
+			{Name: "float", DataType: Float, Value: float32(1.5)},
+			{Name: "double", DataType: Double, Value: float64(-7.25)},
+			{Name: "bool", DataType: Boolean, Value: true},
+			{Name: "string", DataType: String, Value: "foo"},
+			{Name: "bytes", DataType: Bytes, Value: []byte{1, 2, 3}},
+			{Name: "null", DataType: Bytes, IsNull: true},
+			{Name: "timestamp", Timestamp: 1577836800001, DataType: Boolean, Value: false},
+		},
+	}
+
+	b, err := Marshal(in)
+	assert.NoError(err)
+
+	out, err := Unmarshal(b)
+	assert.NoError(err)
+	assert.Equal(in, out)
+
+	t.Run("invalid value type", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := Marshal(Payload{
+			Metrics: []Metric{{Name: "int", DataType: Int32, Value: 123}},
+		})
+		assert.Error(err)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := Unmarshal(b[:len(b)-5])
+		assert.Error(err)
+	})
+}
+
+func TestTopic(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal("spBv1.0/group/NBIRTH/node", Topic("group", NBIRTH, "node", ""))
+	assert.Equal("spBv1.0/group/DCMD/node/device", Topic("group", DCMD, "node", "device"))
+
+	groupID, messageType, edgeNodeID, deviceID, err := ParseTopic("spBv1.0/group/DCMD/node/device")
+	assert.NoError(err)
+	assert.Equal([]string{"group", DCMD, "node", "device"}, []string{groupID, messageType, edgeNodeID, deviceID})
+
+	_, _, _, _, err = ParseTopic("gateway/0102030405060708/command/down")
+	assert.Error(err)
+
+	assert.NoError(ValidateID("node"))
+	assert.Error(ValidateID(""))
+	assert.Error(ValidateID("no/de"))
+}
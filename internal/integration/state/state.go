@@ -0,0 +1,9 @@
+// Package state contains the gateway state messages which are published by
+// the integrations.
+//
+// The chirpstack-api version used by this project does not define a
+// connection-state message. The messages are therefore defined in
+// state.proto, from which state.pb.go is generated using protoc-gen-go.
+package state
+
+//go:generate protoc --go_out=paths=source_relative:. state.proto
@@ -0,0 +1,146 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: state.proto
+
+package state
+
+import (
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	timestamp "github.com/golang/protobuf/ptypes/timestamp"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// State defines the connection state.
+type ConnState_State int32
+
+const (
+	ConnState_OFFLINE ConnState_State = 0
+	ConnState_ONLINE  ConnState_State = 1
+)
+
+var ConnState_State_name = map[int32]string{
+	0: "OFFLINE",
+	1: "ONLINE",
+}
+
+var ConnState_State_value = map[string]int32{
+	"OFFLINE": 0,
+	"ONLINE":  1,
+}
+
+func (x ConnState_State) String() string {
+	return proto.EnumName(ConnState_State_name, int32(x))
+}
+
+func (ConnState_State) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_a888679467bb7853, []int{0, 0}
+}
+
+// ConnState contains the connection state of a gateway.
+type ConnState struct {
+	// Gateway ID. This is empty for the state of the bridge itself.
+	GatewayId []byte `protobuf:"bytes,1,opt,name=gateway_id,json=gatewayID,proto3" json:"gateway_id,omitempty"`
+	// Connection state.
+	State ConnState_State `protobuf:"varint,2,opt,name=state,proto3,enum=state.ConnState_State" json:"state,omitempty"`
+	// Time of the state change.
+	Time *timestamp.Timestamp `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
+	// Backend type (e.g. semtech_udp).
+	BackendType          string   `protobuf:"bytes,4,opt,name=backend_type,json=backendType,proto3" json:"backend_type,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ConnState) Reset()         { *m = ConnState{} }
+func (m *ConnState) String() string { return proto.CompactTextString(m) }
+func (*ConnState) ProtoMessage()    {}
+func (*ConnState) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a888679467bb7853, []int{0}
+}
+
+func (m *ConnState) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ConnState.Unmarshal(m, b)
+}
+func (m *ConnState) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ConnState.Marshal(b, m, deterministic)
+}
+func (m *ConnState) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ConnState.Merge(m, src)
+}
+func (m *ConnState) XXX_Size() int {
+	return xxx_messageInfo_ConnState.Size(m)
+}
+func (m *ConnState) XXX_DiscardUnknown() {
+	xxx_messageInfo_ConnState.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ConnState proto.InternalMessageInfo
+
+func (m *ConnState) GetGatewayId() []byte {
+	if m != nil {
+		return m.GatewayId
+	}
+	return nil
+}
+
+func (m *ConnState) GetState() ConnState_State {
+	if m != nil {
+		return m.State
+	}
+	return ConnState_OFFLINE
+}
+
+func (m *ConnState) GetTime() *timestamp.Timestamp {
+	if m != nil {
+		return m.Time
+	}
+	return nil
+}
+
+func (m *ConnState) GetBackendType() string {
+	if m != nil {
+		return m.BackendType
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterEnum("state.ConnState_State", ConnState_State_name, ConnState_State_value)
+	proto.RegisterType((*ConnState)(nil), "state.ConnState")
+}
+
+func init() {
+	proto.RegisterFile("state.proto", fileDescriptor_a888679467bb7853)
+}
+
+var fileDescriptor_a888679467bb7853 = []byte{
+	// 268 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x3c, 0x8f, 0x4f, 0x4b, 0xc3, 0x30,
+	0x18, 0xc6, 0x8d, 0x6e, 0x93, 0xa6, 0x43, 0x24, 0x07, 0x29, 0x03, 0xb1, 0xee, 0xd4, 0x83, 0x4b,
+	0x60, 0x7e, 0x03, 0xff, 0x4c, 0x0a, 0xb2, 0x41, 0xdd, 0xc9, 0xcb, 0x48, 0xda, 0x98, 0x85, 0xad,
+	0x49, 0x49, 0xdf, 0x21, 0xfd, 0x90, 0x7e, 0x27, 0x59, 0xd2, 0xed, 0x12, 0xde, 0x3c, 0xfc, 0x92,
+	0xe7, 0xf7, 0xe2, 0xb8, 0x05, 0x0e, 0x92, 0x36, 0xce, 0x82, 0x25, 0x43, 0x7f, 0x99, 0x3c, 0x28,
+	0x6b, 0xd5, 0x5e, 0x32, 0x1f, 0x8a, 0xc3, 0x0f, 0x03, 0x5d, 0xcb, 0x16, 0x78, 0xdd, 0x04, 0x6e,
+	0xfa, 0x87, 0x70, 0xf4, 0x6a, 0x8d, 0xf9, 0x3a, 0xe2, 0xe4, 0x1e, 0x63, 0xc5, 0x41, 0xfe, 0xf2,
+	0x6e, 0xa3, 0xab, 0x04, 0xa5, 0x28, 0x1b, 0x17, 0x51, 0x9f, 0xe4, 0x6f, 0xe4, 0x09, 0x87, 0x6f,
+	0x93, 0xcb, 0x14, 0x65, 0x37, 0xf3, 0x3b, 0x1a, 0x1a, 0xcf, 0xef, 0xa9, 0x3f, 0x8b, 0x00, 0x11,
+	0x8a, 0x07, 0xc7, 0xb6, 0xe4, 0x2a, 0x45, 0x59, 0x3c, 0x9f, 0xd0, 0xa0, 0x42, 0x4f, 0x2a, 0x74,
+	0x7d, 0x52, 0x29, 0x3c, 0x47, 0x1e, 0xf1, 0x58, 0xf0, 0x72, 0x27, 0x4d, 0xb5, 0x81, 0xae, 0x91,
+	0xc9, 0x20, 0x45, 0x59, 0x54, 0xc4, 0x7d, 0xb6, 0xee, 0x1a, 0x39, 0x4d, 0xf1, 0x30, 0x88, 0xc6,
+	0xf8, 0x7a, 0xb5, 0x58, 0x7c, 0xe6, 0xcb, 0xf7, 0xdb, 0x0b, 0x82, 0xf1, 0x68, 0xb5, 0xf4, 0x33,
+	0x7a, 0xc9, 0xbf, 0x3f, 0x94, 0x86, 0xed, 0x41, 0xd0, 0xd2, 0xd6, 0x4c, 0x38, 0x5b, 0x72, 0xee,
+	0x58, 0xb9, 0xd5, 0xae, 0x69, 0x81, 0x97, 0xbb, 0x59, 0xbf, 0xcd, 0x4c, 0x38, 0x5d, 0x29, 0xc9,
+	0xb4, 0x01, 0xe9, 0x0c, 0xdf, 0xfb, 0x41, 0x39, 0x0e, 0xda, 0x1a, 0xe6, 0xfd, 0xc5, 0xc8, 0x9b,
+	0x3e, 0xff, 0x0f, 0x00, 0x46, 0x91, 0x72, 0xce, 0x58, 0x01, 0x00, 0x00,
+}
@@ -0,0 +1,51 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+)
+
+func TestConnState(t *testing.T) {
+	assert := require.New(t)
+
+	ts, err := ptypes.TimestampProto(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	assert.NoError(err)
+
+	in := ConnState{
+		GatewayId:   []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		State:       ConnState_ONLINE,
+		Time:        ts,
+		BackendType: "semtech_udp",
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		assert := require.New(t)
+		var m marshaler.JSON
+
+		b, err := m.Marshal(&in)
+		assert.NoError(err)
+		assert.Contains(string(b), `"state":"ONLINE"`)
+		assert.Contains(string(b), `"backendType":"semtech_udp"`)
+
+		var out ConnState
+		assert.NoError(m.Unmarshal(b, &out))
+		assert.Equal(in.String(), out.String())
+	})
+
+	t.Run("Protobuf", func(t *testing.T) {
+		assert := require.New(t)
+		var m marshaler.Protobuf
+
+		b, err := m.Marshal(&in)
+		assert.NoError(err)
+
+		var out ConnState
+		assert.NoError(m.Unmarshal(b, &out))
+		assert.Equal(in.String(), out.String())
+	})
+}
@@ -0,0 +1,197 @@
+package marshaler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/lorawan"
+)
+
+// hexFields contains the byte fields which are rendered as HEX string.
+var hexFields = map[string]struct{}{
+	"gatewayID": {},
+	"context":   {},
+}
+
+// uuidFields contains the byte fields which are rendered as UUID string.
+var uuidFields = map[string]struct{}{
+	"uplinkID":   {},
+	"downlinkID": {},
+	"statsID":    {},
+	"execID":     {},
+	"rawID":      {},
+}
+
+// phyPayloadDecoded contains the decoded LoRaWAN PHYPayload fields.
+type phyPayloadDecoded struct {
+	MType   string  `json:"mType"`
+	DevAddr string  `json:"devAddr,omitempty"`
+	FCnt    *uint32 `json:"fCnt,omitempty"`
+	FPort   *uint8  `json:"fPort,omitempty"`
+	JoinEUI string  `json:"joinEUI,omitempty"`
+	DevEUI  string  `json:"devEUI,omitempty"`
+}
+
+// JSONDecoded implements a human-readable JSON marshaler. Gateway IDs and
+// contexts are rendered as HEX strings, the IDs as UUID strings and uplink
+// frames contain the decoded PHYPayload (phyPayloadDecoded).
+//
+// Unmarshal accepts both the JSON and the JSON decoded format. Note that a
+// HEX encoded value takes precedence over the base64 encoding in case a
+// value is valid in both encodings.
+type JSONDecoded struct{}
+
+// Marshal marshals the given message.
+func (m *JSONDecoded) Marshal(msg proto.Message) ([]byte, error) {
+	b, err := (&JSON{}).Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, errors.Wrap(err, "decode json error")
+	}
+
+	decodeFields(obj)
+
+	switch uf := msg.(type) {
+	case *gw.UplinkFrame:
+		if pl, err := decodePHYPayload(uf.GetPhyPayload()); err == nil {
+			obj["phyPayloadDecoded"] = pl
+		}
+	case *gw.UplinkFrameSet:
+		if pl, err := decodePHYPayload(uf.GetPhyPayload()); err == nil {
+			obj["phyPayloadDecoded"] = pl
+		}
+	}
+
+	return json.Marshal(obj)
+}
+
+// Unmarshal unmarshals the given bytes into the given message.
+func (m *JSONDecoded) Unmarshal(b []byte, msg proto.Message) error {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return errors.Wrap(err, "decode json error")
+	}
+
+	encodeFields(obj)
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrap(err, "encode json error")
+	}
+
+	return (&JSON{}).Unmarshal(b, msg)
+}
+
+// decodeFields replaces the base64 encoded values of the HEX and UUID fields
+// (recursively).
+func decodeFields(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			s, ok := val.(string)
+			if !ok {
+				decodeFields(val)
+				continue
+			}
+
+			_, isHex := hexFields[k]
+			_, isUUID := uuidFields[k]
+			if !isHex && !isUUID {
+				continue
+			}
+
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				continue
+			}
+
+			if isHex {
+				v[k] = hex.EncodeToString(b)
+			} else if len(b) == len(uuid.UUID{}) {
+				var id uuid.UUID
+				copy(id[:], b)
+				v[k] = id.String()
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			decodeFields(val)
+		}
+	}
+}
+
+// encodeFields replaces the HEX and UUID values by their base64 encoding
+// (recursively). Values which are not HEX or UUID encoded are left as-is.
+func encodeFields(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			s, ok := val.(string)
+			if !ok {
+				encodeFields(val)
+				continue
+			}
+
+			if _, ok := hexFields[k]; ok {
+				if b, err := hex.DecodeString(s); err == nil {
+					v[k] = base64.StdEncoding.EncodeToString(b)
+				}
+			}
+
+			if _, ok := uuidFields[k]; ok {
+				if id, err := uuid.FromString(s); err == nil {
+					v[k] = base64.StdEncoding.EncodeToString(id[:])
+				}
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			encodeFields(val)
+		}
+	}
+}
+
+// decodePHYPayload decodes the given LoRaWAN PHYPayload.
+func decodePHYPayload(b []byte) (*phyPayloadDecoded, error) {
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+
+	out := phyPayloadDecoded{
+		MType: phy.MHDR.MType.String(),
+	}
+
+	switch pl := phy.MACPayload.(type) {
+	case *lorawan.MACPayload:
+		fCnt := pl.FHDR.FCnt
+		out.DevAddr = pl.FHDR.DevAddr.String()
+		out.FCnt = &fCnt
+		out.FPort = pl.FPort
+	case *lorawan.JoinRequestPayload:
+		out.JoinEUI = pl.JoinEUI.String()
+		out.DevEUI = pl.DevEUI.String()
+	}
+
+	return &out, nil
+}
+
+// ContentType returns the content-type of the marshaled messages.
+func (m *JSONDecoded) ContentType() string {
+	return "application/json"
+}
@@ -0,0 +1,138 @@
+package marshaler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/lorawan"
+)
+
+func TestJSONDecoded(t *testing.T) {
+	var m JSONDecoded
+
+	fPort := uint8(10)
+	dataUp := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataUp,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.MACPayload{
+			FHDR: lorawan.FHDR{
+				DevAddr: lorawan.DevAddr{1, 2, 3, 4},
+				FCnt:    12,
+			},
+			FPort:      &fPort,
+			FRMPayload: []lorawan.Payload{&lorawan.DataPayload{Bytes: []byte{1, 2, 3}}},
+		},
+	}
+	dataUpB, err := dataUp.MarshalBinary()
+	require.NoError(t, err)
+
+	joinRequest := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.JoinRequest,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.JoinRequestPayload{
+			JoinEUI: lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:  lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+		},
+	}
+	joinRequestB, err := joinRequest.MarshalBinary()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		phyPayload []byte
+		decoded    map[string]interface{}
+	}{
+		{
+			name:       "data up",
+			phyPayload: dataUpB,
+			decoded: map[string]interface{}{
+				"mType":   "UnconfirmedDataUp",
+				"devAddr": "01020304",
+				"fCnt":    float64(12),
+				"fPort":   float64(10),
+			},
+		},
+		{
+			name:       "join request",
+			phyPayload: joinRequestB,
+			decoded: map[string]interface{}{
+				"mType":   "JoinRequest",
+				"joinEUI": "0101010101010101",
+				"devEUI":  "0202020202020202",
+			},
+		},
+		{
+			name:       "invalid phypayload",
+			phyPayload: []byte{1, 2, 3},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			uf := gw.UplinkFrame{
+				PhyPayload: tst.phyPayload,
+				RxInfo: &gw.UplinkRXInfo{
+					GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+					UplinkId:  []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+					Context:   []byte{1, 2, 3, 4},
+				},
+			}
+
+			b, err := m.Marshal(&uf)
+			assert.NoError(err)
+
+			var out struct {
+				RxInfo struct {
+					GatewayID string `json:"gatewayID"`
+					UplinkID  string `json:"uplinkID"`
+					Context   string `json:"context"`
+				} `json:"rxInfo"`
+				PHYPayloadDecoded map[string]interface{} `json:"phyPayloadDecoded"`
+			}
+			assert.NoError(json.Unmarshal(b, &out))
+			assert.Equal("0102030405060708", out.RxInfo.GatewayID)
+			assert.Equal("01020304-0506-0708-090a-0b0c0d0e0f10", out.RxInfo.UplinkID)
+			assert.Equal("01020304", out.RxInfo.Context)
+			assert.Equal(tst.decoded, out.PHYPayloadDecoded)
+
+			var uf2 gw.UplinkFrame
+			assert.NoError(m.Unmarshal(b, &uf2))
+			assert.True(proto.Equal(&uf, &uf2))
+		})
+	}
+
+	t.Run("unmarshal json", func(t *testing.T) {
+		assert := require.New(t)
+
+		df := gw.DownlinkFrame{
+			GatewayId:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DownlinkId: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			Items: []*gw.DownlinkFrameItem{
+				{
+					PhyPayload: []byte{1, 2, 3},
+					TxInfo: &gw.DownlinkTXInfo{
+						Context: []byte{1, 2, 3, 4},
+					},
+				},
+			},
+		}
+
+		var j JSON
+		b, err := j.Marshal(&df)
+		assert.NoError(err)
+
+		var out gw.DownlinkFrame
+		assert.NoError(m.Unmarshal(b, &out))
+		assert.True(proto.Equal(&df, &out))
+	})
+}
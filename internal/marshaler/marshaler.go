@@ -0,0 +1,79 @@
+package marshaler
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// Marshaler defines the interface that a marshaler must implement.
+type Marshaler interface {
+	// Marshal marshals the given message.
+	Marshal(proto.Message) ([]byte, error)
+
+	// Unmarshal unmarshals the given bytes into the given message.
+	Unmarshal([]byte, proto.Message) error
+
+	// ContentType returns the content-type of the marshaled messages.
+	ContentType() string
+}
+
+// New returns the marshaler for the given name.
+func New(name string) (Marshaler, error) {
+	switch name {
+	case "json":
+		return &JSON{}, nil
+	case "json_decoded":
+		return &JSONDecoded{}, nil
+	case "protobuf":
+		return &Protobuf{}, nil
+	default:
+		return nil, fmt.Errorf("unknown marshaler: %s", name)
+	}
+}
+
+// JSON implements a JSON marshaler.
+type JSON struct{}
+
+// Marshal marshals the given message.
+func (m *JSON) Marshal(msg proto.Message) ([]byte, error) {
+	marshaler := &jsonpb.Marshaler{
+		EnumsAsInts:  false,
+		EmitDefaults: true,
+	}
+	str, err := marshaler.MarshalToString(msg)
+	return []byte(str), err
+}
+
+// Unmarshal unmarshals the given bytes into the given message.
+func (m *JSON) Unmarshal(b []byte, msg proto.Message) error {
+	unmarshaler := &jsonpb.Unmarshaler{
+		AllowUnknownFields: true, // we don't want to fail on unknown fields
+	}
+	return unmarshaler.Unmarshal(bytes.NewReader(b), msg)
+}
+
+// ContentType returns the content-type of the marshaled messages.
+func (m *JSON) ContentType() string {
+	return "application/json"
+}
+
+// Protobuf implements a Protobuf marshaler.
+type Protobuf struct{}
+
+// Marshal marshals the given message.
+func (m *Protobuf) Marshal(msg proto.Message) ([]byte, error) {
+	return proto.Marshal(msg)
+}
+
+// Unmarshal unmarshals the given bytes into the given message.
+func (m *Protobuf) Unmarshal(b []byte, msg proto.Message) error {
+	return proto.Unmarshal(b, msg)
+}
+
+// ContentType returns the content-type of the marshaled messages.
+func (m *Protobuf) ContentType() string {
+	return "application/octet-stream"
+}
@@ -0,0 +1,62 @@
+package marshaler
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+)
+
+func TestMarshaler(t *testing.T) {
+	tests := []struct {
+		Name                string
+		ExpectedContentType string
+		ExpectedError       error
+	}{
+		{
+			Name:                "json",
+			ExpectedContentType: "application/json",
+		},
+		{
+			Name:                "json_decoded",
+			ExpectedContentType: "application/json",
+		},
+		{
+			Name:                "protobuf",
+			ExpectedContentType: "application/octet-stream",
+		},
+		{
+			Name:          "foo",
+			ExpectedError: errors.New("unknown marshaler: foo"),
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			m, err := New(tst.Name)
+			assert.Equal(tst.ExpectedError, err)
+			if err != nil {
+				return
+			}
+
+			assert.Equal(tst.ExpectedContentType, m.ContentType())
+
+			stats := gw.GatewayStats{
+				GatewayId:         []byte{1, 2, 3, 4, 5, 6, 7, 8},
+				RxPacketsReceived: 10,
+			}
+
+			b, err := m.Marshal(&stats)
+			assert.NoError(err)
+
+			var out gw.GatewayStats
+			assert.NoError(m.Unmarshal(b, &out))
+			assert.True(proto.Equal(&stats, &out))
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package processor
+
+import (
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/filters"
+)
+
+// filter drops the uplinks not matching the NetID and JoinEUI filters.
+// When no filters are configured, the global filters are used.
+type filter struct {
+	filter *filters.Filter
+}
+
+func newFilter(conf config.Processor) (Processor, error) {
+	if len(conf.Filter.NetIDs) == 0 && len(conf.Filter.JoinEUIs) == 0 {
+		return &filter{}, nil
+	}
+
+	f, err := filters.NewFilter(conf.Filter.NetIDs, conf.Filter.JoinEUIs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filter{filter: f}, nil
+}
+
+// Process implements the Processor interface.
+func (f *filter) Process(ev *Event) (bool, error) {
+	var phyPayload []byte
+
+	switch pl := ev.Message.(type) {
+	case *gw.UplinkFrame:
+		phyPayload = pl.PhyPayload
+	case *gw.UplinkFrameSet:
+		phyPayload = pl.PhyPayload
+	default:
+		return true, nil
+	}
+
+	if f.filter == nil {
+		return filters.MatchFilters(phyPayload), nil
+	}
+
+	return f.filter.Match(phyPayload), nil
+}
@@ -0,0 +1,59 @@
+package processor
+
+import (
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/metadata"
+)
+
+// metaData adds the gateway meta-data (see the metadata package) to the
+// event, filtered by the configured keys. The meta-data of stats events is
+// added to their meta-data field, for other events it is added to the
+// meta-data of the event.
+type metaData struct {
+	keys []string
+}
+
+func newMetaData(conf config.Processor) (Processor, error) {
+	return &metaData{
+		keys: conf.MetaData.Keys,
+	}, nil
+}
+
+// Process implements the Processor interface.
+func (m *metaData) Process(ev *Event) (bool, error) {
+	out := eventMetaData(ev)
+	md := metadata.Get()
+
+	if len(m.keys) == 0 {
+		for k, v := range md {
+			out[k] = v
+		}
+		return true, nil
+	}
+
+	for _, k := range m.keys {
+		if v, ok := md[k]; ok {
+			out[k] = v
+		}
+	}
+
+	return true, nil
+}
+
+// eventMetaData returns the meta-data map of the given event. For stats
+// events, this is the meta-data field of the message. The map is created
+// when it does not yet exist.
+func eventMetaData(ev *Event) map[string]string {
+	if pl, ok := ev.Message.(*gw.GatewayStats); ok {
+		if pl.MetaData == nil {
+			pl.MetaData = make(map[string]string)
+		}
+		return pl.MetaData
+	}
+
+	if ev.MetaData == nil {
+		ev.MetaData = make(map[string]string)
+	}
+	return ev.MetaData
+}
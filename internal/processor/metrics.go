@@ -0,0 +1,17 @@
+package processor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pdc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "processor_event_dropped_count",
+		Help: "The number of events and commands dropped by the processors (per processor, event and reason).",
+	}, []string{"processor", "event", "reason"})
+)
+
+func droppedCounter(processor, event, reason string) prometheus.Counter {
+	return pdc.With(prometheus.Labels{"processor": processor, "event": event, "reason": reason})
+}
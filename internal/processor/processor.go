@@ -0,0 +1,211 @@
+// Package processor implements the event-processing pipeline, which is
+// applied by the forwarder to the events and commands passing between the
+// backend and the integration.
+package processor
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// Event types.
+const (
+	// Events (backend to integration).
+	EventUp    = "up"
+	EventUpSet = "up_set"
+	EventStats = "stats"
+	EventAck   = "ack"
+	EventRaw   = "raw"
+	EventConn  = "conn"
+
+	// Commands (integration to backend).
+	EventDown       = "down"
+	EventConfig     = "config"
+	EventRawCommand = "raw_command"
+)
+
+// Event holds an event or command passing through the pipeline.
+type Event struct {
+	// Type holds the event type.
+	Type string
+
+	// GatewayID holds the gateway ID.
+	GatewayID lorawan.EUI64
+
+	// Message holds the event or command message. Processors are allowed to
+	// modify the message.
+	Message proto.Message
+
+	// MetaData holds the meta-data to publish with the event (in case the
+	// message does not have a meta-data field itself).
+	MetaData map[string]string
+
+	// Destinations holds the names of the integration destinations to which
+	// the event must be published. When empty, the integration defaults are
+	// used.
+	Destinations []string
+}
+
+// IsCommand returns true when the event is a command, sent from the
+// integration to the backend.
+func (e *Event) IsCommand() bool {
+	switch e.Type {
+	case EventDown, EventConfig, EventRawCommand:
+		return true
+	default:
+		return false
+	}
+}
+
+// Processor defines the interface of an event processor.
+type Processor interface {
+	// Process processes the given event. It returns false when the event
+	// must be dropped.
+	Process(ev *Event) (bool, error)
+}
+
+// Factory creates a new processor, given its configuration.
+type Factory func(conf config.Processor) (Processor, error)
+
+var (
+	factoriesMux sync.RWMutex
+	factories    = map[string]Factory{
+		"filter":    newFilter,
+		"meta_data": newMetaData,
+		"sample":    newSample,
+		"rewrite":   newRewrite,
+		"route":     newRoute,
+		"script":    newScript,
+	}
+)
+
+// Register registers the factory of the given processor type.
+func Register(typ string, f Factory) {
+	factoriesMux.Lock()
+	defer factoriesMux.Unlock()
+
+	factories[typ] = f
+}
+
+// stage holds a processor, together with the events to which it applies.
+type stage struct {
+	name       string
+	eventTypes map[string]struct{}
+	gatewayIDs map[lorawan.EUI64]struct{}
+	processor  Processor
+}
+
+// match returns true when the stage applies to the given event.
+func (s *stage) match(ev *Event) bool {
+	if len(s.eventTypes) != 0 {
+		if _, ok := s.eventTypes[ev.Type]; !ok {
+			return false
+		}
+	}
+
+	if len(s.gatewayIDs) != 0 {
+		if _, ok := s.gatewayIDs[ev.GatewayID]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Pipeline holds a chain of processors.
+type Pipeline struct {
+	stages []stage
+}
+
+// New creates a new pipeline, given the processor configurations. The
+// processors are applied in the given order.
+func New(confs []config.Processor) (*Pipeline, error) {
+	var p Pipeline
+
+	factoriesMux.RLock()
+	defer factoriesMux.RUnlock()
+
+	for i, conf := range confs {
+		f, ok := factories[conf.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown processor type: %s", conf.Type)
+		}
+
+		s := stage{
+			name:       conf.Name,
+			eventTypes: make(map[string]struct{}),
+			gatewayIDs: make(map[lorawan.EUI64]struct{}),
+		}
+		if s.name == "" {
+			s.name = fmt.Sprintf("%d_%s", i, conf.Type)
+		}
+
+		for _, t := range conf.EventTypes {
+			s.eventTypes[t] = struct{}{}
+		}
+
+		for _, idStr := range conf.GatewayIDs {
+			var id lorawan.EUI64
+			if err := id.UnmarshalText([]byte(idStr)); err != nil {
+				return nil, errors.Wrapf(err, "processor %s: unmarshal gateway id error", s.name)
+			}
+			s.gatewayIDs[id] = struct{}{}
+		}
+
+		var err error
+		s.processor, err = f(conf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "processor %s: new processor error", s.name)
+		}
+
+		log.WithFields(log.Fields{
+			"name": s.name,
+			"type": conf.Type,
+		}).Info("processor: processor configured")
+
+		p.stages = append(p.stages, s)
+	}
+
+	return &p, nil
+}
+
+// Process applies the processors to the given event. It returns false when
+// the event must be dropped.
+func (p *Pipeline) Process(ev *Event) bool {
+	if p == nil {
+		return true
+	}
+
+	for i := range p.stages {
+		s := &p.stages[i]
+
+		if !s.match(ev) {
+			continue
+		}
+
+		ok, err := s.processor.Process(ev)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"processor":  s.name,
+				"event_type": ev.Type,
+				"gateway_id": ev.GatewayID,
+			}).Error("processor: process event error")
+			droppedCounter(s.name, ev.Type, "error").Inc()
+			return false
+		}
+
+		if !ok {
+			droppedCounter(s.name, ev.Type, "drop").Inc()
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,212 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// dropProcessor drops all the events.
+type dropProcessor struct{}
+
+func (p dropProcessor) Process(ev *Event) (bool, error) {
+	return false, nil
+}
+
+func TestPipeline(t *testing.T) {
+	Register("test_drop", func(conf config.Processor) (Processor, error) {
+		return dropProcessor{}, nil
+	})
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	tests := []struct {
+		name       string
+		processors []config.Processor
+		event      Event
+		expected   bool
+		err        bool
+	}{
+		{
+			name:     "no processors",
+			event:    Event{Type: EventUp},
+			expected: true,
+		},
+		{
+			name:       "unknown processor type",
+			processors: []config.Processor{{Type: "foo"}},
+			err:        true,
+		},
+		{
+			name:       "invalid gateway id",
+			processors: []config.Processor{{Type: "test_drop", GatewayIDs: []string{"foo"}}},
+			err:        true,
+		},
+		{
+			name:       "matching event type",
+			processors: []config.Processor{{Type: "test_drop", EventTypes: []string{EventUp}}},
+			event:      Event{Type: EventUp},
+			expected:   false,
+		},
+		{
+			name:       "non-matching event type",
+			processors: []config.Processor{{Type: "test_drop", EventTypes: []string{EventStats}}},
+			event:      Event{Type: EventUp},
+			expected:   true,
+		},
+		{
+			name:       "matching gateway id",
+			processors: []config.Processor{{Type: "test_drop", GatewayIDs: []string{"0102030405060708"}}},
+			event:      Event{Type: EventUp, GatewayID: gatewayID},
+			expected:   false,
+		},
+		{
+			name:       "non-matching gateway id",
+			processors: []config.Processor{{Type: "test_drop", GatewayIDs: []string{"0807060504030201"}}},
+			event:      Event{Type: EventUp, GatewayID: gatewayID},
+			expected:   true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			p, err := New(tst.processors)
+			if tst.err {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tst.expected, p.Process(&tst.event))
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Processor
+	conf.Filter.NetIDs = []string{"000001"}
+
+	p, err := newFilter(conf)
+	assert.NoError(err)
+
+	netID := lorawan.NetID{0x00, 0x00, 0x01}
+	devAddr := lorawan.DevAddr{0x01, 0x01, 0x01, 0x01}
+
+	for _, tst := range []struct {
+		netID    lorawan.NetID
+		expected bool
+	}{
+		{netID, true},
+		{lorawan.NetID{0x00, 0x00, 0x02}, false},
+	} {
+		devAddr.SetAddrPrefix(tst.netID)
+		phy := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{
+				MType: lorawan.UnconfirmedDataUp,
+				Major: lorawan.LoRaWANR1,
+			},
+			MACPayload: &lorawan.MACPayload{
+				FHDR: lorawan.FHDR{
+					DevAddr: devAddr,
+				},
+			},
+		}
+		b, err := phy.MarshalBinary()
+		assert.NoError(err)
+
+		ok, err := p.Process(&Event{Type: EventUp, Message: &gw.UplinkFrame{PhyPayload: b}})
+		assert.NoError(err)
+		assert.Equal(tst.expected, ok)
+
+		ok, err = p.Process(&Event{Type: EventUp, Message: &gw.UplinkFrameSet{PhyPayload: b}})
+		assert.NoError(err)
+		assert.Equal(tst.expected, ok)
+	}
+
+	// other events are not filtered
+	ok, err := p.Process(&Event{Type: EventStats, Message: &gw.GatewayStats{}})
+	assert.NoError(err)
+	assert.True(ok)
+}
+
+func TestSample(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Processor
+	conf.Sample.Rate = 1.5
+	_, err := newSample(conf)
+	assert.Error(err)
+
+	for _, rate := range []float64{0, 1} {
+		conf.Sample.Rate = rate
+		p, err := newSample(conf)
+		assert.NoError(err)
+
+		for i := 0; i < 10; i++ {
+			ok, err := p.Process(&Event{Type: EventUp})
+			assert.NoError(err)
+			assert.Equal(rate == 1, ok)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	assert := require.New(t)
+
+	from := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+	to := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+	other := lorawan.EUI64{3, 3, 3, 3, 3, 3, 3, 3}
+
+	var conf config.Processor
+	conf.Rewrite.GatewayIDs = map[string]string{
+		from.String(): to.String(),
+	}
+
+	p, err := newRewrite(conf)
+	assert.NoError(err)
+
+	up := Event{
+		Type:      EventUp,
+		GatewayID: from,
+		Message: &gw.UplinkFrameSet{
+			RxInfo: []*gw.UplinkRXInfo{
+				{GatewayId: from[:]},
+				{GatewayId: other[:]},
+			},
+		},
+	}
+	ok, err := p.Process(&up)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(to, up.GatewayID)
+	assert.Equal(to[:], up.Message.(*gw.UplinkFrameSet).RxInfo[0].GatewayId)
+	assert.Equal(other[:], up.Message.(*gw.UplinkFrameSet).RxInfo[1].GatewayId)
+
+	down := Event{
+		Type:      EventDown,
+		GatewayID: from,
+		Message: &gw.DownlinkFrame{
+			GatewayId: from[:],
+			Items: []*gw.DownlinkFrameItem{
+				{TxInfo: &gw.DownlinkTXInfo{GatewayId: from[:]}},
+			},
+		},
+	}
+	ok, err = p.Process(&down)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(to, down.GatewayID)
+	assert.Equal(to[:], down.Message.(*gw.DownlinkFrame).GatewayId)
+	assert.Equal(to[:], down.Message.(*gw.DownlinkFrame).Items[0].TxInfo.GatewayId)
+
+	conf.Rewrite.GatewayIDs = map[string]string{"foo": to.String()}
+	_, err = newRewrite(conf)
+	assert.Error(err)
+}
@@ -0,0 +1,94 @@
+package processor
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/state"
+	"github.com/brocaar/lorawan"
+)
+
+// rewrite rewrites the gateway IDs of the event, e.g. to map the gateway IDs
+// used by the packet-forwarders to the gateway IDs known by the network
+// server. As the mapping is applied in a single direction, the reverse
+// mapping must be configured for the commands.
+type rewrite struct {
+	gatewayIDs map[lorawan.EUI64]lorawan.EUI64
+}
+
+func newRewrite(conf config.Processor) (Processor, error) {
+	r := rewrite{
+		gatewayIDs: make(map[lorawan.EUI64]lorawan.EUI64),
+	}
+
+	for fromStr, toStr := range conf.Rewrite.GatewayIDs {
+		var from, to lorawan.EUI64
+		if err := from.UnmarshalText([]byte(fromStr)); err != nil {
+			return nil, errors.Wrap(err, "unmarshal gateway id error")
+		}
+		if err := to.UnmarshalText([]byte(toStr)); err != nil {
+			return nil, errors.Wrap(err, "unmarshal gateway id error")
+		}
+		r.gatewayIDs[from] = to
+	}
+
+	return &r, nil
+}
+
+// Process implements the Processor interface.
+func (r *rewrite) Process(ev *Event) (bool, error) {
+	if to, ok := r.gatewayIDs[ev.GatewayID]; ok {
+		ev.GatewayID = to
+	}
+
+	switch pl := ev.Message.(type) {
+	case *gw.UplinkFrame:
+		if pl.RxInfo != nil {
+			pl.RxInfo.GatewayId = r.gatewayID(pl.RxInfo.GatewayId)
+		}
+	case *gw.UplinkFrameSet:
+		for _, rxInfo := range pl.RxInfo {
+			rxInfo.GatewayId = r.gatewayID(rxInfo.GatewayId)
+		}
+	case *gw.GatewayStats:
+		pl.GatewayId = r.gatewayID(pl.GatewayId)
+	case *gw.DownlinkTXAck:
+		pl.GatewayId = r.gatewayID(pl.GatewayId)
+	case *gw.RawPacketForwarderEvent:
+		pl.GatewayId = r.gatewayID(pl.GatewayId)
+	case *state.ConnState:
+		pl.GatewayId = r.gatewayID(pl.GatewayId)
+	case *gw.DownlinkFrame:
+		pl.GatewayId = r.gatewayID(pl.GatewayId)
+		if pl.TxInfo != nil {
+			pl.TxInfo.GatewayId = r.gatewayID(pl.TxInfo.GatewayId)
+		}
+		for _, item := range pl.Items {
+			if item.TxInfo != nil {
+				item.TxInfo.GatewayId = r.gatewayID(item.TxInfo.GatewayId)
+			}
+		}
+	case *gw.GatewayConfiguration:
+		pl.GatewayId = r.gatewayID(pl.GatewayId)
+	case *gw.RawPacketForwarderCommand:
+		pl.GatewayId = r.gatewayID(pl.GatewayId)
+	}
+
+	return true, nil
+}
+
+// gatewayID returns the rewritten gateway ID, or the given gateway ID when
+// it is not rewritten.
+func (r *rewrite) gatewayID(b []byte) []byte {
+	var id lorawan.EUI64
+	if len(b) != len(id) {
+		return b
+	}
+	copy(id[:], b)
+
+	if to, ok := r.gatewayIDs[id]; ok {
+		return to[:]
+	}
+	return b
+}
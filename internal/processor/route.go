@@ -0,0 +1,33 @@
+package processor
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+// route sets the integration destinations to which the event is published.
+// Commands are not affected.
+type route struct {
+	destinations []string
+}
+
+func newRoute(conf config.Processor) (Processor, error) {
+	if len(conf.Route.Destinations) == 0 {
+		return nil, errors.New("destinations must be set")
+	}
+
+	return &route{
+		destinations: conf.Route.Destinations,
+	}, nil
+}
+
+// Process implements the Processor interface.
+func (r *route) Process(ev *Event) (bool, error) {
+	if ev.IsCommand() {
+		return true, nil
+	}
+
+	ev.Destinations = r.destinations
+	return true, nil
+}
@@ -0,0 +1,28 @@
+package processor
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+// sample keeps a random sample of the events, the other events are dropped.
+type sample struct {
+	rate float64
+}
+
+func newSample(conf config.Processor) (Processor, error) {
+	if conf.Sample.Rate < 0 || conf.Sample.Rate > 1 {
+		return nil, fmt.Errorf("sample rate must be between 0 and 1: %f", conf.Sample.Rate)
+	}
+
+	return &sample{
+		rate: conf.Sample.Rate,
+	}, nil
+}
+
+// Process implements the Processor interface.
+func (s *sample) Process(ev *Event) (bool, error) {
+	return rand.Float64() < s.rate, nil
+}
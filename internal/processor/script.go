@@ -0,0 +1,316 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+)
+
+// Script defaults.
+const (
+	scriptMaxExecutionDuration = 10 * time.Millisecond
+	scriptMaxCallStackSize     = 64
+	scriptMaxRegistrySize      = 16 * 1024
+)
+
+// scriptFunctions maps the event types to the script functions.
+var scriptFunctions = map[string]string{
+	EventUp:         "onUplink",
+	EventUpSet:      "onUplinkSet",
+	EventStats:      "onStats",
+	EventAck:        "onAck",
+	EventRaw:        "onRaw",
+	EventConn:       "onConn",
+	EventDown:       "onDownlink",
+	EventConfig:     "onConfig",
+	EventRawCommand: "onRawCommand",
+}
+
+// script calls the Lua function matching the event type (e.g. onUplink)
+// with the event and its meta-data as tables. The function is allowed to
+// modify both tables. It drops the event by returning false.
+//
+// The execution duration is limited per call. The stack memory is limited by
+// the max. size of the call stack and the registry (the data stack) of the
+// Lua state. Optionally, the memory allocated by tables and strings is
+// limited by the max. memory size (see memoryContext). As this adds a cost
+// to each instruction, it is disabled by default. As a Lua state is not safe
+// for concurrent use, the states are pooled.
+type script struct {
+	proto                *lua.FunctionProto
+	maxExecutionDuration time.Duration
+	maxCallStackSize     int
+	maxRegistrySize      int
+	maxMemorySize        int
+	marshaler            marshaler.Marshaler
+	states               sync.Pool
+}
+
+func newScript(conf config.Processor) (Processor, error) {
+	s := script{
+		maxExecutionDuration: conf.Script.MaxExecutionDuration,
+		maxCallStackSize:     conf.Script.MaxCallStackSize,
+		maxRegistrySize:      conf.Script.MaxRegistrySize,
+		maxMemorySize:        conf.Script.MaxMemorySize,
+		marshaler:            &marshaler.JSONDecoded{},
+	}
+
+	if s.maxExecutionDuration == 0 {
+		s.maxExecutionDuration = scriptMaxExecutionDuration
+	}
+	if s.maxCallStackSize == 0 {
+		s.maxCallStackSize = scriptMaxCallStackSize
+	}
+	if s.maxRegistrySize == 0 {
+		s.maxRegistrySize = scriptMaxRegistrySize
+	}
+
+	b, err := ioutil.ReadFile(conf.Script.File)
+	if err != nil {
+		return nil, errors.Wrap(err, "read script error")
+	}
+
+	chunk, err := parse.Parse(bytes.NewReader(b), conf.Script.File)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse script error")
+	}
+
+	s.proto, err = lua.Compile(chunk, conf.Script.File)
+	if err != nil {
+		return nil, errors.Wrap(err, "compile script error")
+	}
+
+	// validate that the script can be loaded
+	L, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	s.states.Put(L)
+
+	return &s, nil
+}
+
+// newState returns a new Lua state with the script loaded. Only the base
+// (without the file functions), table, string and math libraries are
+// available.
+func (s *script) newState() (*lua.LState, error) {
+	registrySize := lua.RegistrySize
+	if registrySize > s.maxRegistrySize {
+		registrySize = s.maxRegistrySize
+	}
+
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   s.maxCallStackSize,
+		RegistrySize:    registrySize,
+		RegistryMaxSize: s.maxRegistrySize,
+	})
+
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		if err := L.CallByParam(lua.P{
+			Fn:      L.NewFunction(lib.fn),
+			NRet:    0,
+			Protect: true,
+		}, lua.LString(lib.name)); err != nil {
+			L.Close()
+			return nil, errors.Wrapf(err, "open %s library error", lib.name)
+		}
+	}
+
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if s.maxMemorySize > 0 {
+		wrapAllocs(L)
+	}
+
+	if err := s.call(L, L.NewFunctionFromProto(s.proto), 0); err != nil {
+		L.Close()
+		return nil, errors.Wrap(err, "load script error")
+	}
+
+	return L, nil
+}
+
+// call calls the given function within the max. execution duration and
+// memory size (when set).
+func (s *script) call(L *lua.LState, fn *lua.LFunction, nRet int, args ...lua.LValue) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.maxExecutionDuration)
+	defer cancel()
+
+	if s.maxMemorySize > 0 {
+		L.SetContext(newMemoryContext(ctx, L, s.maxMemorySize))
+	} else {
+		L.SetContext(ctx)
+	}
+	defer L.RemoveContext()
+
+	return L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    nRet,
+		Protect: true,
+	}, args...)
+}
+
+// Process implements the Processor interface.
+func (s *script) Process(ev *Event) (bool, error) {
+	var L *lua.LState
+	if v := s.states.Get(); v != nil {
+		L = v.(*lua.LState)
+	} else {
+		var err error
+		L, err = s.newState()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	ok, err := s.process(L, ev)
+	if err != nil {
+		// the state might be left in an inconsistent state
+		L.Close()
+		return false, err
+	}
+
+	s.states.Put(L)
+	return ok, nil
+}
+
+func (s *script) process(L *lua.LState, ev *Event) (bool, error) {
+	fn, ok := L.GetGlobal(scriptFunctions[ev.Type]).(*lua.LFunction)
+	if !ok {
+		return true, nil
+	}
+
+	b, err := s.marshaler.Marshal(ev.Message)
+	if err != nil {
+		return false, errors.Wrap(err, "marshal event error")
+	}
+
+	var obj interface{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return false, errors.Wrap(err, "unmarshal event error")
+	}
+
+	metaDataTable := L.NewTable()
+	for k, v := range eventMetaData(ev) {
+		metaDataTable.RawSetString(k, lua.LString(v))
+	}
+
+	eventTable := toLuaValue(L, obj)
+
+	if err := s.call(L, fn, 1, eventTable, metaDataTable); err != nil {
+		return false, errors.Wrapf(err, "call %s error", scriptFunctions[ev.Type])
+	}
+
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	if ret == lua.LFalse {
+		return false, nil
+	}
+
+	b, err = json.Marshal(fromLuaValue(eventTable))
+	if err != nil {
+		return false, errors.Wrap(err, "marshal event error")
+	}
+
+	ev.Message.Reset()
+	if err := s.marshaler.Unmarshal(b, ev.Message); err != nil {
+		return false, errors.Wrap(err, "unmarshal event error")
+	}
+
+	// the meta-data of stats events is part of the (unmarshaled) message
+	metaData := eventMetaData(ev)
+	for k := range metaData {
+		delete(metaData, k)
+	}
+	metaDataTable.ForEach(func(k, v lua.LValue) {
+		metaData[k.String()] = v.String()
+	})
+
+	return true, nil
+}
+
+// toLuaValue converts the given decoded JSON value to a Lua value.
+func toLuaValue(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		t := L.NewTable()
+		for k, val := range v {
+			t.RawSetString(k, toLuaValue(L, val))
+		}
+		return t
+	case []interface{}:
+		t := L.NewTable()
+		for _, val := range v {
+			t.Append(toLuaValue(L, val))
+		}
+		return t
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	default:
+		return lua.LNil
+	}
+}
+
+// fromLuaValue converts the given Lua value to a value which can be encoded
+// as JSON. Tables with a sequence are converted to arrays, other tables to
+// objects. Empty tables are converted to null, as these can be either.
+func fromLuaValue(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case *lua.LTable:
+		if v.MaxN() != 0 {
+			var out []interface{}
+			for i := 1; i <= v.MaxN(); i++ {
+				out = append(out, fromLuaValue(v.RawGetInt(i)))
+			}
+			return out
+		}
+
+		out := make(map[string]interface{})
+		v.ForEach(func(k, val lua.LValue) {
+			out[k.String()] = fromLuaValue(val)
+		})
+		if len(out) == 0 {
+			return nil
+		}
+		return out
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		// integers must not be encoded using the exponent notation
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f)
+		}
+		return f
+	case lua.LBool:
+		return bool(v)
+	default:
+		return nil
+	}
+}
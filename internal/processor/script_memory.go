@@ -0,0 +1,365 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Memory estimation (in bytes). The sizes approximate the memory used by
+// gopher-lua, they are not exact.
+const (
+	scriptStringSize   = 16
+	scriptTableSize    = 64
+	scriptEntrySize    = 40
+	scriptFunctionSize = 64
+
+	// scriptInstructionSize is the growth of a table by a single
+	// instruction. A table constructor sets multiple items at once, but
+	// these items have been loaded into registers by an instruction each.
+	scriptInstructionSize = scriptEntrySize
+
+	// scriptFormatVerbSize is the max. size of a formatted value (without
+	// width or precision) and scriptFormatMaxWidth is the max. width or
+	// precision accepted by the fmt package.
+	scriptFormatVerbSize = 512
+	scriptFormatMaxWidth = 1e6
+)
+
+var errMemoryLimit = errors.New("memory limit exceeded")
+
+// memoryContext limits the memory used by a script call. As gopher-lua does
+// not provide an allocation hook, the Done method (which is called by the VM
+// before each instruction) is used to account for the allocations. Each
+// instruction is assumed to grow a table by an item and each new string in
+// the registers of the running function is accounted for by its size, so
+// that a string growing by concatenation is caught right away.
+//
+// Once the accounted allocations exceed the remaining memory, the size of
+// the values that can be reached from the globals and the call stack is
+// estimated again. The library functions which can allocate large strings
+// by a single call reserve the memory in advance (see wrapAllocs).
+//
+// This relies on the VM of gopher-lua v1.1.1 calling Done before each
+// instruction and on the wrapped library functions, the version is pinned
+// in go.mod.
+type memoryContext struct {
+	context.Context
+
+	L         *lua.LState
+	maxSize   int
+	remaining int
+	spent     int
+	reserved  int
+	registers []lua.LValue
+
+	err  error
+	done chan struct{}
+}
+
+func newMemoryContext(ctx context.Context, L *lua.LState, maxSize int) *memoryContext {
+	return &memoryContext{
+		Context: ctx,
+		L:       L,
+		maxSize: maxSize,
+		done:    make(chan struct{}),
+	}
+}
+
+// Done implements context.Context.
+func (c *memoryContext) Done() <-chan struct{} {
+	if c.err == nil {
+		c.spent += scriptInstructionSize + c.newStrings()
+		if c.spent > c.remaining {
+			c.check()
+		}
+	}
+	if c.err != nil {
+		return c.done
+	}
+	return c.Context.Done()
+}
+
+// Err implements context.Context.
+func (c *memoryContext) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Context.Err()
+}
+
+// reserve reserves n bytes for a value which is not (yet) reachable by the
+// script. It returns false when the memory limit has been exceeded.
+func (c *memoryContext) reserve(n int) bool {
+	if c.err != nil {
+		return false
+	}
+
+	c.reserved += n
+	c.spent += n
+	if c.spent > c.remaining {
+		c.check()
+	}
+
+	return c.err == nil
+}
+
+// check estimates the remaining memory and sets the error when the memory
+// limit has been exceeded.
+func (c *memoryContext) check() {
+	c.remaining = c.maxSize - c.reserved - c.size()
+	c.spent = 0
+
+	if c.remaining < 0 {
+		c.err = errMemoryLimit
+		close(c.done)
+	}
+}
+
+// newStrings returns the size of the strings that have been stored in the
+// registers of the running function since the previous call.
+func (c *memoryContext) newStrings() int {
+	top := c.L.GetTop()
+	if top > len(c.registers) {
+		c.registers = append(c.registers, make([]lua.LValue, top-len(c.registers))...)
+	}
+
+	var n int
+	for i := 0; i < top; i++ {
+		v := c.L.Get(i + 1)
+		if v == c.registers[i] {
+			continue
+		}
+		c.registers[i] = v
+
+		if s, ok := v.(lua.LString); ok {
+			n += scriptStringSize + len(s)
+		}
+	}
+
+	return n
+}
+
+// size returns the estimated size of the values that can be reached from
+// the globals and the call stack. The estimation stops once the max. size
+// has been exceeded.
+func (c *memoryContext) size() int {
+	var size int
+	tables := make(map[*lua.LTable]struct{})
+	functions := make(map[*lua.LFunction]struct{})
+	stack := []lua.LValue{c.L.G.Global, c.L.G.Registry}
+
+	for level := 0; ; level++ {
+		dbg, ok := c.L.GetStack(level)
+		if !ok {
+			break
+		}
+		for i := 1; ; i++ {
+			name, v := c.L.GetLocal(dbg, i)
+			if name == "" {
+				break
+			}
+			stack = append(stack, v)
+		}
+	}
+
+	for len(stack) != 0 && size <= c.maxSize {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		switch v := v.(type) {
+		case lua.LString:
+			size += scriptStringSize + len(v)
+		case *lua.LTable:
+			if _, ok := tables[v]; ok {
+				continue
+			}
+			tables[v] = struct{}{}
+
+			size += scriptTableSize
+			v.ForEach(func(k, val lua.LValue) {
+				size += scriptEntrySize
+				stack = append(stack, k, val)
+			})
+			if v.Metatable != nil {
+				stack = append(stack, v.Metatable)
+			}
+		case *lua.LFunction:
+			if _, ok := functions[v]; ok {
+				continue
+			}
+			functions[v] = struct{}{}
+
+			size += scriptFunctionSize
+			if v.Env != nil {
+				stack = append(stack, v.Env)
+			}
+			for _, uv := range v.Upvalues {
+				stack = append(stack, uv.Value())
+			}
+		}
+	}
+
+	return size
+}
+
+// wrapAllocs replaces the library functions which can allocate large
+// strings by a single call, by functions which reserve the (max.) size of
+// the result before calling the library function.
+func wrapAllocs(L *lua.LState) {
+	wrap := func(lib, name string, size func(L *lua.LState, c *memoryContext) int) {
+		t, ok := L.GetGlobal(lib).(*lua.LTable)
+		if !ok {
+			return
+		}
+		fn, ok := t.RawGetString(name).(*lua.LFunction)
+		if !ok {
+			return
+		}
+
+		t.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			c, ok := L.Context().(*memoryContext)
+			if !ok {
+				return fn.GFunction(L)
+			}
+
+			// the result is accounted for by the VM once returned
+			defer func(reserved int) { c.reserved = reserved }(c.reserved)
+
+			if !c.reserve(size(L, c)) {
+				L.RaiseError("%s.%s: %s", lib, name, errMemoryLimit)
+			}
+			return fn.GFunction(L)
+		}))
+	}
+
+	wrap(lua.StringLibName, "rep", repSize)
+	wrap(lua.StringLibName, "format", formatSize)
+	wrap(lua.StringLibName, "gsub", gsubSize)
+	wrap(lua.TabLibName, "concat", concatSize)
+}
+
+// repSize returns the size of the result of string.rep.
+func repSize(L *lua.LState, c *memoryContext) int {
+	s := len(L.CheckString(1))
+	n := L.CheckInt(2)
+	if n <= 0 || s == 0 {
+		return 0
+	}
+
+	// prevent an overflow
+	if n > math.MaxInt32/s {
+		return math.MaxInt32
+	}
+	return s * n
+}
+
+// formatSize returns the max. size of the result of string.format.
+func formatSize(L *lua.LState, c *memoryContext) int {
+	f := L.CheckString(1)
+	size := len(f)
+
+	// a quoted (%q) string is at most 4 times its size (\x00)
+	for i := 2; i <= L.GetTop(); i++ {
+		if s, ok := L.Get(i).(lua.LString); ok {
+			size += 4 * len(s)
+		}
+	}
+
+	// Each verb is padded to its width or precision (the max. is set by the
+	// fmt package).
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			continue
+		}
+
+		verb := scriptFormatVerbSize
+		for i++; i < len(f) && strings.IndexByte("+-# 0.", f[i]) != -1; i++ {
+		}
+		for n := 0; i < len(f) && (f[i] == '.' || (f[i] >= '0' && f[i] <= '9')); i++ {
+			if f[i] == '.' {
+				n = 0
+				continue
+			}
+			if n = n*10 + int(f[i]-'0'); n > scriptFormatMaxWidth {
+				n = scriptFormatMaxWidth
+			}
+			if n > verb {
+				verb = n
+			}
+		}
+		size += verb
+	}
+
+	return size
+}
+
+// gsubSize returns the max. size of the result of string.gsub. A table or
+// function replacement is replaced by a function which accounts for the
+// size of each replacement value.
+func gsubSize(L *lua.LState, c *memoryContext) int {
+	s := len(L.CheckString(1))
+
+	switch repl := L.Get(3).(type) {
+	case lua.LString:
+		matches := s + 1
+		if n, ok := L.Get(4).(lua.LNumber); ok && n >= 0 && int(n) < matches {
+			matches = int(n)
+		}
+
+		// each %0-%9 is replaced by (at most) the string itself
+		perMatch := len(repl)
+		for i := 0; i+1 < len(repl); i++ {
+			if repl[i] == '%' {
+				if repl[i+1] >= '0' && repl[i+1] <= '9' {
+					perMatch += s
+				}
+				i++
+			}
+		}
+
+		// prevent an overflow
+		if perMatch != 0 && matches > (math.MaxInt32-s)/perMatch {
+			return math.MaxInt32
+		}
+		return s + matches*perMatch
+	case *lua.LTable, *lua.LFunction:
+		L.Replace(3, L.NewFunction(func(L *lua.LState) int {
+			var v lua.LValue
+			if t, ok := repl.(*lua.LTable); ok {
+				v = L.GetTable(t, L.Get(1))
+			} else {
+				args := make([]lua.LValue, L.GetTop())
+				for i := range args {
+					args[i] = L.Get(i + 1)
+				}
+				L.CallByParam(lua.P{Fn: repl, NRet: 1}, args...)
+				v = L.Get(-1)
+				L.Pop(1)
+			}
+
+			if !c.reserve(len(lua.LVAsString(v))) {
+				L.RaiseError("string.gsub: %s", errMemoryLimit)
+			}
+			L.Push(v)
+			return 1
+		}))
+	}
+
+	return s
+}
+
+// concatSize returns the size of the result of table.concat.
+func concatSize(L *lua.LState, c *memoryContext) int {
+	t := L.CheckTable(1)
+	sep := len(L.OptString(2, ""))
+
+	var size int
+	for i := 1; i <= t.Len(); i++ {
+		size += sep + len(lua.LVAsString(t.RawGetInt(i)))
+	}
+	return size
+}
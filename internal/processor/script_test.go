@@ -0,0 +1,345 @@
+package processor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/common"
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+const testScript = `
+function onUplink(up, meta)
+	if up.rxInfo.rssi < -125 then
+		return false
+	end
+
+	if up.txInfo.frequency >= 868300000 then
+		meta.band = "high"
+	else
+		meta.band = "low"
+	end
+end
+
+function onStats(stats, meta)
+	meta.gateway = stats.gatewayID
+end
+
+function onDownlink(down)
+	for _, item in ipairs(down.items) do
+		item.txInfo.fskModulationInfo.frequencyDeviation = 25000
+	end
+end
+
+function onAck(ack)
+	while true do end
+end
+
+function onRaw(raw)
+	local t = {}
+	for i = 1, 100000 do
+		t[i] = i
+	end
+	return unpack(t)
+end
+
+function onRawCommand(cmd)
+	local function recurse(n)
+		return 1 + recurse(n + 1)
+	end
+	recurse(1)
+end
+
+function onConn(conn)
+	error("conn error")
+end
+`
+
+func TestScript(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "script")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "script.lua")
+	assert.NoError(ioutil.WriteFile(file, []byte(testScript), 0644))
+
+	var conf config.Processor
+	conf.Script.File = file
+	conf.Script.MaxExecutionDuration = 50 * time.Millisecond
+
+	p, err := newScript(conf)
+	assert.NoError(err)
+
+	t.Run("Uplink", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			rssi      int32
+			frequency uint32
+			expected  bool
+			band      string
+		}{
+			{"dropped", -130, 868100000, false, ""},
+			{"low band", -100, 868100000, true, "low"},
+			{"high band", -100, 868500000, true, "high"},
+		}
+
+		for _, tst := range tests {
+			t.Run(tst.name, func(t *testing.T) {
+				assert := require.New(t)
+
+				up := gw.UplinkFrame{
+					PhyPayload: []byte{1, 2, 3},
+					TxInfo: &gw.UplinkTXInfo{
+						Frequency:  tst.frequency,
+						Modulation: common.Modulation_LORA,
+					},
+					RxInfo: &gw.UplinkRXInfo{
+						GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+						Rssi:      tst.rssi,
+						LoraSnr:   5.5,
+					},
+				}
+
+				ev := Event{Type: EventUp, Message: &up}
+				ok, err := p.Process(&ev)
+				assert.NoError(err)
+				assert.Equal(tst.expected, ok)
+
+				if tst.expected {
+					assert.Equal(map[string]string{"band": tst.band}, ev.MetaData)
+					assert.Equal([]byte{1, 2, 3}, up.PhyPayload)
+					assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8}, up.RxInfo.GatewayId)
+					assert.Equal(tst.rssi, up.RxInfo.Rssi)
+					assert.Equal(5.5, up.RxInfo.LoraSnr)
+					assert.Equal(tst.frequency, up.TxInfo.Frequency)
+				}
+			})
+		}
+	})
+
+	t.Run("Stats meta-data", func(t *testing.T) {
+		assert := require.New(t)
+
+		stats := gw.GatewayStats{
+			GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			MetaData:  map[string]string{"site": "hq"},
+		}
+
+		ev := Event{Type: EventStats, Message: &stats}
+		ok, err := p.Process(&ev)
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Equal(map[string]string{
+			"site":    "hq",
+			"gateway": "0102030405060708",
+		}, stats.MetaData)
+	})
+
+	t.Run("Downlink", func(t *testing.T) {
+		assert := require.New(t)
+
+		down := gw.DownlinkFrame{
+			GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Items: []*gw.DownlinkFrameItem{
+				{
+					PhyPayload: []byte{1, 2, 3},
+					TxInfo: &gw.DownlinkTXInfo{
+						Frequency:  868100000,
+						Modulation: common.Modulation_FSK,
+						ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+							FskModulationInfo: &gw.FSKModulationInfo{
+								FrequencyDeviation: 50000,
+								Datarate:           50000,
+							},
+						},
+					},
+				},
+			},
+		}
+
+		ev := Event{Type: EventDown, Message: &down}
+		ok, err := p.Process(&ev)
+		assert.NoError(err)
+		assert.True(ok)
+		assert.EqualValues(25000, down.Items[0].TxInfo.GetFskModulationInfo().FrequencyDeviation)
+		assert.EqualValues(50000, down.Items[0].TxInfo.GetFskModulationInfo().Datarate)
+		assert.Equal([]byte{1, 2, 3}, down.Items[0].PhyPayload)
+	})
+
+	t.Run("No function", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := gw.GatewayConfiguration{Version: "1.2.3"}
+		ok, err := p.Process(&Event{Type: EventConfig, Message: &conf})
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Equal("1.2.3", conf.Version)
+	})
+
+	t.Run("Execution duration exceeded", func(t *testing.T) {
+		assert := require.New(t)
+
+		start := time.Now()
+		_, err := p.Process(&Event{Type: EventAck, Message: &gw.DownlinkTXAck{}})
+		assert.Error(err)
+		assert.True(time.Since(start) < time.Second)
+	})
+
+	t.Run("Registry size exceeded", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := p.Process(&Event{Type: EventRaw, Message: &gw.RawPacketForwarderEvent{}})
+		assert.Error(err)
+	})
+
+	t.Run("Call stack size exceeded", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := p.Process(&Event{Type: EventRawCommand, Message: &gw.RawPacketForwarderCommand{}})
+		assert.Error(err)
+	})
+
+	t.Run("Script error", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := p.Process(&Event{Type: EventConn, Message: &gw.GatewayStats{}})
+		assert.Error(err)
+	})
+
+	t.Run("Memory size exceeded", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			script string
+		}{
+			{"string.rep", `local s = string.rep("x", 2^31)`},
+			{"concatenation", `local s = "x" for i = 1, 64 do s = s .. s end`},
+			{"table", `local t = {} for i = 1, 1e8 do t[i] = i end`},
+			{"table of strings", `t = {} for i = 1, 1e8 do t[i] = "x" .. i end`},
+			{"string.gsub", `local s = string.rep("x", 1000) s = s:gsub("x", s)`},
+			{"string.gsub function", `local s = string.rep("x", 1e5) s = s:gsub("x", function() return s end)`},
+			{"string.format", `local s = string.format(string.rep("%999999d", 100), 1)`},
+			{"table.concat", `local t = {string.rep("x", 1e6)} for i = 1, 64 do t[#t+1] = table.concat(t) end`},
+		}
+
+		for _, tst := range tests {
+			t.Run(tst.name, func(t *testing.T) {
+				assert := require.New(t)
+
+				file := filepath.Join(dir, "memory.lua")
+				assert.NoError(ioutil.WriteFile(file, []byte("function onUplink(up)\n"+tst.script+"\nend"), 0644))
+
+				conf := conf
+				conf.Script.File = file
+				conf.Script.MaxExecutionDuration = time.Minute
+				conf.Script.MaxMemorySize = 1024 * 1024
+
+				p, err := newScript(conf)
+				assert.NoError(err)
+
+				_, err = p.Process(&Event{Type: EventUp, Message: &gw.UplinkFrame{}})
+				assert.Error(err)
+				assert.Contains(err.Error(), "memory limit exceeded")
+			})
+		}
+
+		// the limit does not apply to the memory released by the script
+		assert := require.New(t)
+
+		file := filepath.Join(dir, "memory.lua")
+		assert.NoError(ioutil.WriteFile(file, []byte(`function onUplink(up)
+	for i = 1, 100 do
+		local s = string.rep("x", 256 * 1024)
+		local t = {}
+		for j = 1, 1000 do t[j] = j end
+		up.phyPayload = s:sub(1, 0)
+	end
+end`), 0644))
+
+		conf := conf
+		conf.Script.File = file
+		conf.Script.MaxExecutionDuration = time.Minute
+		conf.Script.MaxMemorySize = 1024 * 1024
+
+		p, err := newScript(conf)
+		assert.NoError(err)
+
+		ok, err := p.Process(&Event{Type: EventUp, Message: &gw.UplinkFrame{}})
+		assert.NoError(err)
+		assert.True(ok)
+	})
+
+	t.Run("Invalid script", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(ioutil.WriteFile(file, []byte(`function onUplink(`), 0644))
+		_, err := newScript(conf)
+		assert.Error(err)
+
+		// the file functions are not available
+		assert.NoError(ioutil.WriteFile(file, []byte(`dofile("/etc/passwd")`), 0644))
+		_, err = newScript(conf)
+		assert.Error(err)
+	})
+}
+
+func BenchmarkScript(b *testing.B) {
+	dir, err := ioutil.TempDir("", "script")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "script.lua")
+	if err := ioutil.WriteFile(file, []byte(testScript), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarks := []struct {
+		name          string
+		maxMemorySize int
+	}{
+		{"Without memory limit", 0},
+		{"With memory limit", 4 * 1024 * 1024},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			var conf config.Processor
+			conf.Script.File = file
+			conf.Script.MaxMemorySize = bm.maxMemorySize
+
+			p, err := newScript(conf)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			up := gw.UplinkFrame{
+				PhyPayload: []byte{1, 2, 3},
+				TxInfo: &gw.UplinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_LORA,
+				},
+				RxInfo: &gw.UplinkRXInfo{
+					GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+					Rssi:      -100,
+					LoraSnr:   5.5,
+				},
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.Process(&Event{Type: EventUp, Message: &up}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// Package record implements the JSON Lines record format, used by the
+// recorder to record the events and commands and by the replay backend to
+// replay these.
+package record
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/marshaler"
+)
+
+// Directions.
+const (
+	// DirectionEvent is used for events (gateway to integration).
+	DirectionEvent = "event"
+
+	// DirectionCommand is used for commands (integration to gateway).
+	DirectionCommand = "command"
+)
+
+// maxLineSize defines the max. size of a single record.
+const maxLineSize = 1024 * 1024
+
+// Record defines a single JSON Lines record.
+type Record struct {
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"direction,omitempty"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// New returns a new record for the given message, using the current time.
+// The message is JSON encoded, using the same encoding as the JSON marshaler.
+func New(direction, typ string, msg proto.Message) (Record, error) {
+	var m marshaler.JSON
+	pl, err := m.Marshal(msg)
+	if err != nil {
+		return Record{}, errors.Wrap(err, "marshal message error")
+	}
+
+	return Record{
+		Time:      time.Now().UTC(),
+		Direction: direction,
+		Type:      typ,
+		Payload:   pl,
+	}, nil
+}
+
+// Unmarshal unmarshals the payload of the record into the given message.
+func (r Record) Unmarshal(msg proto.Message) error {
+	var m marshaler.JSON
+	return m.Unmarshal(r.Payload, msg)
+}
+
+// Write writes the given record as a single line to the given writer.
+func Write(w io.Writer, rec Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "marshal record error")
+	}
+
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "write record error")
+	}
+
+	return nil
+}
+
+// Reader reads records from a JSON Lines file. Gzip compressed files are
+// decompressed transparently.
+type Reader struct {
+	scanner *bufio.Scanner
+}
+
+// NewReader creates a new Reader.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	var rr io.Reader = br
+	if b, err := br.Peek(2); err == nil && b[0] == 0x1f && b[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "new gzip reader error")
+		}
+		rr = gr
+	}
+
+	scanner := bufio.NewScanner(rr)
+	scanner.Buffer(nil, maxLineSize)
+
+	return &Reader{
+		scanner: scanner,
+	}, nil
+}
+
+// Next returns the next record. It returns io.EOF when there are no records
+// left. Empty lines are skipped.
+func (r *Reader) Next() (Record, error) {
+	for r.scanner.Scan() {
+		if len(r.scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec Record
+		if err := json.Unmarshal(r.scanner.Bytes(), &rec); err != nil {
+			return Record{}, errors.Wrap(err, "unmarshal record error")
+		}
+
+		return rec, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return Record{}, err
+	}
+
+	return Record{}, io.EOF
+}
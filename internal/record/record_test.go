@@ -0,0 +1,83 @@
+package record
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+)
+
+func TestRecord(t *testing.T) {
+	assert := require.New(t)
+
+	up := gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		},
+	}
+	down := gw.DownlinkFrame{
+		GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Token:     1234,
+	}
+
+	upRec, err := New(DirectionEvent, "up", &up)
+	assert.NoError(err)
+	downRec, err := New(DirectionCommand, "down", &down)
+	assert.NoError(err)
+
+	var buf bytes.Buffer
+	assert.NoError(Write(&buf, upRec))
+	buf.WriteString("\n")
+	assert.NoError(Write(&buf, downRec))
+
+	var gzBuf bytes.Buffer
+	zw := gzip.NewWriter(&gzBuf)
+	_, err = zw.Write(buf.Bytes())
+	assert.NoError(err)
+	assert.NoError(zw.Close())
+
+	tests := []struct {
+		Name string
+		Data []byte
+	}{
+		{"Plain", buf.Bytes()},
+		{"Gzip", gzBuf.Bytes()},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			r, err := NewReader(bytes.NewReader(tst.Data))
+			assert.NoError(err)
+
+			rec, err := r.Next()
+			assert.NoError(err)
+			assert.Equal(DirectionEvent, rec.Direction)
+			assert.Equal("up", rec.Type)
+			assert.True(rec.Time.Equal(upRec.Time))
+
+			var upReceived gw.UplinkFrame
+			assert.NoError(rec.Unmarshal(&upReceived))
+			assert.True(proto.Equal(&up, &upReceived))
+
+			rec, err = r.Next()
+			assert.NoError(err)
+			assert.Equal(DirectionCommand, rec.Direction)
+			assert.Equal("down", rec.Type)
+
+			var downReceived gw.DownlinkFrame
+			assert.NoError(rec.Unmarshal(&downReceived))
+			assert.True(proto.Equal(&down, &downReceived))
+
+			_, err = r.Next()
+			assert.Equal(io.EOF, err)
+		})
+	}
+}
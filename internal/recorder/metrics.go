@@ -0,0 +1,26 @@
+package recorder
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "recorder_record_count",
+		Help: "The number of recorded events and commands (per direction and type).",
+	}, []string{"direction", "type"})
+
+	dc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "recorder_record_dropped_count",
+		Help: "The number of events and commands dropped because the write queue was full (per direction and type).",
+	}, []string{"direction", "type"})
+)
+
+func recordCounter(direction, typ string) prometheus.Counter {
+	return rc.With(prometheus.Labels{"direction": direction, "type": typ})
+}
+
+func droppedCounter(direction, typ string) prometheus.Counter {
+	return dc.With(prometheus.Labels{"direction": direction, "type": typ})
+}
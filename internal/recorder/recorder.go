@@ -0,0 +1,176 @@
+// Package recorder records the events and commands passing through the
+// ChirpStack Gateway Bridge to JSON Lines files, which can be replayed using
+// the replay backend.
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/record"
+	"github.com/brocaar/lorawan"
+)
+
+// Command is the name of the gateway command to start and stop the
+// recording of a gateway.
+const Command = "recorder"
+
+var (
+	mux            sync.RWMutex
+	all            bool
+	commandEnabled bool
+	gateways       map[lorawan.EUI64]struct{}
+	records        chan record.Record
+	done           chan struct{}
+)
+
+// Setup configures the recorder.
+func Setup(conf config.Config) error {
+	mux.Lock()
+	defer mux.Unlock()
+
+	// stop the writer of a previous setup
+	stop()
+
+	all = conf.Recorder.Enabled
+	commandEnabled = conf.Recorder.CommandEnabled
+	gateways = make(map[lorawan.EUI64]struct{})
+
+	if !all && !commandEnabled {
+		return nil
+	}
+
+	w, err := newWriter(conf.Recorder.File, conf.Recorder.MaxSize, conf.Recorder.MaxFiles, conf.Recorder.Gzip)
+	if err != nil {
+		return err
+	}
+
+	records = make(chan record.Record, conf.Recorder.QueueSize)
+	done = make(chan struct{})
+	go w.run(records, done)
+
+	log.WithFields(log.Fields{
+		"file":            conf.Recorder.File,
+		"max_size":        conf.Recorder.MaxSize,
+		"max_files":       conf.Recorder.MaxFiles,
+		"gzip":            conf.Recorder.Gzip,
+		"enabled":         all,
+		"command_enabled": commandEnabled,
+	}).Info("recorder: recorder configured")
+
+	return nil
+}
+
+// Stop stops the recorder and waits until the queued records have been
+// written.
+func Stop() {
+	mux.Lock()
+	defer mux.Unlock()
+
+	stop()
+}
+
+// stop stops the writer. The caller must hold the lock.
+func stop() {
+	if records == nil {
+		return
+	}
+
+	close(records)
+	<-done
+	records = nil
+}
+
+// Enabled returns true when the events and commands of the given gateway are
+// recorded.
+func Enabled(gatewayID lorawan.EUI64) bool {
+	mux.RLock()
+	defer mux.RUnlock()
+
+	if records == nil {
+		return false
+	}
+
+	if all {
+		return true
+	}
+
+	_, ok := gateways[gatewayID]
+	return ok
+}
+
+// Record records the given event or command of the given gateway. The record
+// is dropped when the write queue is full.
+func Record(gatewayID lorawan.EUI64, direction, typ string, msg proto.Message) {
+	if !Enabled(gatewayID) {
+		return
+	}
+
+	// the message is encoded immediately, as it might be modified afterwards
+	rec, err := record.New(direction, typ, msg)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"type":       typ,
+		}).Error("recorder: new record error")
+		return
+	}
+
+	mux.RLock()
+	defer mux.RUnlock()
+
+	if records == nil {
+		return
+	}
+
+	select {
+	case records <- rec:
+		recordCounter(direction, typ).Inc()
+	default:
+		droppedCounter(direction, typ).Inc()
+	}
+}
+
+// CommandEnabled returns true when the recording can be started and stopped
+// using the recorder gateway command.
+func CommandEnabled() bool {
+	mux.RLock()
+	defer mux.RUnlock()
+
+	return commandEnabled
+}
+
+// ExecCommand executes the recorder gateway command for the given gateway.
+// The stdin must contain start, stop or status.
+func ExecCommand(gatewayID lorawan.EUI64, stdin []byte) ([]byte, error) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if !commandEnabled {
+		return nil, errors.New("recorder command is not enabled")
+	}
+
+	switch string(bytes.TrimSpace(stdin)) {
+	case "start":
+		gateways[gatewayID] = struct{}{}
+		log.WithField("gateway_id", gatewayID).Info("recorder: recording started")
+	case "stop":
+		delete(gateways, gatewayID)
+		log.WithField("gateway_id", gatewayID).Info("recorder: recording stopped")
+	case "status":
+	default:
+		return nil, fmt.Errorf("invalid stdin, expected start, stop or status: %s", stdin)
+	}
+
+	_, ok := gateways[gatewayID]
+	if all || ok {
+		return []byte("recording\n"), nil
+	}
+	return []byte("not recording\n"), nil
+}
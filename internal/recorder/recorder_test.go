@@ -0,0 +1,190 @@
+package recorder
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/record"
+	"github.com/brocaar/lorawan"
+)
+
+// readRecords reads all the records from the given file.
+func readRecords(t *testing.T, file string) []record.Record {
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+
+	r, err := record.NewReader(f)
+	require.NoError(t, err)
+
+	var out []record.Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return out
+		}
+		require.NoError(t, err)
+		out = append(out, rec)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	file := filepath.Join(tempDir, "recording.jsonl")
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	up := gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: gatewayID[:],
+		},
+	}
+	down := gw.DownlinkFrame{
+		GatewayId: gatewayID[:],
+		Token:     1234,
+	}
+
+	t.Run("Missing file", func(t *testing.T) {
+		assert := require.New(t)
+
+		var conf config.Config
+		conf.Recorder.Enabled = true
+		conf.Recorder.MaxSize = 1024
+		conf.Recorder.QueueSize = 10
+		assert.EqualError(Setup(conf), "recorder file must be set")
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(Setup(config.Config{}))
+		assert.False(Enabled(gatewayID))
+		Record(gatewayID, record.DirectionEvent, "up", &up)
+
+		_, err := os.Stat(file)
+		assert.True(os.IsNotExist(err))
+	})
+
+	t.Run("All gateways", func(t *testing.T) {
+		assert := require.New(t)
+
+		var conf config.Config
+		conf.Recorder.Enabled = true
+		conf.Recorder.File = file
+		conf.Recorder.MaxSize = 1024 * 1024
+		conf.Recorder.QueueSize = 10
+		assert.NoError(Setup(conf))
+		assert.True(Enabled(gatewayID))
+
+		Record(gatewayID, record.DirectionEvent, "up", &up)
+		Record(gatewayID, record.DirectionCommand, "down", &down)
+
+		// the queued records are written before Stop returns
+		Stop()
+		assert.False(Enabled(gatewayID))
+		Record(gatewayID, record.DirectionEvent, "up", &up)
+
+		records := readRecords(t, file)
+		assert.Len(records, 2)
+		assert.Equal(record.DirectionEvent, records[0].Direction)
+		assert.Equal("up", records[0].Type)
+		assert.Equal(record.DirectionCommand, records[1].Direction)
+		assert.Equal("down", records[1].Type)
+		assert.False(records[0].Time.IsZero())
+
+		var received gw.DownlinkFrame
+		assert.NoError(records[1].Unmarshal(&received))
+		assert.True(proto.Equal(&down, &received))
+
+		assert.NoError(os.Remove(file))
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		assert := require.New(t)
+
+		var conf config.Config
+		conf.Recorder.Enabled = true
+		conf.Recorder.File = file
+		conf.Recorder.MaxSize = 1
+		conf.Recorder.MaxFiles = 2
+		conf.Recorder.Gzip = true
+		conf.Recorder.QueueSize = 10
+		assert.NoError(Setup(conf))
+
+		// each record exceeds the max size, the oldest record is removed
+		for i := 0; i < 4; i++ {
+			Record(gatewayID, record.DirectionCommand, "down", &gw.DownlinkFrame{Token: uint32(i)})
+		}
+		Stop()
+
+		for i, f := range []string{file, file + ".1.gz", file + ".2.gz"} {
+			records := readRecords(t, f)
+			assert.Len(records, 1)
+
+			var received gw.DownlinkFrame
+			assert.NoError(records[0].Unmarshal(&received))
+			assert.EqualValues(3-i, received.Token)
+		}
+
+		_, err := os.Stat(file + ".3.gz")
+		assert.True(os.IsNotExist(err))
+
+		files, err := filepath.Glob(file + "*")
+		assert.NoError(err)
+		for _, f := range files {
+			assert.NoError(os.Remove(f))
+		}
+	})
+
+	t.Run("Command", func(t *testing.T) {
+		assert := require.New(t)
+
+		otherID := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+		_, err := ExecCommand(gatewayID, []byte("start"))
+		assert.EqualError(err, "recorder command is not enabled")
+
+		var conf config.Config
+		conf.Recorder.CommandEnabled = true
+		conf.Recorder.File = file
+		conf.Recorder.MaxSize = 1024 * 1024
+		conf.Recorder.QueueSize = 10
+		assert.NoError(Setup(conf))
+		assert.True(CommandEnabled())
+		assert.False(Enabled(gatewayID))
+
+		_, err = ExecCommand(gatewayID, []byte("foo"))
+		assert.Error(err)
+
+		stdout, err := ExecCommand(gatewayID, []byte("start\n"))
+		assert.NoError(err)
+		assert.Equal("recording\n", string(stdout))
+		assert.True(Enabled(gatewayID))
+		assert.False(Enabled(otherID))
+
+		Record(gatewayID, record.DirectionEvent, "up", &up)
+		Record(otherID, record.DirectionEvent, "up", &up)
+
+		stdout, err = ExecCommand(gatewayID, []byte("stop"))
+		assert.NoError(err)
+		assert.Equal("not recording\n", string(stdout))
+		assert.False(Enabled(gatewayID))
+
+		Record(gatewayID, record.DirectionEvent, "up", &up)
+		Stop()
+
+		assert.Len(readRecords(t, file), 1)
+	})
+}
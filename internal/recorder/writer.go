@@ -0,0 +1,184 @@
+package recorder
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/record"
+)
+
+// writer appends the records to the configured file. Once the file exceeds
+// the max. size, it is rotated: file becomes file.1, file.1 becomes file.2,
+// etc. and the oldest file is removed. Rotated files are (optionally) gzip
+// compressed, the file being written to is never compressed.
+type writer struct {
+	file     string
+	maxSize  int64
+	maxFiles int
+	gzip     bool
+
+	f    *os.File
+	size int64
+}
+
+func newWriter(file string, maxSize int64, maxFiles int, gzip bool) (*writer, error) {
+	if file == "" {
+		return nil, errors.New("recorder file must be set")
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("max size must be greater than 0: %d", maxSize)
+	}
+	if maxFiles < 0 {
+		return nil, fmt.Errorf("max files must be greater than or equal to 0: %d", maxFiles)
+	}
+
+	w := writer{
+		file:     file,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		gzip:     gzip,
+	}
+
+	// validate that the file can be opened
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// run writes the records until the given channel is closed.
+func (w *writer) run(records chan record.Record, done chan struct{}) {
+	defer close(done)
+
+	for rec := range records {
+		if err := w.write(rec); err != nil {
+			log.WithError(err).WithField("file", w.file).Error("recorder: write record error")
+		}
+	}
+
+	if err := w.close(); err != nil {
+		log.WithError(err).WithField("file", w.file).Error("recorder: close file error")
+	}
+}
+
+func (w *writer) write(rec record.Record) error {
+	if w.size >= w.maxSize {
+		if err := w.rotate(); err != nil {
+			return errors.Wrap(err, "rotate file error")
+		}
+	}
+
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	return record.Write(w, rec)
+}
+
+// Write implements the io.Writer interface.
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *writer) open() error {
+	f, err := os.OpenFile(w.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return errors.Wrap(err, "open file error")
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "stat file error")
+	}
+
+	w.f = f
+	w.size = fi.Size()
+
+	return nil
+}
+
+func (w *writer) close() error {
+	if w.f == nil {
+		return nil
+	}
+
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// rotatedFile returns the name of the n-th rotated file.
+func (w *writer) rotatedFile(n int) string {
+	if w.gzip {
+		return fmt.Sprintf("%s.%d.gz", w.file, n)
+	}
+	return fmt.Sprintf("%s.%d", w.file, n)
+}
+
+func (w *writer) rotate() error {
+	if err := w.close(); err != nil {
+		return errors.Wrap(err, "close file error")
+	}
+
+	if w.maxFiles == 0 {
+		return os.Remove(w.file)
+	}
+
+	if err := os.Remove(w.rotatedFile(w.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove file error")
+	}
+
+	for i := w.maxFiles - 1; i > 0; i-- {
+		if err := os.Rename(w.rotatedFile(i), w.rotatedFile(i+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "rename file error")
+		}
+	}
+
+	if !w.gzip {
+		return os.Rename(w.file, w.rotatedFile(1))
+	}
+
+	if err := compressFile(w.file, w.rotatedFile(1)); err != nil {
+		return errors.Wrap(err, "compress file error")
+	}
+
+	return os.Remove(w.file)
+}
+
+// compressFile writes the gzip compressed content of src to dst.
+func compressFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(out)
+	if _, err := io.Copy(gw, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := gw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := newOTLPExporter("localhost:4318", nil, time.Second)
+	assert.Error(err)
+
+	type request struct {
+		path   string
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 1)
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		requests <- request{path: r.URL.Path, header: r.Header, body: b}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	e, err := newOTLPExporter(server.URL+"/", map[string]string{"Authorization": "Bearer secret"}, time.Second)
+	assert.NoError(err)
+
+	sr := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(sr),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "test"))),
+	)
+
+	start := time.Unix(1, 0)
+	end := time.Unix(2, 500)
+
+	ctx, root := provider.Tracer("test").Start(context.Background(), "root", trace.WithTimestamp(start), trace.WithAttributes(
+		attribute.String("uplink_id", "foo"),
+		attribute.Int64("token", 1234),
+		attribute.Bool("dropped", true),
+		attribute.Float64("ratio", 0.5),
+		attribute.StringSlice("destinations", []string{"a", "b"}),
+	))
+	root.AddEvent("dequeued", trace.WithTimestamp(start))
+	root.End(trace.WithTimestamp(end))
+
+	_, child := provider.Tracer("test").Start(ctx, "child", trace.WithTimestamp(start), trace.WithSpanKind(trace.SpanKindProducer))
+	child.RecordError(errors.New("boom"))
+	child.SetStatus(codes.Error, "boom")
+	child.End(trace.WithTimestamp(end))
+
+	t.Run("Export", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(e.ExportSpans(context.Background(), sr.Ended()))
+
+		req := <-requests
+		assert.Equal("/v1/traces", req.path)
+		assert.Equal("application/x-protobuf", req.header.Get("Content-Type"))
+		assert.Equal("Bearer secret", req.header.Get("Authorization"))
+
+		var out coltracepb.ExportTraceServiceRequest
+		assert.NoError(proto.Unmarshal(req.body, &out))
+
+		assert.Len(out.ResourceSpans, 1)
+		rs := out.ResourceSpans[0]
+		assert.Equal("service.name", rs.Resource.Attributes[0].Key)
+		assert.Equal("test", rs.Resource.Attributes[0].Value.GetStringValue())
+
+		assert.Len(rs.ScopeSpans, 1)
+		ss := rs.ScopeSpans[0]
+		assert.Equal("test", ss.Scope.Name)
+		assert.Len(ss.Spans, 2)
+
+		rootSC := root.SpanContext()
+		rootSpan := ss.Spans[0]
+		assert.Equal(rootSC.TraceID().String(), hex.EncodeToString(rootSpan.TraceId))
+		assert.Equal(rootSC.SpanID().String(), hex.EncodeToString(rootSpan.SpanId))
+		assert.Equal("root", rootSpan.Name)
+		assert.Equal(tracepb.Span_SPAN_KIND_INTERNAL, rootSpan.Kind)
+		assert.EqualValues(1000000000, rootSpan.StartTimeUnixNano)
+		assert.EqualValues(2000000500, rootSpan.EndTimeUnixNano)
+		assert.Len(rootSpan.Attributes, 5)
+		assert.Equal("uplink_id", rootSpan.Attributes[0].Key)
+		assert.Equal("foo", rootSpan.Attributes[0].Value.GetStringValue())
+		assert.EqualValues(1234, rootSpan.Attributes[1].Value.GetIntValue())
+		assert.Len(rootSpan.Events, 1)
+		assert.Equal("dequeued", rootSpan.Events[0].Name)
+
+		childSpan := ss.Spans[1]
+		assert.Equal(rootSC.TraceID().String(), hex.EncodeToString(childSpan.TraceId))
+		assert.Equal(rootSC.SpanID().String(), hex.EncodeToString(childSpan.ParentSpanId))
+		assert.Equal(tracepb.Span_SPAN_KIND_PRODUCER, childSpan.Kind)
+		assert.Equal(tracepb.Status_STATUS_CODE_ERROR, childSpan.Status.Code)
+		assert.Equal("boom", childSpan.Status.Message)
+		assert.Len(childSpan.Events, 1)
+	})
+
+	t.Run("Collector error", func(t *testing.T) {
+		assert := require.New(t)
+
+		status = http.StatusBadRequest
+		assert.Error(e.ExportSpans(context.Background(), sr.Ended()))
+		<-requests
+	})
+}
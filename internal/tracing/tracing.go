@@ -0,0 +1,184 @@
+// Package tracing implements the OpenTelemetry tracing of the uplinks and
+// downlinks passing through the ChirpStack Gateway Bridge.
+//
+// A trace is keyed by the uplink ID or downlink ID, which is used as trace ID.
+// The first span started for an ID becomes the root span of the trace, the
+// spans started by the other components are added as child spans.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+// rootTTL defines how long the root span of a trace is remembered. Spans
+// started after this duration start a new root span (with the same trace ID).
+const rootTTL = time.Minute
+
+const instrumentationName = "github.com/brocaar/chirpstack-gateway-bridge"
+
+var (
+	tracer trace.Tracer = trace.NewNoopTracerProvider().Tracer(instrumentationName)
+
+	// provider holds the provider set by Setup, it is nil when tracing is
+	// disabled.
+	provider *sdktrace.TracerProvider
+
+	rootsMux sync.Mutex
+	roots    = cache.New(rootTTL, rootTTL)
+)
+
+type traceIDKey struct{}
+
+// Setup configures the tracing package.
+func Setup(conf config.Config) error {
+	if !conf.Metrics.Tracing.Enabled {
+		return nil
+	}
+
+	exporter, err := newOTLPExporter(conf.Metrics.Tracing.Endpoint, conf.Metrics.Tracing.Headers, conf.Metrics.Tracing.Timeout)
+	if err != nil {
+		return errors.Wrap(err, "new otlp exporter error")
+	}
+
+	if r := conf.Metrics.Tracing.SampleRatio; r < 0 || r > 1 {
+		return fmt.Errorf("sample ratio must be between 0 and 1: %f", r)
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", conf.Metrics.Tracing.ServiceName),
+		)),
+		sdktrace.WithIDGenerator(idGenerator{}),
+		sdktrace.WithSampler(sdktrace.ParentBased(idRatioSampler(conf.Metrics.Tracing.SampleRatio))),
+	)
+
+	setTracerProvider(provider)
+
+	log.WithFields(log.Fields{
+		"endpoint":     conf.Metrics.Tracing.Endpoint,
+		"sample_ratio": conf.Metrics.Tracing.SampleRatio,
+	}).Info("tracing: exporting spans to otlp collector")
+
+	return nil
+}
+
+// Shutdown exports the pending spans and shuts down the exporter.
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+
+	return provider.Shutdown(ctx)
+}
+
+// setTracerProvider sets the provider used to start the spans and forgets
+// the root spans of the previous provider.
+func setTracerProvider(provider trace.TracerProvider) {
+	rootsMux.Lock()
+	defer rootsMux.Unlock()
+
+	tracer = provider.Tracer(instrumentationName)
+	roots.Flush()
+}
+
+// Start starts a new span within the trace of the given uplink or downlink
+// ID. In case the ID is not a valid (non-nil) UUID, a non-recording span is
+// returned. The caller must end the returned span.
+func Start(id []byte, name string, opts ...trace.SpanStartOption) trace.Span {
+	var traceID trace.TraceID
+	if len(id) != len(traceID) {
+		return trace.SpanFromContext(context.Background())
+	}
+	copy(traceID[:], id)
+	if !traceID.IsValid() {
+		return trace.SpanFromContext(context.Background())
+	}
+
+	rootsMux.Lock()
+	defer rootsMux.Unlock()
+
+	if v, ok := roots.Get(traceID.String()); ok {
+		ctx := trace.ContextWithSpanContext(context.Background(), v.(trace.SpanContext))
+		_, span := tracer.Start(ctx, name, opts...)
+		return span
+	}
+
+	ctx := context.WithValue(context.Background(), traceIDKey{}, traceID)
+	_, span := tracer.Start(ctx, name, append(opts, trace.WithNewRoot())...)
+	if span.SpanContext().IsValid() {
+		roots.SetDefault(traceID.String(), span.SpanContext())
+	}
+
+	return span
+}
+
+// idGenerator uses the trace ID from the context (the uplink or downlink ID)
+// as trace ID of the root span.
+type idGenerator struct{}
+
+func (g idGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	traceID, ok := ctx.Value(traceIDKey{}).(trace.TraceID)
+	if !ok {
+		_, _ = rand.Read(traceID[:])
+	}
+
+	return traceID, g.NewSpanID(ctx, traceID)
+}
+
+func (g idGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	var spanID trace.SpanID
+	_, _ = rand.Read(spanID[:])
+	return spanID
+}
+
+// idRatioSampler samples the given ratio of the traces. Unlike the
+// TraceIDRatioBased sampler, which expects random trace IDs, the trace ID is
+// hashed as the UUID version and variant bits are not random.
+type idRatioSampler float64
+
+func (s idRatioSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	h := fnv.New64a()
+	_, _ = h.Write(p.TraceID[:])
+
+	res := sdktrace.SamplingResult{
+		Decision:   sdktrace.Drop,
+		Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+	}
+	if s >= 1 || float64(h.Sum64()) < float64(s)*math.MaxUint64 {
+		res.Decision = sdktrace.RecordAndSample
+	}
+
+	return res
+}
+
+func (s idRatioSampler) Description() string {
+	return fmt.Sprintf("IDRatioSampler{%g}", float64(s))
+}
+
+// End ends the given span. In case the given error is not nil, it is recorded
+// and the span status is set to error.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
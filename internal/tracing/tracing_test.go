@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestStart(t *testing.T) {
+	assert := require.New(t)
+
+	sr := tracetest.NewSpanRecorder()
+	setTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(sr),
+		sdktrace.WithIDGenerator(idGenerator{}),
+		sdktrace.WithSampler(sdktrace.ParentBased(idRatioSampler(1))),
+	))
+	defer setTracerProvider(trace.NewNoopTracerProvider())
+
+	uplinkID, err := uuid.NewV4()
+	assert.NoError(err)
+	downlinkID, err := uuid.NewV4()
+	assert.NoError(err)
+
+	t.Run("Invalid ID", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.False(Start(nil, "test").IsRecording())
+		assert.False(Start(uuid.Nil[:], "test").IsRecording())
+		assert.False(Start([]byte{1, 2, 3}, "test").IsRecording())
+	})
+
+	t.Run("Uplink", func(t *testing.T) {
+		assert := require.New(t)
+
+		Start(uplinkID[:], "backend").End()
+		Start(uplinkID[:], "forwarder").End()
+		Start(downlinkID[:], "integration").End()
+		Start(uplinkID[:], "integration").End()
+
+		spans := sr.Ended()
+		assert.Len(spans, 4)
+
+		// the first span for an id is the root span
+		root := spans[0]
+		assert.Equal("backend", root.Name())
+		traceID := root.SpanContext().TraceID()
+		assert.Equal(uplinkID[:], traceID[:])
+		assert.False(root.Parent().IsValid())
+
+		for _, i := range []int{1, 3} {
+			assert.Equal(root.SpanContext().TraceID(), spans[i].SpanContext().TraceID())
+			assert.Equal(root.SpanContext().SpanID(), spans[i].Parent().SpanID())
+		}
+
+		traceID = spans[2].SpanContext().TraceID()
+		assert.Equal(downlinkID[:], traceID[:])
+		assert.False(spans[2].Parent().IsValid())
+	})
+}
+
+func TestIDRatioSampler(t *testing.T) {
+	tests := []struct {
+		Ratio float64
+		Min   int
+		Max   int
+	}{
+		{0, 0, 0},
+		{0.25, 200, 300},
+		{1, 1000, 1000},
+	}
+
+	for _, tst := range tests {
+		sampled := 0
+		for i := 0; i < 1000; i++ {
+			id, err := uuid.NewV4()
+			require.NoError(t, err)
+
+			var traceID trace.TraceID
+			copy(traceID[:], id[:])
+
+			res := idRatioSampler(tst.Ratio).ShouldSample(sdktrace.SamplingParameters{
+				ParentContext: context.Background(),
+				TraceID:       traceID,
+			})
+			if res.Decision == sdktrace.RecordAndSample {
+				sampled++
+			}
+		}
+
+		require.True(t, sampled >= tst.Min && sampled <= tst.Max, "ratio: %f, sampled: %d", tst.Ratio, sampled)
+	}
+}